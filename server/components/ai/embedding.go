@@ -0,0 +1,128 @@
+package ai
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// EmbeddingProvider is the core interface for all embedding providers
+type EmbeddingProvider interface {
+	// Embed returns a vector for each of texts, in the order of texts
+	Embed(ctx core.RequestContext, texts []string) ([][]float32, error)
+
+	// Dimension returns the length of the vectors returned
+	Dimension() int
+
+	// MaxBatch returns how many texts one call to Embed takes, or 0 when there is no limit
+	MaxBatch() int
+
+	// Name returns provider name
+	Name() string
+}
+
+// CONF_AI_EMBEDDING_DIMENSION is the length of the vectors a HashingEmbedder returns.
+const CONF_AI_EMBEDDING_DIMENSION = "embeddingdimension"
+
+// DefaultHashingDimension is the length of the vectors a HashingEmbedder returns when it is not
+// configured.
+const DefaultHashingDimension = 256
+
+/*
+HashingEmbedder embeds text locally by feature hashing: every token of the text, as data.Tokenize
+splits it, adds or subtracts one in the dimension its hash picks, and the vector is scaled to unit
+length. Texts sharing words are near one another and the same text always has the same vector, so
+it stands in for a model in tests and in development. It knows nothing of meaning: synonyms are as
+far apart as any two words.
+*/
+type HashingEmbedder struct {
+	core.Service
+	Dim int
+}
+
+func NewHashingEmbedder(ctx core.ServerContext) *HashingEmbedder {
+	return &HashingEmbedder{}
+}
+
+// NewHashingEmbedderWithDimension creates an embedder returning vectors of length dimension.
+func NewHashingEmbedderWithDimension(ctx core.ServerContext, dimension int) *HashingEmbedder {
+	return &HashingEmbedder{Dim: dimension}
+}
+
+func (svc *HashingEmbedder) Describe(ctx core.ServerContext) error {
+	if svc.Dim == 0 {
+		svc.AddStringConfiguration(ctx, CONF_AI_EMBEDDING_DIMENSION, "Length of the vectors returned", strconv.Itoa(DefaultHashingDimension))
+	}
+	return nil
+}
+
+func (svc *HashingEmbedder) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if svc.Dim != 0 {
+		return nil
+	}
+	svc.Dim = DefaultHashingDimension
+	if val, ok := svc.GetStringConfiguration(ctx, CONF_AI_EMBEDDING_DIMENSION); ok && val != "" {
+		dim, err := strconv.Atoi(val)
+		if err != nil || dim <= 0 {
+			return errors.BadConf(ctx, CONF_AI_EMBEDDING_DIMENSION)
+		}
+		svc.Dim = dim
+	}
+	return nil
+}
+
+func (svc *HashingEmbedder) Embed(ctx core.RequestContext, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = svc.embed(text)
+	}
+	return vectors, nil
+}
+
+func (svc *HashingEmbedder) Dimension() int {
+	if svc.Dim <= 0 {
+		return DefaultHashingDimension
+	}
+	return svc.Dim
+}
+
+func (svc *HashingEmbedder) MaxBatch() int {
+	return 0
+}
+
+func (svc *HashingEmbedder) Name() string {
+	return "hashing"
+}
+
+// embed returns the vector of text. Text with no tokens has the zero vector.
+func (svc *HashingEmbedder) embed(text string) []float32 {
+	dim := svc.Dimension()
+	vector := make([]float32, dim)
+	for _, token := range data.Tokenize(text) {
+		h := fnv.New64a()
+		h.Write([]byte(token))
+		sum := h.Sum64()
+		if sum>>63 == 1 {
+			vector[sum%uint64(dim)]--
+		} else {
+			vector[sum%uint64(dim)]++
+		}
+	}
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
@@ -0,0 +1,527 @@
+package ai
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/auth"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_AI_EMBEDDING_PROVIDER names the EmbeddingProvider service an EmbeddingPipeline embeds with.
+	CONF_AI_EMBEDDING_PROVIDER = "embeddingprovider"
+	// CONF_AI_EMBEDDING_BATCHSIZE is how many records an EmbeddingPipeline embeds in one batch.
+	CONF_AI_EMBEDDING_BATCHSIZE = "embeddingbatchsize"
+	// CONF_AI_EMBEDDING_FLUSHINTERVAL is how long an EmbeddingPipeline holds a batch that is not
+	// full, as a duration such as "1s".
+	CONF_AI_EMBEDDING_FLUSHINTERVAL = "embeddingflushinterval"
+	// CONF_AI_EMBEDDING_RETRIES is how many times an EmbeddingPipeline embeds a record again after
+	// a batch holding it failed, before it gives the record up.
+	CONF_AI_EMBEDDING_RETRIES = "embeddingretries"
+	// EMBEDDING_PARAM_FORCE makes a backfill embed every record, rather than those out of date.
+	EMBEDDING_PARAM_FORCE = "force"
+)
+
+const (
+	// DefaultEmbeddingBatchSize is how many records are embedded in one batch when it is not
+	// configured.
+	DefaultEmbeddingBatchSize = 32
+	// DefaultEmbeddingFlushInterval is how long a batch that is not full is held when it is not
+	// configured.
+	DefaultEmbeddingFlushInterval = time.Second
+	// DefaultEmbeddingRetries is how many times a record is embedded again after a failed batch
+	// when it is not configured.
+	DefaultEmbeddingRetries = 3
+)
+
+/*
+EmbeddingPipeline keeps the vectors of records in step with their text. Each of its data services
+stores an entity declaring an Embedding in its StorableConfig; the pipeline subscribes to the
+services' created and updated events when it starts, and embeds the declared fields of every record
+written, storing the vector with Update.
+
+Records written are embedded in batches: a batch is embedded once BatchSize records are waiting,
+or FlushInterval after the first of them, and whatever is waiting when the pipeline stops. A full
+batch is embedded in the background rather than in the delivery of the event that filled it, so a
+write is not held up by the provider. The records of a batch that fails are queued again, each up
+to Retries times before it is given up and left to Backfill. The vector is stored by a system
+request made for the tenant and on behalf of the user of the write that raised the event, as the
+request of that write is over by then. The pipeline ignores the events of its own updates; an entity declaring a
+Digest is besides not embedded again while its text is unchanged, which also keeps a provider that
+delivers events late from re-embedding a record without end.
+
+Backfill embeds the records stored before the pipeline was set up, and Invoke runs it, so that it
+can be run as a job.
+*/
+type EmbeddingPipeline struct {
+	core.Service
+	Provider      EmbeddingProvider
+	Components    []data.DataComponent
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int
+	mu            sync.Mutex
+	pending       []*embedJob
+	writing       map[string]int
+	full          chan struct{}
+	stop          chan struct{}
+	done          sync.WaitGroup
+}
+
+// embedJob is a record waiting to be embedded, with the tenant and user of the write that queued
+// it, and how many times it has been embedded in a batch that failed.
+type embedJob struct {
+	comp     data.DataComponent
+	target   *embeddingTarget
+	id       string
+	text     string
+	tenant   string
+	user     string
+	attempts int
+}
+
+// embeddingTarget is what an entity embeds, and where it stores the result.
+type embeddingTarget struct {
+	fields []string
+	vector string
+	digest string
+}
+
+func NewEmbeddingPipeline(ctx core.ServerContext) *EmbeddingPipeline {
+	return &EmbeddingPipeline{}
+}
+
+// NewEmbeddingPipelineWithServices creates a pipeline embedding the records of comps with provider.
+func NewEmbeddingPipelineWithServices(ctx core.ServerContext, provider EmbeddingProvider, comps ...data.DataComponent) *EmbeddingPipeline {
+	return &EmbeddingPipeline{Provider: provider, Components: comps}
+}
+
+func (svc *EmbeddingPipeline) Describe(ctx core.ServerContext) error {
+	if svc.Provider == nil {
+		svc.AddStringConfiguration(ctx, CONF_AI_EMBEDDING_PROVIDER, "Embedding provider records are embedded with", "")
+		svc.AddConfiguration(ctx, data.CONF_DATA_SVCS, "Data services whose records are embedded", datatypes.Stringarr, nil)
+		svc.AddStringConfiguration(ctx, CONF_AI_EMBEDDING_BATCHSIZE, "How many records are embedded in one batch", strconv.Itoa(DefaultEmbeddingBatchSize))
+		svc.AddStringConfiguration(ctx, CONF_AI_EMBEDDING_FLUSHINTERVAL, "How long a batch that is not full is held", DefaultEmbeddingFlushInterval.String())
+		svc.AddStringConfiguration(ctx, CONF_AI_EMBEDDING_RETRIES, "How many times a record is embedded again after a failed batch", strconv.Itoa(DefaultEmbeddingRetries))
+	}
+	return nil
+}
+
+func (svc *EmbeddingPipeline) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if svc.Provider != nil {
+		return nil
+	}
+	name, _ := svc.GetStringConfiguration(ctx, CONF_AI_EMBEDDING_PROVIDER)
+	if name == "" {
+		return errors.MissingConf(ctx, CONF_AI_EMBEDDING_PROVIDER)
+	}
+	s, err := ctx.GetService(name)
+	if err != nil {
+		return errors.BadConf(ctx, CONF_AI_EMBEDDING_PROVIDER)
+	}
+	provider, ok := s.(EmbeddingProvider)
+	if !ok {
+		return errors.BadConf(ctx, CONF_AI_EMBEDDING_PROVIDER)
+	}
+	svc.Provider = provider
+	names, _ := svc.GetStringArrayConfiguration(ctx, data.CONF_DATA_SVCS)
+	for _, name := range names {
+		s, err := ctx.GetService(name)
+		if err != nil {
+			return errors.BadConf(ctx, data.CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		dc, ok := s.(data.DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, data.CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		svc.Components = append(svc.Components, dc)
+	}
+	if val, ok := svc.GetStringConfiguration(ctx, CONF_AI_EMBEDDING_BATCHSIZE); ok && val != "" {
+		size, err := strconv.Atoi(val)
+		if err != nil || size <= 0 {
+			return errors.BadConf(ctx, CONF_AI_EMBEDDING_BATCHSIZE)
+		}
+		svc.BatchSize = size
+	}
+	if val, ok := svc.GetStringConfiguration(ctx, CONF_AI_EMBEDDING_FLUSHINTERVAL); ok && val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return errors.BadConf(ctx, CONF_AI_EMBEDDING_FLUSHINTERVAL)
+		}
+		svc.FlushInterval = d
+	}
+	if val, ok := svc.GetStringConfiguration(ctx, CONF_AI_EMBEDDING_RETRIES); ok && val != "" {
+		retries, err := strconv.Atoi(val)
+		if err != nil || retries <= 0 {
+			return errors.BadConf(ctx, CONF_AI_EMBEDDING_RETRIES)
+		}
+		svc.Retries = retries
+	}
+	return nil
+}
+
+// Start subscribes to the writes of the data services, and flushes the batch every FlushInterval,
+// and whenever it fills, until Stop.
+func (svc *EmbeddingPipeline) Start(ctx core.ServerContext) error {
+	svc.full = make(chan struct{}, 1)
+	req := core.NewSystemRequest(ctx, "EmbeddingPipeline", nil, nil, nil)
+	for _, comp := range svc.Components {
+		target, err := embeddingTargetOf(req, comp)
+		if err != nil {
+			return err
+		}
+		listener := svc.listener(comp, target)
+		for _, eventType := range []data.DataEventType{data.EventDataCreated, data.EventDataUpdated} {
+			if err = comp.Subscribe(req, comp.GetObject(), eventType, listener); err != nil {
+				return err
+			}
+		}
+	}
+	interval := svc.FlushInterval
+	if interval <= 0 {
+		interval = DefaultEmbeddingFlushInterval
+	}
+	svc.stop = make(chan struct{})
+	svc.done.Add(1)
+	go func() {
+		defer svc.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-svc.stop:
+				return
+			case <-ticker.C:
+			case <-svc.full:
+			}
+			if err := svc.Flush(core.NewSystemRequest(ctx, "EmbeddingPipeline", nil, nil, nil)); err != nil {
+				log.Error(ctx, "Embedding records failed", slog.String("Error", err.Error()))
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops flushing on a schedule, and embeds the records still waiting.
+func (svc *EmbeddingPipeline) Stop(ctx core.ServerContext) error {
+	if svc.stop != nil {
+		close(svc.stop)
+		svc.done.Wait()
+		svc.stop = nil
+	}
+	return svc.Flush(core.NewSystemRequest(ctx, "EmbeddingPipeline", nil, nil, nil))
+}
+
+// Invoke backfills the records of every data service, and responds with how many it embedded by
+// object.
+func (svc *EmbeddingPipeline) Invoke(ctx core.RequestContext) error {
+	force := false
+	if val, ok := ctx.GetParamValue(EMBEDDING_PARAM_FORCE); ok {
+		force, _ = val.(bool)
+	}
+	embedded, err := svc.Backfill(ctx, force)
+	if err != nil {
+		return err
+	}
+	ctx.SetResponse(core.SuccessResponse(embedded))
+	return nil
+}
+
+// Backfill embeds the stored records of every data service that have no vector, or whose digest
+// does not match their text, or every record when force is set. It returns how many it embedded
+// by object.
+func (svc *EmbeddingPipeline) Backfill(ctx core.RequestContext, force bool) (map[string]int, error) {
+	embedded := make(map[string]int)
+	for _, comp := range svc.Components {
+		target, err := embeddingTargetOf(ctx, comp)
+		if err != nil {
+			return embedded, err
+		}
+		n, err := svc.backfill(ctx, comp, target, force)
+		embedded[comp.GetObject()] += n
+		if err != nil {
+			return embedded, err
+		}
+	}
+	return embedded, nil
+}
+
+func (svc *EmbeddingPipeline) backfill(ctx core.RequestContext, comp data.DataComponent, target *embeddingTarget, force bool) (int, error) {
+	it, err := comp.Iterate(ctx, nil, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	embedded := 0
+	var batch []*embedJob
+	for it.Next() {
+		item := it.Item()
+		text := embeddingText(item, target.fields)
+		if !force && svc.current(item, target, text) {
+			continue
+		}
+		batch = append(batch, newEmbedJob(ctx, comp, target, item, text))
+		if len(batch) < svc.batchSize() {
+			continue
+		}
+		done, err := svc.embed(ctx, batch)
+		embedded += done
+		if err != nil {
+			return embedded, err
+		}
+		batch = nil
+	}
+	if err = it.Err(); err != nil {
+		return embedded, err
+	}
+	if len(batch) > 0 {
+		done, err := svc.embed(ctx, batch)
+		embedded += done
+		if err != nil {
+			return embedded, err
+		}
+	}
+	return embedded, nil
+}
+
+// Flush embeds the records waiting, without waiting for the batch to fill. When the batch fails,
+// the records it did not store are queued again, and those that have failed Retries times already
+// are given up.
+func (svc *EmbeddingPipeline) Flush(ctx core.RequestContext) error {
+	svc.mu.Lock()
+	jobs := svc.pending
+	svc.pending = nil
+	svc.mu.Unlock()
+	if len(jobs) == 0 {
+		return nil
+	}
+	// a record written twice while waiting is embedded once, with its latest text
+	latest := make(map[string]int, len(jobs))
+	for i, job := range jobs {
+		latest[writingKey(job.comp, job.id)] = i
+	}
+	batch := make([]*embedJob, 0, len(latest))
+	for i, job := range jobs {
+		if latest[writingKey(job.comp, job.id)] == i {
+			batch = append(batch, job)
+		}
+	}
+	done, err := svc.embed(ctx, batch)
+	if err == nil {
+		return nil
+	}
+	var retry []*embedJob
+	for _, job := range batch[done:] {
+		if job.attempts++; job.attempts > svc.retries() {
+			log.Error(ctx, "Embedding a record failed", slog.String("Object", job.comp.GetObject()), slog.String("Id", job.id), slog.Int("Attempts", job.attempts))
+			continue
+		}
+		retry = append(retry, job)
+	}
+	// queued ahead of what was written since, so that a later write of a record still wins
+	svc.mu.Lock()
+	svc.pending = append(retry, svc.pending...)
+	svc.mu.Unlock()
+	return err
+}
+
+// listener queues the records of comp written for embedding, and has the batch flushed once it is
+// full.
+func (svc *EmbeddingPipeline) listener(comp data.DataComponent, target *embeddingTarget) core.MessageListener {
+	return func(ctx core.RequestContext, msg *core.Message, info utils.StringMap) error {
+		item, ok := msg.Data.(core.Storable)
+		if !ok || item == nil {
+			return nil
+		}
+		text := embeddingText(item, target.fields)
+		svc.mu.Lock()
+		if svc.writing[writingKey(comp, item.GetId())] > 0 || (target.digest != "" && svc.current(item, target, text)) {
+			svc.mu.Unlock()
+			return nil
+		}
+		svc.pending = append(svc.pending, newEmbedJob(ctx, comp, target, item, text))
+		full := len(svc.pending) >= svc.batchSize()
+		svc.mu.Unlock()
+		if full {
+			select {
+			case svc.full <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	}
+}
+
+// newEmbedJob queues item, written by the request ctx, to be embedded.
+func newEmbedJob(ctx core.RequestContext, comp data.DataComponent, target *embeddingTarget, item core.Storable, text string) *embedJob {
+	job := &embedJob{comp: comp, target: target, id: item.GetId(), text: text}
+	if tenant := ctx.GetTenant(); tenant != nil {
+		job.tenant = tenant.GetTenantId()
+	}
+	if user := ctx.GetUser(); user != nil {
+		job.user = user.GetId()
+	}
+	return job
+}
+
+// embed embeds the text of jobs, in calls to the provider of no more than its MaxBatch texts, and
+// stores the vectors, returning how many of jobs, from the first, it is done with. A record
+// deleted since it was queued is skipped.
+func (svc *EmbeddingPipeline) embed(ctx core.RequestContext, jobs []*embedJob) (int, error) {
+	size := svc.Provider.MaxBatch()
+	if size <= 0 {
+		size = len(jobs)
+	}
+	for start := 0; start < len(jobs); start += size {
+		end := min(start+size, len(jobs))
+		chunk := jobs[start:end]
+		texts := make([]string, len(chunk))
+		for i, job := range chunk {
+			texts[i] = job.text
+		}
+		vectors, err := svc.Provider.Embed(ctx, texts)
+		if err != nil {
+			return start, err
+		}
+		if len(vectors) != len(texts) {
+			return start, errors.InternalError(ctx, slog.String("Provider", svc.Provider.Name()), slog.Int("Texts", len(texts)), slog.Int("Vectors", len(vectors)))
+		}
+		for i, job := range chunk {
+			vals := utils.StringMap{job.target.vector: vectors[i]}
+			if job.target.digest != "" {
+				vals[job.target.digest] = svc.digest(job.text)
+			}
+			if err = svc.store(ctx, job, vals); err != nil && !errors.IsNotFound(err) {
+				return start + i, err
+			}
+		}
+	}
+	return len(jobs), nil
+}
+
+// store updates the record of job with vals, ignoring the events the update raises. The update is
+// a system request made for the job's tenant and on behalf of its user.
+func (svc *EmbeddingPipeline) store(ctx core.RequestContext, job *embedJob, vals utils.StringMap) error {
+	key := writingKey(job.comp, job.id)
+	svc.mu.Lock()
+	if svc.writing == nil {
+		svc.writing = make(map[string]int)
+	}
+	svc.writing[key]++
+	svc.mu.Unlock()
+	defer func() {
+		svc.mu.Lock()
+		if svc.writing[key]--; svc.writing[key] <= 0 {
+			delete(svc.writing, key)
+		}
+		svc.mu.Unlock()
+	}()
+	var tenant auth.TenantInfo
+	if job.tenant != "" {
+		tenant = &data.TenantInfo{TenantId: job.tenant}
+	}
+	var behalfOf interface{}
+	if job.user != "" {
+		behalfOf = job.user
+	}
+	req := core.NewSystemRequest(ctx.ServerContext(), "EmbeddingPipeline", tenant, behalfOf, nil)
+	return job.comp.Update(req, job.id, vals)
+}
+
+// current reports whether item has a vector for text: one whose digest matches when the entity
+// declares a Digest, and otherwise any.
+func (svc *EmbeddingPipeline) current(item core.Storable, target *embeddingTarget, text string) bool {
+	if target.digest != "" {
+		digest, _ := data.FieldValue(item, target.digest)
+		return digest == svc.digest(text)
+	}
+	vector, ok := data.FieldValue(item, target.vector)
+	if !ok {
+		return false
+	}
+	embedded, ok := vector.([]float32)
+	return ok && len(embedded) > 0
+}
+
+// digest identifies text as embedded by the provider, so that a change of provider or of its
+// dimension is embedded again.
+func (svc *EmbeddingPipeline) digest(text string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d\x00%s", svc.Provider.Name(), svc.Provider.Dimension(), text)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (svc *EmbeddingPipeline) retries() int {
+	if svc.Retries <= 0 {
+		return DefaultEmbeddingRetries
+	}
+	return svc.Retries
+}
+
+func (svc *EmbeddingPipeline) batchSize() int {
+	if svc.BatchSize <= 0 {
+		return DefaultEmbeddingBatchSize
+	}
+	return svc.BatchSize
+}
+
+func writingKey(comp data.DataComponent, id string) string {
+	return comp.GetObject() + "/" + id
+}
+
+// embeddingTargetOf returns what the entity comp stores embeds. It fails when the entity declares
+// no Embedding.
+func embeddingTargetOf(ctx core.RequestContext, comp data.DataComponent) (*embeddingTarget, error) {
+	var conf *core.StorableConfig
+	if factory := comp.GetObjectFactory(); factory != nil {
+		if stor, ok := factory.CreateObject(ctx).(core.Storable); ok {
+			conf = stor.Config()
+		}
+	}
+	if conf == nil || conf.Embedding == nil || len(conf.Embedding.Fields) == 0 {
+		return nil, errors.BadConf(ctx, data.CONF_DATA_SVCS, slog.String("Object", comp.GetObject()))
+	}
+	target := &embeddingTarget{fields: conf.Embedding.Fields, vector: conf.Embedding.Vector, digest: conf.Embedding.Digest}
+	if target.vector == "" {
+		target.vector = "Vector"
+		for _, index := range conf.Indexes {
+			if index.Vector != nil && len(index.Fields) == 1 {
+				target.vector, _ = data.IndexField(index.Fields[0])
+				break
+			}
+		}
+	}
+	return target, nil
+}
+
+// embeddingText joins the text in fields of item: strings, bytes, and the strings of string slices.
+func embeddingText(item interface{}, fields []string) string {
+	var parts []string
+	for _, field := range fields {
+		val, ok := data.FieldValue(item, field)
+		if !ok {
+			continue
+		}
+		switch text := val.(type) {
+		case string:
+			parts = append(parts, text)
+		case []byte:
+			parts = append(parts, string(text))
+		case []string:
+			parts = append(parts, text...)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,236 @@
+package ai_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/ai"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+type note struct {
+	data.StorageInfo
+	Text      string    `json:"Text"`
+	Embedding []float32 `json:"Embedding"`
+	Digest    string    `json:"Digest"`
+}
+
+func (n *note) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "note", Collection: "note",
+		Indexes:   []core.IndexSpec{{Fields: []string{"Embedding"}, Vector: &core.VectorIndex{Dimension: 64, Metric: core.VectorCosine}}},
+		Embedding: &core.EmbeddingSpec{Fields: []string{"Text"}, Digest: "Digest"},
+	}
+}
+
+// plainNote is a note declaring no digest, so that whether its vector is current cannot be read
+// off the record.
+type plainNote struct {
+	data.StorageInfo
+	Text      string    `json:"Text"`
+	Embedding []float32 `json:"Embedding"`
+}
+
+func (n *plainNote) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "plainnote", Collection: "plainnote",
+		Indexes:   []core.IndexSpec{{Fields: []string{"Embedding"}, Vector: &core.VectorIndex{Dimension: 64, Metric: core.VectorCosine}}},
+		Embedding: &core.EmbeddingSpec{Fields: []string{"Text"}},
+	}
+}
+
+// failingEmbedder fails the next fail calls made of it, and counts the texts it embeds.
+type failingEmbedder struct {
+	*ai.HashingEmbedder
+	fail  int
+	texts int
+}
+
+func (e *failingEmbedder) Embed(ctx core.RequestContext, texts []string) ([][]float32, error) {
+	if e.fail > 0 {
+		e.fail--
+		return nil, errors.InternalError(ctx)
+	}
+	e.texts += len(texts)
+	return e.HashingEmbedder.Embed(ctx, texts)
+}
+
+func TestHashingEmbedder(t *testing.T) {
+	server := datatest.NewServerContext()
+	c := datatest.NewRequestContext(server, "user1", "")
+	embedder := ai.NewHashingEmbedderWithDimension(server, 64)
+	vectors, _ := embedder.Embed(c, []string{"Go channels", "go CHANNELS", "borrow checker"})
+	if fmt.Sprint(vectors[0]) != fmt.Sprint(vectors[1]) || fmt.Sprint(vectors[0]) == fmt.Sprint(vectors[2]) {
+		t.Fatalf("hashing embedder is not deterministic over tokens: %v", vectors)
+	}
+	if score, _ := data.VectorSimilarity(core.VectorCosine, vectors[0], vectors[0]); score < 0.999 {
+		t.Fatalf("hashing vectors are not unit length: %v", score)
+	}
+}
+
+func TestEmbeddingPipeline(t *testing.T) {
+	// setup stores a note written before the pipeline, and starts a pipeline embedding the notes in
+	// batches of two, flushed only when full
+	setup := func(t *testing.T) (*ai.EmbeddingPipeline, *failingEmbedder, data.DataComponent, *datatest.RequestContext) {
+		t.Helper()
+		server := datatest.NewServerContext()
+		c := datatest.NewRequestContext(server, "user1", "")
+		svc := memory.NewMemoryDataComponentForObject(server, "note", datatest.EntityFactory[note]{})
+		if err := svc.CreateDBCollection(server); err != nil {
+			t.Fatalf("CreateDBCollection: %v", err)
+		}
+		if err := svc.Save(c, &note{Text: "written before the pipeline"}); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		embedder := &failingEmbedder{HashingEmbedder: ai.NewHashingEmbedderWithDimension(server, 64)}
+		pipeline := ai.NewEmbeddingPipelineWithServices(server, embedder, svc)
+		pipeline.BatchSize = 2
+		pipeline.FlushInterval = time.Hour
+		if err := pipeline.Start(server); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := pipeline.Stop(server); err != nil {
+				t.Errorf("Stop: %v", err)
+			}
+		})
+		return pipeline, embedder, svc, c
+	}
+	embedded := func(t *testing.T, svc data.DataComponent, c core.RequestContext, id string, text string) bool {
+		t.Helper()
+		item, err := svc.GetById(c, id, "")
+		if err != nil {
+			t.Fatalf("GetById: %v", err)
+		}
+		want, _ := ai.NewHashingEmbedderWithDimension(c.ServerContext(), 64).Embed(c, []string{text})
+		return item.(*note).Digest != "" && fmt.Sprint(item.(*note).Embedding) == fmt.Sprint(want[0])
+	}
+	save := func(t *testing.T, svc data.DataComponent, c core.RequestContext, texts ...string) []string {
+		t.Helper()
+		ids := make([]string, len(texts))
+		for i, text := range texts {
+			item := &note{Text: text}
+			if err := svc.Save(c, item); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			ids[i] = item.Id
+		}
+		return ids
+	}
+
+	// a full batch is embedded in the background, and a batch that is not full waits
+	t.Run("batches", func(t *testing.T) {
+		_, _, svc, c := setup(t)
+		first := save(t, svc, c, "go channels")[0]
+		if embedded(t, svc, c, first, "go channels") {
+			t.Fatalf("embedded before the batch filled")
+		}
+		second := save(t, svc, c, "rust ownership")[0]
+		for deadline := time.Now().Add(time.Second); !embedded(t, svc, c, first, "go channels") || !embedded(t, svc, c, second, "rust ownership"); {
+			if time.Now().After(deadline) {
+				t.Fatalf("a full batch was not embedded")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	// an update re-embeds, and a flush embeds a batch that is not full
+	t.Run("updates", func(t *testing.T) {
+		pipeline, _, svc, c := setup(t)
+		id := save(t, svc, c, "go channels")[0]
+		if err := svc.Update(c, id, utils.StringMap{"Text": "go generics"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if err := pipeline.Flush(c); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if !embedded(t, svc, c, id, "go generics") {
+			t.Fatalf("an update was not re-embedded")
+		}
+	})
+
+	// a batch that fails is queued again, until a record has failed its retries
+	t.Run("retries", func(t *testing.T) {
+		pipeline, embedder, svc, c := setup(t)
+		pipeline.Retries = 1
+		embedder.fail = 1
+		id := save(t, svc, c, "rust lifetimes")[0]
+		if err := pipeline.Flush(c); err == nil || embedded(t, svc, c, id, "rust lifetimes") {
+			t.Fatalf("a failing provider embedded the batch: %v", err)
+		}
+		if err := pipeline.Flush(c); err != nil || !embedded(t, svc, c, id, "rust lifetimes") {
+			t.Fatalf("a failed batch was not embedded again: %v", err)
+		}
+		embedder.fail = 2
+		if err := svc.Update(c, id, utils.StringMap{"Text": "rust traits"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		pipeline.Flush(c)
+		pipeline.Flush(c)
+		if err := pipeline.Flush(c); err != nil || embedded(t, svc, c, id, "rust traits") {
+			t.Fatalf("a record was embedded after failing its retries: %v", err)
+		}
+	})
+
+	// the backfill embeds what was stored before the pipeline, and then finds nothing out of date
+	t.Run("backfill", func(t *testing.T) {
+		pipeline, _, svc, c := setup(t)
+		ids := save(t, svc, c, "go generics", "rust ownership")
+		if err := pipeline.Flush(c); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		counts, err := pipeline.Backfill(c, false)
+		if err != nil || counts["note"] != 1 {
+			t.Fatalf("Backfill: %v %v", counts, err)
+		}
+		if counts, _ = pipeline.Backfill(c, false); counts["note"] != 0 {
+			t.Fatalf("second backfill embedded %v", counts)
+		}
+		if counts, _ = pipeline.Backfill(c, true); counts["note"] != 3 {
+			t.Fatalf("forced backfill embedded %v", counts)
+		}
+		query, _ := ai.NewHashingEmbedderWithDimension(c.ServerContext(), 64).Embed(c, []string{"generics in go"})
+		results, err := svc.VectorSearch(c, query[0], 1, nil)
+		if err != nil || len(results) != 1 || results[0].Item.GetId() != ids[0] {
+			t.Fatalf("VectorSearch: %v %v", results, err)
+		}
+	})
+
+	// a record without a digest cannot tell the pipeline its vector is current, so the pipeline
+	// leaves the writes it makes itself out of the batch
+	t.Run("without a digest", func(t *testing.T) {
+		server := datatest.NewServerContext()
+		c := datatest.NewRequestContext(server, "user1", "")
+		svc := memory.NewMemoryDataComponentForObject(server, "plainnote", datatest.EntityFactory[plainNote]{})
+		if err := svc.CreateDBCollection(server); err != nil {
+			t.Fatalf("CreateDBCollection: %v", err)
+		}
+		embedder := &failingEmbedder{HashingEmbedder: ai.NewHashingEmbedderWithDimension(server, 64)}
+		pipeline := ai.NewEmbeddingPipelineWithServices(server, embedder, svc)
+		pipeline.FlushInterval = time.Hour
+		if err := pipeline.Start(server); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		defer pipeline.Stop(server)
+		item := &plainNote{Text: "go channels"}
+		if err := svc.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := pipeline.Flush(c); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+		if embedder.texts != 1 {
+			t.Errorf("want the record embedded once, got %d texts embedded", embedder.texts)
+		}
+		stored, err := svc.GetById(c, item.Id, "")
+		if err != nil || len(stored.(*plainNote).Embedding) != 64 {
+			t.Errorf("the record was not embedded: %v", err)
+		}
+	})
+}
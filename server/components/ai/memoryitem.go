@@ -20,6 +20,7 @@ type AIMemoryItem struct {
 	Tags       []string        `json:"Tags"`
 	Metadata   utils.StringMap `json:"Metadata"`
 	Vector     []float32       `json:"Vector"`
+	Digest     string          `json:"Digest"` // digest of the content Vector embeds
 }
 
 func (mi *AIMemoryItem) GetImportance() float64       { return mi.Importance }
@@ -41,6 +42,7 @@ func (mi *AIMemoryItem) Config() *core.StorableConfig {
 		Multitenant: true,
 		Collection:  "MemoryItem",
 		Cacheable:   true,
+		Embedding:   &core.EmbeddingSpec{Fields: []string{"Content"}, Vector: "Vector", Digest: "Digest"},
 	}
 }
 
@@ -78,6 +80,10 @@ func (ent *AIMemoryItem) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatyp
 		return err
 	}
 
+	if err = rdr.ReadString(c, cdc, "Digest", &ent.Digest); err != nil {
+		return err
+	}
+
 	err = ent.TenantInfo.ReadAll(c, cdc, rdr)
 	if err != nil {
 		return err
@@ -121,6 +127,10 @@ func (ent *AIMemoryItem) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr dataty
 		return err
 	}
 
+	if err = wtr.WriteString(c, cdc, "Digest", &ent.Digest); err != nil {
+		return err
+	}
+
 	err = ent.TenantInfo.WriteAll(c, cdc, wtr)
 	if err != nil {
 		return err
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"time"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+)
+
+// AUDIT_OBJECT is the object type audit records are stored as.
+const AUDIT_OBJECT = "data.AuditRecord"
+
+// AuditOperation is the kind of write an audit record describes.
+type AuditOperation string
+
+const (
+	AuditCreate AuditOperation = "create"
+	AuditUpdate AuditOperation = "update"
+	AuditDelete AuditOperation = "delete"
+	// AuditRestore is a soft-deleted record being restored, and AuditPurge one being purged.
+	AuditRestore AuditOperation = "restore"
+	AuditPurge   AuditOperation = "purge"
+)
+
+// FieldChange is one field's value before and after a write. Old is nil for a record being
+// created, and New for one being deleted.
+type FieldChange struct {
+	Field string      `json:"Field" bson:"Field"`
+	Old   interface{} `json:"Old" bson:"Old"`
+	New   interface{} `json:"New" bson:"New"`
+}
+
+// AuditRecord describes one write to one record: who made it, in which tenant, when, and which
+// fields it changed from what to what. Audit records are only ever created, never updated.
+type AuditRecord struct {
+	StorageInfo
+	Object    string         `json:"Object" bson:"Object"`
+	EntityId  string         `json:"EntityId" bson:"EntityId"`
+	Operation AuditOperation `json:"Operation" bson:"Operation"`
+	User      string         `json:"User" bson:"User"`
+	Tenant    string         `json:"Tenant" bson:"Tenant"`
+	At        time.Time      `json:"At" bson:"At"`
+	Changes   []FieldChange  `json:"Changes" bson:"Changes"`
+}
+
+func (ar *AuditRecord) Config() *core.StorableConfig {
+	return &core.StorableConfig{
+		ObjectType: AUDIT_OBJECT,
+		LabelField: "Id",
+		Collection: "AuditRecord",
+	}
+}
+
+func (ar *AuditRecord) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatypes.SerializableReader) error {
+	var err error
+	if err = rdr.ReadString(c, cdc, "Object", &ar.Object); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "EntityId", &ar.EntityId); err != nil {
+		return err
+	}
+	operation := string(ar.Operation)
+	if err = rdr.ReadString(c, cdc, "Operation", &operation); err != nil {
+		return err
+	}
+	ar.Operation = AuditOperation(operation)
+	if err = rdr.ReadString(c, cdc, "User", &ar.User); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "Tenant", &ar.Tenant); err != nil {
+		return err
+	}
+	if err = rdr.ReadTime(c, cdc, "At", &ar.At); err != nil {
+		return err
+	}
+	if err = rdr.ReadArray(c, cdc, "Changes", &ar.Changes); err != nil {
+		return err
+	}
+	return ar.StorageInfo.ReadAll(c, cdc, rdr)
+}
+
+func (ar *AuditRecord) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr datatypes.SerializableWriter) error {
+	var err error
+	if err = wtr.WriteString(c, cdc, "Object", &ar.Object); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "EntityId", &ar.EntityId); err != nil {
+		return err
+	}
+	operation := string(ar.Operation)
+	if err = wtr.WriteString(c, cdc, "Operation", &operation); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "User", &ar.User); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "Tenant", &ar.Tenant); err != nil {
+		return err
+	}
+	if err = wtr.WriteTime(c, cdc, "At", &ar.At); err != nil {
+		return err
+	}
+	if err = wtr.WriteArray(c, cdc, "Changes", &ar.Changes); err != nil {
+		return err
+	}
+	return ar.StorageInfo.WriteAll(c, cdc, wtr)
+}
+
+// AuditRecordFactory creates AuditRecords, for registering the audit object with a server or for
+// handing to a data component directly.
+type AuditRecordFactory struct{}
+
+func (f AuditRecordFactory) CreateObject(ctx.Context) interface{} {
+	return &AuditRecord{}
+}
+
+func (f AuditRecordFactory) CreateObjectCollection(cx ctx.Context, length int) interface{} {
+	return make([]AuditRecord, length)
+}
+
+func (f AuditRecordFactory) CreateObjectPointersCollection(cx ctx.Context, length int) interface{} {
+	return make([]*AuditRecord, length)
+}
+
+func (f AuditRecordFactory) Info() core.Info {
+	return core.NewInfo("Audit record of a write to a trackable entity", AUDIT_OBJECT, "1.0", nil)
+}
@@ -0,0 +1,373 @@
+package data
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// CONF_DATA_AUDIT_SVC names the data service an AuditPlugin writes its audit records to.
+const CONF_DATA_AUDIT_SVC = "auditservice"
+
+// auditIgnoredFields are the fields an audit record leaves out of its changes: the id and version
+// identify the record rather than describe it, the tracking stamps and tenant repeat the audit
+// record's own who, when and where, and the deletion fields are its operation.
+var auditIgnoredFields = map[string]bool{
+	"Id":             true,
+	"Version":        true,
+	FIELD_SOFTDELETE: true,
+	FIELD_DELETEDAT:  true,
+	FIELD_DELETEDBY:  true,
+	"TenantId":       true,
+	"TenantName":     true,
+	"IsNew":          true,
+	"CreatedBy":      true,
+	"CreatedAt":      true,
+	"UpdatedBy":      true,
+	"UpdatedAt":      true,
+}
+
+var _ DataComponent = (*AuditPlugin)(nil)
+
+/*
+AuditPlugin layers an audit trail over a data service. Every write to an entity configured as
+Trackable — saves, puts, updates, upserts and deletes, by id or by condition, and the restores and
+purges of soft-deleted records, each audited as its own operation — is followed by one audit
+record per record it touched, holding the fields it changed with their values before and after,
+written to the audit data service. Writes to other entities pass straight through.
+
+The records before a write are read before it and the records after it are read back after, so a
+write through the plugin costs a read on either side of it. An audit record is written only once
+its write has succeeded; when the audit write then fails, the error is returned, and running the
+write in a transaction is what keeps the two together.
+*/
+type AuditPlugin struct {
+	DataPlugin
+	AuditDataComponent DataComponent
+	trackable          bool
+}
+
+func NewAuditPlugin(ctx core.ServerContext) *AuditPlugin {
+	return &AuditPlugin{}
+}
+
+// NewAuditPluginWithBase creates a plugin over comp writing its audit records to audit.
+func NewAuditPluginWithBase(ctx core.ServerContext, comp DataComponent, audit DataComponent) *AuditPlugin {
+	svc := &AuditPlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, AuditDataComponent: audit}
+	svc.trackable = isTrackable(ctx, comp)
+	return svc
+}
+
+func (svc *AuditPlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.AuditDataComponent == nil {
+		svc.AddStringConfiguration(ctx, CONF_DATA_AUDIT_SVC, "Data service audit records are written to", "")
+	}
+	return nil
+}
+
+func (svc *AuditPlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.AuditDataComponent == nil {
+		auditSvc, _ := svc.GetStringConfiguration(ctx, CONF_DATA_AUDIT_SVC)
+		s, err := ctx.GetService(auditSvc)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_AUDIT_SVC)
+		}
+		dc, ok := s.(DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_AUDIT_SVC)
+		}
+		svc.AuditDataComponent = dc
+	}
+	svc.trackable = isTrackable(ctx, svc.PluginDataComponent)
+	return nil
+}
+
+// isTrackable reports whether comp stores an entity configured as Trackable.
+func isTrackable(ctx core.ServerContext, comp DataComponent) bool {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return false
+	}
+	stor, ok := factory.CreateObject(ctx).(core.Storable)
+	return ok && stor.Config() != nil && stor.Config().Trackable
+}
+
+func (svc *AuditPlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	return svc.auditItems(ctx, []core.Storable{item}, func() error {
+		return svc.PluginDataComponent.Save(ctx, item)
+	})
+}
+
+func (svc *AuditPlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	if item != nil {
+		item.SetId(id)
+	}
+	return svc.auditItems(ctx, []core.Storable{item}, func() error {
+		return svc.PluginDataComponent.Put(ctx, id, item)
+	})
+}
+
+func (svc *AuditPlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.auditItems(ctx, items, func() error {
+		return svc.PluginDataComponent.PutMulti(ctx, items)
+	})
+}
+
+func (svc *AuditPlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.auditItems(ctx, items, func() error {
+		return svc.PluginDataComponent.CreateMulti(ctx, items)
+	})
+}
+
+func (svc *AuditPlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.auditIds(ctx, []string{id}, func() error {
+		return svc.PluginDataComponent.UpsertId(ctx, id, newVals)
+	})
+}
+
+func (svc *AuditPlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.auditIds(ctx, []string{id}, func() error {
+		return svc.PluginDataComponent.Update(ctx, id, newVals)
+	})
+}
+
+func (svc *AuditPlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	return svc.auditIds(ctx, ids, func() error {
+		return svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+	})
+}
+
+func (svc *AuditPlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return svc.auditCondition(ctx, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, true)
+	})
+}
+
+func (svc *AuditPlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return svc.auditCondition(ctx, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, true)
+	})
+}
+
+func (svc *AuditPlugin) Delete(ctx core.RequestContext, id string) error {
+	return svc.auditIds(ctx, []string{id}, func() error {
+		return svc.PluginDataComponent.Delete(ctx, id)
+	})
+}
+
+func (svc *AuditPlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	return svc.auditIds(ctx, ids, func() error {
+		return svc.PluginDataComponent.DeleteMulti(ctx, ids)
+	})
+}
+
+func (svc *AuditPlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	return svc.auditCondition(ctx, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.DeleteAll(ctx, queryCond, true)
+	})
+}
+
+// Restore is audited with an AuditRestore record for each record restored, holding its fields as
+// restored.
+func (svc *AuditPlugin) Restore(ctx core.RequestContext, ids []string) error {
+	write := func() error {
+		return svc.PluginDataComponent.Restore(ctx, ids)
+	}
+	if !svc.trackable {
+		return write()
+	}
+	return captureIds(ctx, svc.PluginDataComponent, ids, write, func(ctx core.RequestContext, ids []string, before map[string]core.Storable, after map[string]core.Storable) error {
+		return svc.recordAs(ctx, AuditRestore, ids, before, after)
+	})
+}
+
+// Purge is audited with an AuditPurge record for each record purged, holding its fields as they
+// were. The records it purges are listed before it runs, as they cannot be read after.
+func (svc *AuditPlugin) Purge(ctx core.RequestContext, olderThan time.Time) (int, error) {
+	if !svc.trackable {
+		return svc.PluginDataComponent.Purge(ctx, olderThan)
+	}
+	items, _, _, _, err := svc.PluginDataComponent.ListDeleted(ctx, nil, -1, 1, nil)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	before := make(map[string]core.Storable, len(items))
+	for _, item := range items {
+		if deletedAt, ok := FieldValue(item, FIELD_DELETEDAT); ok {
+			if at, ok := deletedAt.(time.Time); ok && !at.Before(olderThan) {
+				continue
+			}
+		}
+		ids = append(ids, item.GetId())
+		before[item.GetId()] = item
+	}
+	purged, err := svc.PluginDataComponent.Purge(ctx, olderThan)
+	if err != nil {
+		return purged, err
+	}
+	return purged, svc.recordAs(ctx, AuditPurge, ids, before, nil)
+}
+
+// GetHistory returns the audit records of the record with id, oldest first. A request scoped to a
+// tenant sees only the records of writes made in that tenant.
+func (svc *AuditPlugin) GetHistory(ctx core.RequestContext, id string) ([]*AuditRecord, error) {
+	operands := []Predicate{
+		&Comparison{Field: "Object", Operator: OpEqual, Value: LiteralOperand(svc.GetObject())},
+		&Comparison{Field: "EntityId", Operator: OpEqual, Value: LiteralOperand(id)},
+	}
+	if tenant := ctx.GetTenant(); tenant != nil && tenant.GetTenantId() != "" {
+		operands = append(operands, &Comparison{Field: "Tenant", Operator: OpEqual, Value: LiteralOperand(tenant.GetTenantId())})
+	}
+	query := NewQuery()
+	query.Filter = &Logical{Operator: LogicalAnd, Operands: operands}
+	cond, err := svc.AuditDataComponent.CreateQueryCondition(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	items, _, _, _, err := svc.AuditDataComponent.Get(ctx, nil, cond, -1, 1, "", []string{"At"}, "")
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*AuditRecord, 0, len(items))
+	for _, item := range items {
+		record, ok := item.(*AuditRecord)
+		if !ok {
+			return nil, errors.TypeMismatch(ctx)
+		}
+		history = append(history, record)
+	}
+	return history, nil
+}
+
+// auditItems runs a write of items and audits it.
+func (svc *AuditPlugin) auditItems(ctx core.RequestContext, items []core.Storable, write func() error) error {
+	if !svc.trackable {
+		return write()
+	}
+	return captureItems(ctx, svc.PluginDataComponent, items, write, svc.record)
+}
+
+// auditIds runs a write of the records with ids and audits it.
+func (svc *AuditPlugin) auditIds(ctx core.RequestContext, ids []string, write func() error) error {
+	if !svc.trackable {
+		return write()
+	}
+	return captureIds(ctx, svc.PluginDataComponent, ids, write, svc.record)
+}
+
+// auditCondition runs a write of the records matching queryCond, which returns the ids it wrote,
+// and audits it.
+func (svc *AuditPlugin) auditCondition(ctx core.RequestContext, queryCond interface{}, getids bool, write func() ([]string, error)) ([]string, error) {
+	if !svc.trackable {
+		return passCondition(getids, write)
+	}
+	return captureCondition(ctx, svc.PluginDataComponent, queryCond, getids, write, svc.record)
+}
+
+// record writes an audit record for each of ids whose record changed between before and after.
+// A record missing from before was created, and one missing from after was deleted.
+func (svc *AuditPlugin) record(ctx core.RequestContext, ids []string, before map[string]core.Storable, after map[string]core.Storable) error {
+	return svc.recordAs(ctx, "", ids, before, after)
+}
+
+// recordAs writes the audit records of a write of operation, or of the operation each record's
+// presence before and after tells when it is empty.
+func (svc *AuditPlugin) recordAs(ctx core.RequestContext, operation AuditOperation, ids []string, before map[string]core.Storable, after map[string]core.Storable) error {
+	at := time.Now()
+	var user, tenant string
+	if u := ctx.GetUser(); u != nil {
+		user = u.GetId()
+	}
+	if t := ctx.GetTenant(); t != nil {
+		tenant = t.GetTenantId()
+	}
+	for _, id := range ids {
+		old, wasStored := before[id]
+		current, isStored := after[id]
+		op := operation
+		switch {
+		case !wasStored && !isStored:
+			continue
+		case op != "":
+		case !wasStored:
+			op = AuditCreate
+		case !isStored:
+			op = AuditDelete
+		default:
+			op = AuditUpdate
+		}
+		changes, err := fieldChanges(old, current)
+		if err != nil {
+			return errors.WrapError(ctx, err)
+		}
+		if op == AuditUpdate && len(changes) == 0 {
+			continue
+		}
+		record := &AuditRecord{Object: svc.GetObject(), EntityId: id, Operation: op, User: user, Tenant: tenant, At: at, Changes: changes}
+		record.Id = ctx.CreateUUID()
+		if err = svc.AuditDataComponent.Save(ctx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldChanges lists the fields whose stored values differ between two versions of a record,
+// ordered by field. Either version may be nil, when the record was created or deleted.
+func fieldChanges(old core.Storable, current core.Storable) ([]FieldChange, error) {
+	oldFields, err := storedFields(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := storedFields(current)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(oldFields)+len(newFields))
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []FieldChange
+	for _, name := range names {
+		if auditIgnoredFields[name] || reflect.DeepEqual(oldFields[name], newFields[name]) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: name, Old: oldFields[name], New: newFields[name]})
+	}
+	return changes, nil
+}
+
+// storedFields returns a record's fields as they are stored, by their stored names.
+func storedFields(item core.Storable) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if item == nil {
+		return fields, nil
+	}
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,145 @@
+package data_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/utils"
+)
+
+func TestAuditPlugin(t *testing.T) {
+	audit := func(t *testing.T, conf core.StorableConfig) (*data.AuditPlugin, *memory.MemoryDataComponent, *memory.MemoryDataComponent, *datatest.ObjectFactory, *datatest.RequestContext) {
+		t.Helper()
+		svc, objects, c := newWidgets(t, conf)
+		trail := memory.NewMemoryDataComponentForObject(c.Server, data.AUDIT_OBJECT, data.AuditRecordFactory{})
+		return data.NewAuditPluginWithBase(c.Server, svc, trail), svc, trail, objects, c
+	}
+	history := func(t *testing.T, audited *data.AuditPlugin, c core.RequestContext, id string) string {
+		t.Helper()
+		records, err := audited.GetHistory(c, id)
+		if err != nil {
+			t.Fatalf("GetHistory: %v", err)
+		}
+		var got []string
+		for _, record := range records {
+			if record.User != "user1" || record.Object != "widget" {
+				t.Errorf("audit record by %q for %q", record.User, record.Object)
+			}
+			entry := string(record.Operation)
+			for _, change := range record.Changes {
+				entry += fmt.Sprintf(" %s:%v>%v", change.Field, change.Old, change.New)
+			}
+			got = append(got, entry)
+		}
+		return strings.Join(got, "\n")
+	}
+
+	t.Run("writes", func(t *testing.T) {
+		audited, svc, _, objects, c := audit(t, core.StorableConfig{Trackable: true, SoftDelete: true})
+		item := objects.NewRecord("alpha", 1)
+		if err := audited.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := audited.Update(c, item.Id, utils.StringMap{"Name": "beta", "Size": 2}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if err := audited.Update(c, item.Id, utils.StringMap{"Name": "beta"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		query := data.NewQuery()
+		query.Filter = &data.Comparison{Field: "Size", Operator: data.OpEqual, Value: data.LiteralOperand(2)}
+		cond, err := svc.CreateQueryCondition(c, query, nil)
+		if err != nil {
+			t.Fatalf("CreateQueryCondition: %v", err)
+		}
+		if _, err = audited.UpdateAll(c, cond, utils.StringMap{"Size": 3}, false); err != nil {
+			t.Fatalf("UpdateAll: %v", err)
+		}
+		if err = audited.Delete(c, item.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		want := strings.Join([]string{
+			"create Name:<nil>>alpha Size:<nil>>1",
+			"update Name:alpha>beta Size:1>2",
+			"update Size:2>3",
+			"delete Name:beta><nil> Size:3><nil>",
+		}, "\n")
+		if got := history(t, audited, c, item.Id); got != want {
+			t.Errorf("want history\n%s\ngot\n%s", want, got)
+		}
+	})
+
+	t.Run("trash", func(t *testing.T) {
+		audited, svc, _, objects, c := audit(t, core.StorableConfig{Trackable: true, SoftDelete: true})
+		item := objects.NewRecord("beta", 3)
+		if err := audited.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := audited.Delete(c, item.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		var events []string
+		for _, evt := range []data.DataEventType{data.EventDataRestored, data.EventDataPurged} {
+			svc.Subscribe(c, "widget", evt, func(ctx core.RequestContext, msg *core.Message, info utils.StringMap) error {
+				events = append(events, info["event"].(string)+":"+msg.Data.(*datatest.Record).Name)
+				return nil
+			})
+		}
+		if err := audited.Restore(c, []string{item.Id}); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if err := audited.Delete(c, item.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if n, err := audited.Purge(c, time.Now().Add(time.Minute)); err != nil || n != 1 {
+			t.Fatalf("Purge: %d %v", n, err)
+		}
+		if want := "data.object.restored:beta data.object.purged:beta"; strings.Join(events, " ") != want {
+			t.Errorf("want events %s, got %v", want, events)
+		}
+		want := strings.Join([]string{
+			"create Name:<nil>>beta Size:<nil>>3",
+			"delete Name:beta><nil> Size:3><nil>",
+			"restore Name:<nil>>beta Size:<nil>>3",
+			"delete Name:beta><nil> Size:3><nil>",
+			"purge Name:beta><nil> Size:3><nil>",
+		}, "\n")
+		if got := history(t, audited, c, item.Id); got != want {
+			t.Errorf("want history\n%s\ngot\n%s", want, got)
+		}
+	})
+
+	// a store that removes what it deletes leaves nothing to read after, and the delete is audited all the same
+	t.Run("hard deletes", func(t *testing.T) {
+		audited, svc, _, objects, c := audit(t, core.StorableConfig{Trackable: true})
+		item := objects.NewRecord("gamma", 4)
+		if err := audited.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := audited.Delete(c, item.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if deleted, _, _, _, _ := svc.ListDeleted(c, nil, -1, 1, nil); len(deleted) != 0 {
+			t.Fatalf("the store kept %d deleted records", len(deleted))
+		}
+		if got, want := history(t, audited, c, item.Id), "create Name:<nil>>gamma Size:<nil>>4\ndelete Name:gamma><nil> Size:4><nil>"; got != want {
+			t.Errorf("want history\n%s\ngot\n%s", want, got)
+		}
+	})
+
+	t.Run("untracked", func(t *testing.T) {
+		audited, _, trail, objects, c := audit(t, core.StorableConfig{})
+		if err := audited.Save(c, objects.NewRecord("delta", 1)); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if records, _, _, _, _ := trail.GetList(c, nil, 0, 0, "", nil, ""); len(records) != 0 {
+			t.Errorf("a write to an entity that is not trackable was audited %d times", len(records))
+		}
+	})
+}
@@ -0,0 +1,552 @@
+package data
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_DATA_CACHE_NAME names the cache of the cache manager records are cached in.
+	CONF_DATA_CACHE_NAME = "datacache"
+	// CONF_DATA_CACHE_TTL is how long a record is cached, as a duration such as "10m".
+	CONF_DATA_CACHE_TTL = "cachettl"
+	// CONF_DATA_CACHE_NEGATIVETTL is how long an id with no record is remembered as missing, as a
+	// duration such as "30s". Zero turns negative caching off.
+	CONF_DATA_CACHE_NEGATIVETTL = "cachenegativettl"
+)
+
+const (
+	// DefaultCacheTTL is how long a record is cached when it is not configured.
+	DefaultCacheTTL = 10 * time.Minute
+	// DefaultNegativeCacheTTL is how long a missing id is remembered when it is not configured.
+	DefaultNegativeCacheTTL = 30 * time.Second
+)
+
+// cacheProvider is the cache manager server element, which hands out caches by name.
+type cacheProvider interface {
+	GetCache(ctx core.ServerContext, name string) components.CacheComponent
+}
+
+var _ DataComponent = (*CachePlugin)(nil)
+
+/*
+CachePlugin caches the records GetById, GetMulti and GetMultiHash read, in a CacheComponent, for an
+entity configured as Cacheable or a plugin configured cacheable. A record missing from the cache is
+read from the data service underneath and cached for TTL; an id with no record is remembered as
+missing for NegativeTTL, so that repeated reads of it do not reach the store either. Reads that
+project fields or name a dao are not cached.
+
+Concurrent reads of the same id that miss wait for one of them to read the store, rather than
+each reading it. This holds within an instance; instances sharing a cache may each read once. A
+write to the id ends the wait for reads that start after it, so that they read the store again.
+
+Records are cached in a bucket of their object, under their id and the tenant of the request that
+read them, so that a record one tenant may read never reaches another through the cache. The
+cache does not know of the policies of plugins restricting by user, and must be placed beneath
+them.
+
+Every write through the plugin invalidates the records it wrote, instead of writing them through,
+so that two writes racing cannot leave the older in the cache; the next read caches the record
+again. The cache keeps a generation for each id, which every entry of the id is cached with, and
+a write removes it, so that the entries every tenant holds for the id are invalidated at once.
+Upsert, UpdateAll and DeleteAll ask the service underneath for the ids they wrote whether or not
+their caller does. A read that was under way when a write was made, or made inside a transaction
+through the plugin, is not cached, and the records written in a transaction are invalidated again
+once it ends.
+*/
+type CachePlugin struct {
+	DataPlugin
+	Cache       components.CacheComponent
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// Enabled is set for an entity configured as Cacheable; a plugin that is not enabled passes every
+	// call to the service underneath.
+	Enabled bool
+
+	mu      sync.Mutex
+	flights map[string]map[string]*cacheFlight
+	epoch   uint64
+	txOpen  int
+	txIds   []string
+}
+
+// cacheEntry is what the cache holds for an id and a tenant: the record, or that there is none, as
+// the tenant saw it in the generation of the id it was read in.
+type cacheEntry struct {
+	Generation string          `json:"g"`
+	Missing    bool            `json:"m,omitempty"`
+	Item       json.RawMessage `json:"i,omitempty"`
+}
+
+// cacheGeneration is the generation of an id the cache holds its entries for.
+type cacheGeneration struct {
+	Generation string `json:"g"`
+}
+
+// cacheFlight is a read of the store that requests missing the same id wait for.
+type cacheFlight struct {
+	done    chan struct{}
+	encoded []byte
+	err     error
+}
+
+func NewCachePlugin(ctx core.ServerContext) *CachePlugin {
+	return &CachePlugin{}
+}
+
+// NewCachePluginWithBase creates a plugin over comp caching in cache, enabled when the entity comp
+// stores is Cacheable.
+func NewCachePluginWithBase(ctx core.ServerContext, comp DataComponent, cache components.CacheComponent) *CachePlugin {
+	return &CachePlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, Cache: cache, TTL: DefaultCacheTTL,
+		NegativeTTL: DefaultNegativeCacheTTL, Enabled: isCacheable(ctx, comp)}
+}
+
+// isCacheable reports whether comp stores an entity configured as Cacheable.
+func isCacheable(ctx core.ServerContext, comp DataComponent) bool {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return false
+	}
+	stor, ok := factory.CreateObject(ctx).(core.Storable)
+	return ok && stor.Config() != nil && stor.Config().Cacheable
+}
+
+func (svc *CachePlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.Cache == nil {
+		svc.AddStringConfiguration(ctx, CONF_DATA_CACHE_NAME, "Cache records are cached in", "")
+		svc.AddOptionalConfiguration(ctx, CONF_DATA_CACHEABLE, "Cache the records even when the entity is not Cacheable", datatypes.Bool, false)
+		svc.AddStringConfiguration(ctx, CONF_DATA_CACHE_TTL, "How long a record is cached", DefaultCacheTTL.String())
+		svc.AddStringConfiguration(ctx, CONF_DATA_CACHE_NEGATIVETTL, "How long an id with no record is remembered, zero for never", DefaultNegativeCacheTTL.String())
+	}
+	return nil
+}
+
+func (svc *CachePlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.Cache != nil {
+		return nil
+	}
+	cacheable, _ := svc.GetBoolConfiguration(ctx, CONF_DATA_CACHEABLE)
+	svc.Enabled = cacheable || isCacheable(ctx, svc.PluginDataComponent)
+	svc.TTL, svc.NegativeTTL = DefaultCacheTTL, DefaultNegativeCacheTTL
+	for name, ttl := range map[string]*time.Duration{CONF_DATA_CACHE_TTL: &svc.TTL, CONF_DATA_CACHE_NEGATIVETTL: &svc.NegativeTTL} {
+		if val, ok := svc.GetStringConfiguration(ctx, name); ok && val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return errors.BadConf(ctx, name)
+			}
+			*ttl = d
+		}
+	}
+	if !svc.Enabled {
+		return nil
+	}
+	caches, ok := ctx.GetServerElement(core.ServerElementCacheManager).(cacheProvider)
+	if !ok {
+		return errors.MissingService(ctx, "CacheManager")
+	}
+	name, _ := svc.GetStringConfiguration(ctx, CONF_DATA_CACHE_NAME)
+	if svc.Cache = caches.GetCache(ctx, name); svc.Cache == nil {
+		return errors.BadConf(ctx, CONF_DATA_CACHE_NAME)
+	}
+	return nil
+}
+
+// cacheable reports whether a read of the given shape is cached.
+func (svc *CachePlugin) cacheable(props []string, dao string) bool {
+	return svc.Enabled && len(props) == 0 && dao == ""
+}
+
+// entryKey returns the key the entry of id for the request's tenant is cached under. The tenant is
+// escaped, so that no tenant and id make the key of another.
+func entryKey(ctx core.RequestContext, id string) string {
+	return url.PathEscape(requestTenant(ctx)) + "/" + id
+}
+
+// generationKey returns the key the generation of id is cached under, which is no entry's key.
+func generationKey(id string) string {
+	return "#" + id
+}
+
+// generation returns the generation of id the cache holds, and false when it holds none.
+func (svc *CachePlugin) generation(ctx core.RequestContext, id string) (string, bool) {
+	var gen cacheGeneration
+	if err := svc.Cache.GetIntoObject(ctx, svc.GetObject(), generationKey(id), &gen); err != nil || gen.Generation == "" {
+		return "", false
+	}
+	return gen.Generation, true
+}
+
+// lookup returns the record cached for id, and whether the cache held an entry for the request's
+// tenant in the id's generation. An entry remembering that id has no record is reported as not
+// found, and an entry that cannot be read is taken for a miss.
+func (svc *CachePlugin) lookup(ctx core.RequestContext, id string) (core.Storable, bool, error) {
+	gen, ok := svc.generation(ctx, id)
+	if !ok {
+		return nil, false, nil
+	}
+	var entry cacheEntry
+	if err := svc.Cache.GetIntoObject(ctx, svc.GetObject(), entryKey(ctx, id), &entry); err != nil || entry.Generation != gen {
+		return nil, false, nil
+	}
+	if entry.Missing {
+		return nil, true, errors.NotFound(ctx, svc.GetObject(), slog.String("Id", id))
+	}
+	if len(entry.Item) == 0 {
+		return nil, false, nil
+	}
+	item, err := svc.decode(ctx, entry.Item)
+	if err != nil {
+		return nil, false, nil
+	}
+	return item, true, nil
+}
+
+func (svc *CachePlugin) decode(ctx core.RequestContext, encoded []byte) (core.Storable, error) {
+	item, ok := svc.PluginDataComponent.GetObjectFactory().CreateObject(ctx).(core.Storable)
+	if !ok {
+		return nil, errors.TypeMismatch(ctx, slog.String("Object", svc.GetObject()))
+	}
+	if err := json.Unmarshal(encoded, item); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	return item, nil
+}
+
+// begin returns the epoch a read of the store starts at, and false when its result must not be
+// cached, as a transaction is open.
+func (svc *CachePlugin) begin() (uint64, bool) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.epoch, svc.txOpen == 0
+}
+
+// current reports whether no write has been made since epoch.
+func (svc *CachePlugin) current(epoch uint64) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.epoch == epoch && svc.txOpen == 0
+}
+
+// store caches what a read of id begun at epoch found: the record encoded, or that there is none
+// when encoded is nil. It is cached in the id's generation, which is begun when the cache holds
+// none. Nothing is cached when a write has been made since the read began, and an entry cached as
+// a write was made is removed again.
+func (svc *CachePlugin) store(ctx core.RequestContext, id string, encoded []byte, epoch uint64) {
+	entry := &cacheEntry{Missing: encoded == nil, Item: encoded}
+	ttl := svc.TTL
+	if entry.Missing {
+		ttl = svc.NegativeTTL
+	}
+	if ttl <= 0 || !svc.current(epoch) {
+		return
+	}
+	gen, ok := svc.generation(ctx, id)
+	if !ok {
+		gen = ctx.CreateUUID()
+		genTTL := svc.TTL
+		if svc.NegativeTTL > genTTL {
+			genTTL = svc.NegativeTTL
+		}
+		if err := svc.Cache.PutTempObject(ctx, svc.GetObject(), generationKey(id), &cacheGeneration{Generation: gen}, genTTL); err != nil {
+			log.Warn(ctx, "Could not cache record", slog.String("Object", svc.GetObject()), slog.String("Id", id), slog.String("Error", err.Error()))
+			return
+		}
+	}
+	entry.Generation = gen
+	if err := svc.Cache.PutTempObject(ctx, svc.GetObject(), entryKey(ctx, id), entry, ttl); err != nil {
+		log.Warn(ctx, "Could not cache record", slog.String("Object", svc.GetObject()), slog.String("Id", id), slog.String("Error", err.Error()))
+		return
+	}
+	if !svc.current(epoch) {
+		svc.remove(ctx, id)
+	}
+}
+
+// load reads the record with id through the cache. A request missing an id another is reading
+// waits for that read, and is handed a copy of what it found.
+func (svc *CachePlugin) load(ctx core.RequestContext, id string) (core.Storable, error) {
+	if item, hit, err := svc.lookup(ctx, id); hit {
+		return item, err
+	}
+	tenant := requestTenant(ctx)
+	svc.mu.Lock()
+	if flight, ok := svc.flights[id][tenant]; ok {
+		svc.mu.Unlock()
+		<-flight.done
+		if flight.err != nil {
+			return nil, flight.err
+		}
+		return svc.decode(ctx, flight.encoded)
+	}
+	flight := &cacheFlight{done: make(chan struct{})}
+	if svc.flights == nil {
+		svc.flights = map[string]map[string]*cacheFlight{}
+	}
+	if svc.flights[id] == nil {
+		svc.flights[id] = map[string]*cacheFlight{}
+	}
+	svc.flights[id][tenant] = flight
+	epoch, cache := svc.epoch, svc.txOpen == 0
+	svc.mu.Unlock()
+	defer func() {
+		svc.mu.Lock()
+		// a write to the id may have ended the flight and another begun since
+		if svc.flights[id][tenant] == flight {
+			delete(svc.flights[id], tenant)
+			if len(svc.flights[id]) == 0 {
+				delete(svc.flights, id)
+			}
+		}
+		svc.mu.Unlock()
+		close(flight.done)
+	}()
+
+	item, err := svc.PluginDataComponent.GetById(ctx, id, "")
+	if err != nil {
+		flight.err = err
+		if cache && errors.IsNotFound(err) {
+			svc.store(ctx, id, nil, epoch)
+		}
+		return nil, err
+	}
+	if flight.encoded, err = json.Marshal(item); err != nil {
+		flight.err = errors.WrapError(ctx, err)
+		return nil, flight.err
+	}
+	if cache {
+		svc.store(ctx, id, flight.encoded, epoch)
+	}
+	return item, nil
+}
+
+// loadMulti reads the records with ids through the cache, in the order of ids, skipping those
+// with no record.
+func (svc *CachePlugin) loadMulti(ctx core.RequestContext, ids []string) ([]core.Storable, error) {
+	found := make(map[string]core.Storable, len(ids))
+	var missing []string
+	for _, id := range ids {
+		if _, ok := found[id]; ok || utils.StrContains(missing, id) >= 0 {
+			continue
+		}
+		if item, hit, _ := svc.lookup(ctx, id); hit {
+			found[id] = item
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		epoch, cache := svc.begin()
+		items, err := svc.PluginDataComponent.GetMulti(ctx, nil, missing, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			found[item.GetId()] = item
+		}
+		for _, id := range missing {
+			item, ok := found[id]
+			if !cache {
+				continue
+			}
+			if !ok {
+				svc.store(ctx, id, nil, epoch)
+				continue
+			}
+			encoded, err := json.Marshal(item)
+			if err != nil {
+				return nil, errors.WrapError(ctx, err)
+			}
+			svc.store(ctx, id, encoded, epoch)
+		}
+	}
+	items := make([]core.Storable, 0, len(ids))
+	for _, id := range ids {
+		if item, ok := found[id]; ok && item != nil {
+			items = append(items, item)
+			delete(found, id)
+		}
+	}
+	return items, nil
+}
+
+// remove removes the generation of id from the cache, invalidating the entries of every tenant.
+func (svc *CachePlugin) remove(ctx core.RequestContext, id string) {
+	if err := svc.Cache.Delete(ctx, svc.GetObject(), generationKey(id)); err != nil {
+		log.Error(ctx, "Could not remove record from cache", slog.String("Object", svc.GetObject()), slog.String("Id", id), slog.String("Error", err.Error()))
+	}
+}
+
+// invalidate removes the records with ids from the cache, keeps reads under way from caching what
+// they found, and ends the waits for them of reads yet to start. Inside a transaction the ids are
+// removed again once it ends.
+func (svc *CachePlugin) invalidate(ctx core.RequestContext, ids ...string) {
+	if !svc.Enabled {
+		return
+	}
+	svc.mu.Lock()
+	svc.epoch++
+	if svc.txOpen > 0 {
+		svc.txIds = append(svc.txIds, ids...)
+	}
+	for _, id := range ids {
+		delete(svc.flights, id)
+	}
+	svc.mu.Unlock()
+	for _, id := range ids {
+		svc.remove(ctx, id)
+	}
+}
+
+// Transaction runs callback in a transaction of the data service. Nothing read through the plugin
+// while it is open is cached, and the records written through the plugin in it are removed from
+// the cache again once it ends, as a read made before it committed may have cached them.
+func (svc *CachePlugin) Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error {
+	svc.mu.Lock()
+	svc.txOpen++
+	svc.mu.Unlock()
+	err := svc.PluginDataComponent.Transaction(ctx, callback)
+	svc.mu.Lock()
+	svc.txOpen--
+	var ids []string
+	if svc.txOpen == 0 {
+		ids, svc.txIds = svc.txIds, nil
+	}
+	svc.mu.Unlock()
+	svc.invalidate(ctx, ids...)
+	return err
+}
+
+func (svc *CachePlugin) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	if !svc.cacheable(nil, dao) {
+		return svc.PluginDataComponent.GetById(ctx, id, dao)
+	}
+	return svc.load(ctx, id)
+}
+
+// GetMulti caches the records when they are read without orderBy, in the order of ids.
+func (svc *CachePlugin) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	if !svc.cacheable(props, dao) || len(orderBy) > 0 {
+		return svc.PluginDataComponent.GetMulti(ctx, props, ids, orderBy, dao)
+	}
+	return svc.loadMulti(ctx, ids)
+}
+
+func (svc *CachePlugin) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	if !svc.cacheable(props, dao) {
+		return svc.PluginDataComponent.GetMultiHash(ctx, props, ids, dao)
+	}
+	items, err := svc.loadMulti(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return StorableArrayToMap(items), nil
+}
+
+func (svc *CachePlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	err := svc.PluginDataComponent.Save(ctx, item)
+	svc.invalidate(ctx, item.GetId())
+	return err
+}
+
+func (svc *CachePlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	err := svc.PluginDataComponent.Put(ctx, id, item)
+	svc.invalidate(ctx, id)
+	return err
+}
+
+func (svc *CachePlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	err := svc.PluginDataComponent.PutMulti(ctx, items)
+	svc.invalidate(ctx, storableIds(items)...)
+	return err
+}
+
+func (svc *CachePlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	err := svc.PluginDataComponent.CreateMulti(ctx, items)
+	svc.invalidate(ctx, storableIds(items)...)
+	return err
+}
+
+func (svc *CachePlugin) AddToArray(ctx core.RequestContext, id string, fieldName string, item interface{}) error {
+	err := svc.PluginDataComponent.AddToArray(ctx, id, fieldName, item)
+	svc.invalidate(ctx, id)
+	return err
+}
+
+func (svc *CachePlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	err := svc.PluginDataComponent.UpsertId(ctx, id, newVals)
+	svc.invalidate(ctx, id)
+	return err
+}
+
+func (svc *CachePlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	err := svc.PluginDataComponent.Update(ctx, id, newVals)
+	svc.invalidate(ctx, id)
+	return err
+}
+
+func (svc *CachePlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	err := svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+	svc.invalidate(ctx, ids...)
+	return err
+}
+
+func (svc *CachePlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	ids, err := svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, getids || svc.Enabled)
+	svc.invalidate(ctx, ids...)
+	return returnedIds(ids, getids), err
+}
+
+func (svc *CachePlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	ids, err := svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, getids || svc.Enabled)
+	svc.invalidate(ctx, ids...)
+	return returnedIds(ids, getids), err
+}
+
+func (svc *CachePlugin) Delete(ctx core.RequestContext, id string) error {
+	err := svc.PluginDataComponent.Delete(ctx, id)
+	svc.invalidate(ctx, id)
+	return err
+}
+
+func (svc *CachePlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	err := svc.PluginDataComponent.DeleteMulti(ctx, ids)
+	svc.invalidate(ctx, ids...)
+	return err
+}
+
+func (svc *CachePlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	ids, err := svc.PluginDataComponent.DeleteAll(ctx, queryCond, getids || svc.Enabled)
+	svc.invalidate(ctx, ids...)
+	return returnedIds(ids, getids), err
+}
+
+func (svc *CachePlugin) Restore(ctx core.RequestContext, ids []string) error {
+	err := svc.PluginDataComponent.Restore(ctx, ids)
+	svc.invalidate(ctx, ids...)
+	return err
+}
+
+// returnedIds returns ids when the caller asked for them.
+func returnedIds(ids []string, getids bool) []string {
+	if !getids {
+		return nil
+	}
+	return ids
+}
@@ -0,0 +1,291 @@
+package data_test
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// memCache is a CacheComponent keeping JSON copies of what it is given.
+type memCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (m *memCache) PutTempObject(ctx core.RequestContext, bucket string, key string, item interface{}, ttl time.Duration) error {
+	return m.PutObject(ctx, bucket, key, item)
+}
+func (m *memCache) PutObject(ctx core.RequestContext, bucket string, key string, item interface{}) error {
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[bucket+"/"+key] = encoded
+	return nil
+}
+func (m *memCache) PutObjects(ctx core.RequestContext, bucket string, vals utils.StringMap) error {
+	return nil
+}
+func (m *memCache) GetObject(ctx core.RequestContext, bucket string, key string, objectType string) (interface{}, bool) {
+	return nil, false
+}
+func (m *memCache) GetIntoObject(ctx core.RequestContext, bucket string, key string, obj interface{}) error {
+	m.mu.Lock()
+	encoded, ok := m.entries[bucket+"/"+key]
+	m.mu.Unlock()
+	if !ok {
+		return errors.NotFound(ctx, key)
+	}
+	return json.Unmarshal(encoded, obj)
+}
+func (m *memCache) Get(ctx core.RequestContext, bucket string, key string) (interface{}, bool) {
+	return nil, false
+}
+func (m *memCache) GetObjects(ctx core.RequestContext, bucket string, keys []string, objectType string) utils.StringMap {
+	return nil
+}
+func (m *memCache) GetMulti(ctx core.RequestContext, bucket string, keys []string) utils.StringMap {
+	return nil
+}
+func (m *memCache) Delete(ctx core.RequestContext, bucket string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, bucket+"/"+key)
+	return nil
+}
+func (m *memCache) Increment(ctx core.RequestContext, bucket string, key string) error { return nil }
+func (m *memCache) Decrement(ctx core.RequestContext, bucket string, key string) error { return nil }
+func (m *memCache) ListKeys(ctx core.RequestContext, bucket string) ([]string, error) {
+	return nil, nil
+}
+
+// countingStore counts the reads by id made of a component, holding what each read until release
+// is closed.
+type countingStore struct {
+	data.DataComponent
+	reads   atomic.Int32
+	release chan struct{}
+}
+
+func (c *countingStore) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	item, err := c.DataComponent.GetById(ctx, id, dao)
+	c.reads.Add(1)
+	<-c.release
+	return item, err
+}
+
+// waitReads waits for the store to have been read n times.
+func (c *countingStore) waitReads(t *testing.T, n int32) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); c.reads.Load() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the store was read %d times, want %d", c.reads.Load(), n)
+		}
+	}
+}
+
+func (c *countingStore) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	c.reads.Add(int32(len(ids)))
+	return c.DataComponent.GetMulti(ctx, props, ids, orderBy, dao)
+}
+
+func TestCachePlugin(t *testing.T) {
+	// setup saves a and b through a plugin over a store configured as conf, whose reads by id are
+	// held until the store is released, unless release is set
+	setup := func(t *testing.T, conf core.StorableConfig, release bool) (*data.CachePlugin, *countingStore, *datatest.RequestContext, *datatest.Record, *datatest.Record) {
+		t.Helper()
+		base, objects, c := newWidgets(t, conf)
+		store := &countingStore{DataComponent: base, release: make(chan struct{})}
+		if release {
+			close(store.release)
+		}
+		svc := data.NewCachePluginWithBase(c.Server, store, &memCache{entries: map[string][]byte{}})
+		a, b := objects.NewRecord("a", 1), objects.NewRecord("b", 2)
+		for _, item := range []*datatest.Record{a, b} {
+			if err := svc.Save(c, item); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		return svc, store, c, a, b
+	}
+	get := func(t *testing.T, svc data.DataComponent, c core.RequestContext, id string) (*datatest.Record, error) {
+		t.Helper()
+		item, err := svc.GetById(c, id, "")
+		if err != nil {
+			return nil, err
+		}
+		return item.(*datatest.Record), nil
+	}
+	cacheable := core.StorableConfig{Cacheable: true}
+
+	// concurrent misses read the store once, and each is handed its own copy
+	t.Run("concurrent misses", func(t *testing.T) {
+		svc, store, c, a, _ := setup(t, cacheable, false)
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if item, err := svc.GetById(c, a.Id, ""); err != nil || item.(*datatest.Record).Name != "a" {
+					t.Errorf("GetById: %v %v", item, err)
+				}
+			}()
+		}
+		store.waitReads(t, 1)
+		close(store.release)
+		wg.Wait()
+		if n := store.reads.Load(); n != 1 {
+			t.Errorf("concurrent misses read the store %d times", n)
+		}
+		cached, _ := get(t, svc, c, a.Id)
+		cached.Name = "changed"
+		if again, _ := get(t, svc, c, a.Id); again.Name != "a" || store.reads.Load() != 1 {
+			t.Errorf("a cached record was shared or read again: %q %d", again.Name, store.reads.Load())
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		svc, _, c, a, b := setup(t, cacheable, true)
+		for _, id := range []string{a.Id, b.Id} {
+			get(t, svc, c, id)
+		}
+		if err := svc.Update(c, a.Id, utils.StringMap{"Name": "a2"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if item, _ := get(t, svc, c, a.Id); item.Name != "a2" {
+			t.Errorf("Update was not invalidated: %q", item.Name)
+		}
+		cond, err := svc.CreateCondition(c, utils.StringMap{"Name": "b"})
+		if err != nil {
+			t.Fatalf("CreateCondition: %v", err)
+		}
+		if ids, err := svc.UpdateAll(c, cond, utils.StringMap{"Size": 7}, false); err != nil || ids != nil {
+			t.Fatalf("UpdateAll: %v %v", ids, err)
+		}
+		if item, _ := get(t, svc, c, b.Id); item.Size != 7 {
+			t.Errorf("UpdateAll was not invalidated: %d", item.Size)
+		}
+		if _, err = svc.DeleteAll(c, cond, false); err != nil {
+			t.Fatalf("DeleteAll: %v", err)
+		}
+		if _, err = get(t, svc, c, b.Id); !errors.IsNotFound(err) {
+			t.Errorf("DeleteAll was not invalidated: %v", err)
+		}
+	})
+
+	// a missing id is cached as missing, and GetMulti reads only the ids not cached
+	t.Run("misses", func(t *testing.T) {
+		svc, store, c, a, b := setup(t, cacheable, true)
+		get(t, svc, c, a.Id)
+		reads := store.reads.Load()
+		for i := 0; i < 2; i++ {
+			if _, err := get(t, svc, c, "missing"); !errors.IsNotFound(err) {
+				t.Errorf("a missing id: want not found, got %v", err)
+			}
+		}
+		if n := store.reads.Load() - reads; n != 1 {
+			t.Errorf("a missing id was read %d times", n)
+		}
+		items, err := svc.GetMulti(c, nil, []string{b.Id, a.Id, "missing"}, nil, "")
+		if err != nil || len(items) != 2 || items[0].GetId() != b.Id || items[1].GetId() != a.Id {
+			t.Fatalf("GetMulti: %v %v", items, err)
+		}
+		if n := store.reads.Load() - reads; n != 2 {
+			t.Errorf("GetMulti read %d records from the store, want only the uncached one", n-1)
+		}
+	})
+
+	// each tenant's read is cached apart, whether the store scopes the records by tenant, when the
+	// cache must not hand one tenant's record to another, or is shared by tenants
+	for _, tc := range []struct {
+		name   string
+		scoped bool
+	}{
+		{"tenants of a shared store", false},
+		{"tenants of a scoped store", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, store, c, _, _ := setup(t, core.StorableConfig{Cacheable: true, Multitenant: tc.scoped}, true)
+			acme := datatest.NewRequestContext(c.Server, "u1", "acme")
+			globex := datatest.NewRequestContext(c.Server, "u2", "globex")
+			item := datatest.NewObjectFactory("widget", core.StorableConfig{}).NewRecord("acme's", 1)
+			if err := svc.Save(acme, item); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			if _, err := get(t, svc, acme, item.Id); err != nil {
+				t.Fatalf("GetById: %v", err)
+			}
+			reads := store.reads.Load()
+			if _, err := get(t, svc, globex, item.Id); errors.IsNotFound(err) != tc.scoped || store.reads.Load()-reads != 1 {
+				t.Errorf("another tenant was served the cached record: %v", err)
+			}
+			if _, err := get(t, svc, acme, item.Id); err != nil || store.reads.Load()-reads != 1 {
+				t.Errorf("another tenant's read replaced the cached record: %v", err)
+			}
+		})
+	}
+
+	// a record deleted into the trash is not served from the cache, nor missed once restored
+	t.Run("trash", func(t *testing.T) {
+		svc, _, c, a, _ := setup(t, core.StorableConfig{Cacheable: true, SoftDelete: true}, true)
+		get(t, svc, c, a.Id)
+		if err := svc.Delete(c, a.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := get(t, svc, c, a.Id); !errors.IsNotFound(err) {
+			t.Errorf("a deleted record: want not found, got %v", err)
+		}
+		if err := svc.Restore(c, []string{a.Id}); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if _, err := get(t, svc, c, a.Id); err != nil {
+			t.Errorf("a restored record: %v", err)
+		}
+	})
+
+	// a read that starts after a write does not wait for one under way before it
+	t.Run("reads racing writes", func(t *testing.T) {
+		svc, store, c, a, _ := setup(t, cacheable, false)
+		leader := make(chan string)
+		go func() {
+			item, _ := get(t, svc, c, a.Id)
+			leader <- item.Name
+		}()
+		store.waitReads(t, 1)
+		if err := svc.Update(c, a.Id, utils.StringMap{"Name": "a2"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		follower := make(chan string)
+		go func() {
+			item, _ := get(t, svc, c, a.Id)
+			follower <- item.Name
+		}()
+		store.waitReads(t, 2)
+		close(store.release)
+		if old, name := <-leader, <-follower; old != "a" || name != "a2" {
+			t.Errorf("a read after a write got %q, and the read before it %q", name, old)
+		}
+		if item, _ := get(t, svc, c, a.Id); item.Name != "a2" {
+			t.Errorf("the read before a write was cached: %q", item.Name)
+		}
+	})
+
+	t.Run("not cacheable", func(t *testing.T) {
+		svc, store, c, a, _ := setup(t, core.StorableConfig{}, true)
+		get(t, svc, c, a.Id)
+		get(t, svc, c, a.Id)
+		if n := store.reads.Load(); n != 2 {
+			t.Errorf("an entity that is not Cacheable was cached: %d reads", n)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"laatoo.io/sdk/server/core"
+)
+
+// changeSink receives the records a write touched as they were before it and after it, by id. A
+// record missing from before was created by the write, and one missing from after was deleted.
+type changeSink func(ctx core.RequestContext, ids []string, before map[string]core.Storable, after map[string]core.Storable) error
+
+// The capture functions run a write through comp and hand what it changed to a sink, for the
+// plugins that report every write: the records are read before the write and, except where the
+// written items are the records after it, read back after. A soft-deleted record read is left out,
+// as a store may return one read by id, so that a soft delete is reported as the delete it is.
+
+// captureItems runs a write of items, taking the records after it from the items themselves, which
+// the write has stamped.
+func captureItems(ctx core.RequestContext, comp DataComponent, items []core.Storable, write func() error, sink changeSink) error {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil && item.GetId() != "" {
+			ids = append(ids, item.GetId())
+		}
+	}
+	before, err := comp.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return err
+	}
+	before = live(before)
+	if err = write(); err != nil {
+		return err
+	}
+	after := make(map[string]core.Storable, len(items))
+	ids = ids[:0]
+	for _, item := range items {
+		after[item.GetId()] = item
+		ids = append(ids, item.GetId())
+	}
+	return sink(ctx, ids, before, after)
+}
+
+// captureIds runs a write of the records with ids.
+func captureIds(ctx core.RequestContext, comp DataComponent, ids []string, write func() error, sink changeSink) error {
+	before, err := comp.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return err
+	}
+	if err = write(); err != nil {
+		return err
+	}
+	after, err := comp.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return err
+	}
+	return sink(ctx, ids, live(before), live(after))
+}
+
+// captureCondition runs a write of the records matching queryCond, which returns the ids it wrote,
+// and returns them when getids is set.
+func captureCondition(ctx core.RequestContext, comp DataComponent, queryCond interface{}, getids bool, write func() ([]string, error), sink changeSink) ([]string, error) {
+	items, _, _, _, err := comp.Get(ctx, nil, queryCond, -1, 1, "", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	before := live(StorableArrayToMap(items))
+	ids, err := write()
+	if err != nil {
+		return nil, err
+	}
+	after, err := comp.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return nil, err
+	}
+	if err = sink(ctx, ids, before, live(after)); err != nil || !getids {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// passCondition runs a write by condition that is not captured, returning its ids when getids is
+// set.
+func passCondition(getids bool, write func() ([]string, error)) ([]string, error) {
+	ids, err := write()
+	if err != nil || !getids {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// live leaves the soft-deleted records out of items.
+func live(items map[string]core.Storable) map[string]core.Storable {
+	for id, item := range items {
+		if deleted, ok := item.(SoftDeletable); ok && deleted.IsDeleted() {
+			delete(items, id)
+		}
+	}
+	return items
+}
@@ -0,0 +1,123 @@
+package data
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// ChangeRecord is one row-level change published by a CDCPlugin: the record as it was before a
+// write and after it, as stored, with who made the write, in which tenant and when.
+type ChangeRecord struct {
+	Object    string         `json:"Object"`
+	EntityId  string         `json:"EntityId"`
+	Operation AuditOperation `json:"Operation"`
+	// Before is the record before the write in JSON, and empty for a record it created.
+	Before json.RawMessage `json:"Before,omitempty"`
+	// After is the record after the write in JSON, and empty for a record it deleted.
+	After json.RawMessage `json:"After,omitempty"`
+	// Version is the record's version after the write, or before it for a delete.
+	Version string    `json:"Version"`
+	User    string    `json:"User"`
+	Tenant  string    `json:"Tenant"`
+	At      time.Time `json:"At"`
+}
+
+// Decode reads the image of a change, Before or After, into item. An empty image leaves item as
+// it is and returns false.
+func (cr *ChangeRecord) Decode(image json.RawMessage, item interface{}) (bool, error) {
+	if len(image) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(image, item)
+}
+
+// ChangeListener adapts handler to a listener of a change data capture topic, for
+// MessagingManager.Subscribe or, to resume from a sequence handler recorded, SubscribeFrom. The
+// sequence handed to handler is the message's position in the topic. A message that is not a
+// change is declined.
+func ChangeListener(handler func(ctx core.RequestContext, change *ChangeRecord, sequence uint64) error) core.MessageListener {
+	return func(ctx core.RequestContext, message *core.Message, info utils.StringMap) error {
+		change, err := changeOf(ctx, message.Data)
+		if err != nil {
+			return err
+		}
+		return handler(ctx, change, message.Sequence)
+	}
+}
+
+// changeOf reads a change from the data of a message, which is the ChangeRecord itself when it was
+// published in process and its encoding when it crossed a broker.
+func changeOf(c ctx.Context, msgData interface{}) (*ChangeRecord, error) {
+	var bytes []byte
+	switch val := msgData.(type) {
+	case *ChangeRecord:
+		return val, nil
+	case ChangeRecord:
+		return &val, nil
+	case []byte:
+		bytes = val
+	case string:
+		bytes = []byte(val)
+	default:
+		encoded, err := json.Marshal(val)
+		if err != nil {
+			return nil, errors.BadArg(c, "message", slog.String("Error", err.Error()))
+		}
+		bytes = encoded
+	}
+	change := &ChangeRecord{}
+	if err := json.Unmarshal(bytes, change); err != nil {
+		return nil, errors.BadArg(c, "message", slog.String("Error", err.Error()))
+	}
+	return change, nil
+}
+
+// TopicProvisioner provisions a durable topic. components.DurablePubSubComponent is one.
+type TopicProvisioner interface {
+	EnsureDurableTopic(ctx core.ServerContext, topic string, cfg *components.TopicDurability) error
+}
+
+// parseDurability reads a durable topic's configuration from the keys a topic declaration uses:
+// storage (file or memory), replicas, maxage, maxmsgs and maxbytes. Retention and delivery are
+// left at their defaults, which are what a change stream needs.
+func parseDurability(c ctx.Context, conf config.Config) (*components.TopicDurability, error) {
+	durability := &components.TopicDurability{}
+	if conf == nil {
+		return durability, nil
+	}
+	if storage, ok := conf.GetString(c, "storage"); ok {
+		switch storage {
+		case "file", "":
+			durability.Storage = components.FileStorage
+		case "memory":
+			durability.Storage = components.MemoryStorage
+		default:
+			return nil, errors.BadConf(c, "storage", slog.String("Storage", storage))
+		}
+	}
+	if replicas, ok := conf.GetInt(c, "replicas"); ok {
+		durability.Replicas = replicas
+	}
+	if maxAge, ok := conf.GetString(c, "maxage"); ok && maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return nil, errors.BadConf(c, "maxage", slog.String("MaxAge", maxAge))
+		}
+		durability.MaxAge = d
+	}
+	if maxMsgs, ok := conf.GetInt(c, "maxmsgs"); ok {
+		durability.MaxMsgs = int64(maxMsgs)
+	}
+	if maxBytes, ok := conf.GetInt(c, "maxbytes"); ok {
+		durability.MaxBytes = int64(maxBytes)
+	}
+	return durability, nil
+}
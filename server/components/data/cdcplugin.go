@@ -0,0 +1,321 @@
+package data
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_DATA_CDC_TOPIC names the durable topic a CDCPlugin publishes its changes to.
+	CONF_DATA_CDC_TOPIC = "cdctopic"
+	// CONF_DATA_CDC_PUBSUB optionally names the durable pub/sub service that provisions the topic
+	// when the plugin starts. Without it the topic must be declared durable in configuration.
+	CONF_DATA_CDC_PUBSUB = "cdcpubsub"
+	// CONF_DATA_CDC_DURABILITY is the durability the topic is provisioned with, in the keys of a
+	// topic declaration.
+	CONF_DATA_CDC_DURABILITY = "cdcdurability"
+)
+
+var _ DataComponent = (*CDCPlugin)(nil)
+
+/*
+CDCPlugin publishes a ChangeRecord for every record a write through it creates, updates or deletes
+to a durable change data capture topic, so that read models and search indexes can be kept in step
+by subscribing rather than by polling. A consumer subscribes through the MessagingManager with
+ChangeListener, and records the sequence of the last change it applied so that it can resume from
+there with SubscribeFrom.
+
+A change is published after its write, at most once: a change that fails to publish is logged
+and dropped rather than failing the write, which has been made, and the changes after it are still
+published. A consumer that cannot miss a change subscribes to the topic of an OutboxPlugin instead,
+which keeps each entry until it has been published. The changes of the writes made inside
+Transaction are held until it commits, and are published then or, when it rolls back, dropped. The
+id of its message is stable for a Versioned entity, so a retried publish of one change is dropped
+by the topic. The topic must keep what it is sent for consumers to replay it, so it is refused
+durability with work queue retention.
+*/
+type CDCPlugin struct {
+	DataPlugin
+	Publisher   Publisher
+	Provisioner TopicProvisioner
+	Topic       string
+	Durability  *components.TopicDurability
+	versioned   bool
+}
+
+func NewCDCPlugin(ctx core.ServerContext) *CDCPlugin {
+	return &CDCPlugin{}
+}
+
+// NewCDCPluginWithBase creates a plugin over comp publishing its changes to topic through
+// publisher. A non-nil provisioner provisions the topic with durability when the plugin starts.
+func NewCDCPluginWithBase(ctx core.ServerContext, comp DataComponent, publisher Publisher, topic string, provisioner TopicProvisioner, durability *components.TopicDurability) *CDCPlugin {
+	svc := &CDCPlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, Publisher: publisher, Topic: topic, Provisioner: provisioner, Durability: durability}
+	svc.versioned = isVersioned(ctx, comp)
+	return svc
+}
+
+func (svc *CDCPlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.Topic == "" {
+		svc.AddStringConfiguration(ctx, CONF_DATA_CDC_TOPIC, "Durable topic changes are published to", "")
+		svc.AddStringConfiguration(ctx, CONF_DATA_CDC_PUBSUB, "Durable pub/sub service provisioning the topic", "")
+		svc.AddOptionalConfiguration(ctx, CONF_DATA_CDC_DURABILITY, "Durability the topic is provisioned with", datatypes.Config, nil)
+	}
+	return nil
+}
+
+func (svc *CDCPlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.Topic == "" {
+		svc.Topic, _ = svc.GetStringConfiguration(ctx, CONF_DATA_CDC_TOPIC)
+		if svc.Topic == "" {
+			return errors.MissingConf(ctx, CONF_DATA_CDC_TOPIC)
+		}
+		if pubsub, _ := svc.GetStringConfiguration(ctx, CONF_DATA_CDC_PUBSUB); pubsub != "" {
+			s, err := ctx.GetService(pubsub)
+			if err != nil {
+				return errors.BadConf(ctx, CONF_DATA_CDC_PUBSUB)
+			}
+			provisioner, ok := s.(components.DurablePubSubComponent)
+			if !ok {
+				return components.DurableNotSupported(ctx, svc.Topic)
+			}
+			svc.Provisioner = provisioner
+		}
+		durabilityConf, _ := svc.GetMapConfiguration(ctx, CONF_DATA_CDC_DURABILITY)
+		durability, err := parseDurability(ctx, durabilityConf)
+		if err != nil {
+			return err
+		}
+		svc.Durability = durability
+	}
+	if svc.Publisher == nil {
+		publisher, ok := ctx.GetServerElement(core.ServerElementMessagingManager).(Publisher)
+		if !ok {
+			return errors.MissingService(ctx, "MessagingManager")
+		}
+		svc.Publisher = publisher
+	}
+	svc.versioned = isVersioned(ctx, svc.PluginDataComponent)
+	return nil
+}
+
+// Start provisions the topic when the plugin has a provisioner.
+func (svc *CDCPlugin) Start(ctx core.ServerContext) error {
+	if svc.Provisioner == nil {
+		return nil
+	}
+	durability := svc.Durability
+	if durability == nil {
+		durability = &components.TopicDurability{}
+	}
+	if durability.Retention == components.WorkQueueRetention {
+		return errors.BadConf(ctx, CONF_DATA_CDC_DURABILITY, slog.String("Topic", svc.Topic))
+	}
+	return svc.Provisioner.EnsureDurableTopic(ctx, svc.Topic, durability)
+}
+
+// cdcTx holds the changes of one open transaction until it commits. It is carried on the context
+// the transaction's callback is given, under the plugin's txKey.
+type cdcTx struct {
+	messages []*core.Message
+}
+
+// Transaction runs callback in a transaction of the data service, and publishes the changes of the
+// writes it made through the plugin once it has committed. A change that fails to publish is
+// dropped, as the transaction has committed.
+func (svc *CDCPlugin) Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error {
+	var messages []*core.Message
+	err := svc.PluginDataComponent.Transaction(ctx, func(txCtx core.RequestContext) error {
+		tx := &cdcTx{}
+		txCtx = txCtx.SubContext("CDCTransaction")
+		txCtx.Set(svc.txKey(), tx)
+		if err := callback(txCtx); err != nil {
+			return err
+		}
+		messages = tx.messages
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	svc.send(ctx, messages)
+	return nil
+}
+
+// txKey is the key the plugin carries its open transaction under on a context.
+func (svc *CDCPlugin) txKey() string {
+	return "data.cdc.tx:" + svc.GetObject()
+}
+
+// isVersioned reports whether comp stores an entity configured as Versioned.
+func isVersioned(ctx core.ServerContext, comp DataComponent) bool {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return false
+	}
+	stor, ok := factory.CreateObject(ctx).(core.Storable)
+	return ok && stor.Config() != nil && stor.Config().Versioned
+}
+
+func (svc *CDCPlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	return captureItems(ctx, svc.PluginDataComponent, []core.Storable{item}, func() error {
+		return svc.PluginDataComponent.Save(ctx, item)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	if item != nil {
+		item.SetId(id)
+	}
+	return captureItems(ctx, svc.PluginDataComponent, []core.Storable{item}, func() error {
+		return svc.PluginDataComponent.Put(ctx, id, item)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	return captureItems(ctx, svc.PluginDataComponent, items, func() error {
+		return svc.PluginDataComponent.PutMulti(ctx, items)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	return captureItems(ctx, svc.PluginDataComponent, items, func() error {
+		return svc.PluginDataComponent.CreateMulti(ctx, items)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return captureIds(ctx, svc.PluginDataComponent, []string{id}, func() error {
+		return svc.PluginDataComponent.UpsertId(ctx, id, newVals)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return captureIds(ctx, svc.PluginDataComponent, []string{id}, func() error {
+		return svc.PluginDataComponent.Update(ctx, id, newVals)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	return captureIds(ctx, svc.PluginDataComponent, ids, func() error {
+		return svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return captureCondition(ctx, svc.PluginDataComponent, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, true)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return captureCondition(ctx, svc.PluginDataComponent, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, true)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) Delete(ctx core.RequestContext, id string) error {
+	return captureIds(ctx, svc.PluginDataComponent, []string{id}, func() error {
+		return svc.PluginDataComponent.Delete(ctx, id)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	return captureIds(ctx, svc.PluginDataComponent, ids, func() error {
+		return svc.PluginDataComponent.DeleteMulti(ctx, ids)
+	}, svc.publish)
+}
+
+func (svc *CDCPlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	return captureCondition(ctx, svc.PluginDataComponent, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.DeleteAll(ctx, queryCond, true)
+	}, svc.publish)
+}
+
+// Restore is published as the records' creation, as their delete was published as their deletion.
+func (svc *CDCPlugin) Restore(ctx core.RequestContext, ids []string) error {
+	return captureIds(ctx, svc.PluginDataComponent, ids, func() error {
+		return svc.PluginDataComponent.Restore(ctx, ids)
+	}, svc.publish)
+}
+
+// publish publishes a change for each of ids stored before or after a write, or holds them for
+// the commit of the transaction ctx has open through the plugin.
+func (svc *CDCPlugin) publish(ctx core.RequestContext, ids []string, before map[string]core.Storable, after map[string]core.Storable) error {
+	var user, tenant string
+	if u := ctx.GetUser(); u != nil {
+		user = u.GetId()
+	}
+	if t := ctx.GetTenant(); t != nil {
+		tenant = t.GetTenantId()
+	}
+	at := time.Now()
+	var messages []*core.Message
+	for _, id := range ids {
+		old, wasStored := before[id]
+		current, isStored := after[id]
+		change := &ChangeRecord{Object: svc.GetObject(), EntityId: id, Operation: AuditUpdate, User: user, Tenant: tenant, At: at}
+		switch {
+		case !wasStored && !isStored:
+			continue
+		case !wasStored:
+			change.Operation = AuditCreate
+		case !isStored:
+			change.Operation = AuditDelete
+		}
+		var err error
+		if wasStored {
+			if change.Before, err = json.Marshal(old); err != nil {
+				return errors.WrapError(ctx, err)
+			}
+			change.Version = old.GetVersion()
+		}
+		if isStored {
+			if change.After, err = json.Marshal(current); err != nil {
+				return errors.WrapError(ctx, err)
+			}
+			change.Version = current.GetVersion()
+		}
+		msg := &core.Message{Data: change, Tenant: ctx.GetTenant(), User: ctx.GetUser()}
+		if svc.versioned {
+			msg.Id = strings.Join([]string{change.Object, id, change.Version, string(change.Operation)}, "/")
+		}
+		messages = append(messages, msg)
+	}
+	if val, ok := ctx.Get(svc.txKey()); ok {
+		if tx, ok := val.(*cdcTx); ok {
+			tx.messages = append(tx.messages, messages...)
+			return nil
+		}
+	}
+	svc.send(ctx, messages)
+	return nil
+}
+
+// send publishes messages in order. A message that fails to publish is logged and dropped, and the
+// rest are published.
+func (svc *CDCPlugin) send(ctx core.RequestContext, messages []*core.Message) {
+	for _, msg := range messages {
+		if err := svc.Publisher.Publish(ctx, svc.Topic, msg); err != nil {
+			change, _ := msg.Data.(*ChangeRecord)
+			log.Error(ctx, "Dropped a change that failed to publish", slog.String("Object", svc.GetObject()), slog.String("Id", change.EntityId),
+				slog.String("Operation", string(change.Operation)), slog.String("Error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package data_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+func TestCDCPlugin(t *testing.T) {
+	// changes lists the changes published from sequence on, with the images they carry
+	changes := func(t *testing.T, c core.RequestContext, published *topic, from uint64) string {
+		t.Helper()
+		var got []string
+		images := func(c core.RequestContext, change *data.ChangeRecord, sequence uint64) error {
+			var before, after datatest.Record
+			hadBefore, err := change.Decode(change.Before, &before)
+			if err != nil {
+				return err
+			}
+			hadAfter, err := change.Decode(change.After, &after)
+			if err != nil {
+				return err
+			}
+			got = append(got, fmt.Sprintf("%d %s v%s %v:%s %v:%s %s", sequence, change.Operation, change.Version, hadBefore, before.Name, hadAfter, after.Name, change.User))
+			return nil
+		}
+		if err := published.replay(c, from, data.ChangeListener(images)); err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		return strings.Join(got, "\n")
+	}
+	// writeAll creates, updates and deletes a record through widgets
+	writeAll := func(t *testing.T, widgets data.DataComponent, c core.RequestContext, item *datatest.Record) {
+		t.Helper()
+		if err := widgets.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := widgets.Update(c, item.Id, utils.StringMap{"Name": "beta", data.FIELD_VERSION: "1"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if err := widgets.Delete(c, item.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	want := strings.Join([]string{
+		"1 create v1 false: true:alpha user1",
+		"2 update v2 true:alpha true:beta user1",
+		"3 delete v2 true:beta false: user1",
+	}, "\n")
+
+	t.Run("writes", func(t *testing.T) {
+		svc, objects, c := newWidgets(t, core.StorableConfig{Versioned: true})
+		published := &topic{}
+		widgets := data.NewCDCPluginWithBase(c.Server, svc, published, "widgets.cdc", published, &components.TopicDurability{MaxAge: time.Hour})
+		if err := widgets.Start(c.Server); err != nil || published.durability == nil || published.durability.MaxAge != time.Hour {
+			t.Fatalf("Start did not provision the topic: %v", err)
+		}
+		writeAll(t, widgets, c, objects.NewRecord("alpha", 1))
+		if got := changes(t, c, published, 1); got != want {
+			t.Fatalf("want changes\n%s\ngot\n%s", want, got)
+		}
+		// the message id of a change to a versioned entity is stable, so a repeat is dropped
+		if published.messages[0].Id == "" {
+			t.Errorf("a versioned change was published without an id")
+		}
+
+		// a consumer resuming from a sequence sees the changes from there, however they were encoded
+		for _, msg := range published.messages {
+			encoded, _ := json.Marshal(msg.Data)
+			msg.Data = encoded
+		}
+		if got := changes(t, c, published, 2); got != want[strings.Index(want, "\n")+1:] {
+			t.Errorf("resumed at 2, got\n%s", got)
+		}
+	})
+
+	// the store returns a record it has soft deleted, and its delete is published as a delete all the same
+	t.Run("soft deletes", func(t *testing.T) {
+		svc, objects, c := newWidgets(t, core.StorableConfig{Versioned: true, SoftDelete: true})
+		published := &topic{}
+		widgets := data.NewCDCPluginWithBase(c.Server, &showingDeleted{svc}, published, "widgets.cdc", nil, nil)
+		item := objects.NewRecord("alpha", 1)
+		writeAll(t, widgets, c, item)
+		if got := changes(t, c, published, 3); !strings.HasPrefix(got, "3 delete v2 true:beta false:") {
+			t.Errorf("a soft delete was published as %s", got)
+		}
+		if err := widgets.Restore(c, []string{item.Id}); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if got := changes(t, c, published, 4); !strings.HasPrefix(got, "4 create v4 false: true:beta") {
+			t.Errorf("a restore was published as %s", got)
+		}
+	})
+
+	// the changes of a transaction are published when it commits, and not when it rolls back
+	t.Run("transactions", func(t *testing.T) {
+		svc, objects, c := newWidgets(t, core.StorableConfig{Versioned: true})
+		published := &topic{}
+		widgets := data.NewCDCPluginWithBase(c.Server, svc, published, "widgets.cdc", nil, nil)
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			if err := widgets.Save(c, objects.NewRecord("gamma", 3)); err != nil {
+				return err
+			}
+			if len(published.messages) != 0 {
+				t.Errorf("a change was published before its transaction committed")
+			}
+			return errors.BadArg(c, "rollback")
+		}); err == nil {
+			t.Fatalf("a failing callback committed")
+		}
+		if len(published.messages) != 0 {
+			t.Errorf("the change of a rolled back transaction was published")
+		}
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			return widgets.Save(c, objects.NewRecord("delta", 4))
+		}); err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+		if len(published.messages) != 1 || published.messages[0].Data.(*data.ChangeRecord).Operation != data.AuditCreate {
+			t.Errorf("the change of a committed transaction was not published")
+		}
+	})
+
+	t.Run("durability", func(t *testing.T) {
+		svc, _, c := newWidgets(t, core.StorableConfig{})
+		published := &topic{}
+		durable := data.NewCDCPluginWithBase(c.Server, svc, published, "widgets.cdc", published, &components.TopicDurability{Retention: components.WorkQueueRetention})
+		if err := durable.Start(c.Server); err == nil {
+			t.Errorf("a change topic was provisioned with work queue retention")
+		}
+	})
+}
+
+func TestCDCPluginPublishFailure(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	published := &topic{fail: true}
+	widgets := data.NewCDCPluginWithBase(c.Server, svc, published, "widgets.cdc", nil, nil)
+
+	// a write whose change fails to publish is made, and reported as made
+	alpha := objects.NewRecord("alpha", 1)
+	if err := widgets.Save(c, alpha); err != nil {
+		t.Fatalf("a write was failed by its change: %v", err)
+	}
+	if _, err := svc.GetById(c, alpha.Id, ""); err != nil {
+		t.Errorf("GetById: %v", err)
+	}
+	err := widgets.Transaction(c, func(tx core.RequestContext) error {
+		return widgets.Save(tx, objects.NewRecord("beta", 2))
+	})
+	if err != nil {
+		t.Errorf("a committed transaction was failed by its changes: %v", err)
+	}
+
+	// the changes of later writes are published
+	published.fail = false
+	if err = widgets.Save(c, objects.NewRecord("gamma", 3)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(published.messages) != 1 {
+		t.Errorf("want only the change that could be published, got %d", len(published.messages))
+	}
+}
@@ -1,6 +1,8 @@
 package data
 
 import (
+	"time"
+
 	"laatoo.io/sdk/server/core"
 	"laatoo.io/sdk/utils"
 )
@@ -38,6 +40,10 @@ const (
 	EventDataCreated DataEventType = "data.object.created"
 	EventDataUpdated DataEventType = "data.object.updated"
 	EventDataDeleted DataEventType = "data.object.deleted"
+
+	// a soft-deleted record being restored, and being purged for good
+	EventDataRestored DataEventType = "data.object.restored"
+	EventDataPurged   DataEventType = "data.object.purged"
 )
 
 type Dataset struct {
@@ -105,6 +111,11 @@ type DataComponent interface {
 	//must not silently reduce a capability it lacks to a weaker one — it declares it here and
 	//rejects it at compile time.
 	SupportsQuery(capability QueryCapability) bool
+	//runs a compiled query with params bound, returning one page shaped as the query asks:
+	//projected, ordered and paged entities, or group rows for an aggregating query. A
+	//CursorParameter in params is the token of the cursor to resume after, in place of the
+	//query's After.
+	Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*QueryPage, error)
 	//save an object
 	Save(ctx core.RequestContext, item core.Storable) error
 	//adds an item to an array field
@@ -150,6 +161,9 @@ type DataComponent interface {
 	Count(ctx core.RequestContext, queryCond interface{}) (count int, err error)
 	CountGroups(ctx core.RequestContext, queryCond interface{}, groupids []string, group string) (res utils.StringMap, err error)
 
+	//run callback in a transaction. Called with the context of a transaction already open on the
+	//service, it joins that transaction instead of opening another, so that a plugin may wrap its
+	//work in a transaction whether or not its caller has one open.
 	Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error
 
 	//Get all object with given conditions
@@ -158,7 +172,27 @@ type DataComponent interface {
 	GetOne(ctx core.RequestContext, props []string, queryCond interface{}, dao string) (dataToReturn core.Storable, err error)
 	//Get a list of all items
 	GetList(ctx core.RequestContext, props []string, pageSize int, pageNum int, mode string, orderBy []string, dao string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error)
-	//Vector Search
+	//restore soft-deleted records by id. Fails without restoring any of them when one is not a
+	//deleted record.
+	Restore(ctx core.RequestContext, ids []string) error
+	//list soft-deleted records, the trash that Restore takes from and Purge empties
+	ListDeleted(ctx core.RequestContext, props []string, pageSize int, pageNum int, orderBy []string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error)
+	//permanently delete soft-deleted records deleted before olderThan, returning how many
+	Purge(ctx core.RequestContext, olderThan time.Time) (int, error)
+	//get the record with id as it was at a time, for objects configured as Temporal. A record that
+	//did not exist then, or had been deleted, is not found.
+	GetAsOf(ctx core.RequestContext, id string, at time.Time) (core.Storable, error)
+	//get every revision of the record with id, oldest first, for objects configured as Temporal
+	GetRevisions(ctx core.RequestContext, id string) ([]Revision, error)
+	//iterate the records matching a condition, fetching batchSize at a time in orderBy order and
+	//then by id, for jobs too large for a page. Unlike the other methods taking a condition, where a
+	//nil condition matches nothing, a nil queryCond here iterates every record, as the jobs that
+	//iterate mostly walk a whole collection; every provider and plugin honours this, and a plugin
+	//that limits what a request reads limits a nil queryCond as it would a condition for every record.
+	Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (StorableIterator, error)
+	//rank the records matching filter, a condition made by CreateQueryCondition or nil for every
+	//record, by the similarity of their vectors to vector, most similar first. Score is higher for
+	//closer vectors; SearchHybrid adds keyword ranking, fusion and paging
 	VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]VectorResult, error)
 	//Subscribe to data events
 	Subscribe(ctx core.RequestContext, obj string, eventType DataEventType, handler core.MessageListener) error
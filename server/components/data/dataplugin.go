@@ -1,6 +1,8 @@
 package data
 
 import (
+	"time"
+
 	"laatoo.io/sdk/config"
 	"laatoo.io/sdk/server/core"
 	"laatoo.io/sdk/server/errors"
@@ -75,6 +77,32 @@ func (svc *DataPlugin) Supports(feature Feature) bool {
 	return svc.PluginDataComponent.Supports(feature)
 }
 
+// CreateObject creates an object through the wrapped component.
+func (svc *DataPlugin) CreateObject(ctx core.RequestContext) interface{} {
+	return svc.PluginDataComponent.CreateObject(ctx)
+}
+
+// CreateObjectCollection creates a collection of objects through the wrapped component.
+func (svc *DataPlugin) CreateObjectCollection(ctx core.RequestContext, len int) interface{} {
+	return svc.PluginDataComponent.CreateObjectCollection(ctx, len)
+}
+
+// CreateObjectPointersCollection creates a collection of object pointers through the wrapped
+// component.
+func (svc *DataPlugin) CreateObjectPointersCollection(ctx core.RequestContext, len int) interface{} {
+	return svc.PluginDataComponent.CreateObjectPointersCollection(ctx, len)
+}
+
+// GetObjectFactory returns the object factory of the wrapped component.
+func (svc *DataPlugin) GetObjectFactory() core.ObjectFactory {
+	return svc.PluginDataComponent.GetObjectFactory()
+}
+
+// Transaction runs callback in a transaction of the wrapped component.
+func (svc *DataPlugin) Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error {
+	return svc.PluginDataComponent.Transaction(ctx, callback)
+}
+
 func (svc *DataPlugin) Save(ctx core.RequestContext, item core.Storable) error {
 	return svc.PluginDataComponent.Save(ctx, item)
 }
@@ -201,6 +229,11 @@ func (svc *DataPlugin) SupportsQuery(capability QueryCapability) bool {
 	return svc.PluginDataComponent.SupportsQuery(capability)
 }
 
+// Query runs a compiled query on the wrapped component.
+func (svc *DataPlugin) Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*QueryPage, error) {
+	return svc.PluginDataComponent.Query(ctx, compiled, params)
+}
+
 func (svc *DataPlugin) AddToArray(ctx core.RequestContext, id string, fieldName string, item interface{}) error {
 	return svc.PluginDataComponent.AddToArray(ctx, id, fieldName, item)
 }
@@ -208,6 +241,37 @@ func (svc *DataPlugin) AddToArray(ctx core.RequestContext, id string, fieldName
 func (svc *DataPlugin) Execute(ctx core.RequestContext, name string, data interface{}, params utils.StringMap) (interface{}, error) {
 	return svc.PluginDataComponent.Execute(ctx, name, data, params)
 }
+
+// Restore restores soft-deleted records on the wrapped component.
+func (svc *DataPlugin) Restore(ctx core.RequestContext, ids []string) error {
+	return svc.PluginDataComponent.Restore(ctx, ids)
+}
+
+// ListDeleted lists soft-deleted records on the wrapped component.
+func (svc *DataPlugin) ListDeleted(ctx core.RequestContext, props []string, pageSize int, pageNum int, orderBy []string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error) {
+	return svc.PluginDataComponent.ListDeleted(ctx, props, pageSize, pageNum, orderBy)
+}
+
+// Purge permanently deletes soft-deleted records on the wrapped component.
+func (svc *DataPlugin) Purge(ctx core.RequestContext, olderThan time.Time) (int, error) {
+	return svc.PluginDataComponent.Purge(ctx, olderThan)
+}
+
+// GetAsOf reads a record as it was at a time from the wrapped component.
+func (svc *DataPlugin) GetAsOf(ctx core.RequestContext, id string, at time.Time) (core.Storable, error) {
+	return svc.PluginDataComponent.GetAsOf(ctx, id, at)
+}
+
+// GetRevisions lists the revisions of a record on the wrapped component.
+func (svc *DataPlugin) GetRevisions(ctx core.RequestContext, id string) ([]Revision, error) {
+	return svc.PluginDataComponent.GetRevisions(ctx, id)
+}
+
+// Iterate walks the records matching a condition on the wrapped component.
+func (svc *DataPlugin) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (StorableIterator, error) {
+	return svc.PluginDataComponent.Iterate(ctx, props, queryCond, orderBy, batchSize)
+}
+
 	//Vector Search
 func (svc *DataPlugin) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]VectorResult, error) {
 	return svc.PluginDataComponent.VectorSearch(ctx, vector, limit, filter)
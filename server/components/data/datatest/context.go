@@ -0,0 +1,120 @@
+package datatest
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"laatoo.io/sdk/server/auth"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+var uuids atomic.Uint64
+
+// ServerContext is the part of a server context a data component uses while it is exercised: it
+// names itself, creates unique ids and discards what is logged. It embeds the interface it stands
+// in for, so any other method panics — a provider that needs more from its context than this is
+// told so on the first call rather than handed a zero value.
+type ServerContext struct {
+	core.ServerContext
+}
+
+// NewServerContext creates a server context for a component under test.
+func NewServerContext() *ServerContext {
+	return &ServerContext{}
+}
+
+func (c *ServerContext) CreateUUID() string {
+	return fmt.Sprintf("datatest-%d", uuids.Add(1))
+}
+
+// CreateSystemRequest creates a request made by no user, as a background job's is. It leaves the
+// request unmarked, as a server predating CTX_SYSTEM_REQUEST does, so that a test sees the marker
+// only where core.NewSystemRequest sets it.
+func (c *ServerContext) CreateSystemRequest(name string, tenant auth.TenantInfo, behalfOf interface{}, responseHandler core.ResponseHandler) core.RequestContext {
+	return &RequestContext{Server: c, Tenant: tenant}
+}
+
+func (c *ServerContext) GetName() string                        { return "datatest" }
+func (c *ServerContext) GetPath() string                        { return "/datatest" }
+func (c *ServerContext) GetId() string                          { return "datatest" }
+func (c *ServerContext) LogTrace(msg string, args ...slog.Attr) {}
+func (c *ServerContext) LogDebug(msg string, args ...slog.Attr) {}
+func (c *ServerContext) LogInfo(msg string, args ...slog.Attr)  {}
+func (c *ServerContext) LogWarn(msg string, args ...slog.Attr)  {}
+func (c *ServerContext) LogError(msg string, args ...slog.Attr) {}
+
+// User is a user identified by id and nothing else.
+type User struct {
+	auth.User
+	Id string
+}
+
+func (u *User) GetId() string       { return u.Id }
+func (u *User) GetUserName() string { return u.Id }
+
+// RequestContext is a request made by a user on behalf of a tenant, with the same limits as
+// ServerContext. The user holds the Permissions listed and no others. The values set on it are
+// copied into its sub-contexts, and those set on a sub-context are not seen by its parent.
+type RequestContext struct {
+	core.RequestContext
+	Server      *ServerContext
+	User        auth.User
+	Tenant      auth.TenantInfo
+	Permissions []string
+	vals        map[string]interface{}
+}
+
+// NewRequestContext creates a request made by userId. An empty tenantId makes a request that
+// carries no tenant.
+func NewRequestContext(server *ServerContext, userId string, tenantId string) *RequestContext {
+	c := &RequestContext{Server: server, User: &User{Id: userId}}
+	if tenantId != "" {
+		c.Tenant = &data.TenantInfo{TenantId: tenantId, TenantName: tenantId}
+	}
+	return c
+}
+
+func (c *RequestContext) ServerContext() core.ServerContext      { return c.Server }
+func (c *RequestContext) CreateUUID() string                     { return c.Server.CreateUUID() }
+func (c *RequestContext) GetUser() auth.User                     { return c.User }
+func (c *RequestContext) GetTenant() auth.TenantInfo             { return c.Tenant }
+func (c *RequestContext) GetName() string                        { return "datatest" }
+func (c *RequestContext) GetPath() string                        { return "/datatest" }
+func (c *RequestContext) GetId() string                          { return "datatest" }
+func (c *RequestContext) LogTrace(msg string, args ...slog.Attr) {}
+func (c *RequestContext) LogDebug(msg string, args ...slog.Attr) {}
+func (c *RequestContext) LogInfo(msg string, args ...slog.Attr)  {}
+func (c *RequestContext) LogWarn(msg string, args ...slog.Attr)  {}
+func (c *RequestContext) LogError(msg string, args ...slog.Attr) {}
+
+func (c *RequestContext) Get(key string) (interface{}, bool) {
+	val, ok := c.vals[key]
+	return val, ok
+}
+
+func (c *RequestContext) Set(key string, val interface{}) {
+	if c.vals == nil {
+		c.vals = make(map[string]interface{})
+	}
+	c.vals[key] = val
+}
+
+func (c *RequestContext) SubContext(name string) core.RequestContext {
+	sub := *c
+	sub.vals = make(map[string]interface{}, len(c.vals))
+	for key, val := range c.vals {
+		sub.vals[key] = val
+	}
+	return &sub
+}
+
+func (c *RequestContext) HasPermission(perm string) bool {
+	for _, held := range c.Permissions {
+		if held == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,381 @@
+// Package datatest is a conformance suite for data.DataComponent providers.
+//
+// The data layer's contract is mostly behaviour that no interface can express: that soft-deleted
+// records disappear from every read, that one tenant never sees another's records, that an
+// optional filter whose parameter is absent widens rather than empties the result, that a
+// provider rejects a query it cannot compile instead of quietly running a weaker one. Run checks
+// each of those against any provider, so a provider proves it behaves like the others in a test
+// rather than in production.
+//
+// A provider's own test supplies a Factory and calls Run:
+//
+//	func TestConformance(t *testing.T) {
+//		datatest.Run(t, func(t *testing.T, ctx core.ServerContext, object string, objects core.ObjectFactory) data.DataComponent {
+//			return newProvider(ctx, object, objects)
+//		})
+//	}
+package datatest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/utils"
+)
+
+// Factory creates an empty data component for object, whose instances are created by objects and
+// carry the configuration the scenario needs. It is called once per scenario, and the component
+// it returns must not share records with any component it returned before.
+type Factory func(t *testing.T, ctx core.ServerContext, object string, objects core.ObjectFactory) data.DataComponent
+
+// fixture is one scenario's component together with the contexts that drive it.
+type fixture struct {
+	t       *testing.T
+	svc     data.DataComponent
+	objects *ObjectFactory
+	server  *ServerContext
+	ctx     *RequestContext
+}
+
+func newFixture(t *testing.T, factory Factory, object string, conf core.StorableConfig) *fixture {
+	t.Helper()
+	f := &fixture{t: t, objects: NewObjectFactory(object, conf), server: NewServerContext()}
+	f.ctx = NewRequestContext(f.server, "user1", "")
+	f.svc = factory(t, f.server, object, f.objects)
+	if f.svc == nil {
+		t.Fatalf("factory returned no component for %s", object)
+	}
+	return f
+}
+
+// Run exercises the data component contract against the components factory creates.
+func Run(t *testing.T, factory Factory) {
+	t.Run("CastToStorableCollection", testCastToStorableCollection)
+	t.Run("SoftDelete", func(t *testing.T) { testSoftDelete(t, factory) })
+	t.Run("Trackable", func(t *testing.T) { testTrackable(t, factory) })
+	t.Run("Multitenant", func(t *testing.T) { testMultitenant(t, factory) })
+	t.Run("OptionalPredicates", func(t *testing.T) { testOptionalPredicates(t, factory) })
+	t.Run("QueryCapabilities", func(t *testing.T) { testQueryCapabilities(t, factory) })
+	t.Run("QueryShaping", func(t *testing.T) { testQueryShaping(t, factory) })
+	t.Run("QueryCache", func(t *testing.T) { testQueryCache(t, factory) })
+	t.Run("Iterate", func(t *testing.T) { testIterate(t, factory) })
+	t.Run("Versioning", func(t *testing.T) { testVersioning(t, factory) })
+	t.Run("Temporal", func(t *testing.T) { testTemporal(t, factory) })
+	t.Run("Trash", func(t *testing.T) { testTrash(t, factory) })
+	t.Run("Indexes", func(t *testing.T) { testIndexes(t, factory) })
+}
+
+// save stores a record for each name, sized by its position, as ctx.
+func (f *fixture) save(ctx core.RequestContext, names ...string) []*Record {
+	f.t.Helper()
+	records := make([]*Record, len(names))
+	for i, name := range names {
+		records[i] = f.objects.NewRecord(name, i+1)
+		if err := f.svc.Save(ctx, records[i]); err != nil {
+			f.t.Fatalf("Save %s: %v", name, err)
+		}
+	}
+	return records
+}
+
+// condition compiles and binds query for ctx, failing the test if either step fails.
+func (f *fixture) condition(ctx core.RequestContext, query *data.Query, params utils.StringsMap) interface{} {
+	f.t.Helper()
+	cond, err := f.svc.CreateQueryCondition(ctx, query, params)
+	if err != nil {
+		f.t.Fatalf("CreateQueryCondition: %v", err)
+	}
+	return cond
+}
+
+// names returns the names of every record matching cond, sorted, after checking that the page is
+// internally consistent.
+func (f *fixture) names(ctx core.RequestContext, cond interface{}) string {
+	f.t.Helper()
+	items, ids, totalrecs, recsreturned, err := f.svc.Get(ctx, nil, cond, -1, 1, "", nil, "")
+	if err != nil {
+		f.t.Fatalf("Get: %v", err)
+	}
+	checkAligned(f.t, items, ids)
+	if recsreturned != len(items) {
+		f.t.Errorf("recsreturned is %d for %d records", recsreturned, len(items))
+	}
+	if totalrecs != len(items) {
+		f.t.Errorf("totalrecs is %d for an unpaged read of %d records", totalrecs, len(items))
+	}
+	count, err := f.svc.Count(ctx, cond)
+	if err != nil {
+		f.t.Fatalf("Count: %v", err)
+	}
+	if count != len(items) {
+		f.t.Errorf("Count is %d where Get returned %d records", count, len(items))
+	}
+	return sortedNames(items)
+}
+
+// unconstrained binds a query with no filter, which matches every visible record.
+func (f *fixture) unconstrained(ctx core.RequestContext) interface{} {
+	return f.condition(ctx, data.NewQuery(), nil)
+}
+
+func sortedNames(items []core.Storable) string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.(*Record).Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// checkAligned checks that ids and records describe the same records in the same order.
+func checkAligned(t *testing.T, items []core.Storable, ids []string) {
+	t.Helper()
+	if len(items) != len(ids) {
+		t.Fatalf("%d records returned with %d ids", len(items), len(ids))
+	}
+	for i, item := range items {
+		if item == nil || item.GetId() != ids[i] {
+			t.Fatalf("id %d is %q but its record is %v", i, ids[i], item)
+		}
+	}
+}
+
+func testCastToStorableCollection(t *testing.T) {
+	objects := NewObjectFactory("datatest.Record", core.StorableConfig{})
+	records := objects.CreateObjectCollection(nil, 4).([]Record)
+	for i := range records {
+		records[i].Id = fmt.Sprintf("r%d", i)
+	}
+	records[1].Deleted = true
+	items, ids, err := data.CastToStorableCollection(NewServerContext(), records)
+	if err != nil {
+		t.Fatalf("CastToStorableCollection: %v", err)
+	}
+	checkAligned(t, items, ids)
+	if strings.Join(ids, ",") != "r0,r2,r3" {
+		t.Fatalf("want the deleted record dropped from both slices, got ids %v", ids)
+	}
+}
+
+func testSoftDelete(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.SoftDeleteRecord", core.StorableConfig{SoftDelete: true})
+	records := f.save(f.ctx, "alpha", "beta", "gamma", "delta")
+	if err := f.svc.Delete(f.ctx, records[1].Id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got := f.names(f.ctx, f.unconstrained(f.ctx)); got != "alpha,delta,gamma" {
+		t.Errorf("after soft delete, want alpha,delta,gamma, got %s", got)
+	}
+	if item, err := f.svc.GetById(f.ctx, records[1].Id, ""); err == nil && item != nil {
+		t.Errorf("GetById returned a soft-deleted record")
+	}
+	hash, err := f.svc.GetMultiHash(f.ctx, nil, []string{records[0].Id, records[1].Id}, "")
+	if err != nil {
+		t.Fatalf("GetMultiHash: %v", err)
+	}
+	if _, ok := hash[records[1].Id]; ok || len(hash) != 1 {
+		t.Errorf("GetMultiHash returned a soft-deleted record")
+	}
+	// the flag itself is queryable under its fixed name, so a deletion can be filtered on
+	query := data.NewQuery()
+	query.Filter = &data.Comparison{Field: data.FIELD_SOFTDELETE, Operator: data.OpEqual, Value: data.LiteralOperand(false)}
+	if got := f.names(f.ctx, f.condition(f.ctx, query, nil)); got != "alpha,delta,gamma" {
+		t.Errorf("filtering on %s: want alpha,delta,gamma, got %s", data.FIELD_SOFTDELETE, got)
+	}
+	query = data.NewQuery()
+	query.Filter = &data.Comparison{Field: "Size", Operator: data.OpGreater, Value: data.LiteralOperand(2)}
+	if _, err = f.svc.DeleteAll(f.ctx, f.condition(f.ctx, query, nil), false); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if got := f.names(f.ctx, f.unconstrained(f.ctx)); got != "alpha" {
+		t.Errorf("after DeleteAll, want alpha, got %s", got)
+	}
+	_, ids, total, returned, err := f.svc.GetList(f.ctx, nil, 10, 1, "", nil, "")
+	if err != nil {
+		t.Fatalf("GetList: %v", err)
+	}
+	if total != 1 || returned != 1 || len(ids) != 1 {
+		t.Errorf("GetList counted soft-deleted records: total %d, returned %d, ids %v", total, returned, ids)
+	}
+}
+
+func testTrackable(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.TrackableRecord", core.StorableConfig{Trackable: true})
+	before := time.Now().Add(-time.Second)
+	record := f.save(f.ctx, "alpha")[0]
+	item, err := f.svc.GetById(f.ctx, record.Id, "")
+	if err != nil {
+		t.Fatalf("GetById: %v", err)
+	}
+	created := item.(*Record)
+	if created.CreatedBy != "user1" || created.UpdatedBy != "user1" {
+		t.Errorf("want created and updated by user1, got %q and %q", created.CreatedBy, created.UpdatedBy)
+	}
+	if created.CreatedAt.Before(before) || created.UpdatedAt.Before(before) {
+		t.Errorf("timestamps not stamped: created %v, updated %v", created.CreatedAt, created.UpdatedAt)
+	}
+	other := NewRequestContext(f.server, "user2", "")
+	if err = f.svc.Update(other, record.Id, utils.StringMap{"Name": "beta"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	item, err = f.svc.GetById(f.ctx, record.Id, "")
+	if err != nil {
+		t.Fatalf("GetById: %v", err)
+	}
+	updated := item.(*Record)
+	if updated.CreatedBy != "user1" || updated.UpdatedBy != "user2" {
+		t.Errorf("after update by user2, want created by user1 and updated by user2, got %q and %q", updated.CreatedBy, updated.UpdatedBy)
+	}
+	if !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("update changed CreatedAt from %v to %v", created.CreatedAt, updated.CreatedAt)
+	}
+	if updated.UpdatedAt.Before(created.UpdatedAt) {
+		t.Errorf("update moved UpdatedAt backwards from %v to %v", created.UpdatedAt, updated.UpdatedAt)
+	}
+}
+
+func testMultitenant(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.TenantRecord", core.StorableConfig{Multitenant: true})
+	first, second := NewRequestContext(f.server, "user1", "t1"), NewRequestContext(f.server, "user2", "t2")
+	ours := f.save(first, "alpha", "beta")
+	theirs := f.save(second, "gamma")
+
+	if got := f.names(first, f.unconstrained(first)); got != "alpha,beta" {
+		t.Errorf("tenant t1: want alpha,beta, got %s", got)
+	}
+	if got := f.names(second, f.unconstrained(second)); got != "gamma" {
+		t.Errorf("tenant t2: want gamma, got %s", got)
+	}
+	item, err := f.svc.GetById(first, ours[0].Id, "")
+	if err != nil {
+		t.Fatalf("GetById: %v", err)
+	}
+	if item.(*Record).TenantId != "t1" {
+		t.Errorf("record not stamped with its tenant, got %q", item.(*Record).TenantId)
+	}
+	if item, err = f.svc.GetById(first, theirs[0].Id, ""); err == nil && item != nil {
+		t.Errorf("tenant t1 read tenant t2's record by id")
+	}
+	if err = f.svc.Update(first, theirs[0].Id, utils.StringMap{"Name": "stolen"}); err == nil {
+		t.Errorf("tenant t1 updated tenant t2's record by id")
+	}
+	if _, err = f.svc.DeleteAll(first, f.unconstrained(first), false); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if got := f.names(second, f.unconstrained(second)); got != "gamma" {
+		t.Errorf("tenant t1's DeleteAll reached tenant t2: want gamma, got %s", got)
+	}
+}
+
+func testOptionalPredicates(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.Record", core.StorableConfig{})
+	f.save(f.ctx, "alpha", "beta", "gamma")
+
+	query := data.NewQuery()
+	query.Filter = &data.Logical{Operator: data.LogicalAnd, Operands: []data.Predicate{
+		&data.Comparison{Optionality: data.Optionality{Optional: true}, Field: "Size", Operator: data.OpGreaterEqual, Value: data.ParameterOperand("min")},
+		&data.Comparison{Optionality: data.Optionality{Optional: true}, Field: "Name", Operator: data.OpNotEqual, Value: data.ParameterOperand("exclude")},
+	}}
+	compiled, err := f.svc.CompileQuery(f.server, query)
+	if err != nil {
+		t.Fatalf("CompileQuery: %v", err)
+	}
+	cases := []struct {
+		params utils.StringsMap
+		want   string
+	}{
+		{utils.StringsMap{}, "alpha,beta,gamma"},
+		{utils.StringsMap{"min": "2"}, "beta,gamma"},
+		{utils.StringsMap{"exclude": "beta"}, "alpha,gamma"},
+		{utils.StringsMap{"min": "2", "exclude": "beta"}, "gamma"},
+	}
+	for _, tc := range cases {
+		cond, err := f.svc.BindQuery(f.ctx, compiled, tc.params)
+		if err != nil {
+			t.Fatalf("BindQuery %v: %v", tc.params, err)
+		}
+		if got := f.names(f.ctx, cond); got != tc.want {
+			t.Errorf("bound with %v: want %s, got %s", tc.params, tc.want, got)
+		}
+	}
+
+	// a required predicate whose parameter is absent must fail rather than match nothing
+	query = data.NewQuery()
+	query.Filter = &data.Comparison{Field: "Size", Operator: data.OpGreaterEqual, Value: data.ParameterOperand("min")}
+	cond, err := f.svc.CreateQueryCondition(f.ctx, query, utils.StringsMap{})
+	if err == nil {
+		if _, _, _, _, err = f.svc.Get(f.ctx, nil, cond, -1, 1, "", nil, ""); err == nil {
+			t.Errorf("a required parameter that was not supplied neither failed to bind nor to execute")
+		}
+	}
+}
+
+// capabilityCase is a query exercising some capabilities, and what it returns when it runs.
+type capabilityCase struct {
+	name         string
+	capabilities []data.QueryCapability
+	filter       data.Predicate
+	want         string
+}
+
+func capabilityCases() []capabilityCase {
+	named := func(name string) data.Predicate {
+		return &data.Comparison{Field: "Name", Operator: data.OpEqual, Value: data.LiteralOperand(name)}
+	}
+	return []capabilityCase{
+		{"comparison", []data.QueryCapability{data.CapabilityComparison},
+			&data.Comparison{Field: "Size", Operator: data.OpGreater, Value: data.LiteralOperand(1)}, "beta,gamma"},
+		{"disjunction", []data.QueryCapability{data.CapabilityDisjunction},
+			&data.Logical{Operator: data.LogicalOr, Operands: []data.Predicate{named("alpha"), named("gamma")}}, "alpha,gamma"},
+		{"negation", []data.QueryCapability{data.CapabilityNegation},
+			&data.Not{Operand: named("alpha")}, "beta,gamma"},
+		{"membership", []data.QueryCapability{data.CapabilityMembership},
+			&data.Membership{Field: "Name", Values: []data.Operand{data.LiteralOperand("alpha"), data.LiteralOperand("beta")}}, "alpha,beta"},
+		{"nulltest", []data.QueryCapability{data.CapabilityNullTest},
+			&data.NullTest{Field: "Colour"}, "beta,gamma"},
+		{"stringfunctions", []data.QueryCapability{data.CapabilityStringFunctions},
+			&data.FunctionCall{Function: data.FuncContains, Field: "Name", Arguments: []data.Operand{data.LiteralOperand("amm")}}, "gamma"},
+		{"nesting", []data.QueryCapability{data.CapabilityNesting, data.CapabilityDisjunction, data.CapabilityComparison},
+			&data.Logical{Operator: data.LogicalAnd, Operands: []data.Predicate{
+				&data.Logical{Operator: data.LogicalOr, Operands: []data.Predicate{named("alpha"), named("gamma")}},
+				&data.Comparison{Field: "Size", Operator: data.OpLess, Value: data.LiteralOperand(3)},
+			}}, "alpha"},
+	}
+}
+
+func testQueryCapabilities(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.Record", core.StorableConfig{})
+	records := f.save(f.ctx, "alpha", "beta", "gamma")
+	red := "red"
+	records[0].Colour = &red
+	if err := f.svc.Save(f.ctx, records[0]); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for _, tc := range capabilityCases() {
+		supported := true
+		for _, capability := range tc.capabilities {
+			supported = supported && f.svc.SupportsQuery(capability)
+		}
+		query := data.NewQuery()
+		query.Filter = tc.filter
+		_, err := f.svc.CompileQuery(f.server, query)
+		if !supported {
+			if err == nil {
+				t.Errorf("%s: compiled a query using a capability the provider does not declare", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: declared as supported but failed to compile: %v", tc.name, err)
+			continue
+		}
+		if got := f.names(f.ctx, f.condition(f.ctx, query, nil)); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
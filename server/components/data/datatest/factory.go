@@ -0,0 +1,26 @@
+package datatest
+
+import (
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/core"
+)
+
+// EntityFactory creates the objects of an entity a test declares for itself, where the entity is
+// stored through *T and carries its own configuration.
+type EntityFactory[T any] struct{}
+
+func (f EntityFactory[T]) CreateObject(ctx.Context) interface{} {
+	return new(T)
+}
+
+func (f EntityFactory[T]) CreateObjectCollection(cx ctx.Context, length int) interface{} {
+	return make([]T, length)
+}
+
+func (f EntityFactory[T]) CreateObjectPointersCollection(cx ctx.Context, length int) interface{} {
+	return make([]*T, length)
+}
+
+func (f EntityFactory[T]) Info() core.Info {
+	return nil
+}
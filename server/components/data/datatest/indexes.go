@@ -0,0 +1,59 @@
+package datatest
+
+import (
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/utils"
+)
+
+func testIndexes(t *testing.T, factory Factory) {
+	sized := data.NewQuery()
+	sized.Filter = &data.Comparison{Field: "Size", Operator: data.OpGreater, Value: data.LiteralOperand(0)}
+	f := newFixture(t, factory, "datatest.IndexedRecord", core.StorableConfig{Indexes: []core.IndexSpec{
+		{Fields: []string{"Name"}, Unique: true, Filter: sized},
+		{Fields: []string{"-Size", "Name"}},
+	}})
+	if _, ok := f.svc.(data.IndexManager); !ok {
+		t.Skip("the component does not manage indexes")
+	}
+	if err := f.svc.CreateDBCollection(f.server); err != nil {
+		t.Fatalf("CreateDBCollection: %v", err)
+	}
+	if diff, err := data.CheckIndexes(f.server, f.svc); err != nil || !diff.Empty() {
+		t.Fatalf("after creating the collection: %v, %v", diff, err)
+	}
+	records := f.save(f.ctx, "alpha", "beta")
+	if err := f.svc.Save(f.ctx, f.objects.NewRecord("alpha", 3)); !data.IsDuplicate(err) {
+		t.Fatalf("want a duplicate, got %v", err)
+	}
+	// the filter leaves records without a size out of the index
+	if err := f.svc.Save(f.ctx, f.objects.NewRecord("alpha", 0)); err != nil {
+		t.Fatalf("Save outside the filter: %v", err)
+	}
+	if err := f.svc.Update(f.ctx, records[1].Id, utils.StringMap{"Name": "alpha"}); !data.IsDuplicate(err) {
+		t.Fatalf("want an update to a duplicate refused, got %v", err)
+	}
+	if got := f.names(f.ctx, f.unconstrained(f.ctx)); got != "alpha,alpha,beta" {
+		t.Fatalf("refused writes changed the records: %s", got)
+	}
+
+	// an index created by hand is reported, and dropped only when asked
+	im := f.svc.(data.IndexManager)
+	if err := im.CreateIndex(f.server, core.IndexSpec{Fields: []string{"Colour"}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if diff, _ := data.ReconcileIndexes(f.server, f.svc, false); len(diff.Extra) != 1 || data.IndexName(diff.Extra[0]) != "Colour" {
+		t.Fatalf("want the extra index reported, got %v", diff)
+	}
+	if diff, _ := data.ReconcileIndexes(f.server, f.svc, true); len(diff.Extra) != 1 {
+		t.Fatalf("want the extra index dropped, got %v", diff)
+	}
+	if diff, _ := data.CheckIndexes(f.server, f.svc); !diff.Empty() {
+		t.Fatalf("after dropping the extra index: %v", diff)
+	}
+	if err := im.CreateIndex(f.server, core.IndexSpec{Name: "names", Fields: []string{"Name"}, Unique: true}); !data.IsDuplicate(err) {
+		t.Fatalf("created a unique index over duplicates: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package datatest
+
+import (
+	"strings"
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+// walk advances it up to limit times, or to the end when limit is negative, and returns the
+// names it passed and the token after the last of them.
+func walk(t *testing.T, it data.StorableIterator, limit int) (string, string) {
+	t.Helper()
+	var names []string
+	for limit != 0 && it.Next() {
+		names = append(names, it.Item().(*Record).Name)
+		limit--
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterating: %v", err)
+	}
+	return strings.Join(names, ","), it.Token()
+}
+
+func testIterate(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.Record", core.StorableConfig{})
+	f.save(f.ctx, "alpha", "beta", "gamma", "delta", "epsilon")
+
+	// a nil condition walks every record, though it matches none where a condition is counted
+	it, err := f.svc.Iterate(f.ctx, nil, nil, []string{"Name desc"}, 2)
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if got, _ := walk(t, it, -1); got != "gamma,epsilon,delta,beta,alpha" {
+		t.Errorf("want every record in order, got %s", got)
+	}
+	if n, err := f.svc.Count(f.ctx, nil); err != nil || n != 0 {
+		t.Errorf("Count of a nil condition: want 0, got %d %v", n, err)
+	}
+	if it.Next() {
+		t.Errorf("an exhausted iterator advanced")
+	}
+	it.Close()
+
+	// a walk interrupted mid-batch resumes after the last record it passed
+	it, _ = f.svc.Iterate(f.ctx, nil, nil, []string{"Name desc"}, 2)
+	first, token := walk(t, it, 3)
+	it.Close()
+	if first != "gamma,epsilon,delta" {
+		t.Errorf("want the first three records, got %s", first)
+	}
+	f.save(f.ctx, "zeta", "aardvark")
+	resumed, _ := f.svc.Iterate(f.ctx, nil, nil, []string{"Name desc"}, 2)
+	if err = resumed.Resume(token); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if got, _ := walk(t, resumed, -1); got != "beta,alpha,aardvark" {
+		t.Errorf("want the walk to continue after delta, got %s", got)
+	}
+	if err = resumed.Resume(token); err == nil {
+		t.Errorf("an advanced iterator accepted a token")
+	}
+	unordered, _ := f.svc.Iterate(f.ctx, nil, nil, nil, 2)
+	if err = unordered.Resume(token); err == nil {
+		t.Errorf("a token from another order was accepted")
+	}
+
+	// a condition and a projection hold across batches
+	query := data.NewQuery()
+	query.Filter = &data.Comparison{Field: "Size", Operator: data.OpGreater, Value: data.LiteralOperand(1)}
+	cond := f.condition(f.ctx, query, nil)
+	it, err = f.svc.Iterate(f.ctx, []string{"Size"}, cond, []string{"Size"}, 2)
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	var sizes []int
+	for it.Next() {
+		record := it.Item().(*Record)
+		if record.Name != "" {
+			t.Errorf("a projected record carries Name %q", record.Name)
+		}
+		sizes = append(sizes, record.Size)
+	}
+	if err = it.Err(); err != nil || len(sizes) != 5 || sizes[0] != 2 || sizes[4] != 5 {
+		t.Errorf("want sizes 2 to 5 ascending, got %v (%v)", sizes, err)
+	}
+}
@@ -0,0 +1,122 @@
+package datatest
+
+import (
+	"strings"
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+// recordObject is the object the cache scenario stores its records as.
+const recordObject = "datatest.Record"
+
+// cached compiles text through cache and binds it, failing the test if any step fails.
+func (f *fixture) cached(cache *data.QueryCache, text string) interface{} {
+	f.t.Helper()
+	query, err := data.ParseODataFilter(text)
+	if err != nil {
+		f.t.Fatalf("%s: %v", text, err)
+	}
+	compiled, err := cache.Compile(f.server, recordObject, f.svc, query)
+	if err != nil {
+		f.t.Fatalf("%s: Compile: %v", text, err)
+	}
+	cond, err := compiled.Bind(f.ctx, f.svc, nil)
+	if err != nil {
+		f.t.Fatalf("%s: Bind: %v", text, err)
+	}
+	return cond
+}
+
+func testQueryCache(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, recordObject, core.StorableConfig{})
+	f.save(f.ctx, "alpha", "beta", "gamma", "delta")
+	cache := data.NewQueryCache(2)
+
+	// queries differing only in their literals share an entry, and each still sees its own values
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"Size ge 3 or Name eq 'alpha'", "alpha,delta,gamma"},
+		{"Size ge 4 or Name eq 'beta'", "beta,delta"},
+		{"Name in ('gamma','delta') and Size lt 4", "gamma"},
+		{"Name in ('alpha','beta') and Size lt 2", "alpha"},
+	}
+	for _, tc := range cases {
+		if got := f.names(f.ctx, f.cached(cache, tc.text)); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.text, tc.want, got)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Misses != 2 || stats.Hits != 2 {
+		t.Errorf("want 2 entries from 2 misses and 2 hits, got %+v", stats)
+	}
+
+	// the values of a cached shape are still checked against the entity
+	query, _ := data.ParseODataFilter("Size ge 'large' or Name eq 'alpha'")
+	if _, err := cache.Compile(f.server, recordObject, f.svc, query); err == nil {
+		t.Errorf("a cached shape accepted a text value for a numeric field")
+	}
+
+	f.cached(cache, "startswith(Name,'a')")
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("want the least recently used entry evicted, got %+v", stats)
+	}
+	f.cached(cache, "Size ge 1 or Name eq 'x'")
+	if stats := cache.Stats(); stats.Misses != 4 {
+		t.Errorf("an evicted shape must be compiled again, got %+v", stats)
+	}
+
+	// an entry compiled by a replaced component is never handed to its replacement
+	replaced := f.svc
+	f.svc = factory(t, f.server, recordObject, f.objects)
+	f.save(f.ctx, "omega")
+	if got := f.names(f.ctx, f.cached(cache, "Size ge 1 or Name eq 'y'")); got != "omega" {
+		t.Errorf("want the replacement's records, got %s", got)
+	}
+	if stats := cache.Stats(); stats.Misses != 5 {
+		t.Errorf("an entry from a replaced component must not be reused, got %+v", stats)
+	}
+	if replaced == f.svc {
+		t.Fatalf("factory returned the same component twice")
+	}
+
+	if n := cache.Invalidate(recordObject); n != 2 {
+		t.Errorf("want 2 entries invalidated, got %d", n)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Invalidations != 2 {
+		t.Errorf("want an empty cache after invalidation, got %+v", stats)
+	}
+
+	// the pages of a keyset walk share one entry, each resuming from its own cursor
+	query = data.NewShapedQuery()
+	query.OrderBy = []data.OrderTerm{{Field: "Name"}}
+	query.Top = 2
+	if !f.supports(query) || !f.svc.SupportsQuery(data.CapabilityKeyset) {
+		return
+	}
+	f.save(f.ctx, "pi", "rho", "sigma")
+	var pages []string
+	for len(pages) < 5 {
+		compiled, err := cache.Compile(f.server, recordObject, f.svc, query)
+		if err != nil {
+			t.Fatalf("Compile: %v", err)
+		}
+		page, err := compiled.Query(f.ctx, f.svc, nil)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		pages = append(pages, orderedNames(page.Items))
+		if page.Next == nil {
+			break
+		}
+		query.After = page.Next
+	}
+	if got := strings.Join(pages, "|"); got != "omega,pi|rho,sigma" {
+		t.Errorf("cursor pages: want omega,pi|rho,sigma, got %s", got)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Misses != 6 {
+		t.Errorf("want the pages to share one entry, got %+v", stats)
+	}
+}
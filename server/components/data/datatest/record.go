@@ -0,0 +1,119 @@
+package datatest
+
+import (
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+// Record is the entity the suite stores. It embeds every optional storage trait, so one type
+// serves each scenario; which traits a provider must honour is decided by the configuration its
+// factory was created with, as it is for a generated entity.
+type Record struct {
+	data.StorageInfo
+	data.TenantInfo
+	data.DeletionInfo
+	data.TrackingInfo
+	Name   string   `json:"Name" bson:"Name"`
+	Size   int      `json:"Size" bson:"Size"`
+	Colour *string  `json:"Colour" bson:"Colour"`
+	Tags   []string `json:"Tags" bson:"Tags"`
+	conf   *core.StorableConfig
+}
+
+func (ent *Record) Config() *core.StorableConfig {
+	return ent.conf
+}
+
+func (ent *Record) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatypes.SerializableReader) error {
+	var err error
+	if err = rdr.ReadString(c, cdc, "Name", &ent.Name); err != nil {
+		return err
+	}
+	if err = rdr.ReadInt(c, cdc, "Size", &ent.Size); err != nil {
+		return err
+	}
+	if err = rdr.ReadObject(c, cdc, "Colour", &ent.Colour); err != nil {
+		return err
+	}
+	if err = rdr.ReadArray(c, cdc, "Tags", &ent.Tags); err != nil {
+		return err
+	}
+	if err = ent.DeletionInfo.ReadAll(c, cdc, rdr); err != nil {
+		return err
+	}
+	if err = ent.TrackingInfo.ReadAll(c, cdc, rdr); err != nil {
+		return err
+	}
+	if err = ent.TenantInfo.ReadAll(c, cdc, rdr); err != nil {
+		return err
+	}
+	return ent.StorageInfo.ReadAll(c, cdc, rdr)
+}
+
+func (ent *Record) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr datatypes.SerializableWriter) error {
+	var err error
+	if err = wtr.WriteString(c, cdc, "Name", &ent.Name); err != nil {
+		return err
+	}
+	if err = wtr.WriteInt(c, cdc, "Size", &ent.Size); err != nil {
+		return err
+	}
+	if err = wtr.WriteObject(c, cdc, "Colour", &ent.Colour); err != nil {
+		return err
+	}
+	if err = wtr.WriteArray(c, cdc, "Tags", &ent.Tags); err != nil {
+		return err
+	}
+	if err = ent.DeletionInfo.WriteAll(c, cdc, wtr); err != nil {
+		return err
+	}
+	if err = ent.TrackingInfo.WriteAll(c, cdc, wtr); err != nil {
+		return err
+	}
+	if err = ent.TenantInfo.WriteAll(c, cdc, wtr); err != nil {
+		return err
+	}
+	return ent.StorageInfo.WriteAll(c, cdc, wtr)
+}
+
+// ObjectFactory creates Records carrying one configuration.
+type ObjectFactory struct {
+	conf *core.StorableConfig
+}
+
+// NewObjectFactory creates a factory for Records stored as object under conf. The object type
+// and, when it is not set, the collection are filled in from object.
+func NewObjectFactory(object string, conf core.StorableConfig) *ObjectFactory {
+	conf.ObjectType = object
+	if conf.Collection == "" {
+		conf.Collection = object
+	}
+	return &ObjectFactory{conf: &conf}
+}
+
+// NewRecord creates a Record named name with the factory's configuration.
+func (f *ObjectFactory) NewRecord(name string, size int) *Record {
+	return &Record{Name: name, Size: size, conf: f.conf}
+}
+
+func (f *ObjectFactory) CreateObject(ctx.Context) interface{} {
+	return &Record{conf: f.conf}
+}
+
+func (f *ObjectFactory) CreateObjectCollection(cx ctx.Context, length int) interface{} {
+	records := make([]Record, length)
+	for i := range records {
+		records[i].conf = f.conf
+	}
+	return records
+}
+
+func (f *ObjectFactory) CreateObjectPointersCollection(cx ctx.Context, length int) interface{} {
+	return make([]*Record, length)
+}
+
+func (f *ObjectFactory) Info() core.Info {
+	return core.NewInfo("Record stored by the data component conformance suite", f.conf.ObjectType, "1.0", nil)
+}
@@ -0,0 +1,136 @@
+package datatest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+// run compiles query and runs it, failing the test if either step fails.
+func (f *fixture) run(query *data.Query) *data.QueryPage {
+	f.t.Helper()
+	compiled, err := f.svc.CompileQuery(f.server, query)
+	if err != nil {
+		f.t.Fatalf("CompileQuery: %v", err)
+	}
+	page, err := f.svc.Query(f.ctx, compiled, nil)
+	if err != nil {
+		f.t.Fatalf("Query: %v", err)
+	}
+	return page
+}
+
+// supports reports whether the provider declares every capability, and checks that it refuses
+// to compile query when it does not.
+func (f *fixture) supports(query *data.Query) bool {
+	f.t.Helper()
+	for _, capability := range query.ShapeCapabilities() {
+		if !f.svc.SupportsQuery(capability) {
+			if _, err := f.svc.CompileQuery(f.server, query); err == nil {
+				f.t.Errorf("compiled a query using %s, which the provider does not declare", capability)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// orderedNames returns the names of records in the order given.
+func orderedNames(items []core.Storable) string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.(*Record).Name
+	}
+	return strings.Join(names, ",")
+}
+
+func testQueryShaping(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.Record", core.StorableConfig{})
+	records := f.save(f.ctx, "alpha", "beta", "gamma", "delta", "epsilon")
+	red, blue := "red", "blue"
+	records[0].Colour, records[1].Colour, records[2].Colour = &red, &blue, &red
+	for _, record := range records[:3] {
+		if err := f.svc.Save(f.ctx, record); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	query := data.NewShapedQuery()
+	query.Select = []string{"Name"}
+	query.OrderBy = []data.OrderTerm{{Field: "Size", Descending: true}}
+	query.Top = 2
+	if f.supports(query) {
+		page := f.run(query)
+		if got := orderedNames(page.Items); got != "epsilon,delta" || page.Total != 5 {
+			t.Errorf("first page: want epsilon,delta of 5, got %s of %d", got, page.Total)
+		}
+		for _, item := range page.Items {
+			if item.(*Record).Size != 0 || item.GetId() == "" {
+				t.Errorf("projection to Name carried Size %d, id %q", item.(*Record).Size, item.GetId())
+			}
+		}
+	}
+
+	// walking the cursors visits every record once, in order, and the last page has no cursor
+	query = data.NewShapedQuery()
+	query.OrderBy = []data.OrderTerm{{Field: "Colour"}, {Field: "Size", Descending: true}}
+	query.Top = 2
+	if f.supports(query) && f.svc.SupportsQuery(data.CapabilityKeyset) {
+		var pages []string
+		for len(pages) < 5 {
+			page := f.run(query)
+			pages = append(pages, orderedNames(page.Items))
+			if page.Next == nil {
+				break
+			}
+			// a cursor that went to a client and back must still work
+			cursor, err := data.ParseCursor(page.Next.Token())
+			if err != nil {
+				t.Fatalf("ParseCursor: %v", err)
+			}
+			query.After = cursor
+		}
+		if got := strings.Join(pages, "|"); got != "epsilon,delta|beta,gamma|alpha" {
+			t.Errorf("cursor pages: want epsilon,delta|beta,gamma|alpha, got %s", got)
+		}
+	}
+
+	query = data.NewShapedQuery()
+	query.GroupBy = []string{"Colour"}
+	query.Aggregates = []data.Aggregate{{Function: data.AggregateCount}, {Function: data.AggregateSum, Field: "Size"}, {Function: data.AggregateMax, Field: "Name", As: "last"}}
+	query.OrderBy = []data.OrderTerm{{Field: "sum_Size", Descending: true}}
+	if f.supports(query) {
+		page := f.run(query)
+		var rows []string
+		for _, group := range page.Groups {
+			colour := "null"
+			if group["Colour"] != nil {
+				colour = fmt.Sprint(group["Colour"])
+			}
+			rows = append(rows, fmt.Sprintf("%s:%v:%v:%v", colour, group["count"], group["sum_Size"], group["last"]))
+		}
+		want := "null:2:9:epsilon red:2:4:gamma blue:1:2:beta"
+		if got := strings.Join(rows, " "); got != want || page.Total != 3 {
+			t.Errorf("groups: want %s, got %s (total %d)", want, got, page.Total)
+		}
+
+		// aggregating without grouping reports one row, even over no records
+		query = data.NewShapedQuery()
+		query.Filter = &data.Comparison{Field: "Size", Operator: data.OpGreater, Value: data.LiteralOperand(10)}
+		query.Aggregates = []data.Aggregate{{Function: data.AggregateCount}}
+		page = f.run(query)
+		if len(page.Groups) != 1 || fmt.Sprint(page.Groups[0]["count"]) != "0" {
+			t.Errorf("count over no records: want one row of 0, got %v", page.Groups)
+		}
+	}
+
+	// shaping belongs to QueryV2; a QueryV1 query carrying it is malformed
+	query = data.NewQuery()
+	query.Top = 1
+	if _, err := f.svc.CompileQuery(f.server, query); err == nil {
+		t.Errorf("compiled a QueryV1 query carrying QueryV2 shaping")
+	}
+}
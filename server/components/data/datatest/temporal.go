@@ -0,0 +1,68 @@
+package datatest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+func testTemporal(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.TemporalRecord", core.StorableConfig{Temporal: true})
+	record := f.save(f.ctx, "alpha")[0]
+	if err := f.svc.Update(f.ctx, record.Id, utils.StringMap{"Name": "beta"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := f.svc.Delete(f.ctx, record.Id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	record.Version = ""
+	record.Name = "gamma"
+	if err := f.svc.Save(f.ctx, record); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	revisions, err := f.svc.GetRevisions(f.ctx, record.Id)
+	if err != nil {
+		t.Fatalf("GetRevisions: %v", err)
+	}
+	var got []string
+	for _, rev := range revisions {
+		entry := rev.Version + ":" + rev.Item.(*Record).Name
+		if rev.Deleted {
+			entry += ":deleted"
+		}
+		got = append(got, entry)
+	}
+	if want := "[1:alpha 2:beta 3:beta:deleted 4:gamma]"; fmt.Sprint(got) != want {
+		t.Fatalf("want revisions %s, got %s", want, fmt.Sprint(got))
+	}
+
+	for i, want := range []string{"alpha", "beta", "", "gamma"} {
+		item, err := f.svc.GetAsOf(f.ctx, record.Id, revisions[i].At)
+		if want == "" {
+			if !errors.IsNotFound(err) {
+				t.Errorf("as of its deletion: want not found, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GetAsOf revision %d: %v", i, err)
+		}
+		if name := item.(*Record).Name; name != want {
+			t.Errorf("as of revision %d: want %s, got %s", i, want, name)
+		}
+	}
+	if _, err = f.svc.GetAsOf(f.ctx, record.Id, revisions[0].At.Add(-time.Nanosecond)); !errors.IsNotFound(err) {
+		t.Errorf("before its first revision: want not found, got %v", err)
+	}
+
+	plain := newFixture(t, factory, "datatest.Record", core.StorableConfig{})
+	record = plain.save(plain.ctx, "alpha")[0]
+	if _, err = plain.svc.GetAsOf(plain.ctx, record.Id, time.Now()); err == nil {
+		t.Errorf("an object that keeps no revisions answered GetAsOf")
+	}
+}
@@ -0,0 +1,99 @@
+package datatest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+func testTrash(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.TrashRecord", core.StorableConfig{SoftDelete: true, Retention: time.Hour})
+	records := f.save(f.ctx, "alpha", "beta", "gamma")
+	before := time.Now()
+	if err := f.svc.DeleteMulti(f.ctx, []string{records[1].Id, records[2].Id}); err != nil {
+		t.Fatalf("DeleteMulti: %v", err)
+	}
+	deletedAt := time.Now()
+
+	deleted, _, total, _, err := f.svc.ListDeleted(f.ctx, nil, 10, 1, []string{"Name"})
+	if err != nil {
+		t.Fatalf("ListDeleted: %v", err)
+	}
+	if total != 2 || sortedNames(deleted) != "beta,gamma" {
+		t.Fatalf("want beta,gamma deleted, got %d: %s", total, sortedNames(deleted))
+	}
+	for _, item := range deleted {
+		rec := item.(*Record)
+		if rec.GetDeletedBy() != "user1" {
+			t.Errorf("%s: want deleted by user1, got %q", rec.Name, rec.GetDeletedBy())
+		}
+		if at := rec.GetDeletedAt(); at.Before(before) || at.After(deletedAt) {
+			t.Errorf("%s: deletion time %v is not when it was deleted", rec.Name, at)
+		}
+	}
+
+	// restoring and purging raise their own events, not those of a create and a delete
+	var events []string
+	for _, evt := range []data.DataEventType{data.EventDataCreated, data.EventDataDeleted, data.EventDataRestored, data.EventDataPurged} {
+		err = f.svc.Subscribe(f.ctx, "", evt, func(ctx core.RequestContext, msg *core.Message, info utils.StringMap) error {
+			events = append(events, info["event"].(string)+":"+msg.Data.(*Record).Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+
+	if err = f.svc.Restore(f.ctx, []string{records[1].Id, records[0].Id}); !errors.IsNotFound(err) {
+		t.Errorf("restoring a record that is not deleted: want not found, got %v", err)
+	}
+	if err = f.svc.Restore(f.ctx, []string{records[1].Id}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := f.names(f.ctx, f.unconstrained(f.ctx)); got != "alpha,beta" {
+		t.Errorf("after restore, want alpha,beta, got %s", got)
+	}
+	item, err := f.svc.GetById(f.ctx, records[1].Id, "")
+	if err != nil {
+		t.Fatalf("GetById: %v", err)
+	}
+	if rec := item.(*Record); rec.IsDeleted() || !rec.GetDeletedAt().IsZero() || rec.GetDeletedBy() != "" {
+		t.Errorf("a restored record kept its deletion: %v %v %q", rec.IsDeleted(), rec.GetDeletedAt(), rec.GetDeletedBy())
+	}
+
+	if n, err := f.svc.Purge(f.ctx, before); err != nil || n != 0 {
+		t.Errorf("purging before any deletion: want 0, got %d, %v", n, err)
+	}
+	if n, err := f.svc.Purge(f.ctx, deletedAt.Add(time.Nanosecond)); err != nil || n != 1 {
+		t.Errorf("purging after the deletion: want 1, got %d, %v", n, err)
+	}
+	if deleted, _, _, _, err = f.svc.ListDeleted(f.ctx, nil, 10, 1, nil); err != nil || len(deleted) != 0 {
+		t.Errorf("a purged record is still deleted: %s, %v", sortedNames(deleted), err)
+	}
+	if got := strings.Join(events, " "); got != "data.object.restored:beta data.object.purged:gamma" {
+		t.Errorf("want a restored and a purged event, got %s", got)
+	}
+	if err = f.svc.Restore(f.ctx, []string{records[2].Id}); !errors.IsNotFound(err) {
+		t.Errorf("restoring a purged record: want not found, got %v", err)
+	}
+
+	// the retention job purges what was deleted longer ago than the entity's Retention
+	if err = f.svc.Delete(f.ctx, records[0].Id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	job := data.NewRetentionJobWithServices(f.server, time.Minute, f.svc)
+	if purged := job.Run(f.ctx, time.Now()); purged[f.svc.GetObject()] != 0 {
+		t.Errorf("retention purged a record deleted within its period: %v", purged)
+	}
+	if purged := job.Run(f.ctx, time.Now().Add(2*time.Hour)); purged[f.svc.GetObject()] != 1 {
+		t.Errorf("retention after its period: want 1 purged, got %v", purged)
+	}
+	if deleted, _, _, _, err = f.svc.ListDeleted(f.ctx, nil, 10, 1, nil); err != nil || len(deleted) != 0 {
+		t.Errorf("retention left deleted records: %s, %v", sortedNames(deleted), err)
+	}
+}
@@ -0,0 +1,80 @@
+package datatest
+
+import (
+	"testing"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// stored reads back the record with id, failing the test if it cannot.
+func (f *fixture) stored(id string) *Record {
+	f.t.Helper()
+	item, err := f.svc.GetById(f.ctx, id, "")
+	if err != nil {
+		f.t.Fatalf("GetById: %v", err)
+	}
+	return item.(*Record)
+}
+
+func testVersioning(t *testing.T, factory Factory) {
+	f := newFixture(t, factory, "datatest.VersionedRecord", core.StorableConfig{Versioned: true})
+	record := f.save(f.ctx, "alpha")[0]
+	if record.Version != "1" || f.stored(record.Id).Version != "1" {
+		t.Fatalf("a new record must be saved at version 1, got %q", record.Version)
+	}
+
+	// two writers load version 1; the second to save loses and the first's change survives
+	mine, theirs := f.stored(record.Id), f.stored(record.Id)
+	mine.Name = "mine"
+	if err := f.svc.Save(f.ctx, mine); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	theirs.Name = "theirs"
+	if err := f.svc.Save(f.ctx, theirs); !errors.IsVersionConflict(err) {
+		t.Fatalf("a save over a newer version: want a version conflict, got %v", err)
+	}
+	if theirs.Version != "1" {
+		t.Errorf("a rejected save changed the caller's version to %q", theirs.Version)
+	}
+	if got := f.stored(record.Id); got.Name != "mine" || got.Version != "2" {
+		t.Errorf("want mine at version 2, got %s at %q", got.Name, got.Version)
+	}
+
+	// an update naming a version is conditional on it; one naming none is not, and both bump it
+	if err := f.svc.Update(f.ctx, record.Id, utils.StringMap{"Name": "stale", "Version": "1"}); !errors.IsVersionConflict(err) {
+		t.Fatalf("an update expecting an old version: want a version conflict, got %v", err)
+	}
+	if err := f.svc.Update(f.ctx, record.Id, utils.StringMap{"Name": "beta", "Version": "2"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := f.svc.Update(f.ctx, record.Id, utils.StringMap{"Size": 9}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := f.stored(record.Id); got.Name != "beta" || got.Size != 9 || got.Version != "4" {
+		t.Errorf("want beta sized 9 at version 4, got %s sized %d at %q", got.Name, got.Size, got.Version)
+	}
+
+	// a record that does not exist has the empty version
+	if err := f.svc.UpsertId(f.ctx, "missing", utils.StringMap{"Name": "gamma", "Version": "3"}); !errors.IsVersionConflict(err) {
+		t.Errorf("an upsert expecting a version of a missing record: want a version conflict, got %v", err)
+	}
+	if err := f.svc.UpsertId(f.ctx, "missing", utils.StringMap{"Name": "gamma"}); err != nil {
+		t.Fatalf("UpsertId: %v", err)
+	}
+	if got := f.stored("missing"); got.Version != "1" {
+		t.Errorf("an upserted record must start at version 1, got %q", got.Version)
+	}
+
+	// without versioning, writes are last-writer-wins
+	plain := newFixture(t, factory, "datatest.Record", core.StorableConfig{})
+	record = plain.save(plain.ctx, "alpha")[0]
+	stale := plain.stored(record.Id)
+	if err := plain.svc.Save(plain.ctx, record); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := plain.svc.Save(plain.ctx, stale); err != nil {
+		t.Errorf("an unversioned save must not conflict, got %v", err)
+	}
+}
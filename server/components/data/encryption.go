@@ -0,0 +1,570 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// TAG_ENCRYPT is the struct tag declaring a string field stored encrypted by an EncryptionPlugin.
+// Its value optionally names the field the field's blind index is kept in, as in
+//
+//	Email      string `json:"Email" encrypt:"EmailIndex"`
+//	EmailIndex string `json:"EmailIndex"`
+//	Notes      string `json:"Notes" encrypt:""`
+//
+// Fields may also be declared by the Encrypted of the entity's StorableConfig.
+const TAG_ENCRYPT = "encrypt"
+
+// DefaultKeyTenant is the tenant whose keys encrypt records belonging to no tenant.
+const DefaultKeyTenant = "default"
+
+// DefaultKeyPrefix is the prefix of the secrets data keys are kept under when none is configured.
+const DefaultKeyPrefix = "datakeys"
+
+// sealedPrefix marks a value encrypted by a KeyRing. The key id and the ciphertext follow it, as
+// in enc:v1:acme/2-1f0c9a3e:<base64>, so a value is decrypted with the key it was encrypted with
+// whatever key is current.
+const sealedPrefix = "enc:v1:"
+
+// keyWrappingLabel and indexKeysLabel are the labels the key wrapping data keys and the seed of
+// blind index keys are derived from the master key under.
+const (
+	keyWrappingLabel = "laatoo data key wrapping"
+	indexKeysLabel   = "laatoo data blind indexes"
+)
+
+// sealedField is a field of an entity stored encrypted.
+type sealedField struct {
+	// Field is the field's stored name, which is its json name.
+	Field string
+	// BlindIndex is the stored name of the field its blind index is kept in, if it has one.
+	BlindIndex string
+	index      []int
+	blindIndex []int
+	ptr        bool
+}
+
+var (
+	stringType        = reflect.TypeOf("")
+	stringPtrType     = reflect.TypeOf((*string)(nil))
+	sealedFieldsCache sync.Map
+)
+
+// encryptedFields returns the fields item stores encrypted: those tagged TAG_ENCRYPT, including
+// the fields of the structs it embeds, and those the Encrypted of its StorableConfig declares. A
+// field that is not a string or *string, or a blind index that is not a string field of the
+// entity, is a configuration error.
+func encryptedFields(c ctx.Context, item core.Storable) ([]sealedField, error) {
+	typ := reflect.TypeOf(item)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	if fields, ok := sealedFieldsCache.Load(typ); ok {
+		return fields.([]sealedField), nil
+	}
+	declared := []core.EncryptedField{}
+	for _, sf := range reflect.VisibleFields(typ) {
+		if tag, ok := sf.Tag.Lookup(TAG_ENCRYPT); ok {
+			declared = append(declared, core.EncryptedField{Field: storedName(sf), BlindIndex: strings.TrimSpace(tag)})
+		}
+	}
+	if conf := item.Config(); conf != nil {
+		declared = append(declared, conf.Encrypted...)
+	}
+	var fields []sealedField
+	for _, decl := range declared {
+		sf, ok := lookupSealedField(typ, decl.Field)
+		if !ok || (sf.Type != stringType && sf.Type != stringPtrType) {
+			return nil, errors.BadConf(c, TAG_ENCRYPT, slog.String("Type", typ.String()), slog.String("Field", decl.Field))
+		}
+		field := sealedField{Field: storedName(sf), index: sf.Index, ptr: sf.Type == stringPtrType}
+		if decl.BlindIndex != "" {
+			bf, ok := lookupSealedField(typ, decl.BlindIndex)
+			if !ok || bf.Type != stringType {
+				return nil, errors.BadConf(c, TAG_ENCRYPT, slog.String("Type", typ.String()), slog.String("BlindIndex", decl.BlindIndex))
+			}
+			field.BlindIndex, field.blindIndex = storedName(bf), bf.Index
+		}
+		fields = append(fields, field)
+	}
+	sealedFieldsCache.Store(typ, fields)
+	return fields, nil
+}
+
+// storedName returns the name a field is stored under, which is its json name.
+func storedName(sf reflect.StructField) string {
+	if name := strings.Split(sf.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return sf.Name
+}
+
+// lookupSealedField finds a field of typ by its stored name, or else by its Go name.
+func lookupSealedField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for _, sf := range reflect.VisibleFields(typ) {
+		if sf.Anonymous {
+			continue
+		}
+		if storedName(sf) == name {
+			return sf, true
+		}
+	}
+	return typ.FieldByName(name)
+}
+
+// value returns the value item holds in the field, and false when it holds none.
+func (sf sealedField) value(item interface{}) (string, bool) {
+	fieldVal, ok := sealedFieldValue(item, sf.index)
+	if !ok {
+		return "", false
+	}
+	if sf.ptr {
+		if fieldVal.IsNil() {
+			return "", false
+		}
+		return fieldVal.Elem().String(), true
+	}
+	return fieldVal.String(), fieldVal.String() != ""
+}
+
+// set stores val in the field of item.
+func (sf sealedField) set(item interface{}, val string) {
+	fieldVal, ok := sealedFieldValue(item, sf.index)
+	if !ok || !fieldVal.CanSet() {
+		return
+	}
+	if sf.ptr {
+		fieldVal.Set(reflect.ValueOf(&val))
+		return
+	}
+	fieldVal.SetString(val)
+}
+
+// setIndex stores the blind index of the field in item.
+func (sf sealedField) setIndex(item interface{}, val string) {
+	if fieldVal, ok := sealedFieldValue(item, sf.blindIndex); ok && fieldVal.CanSet() {
+		fieldVal.SetString(val)
+	}
+}
+
+func sealedFieldValue(item interface{}, index []int) (reflect.Value, bool) {
+	val := reflect.ValueOf(item)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return reflect.Value{}, false
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	fieldVal, err := val.FieldByIndexErr(index)
+	if err != nil {
+		return reflect.Value{}, false
+	}
+	return fieldVal, true
+}
+
+/*
+KeyRing keeps the keys an EncryptionPlugin encrypts with, in a SecretsManager. Each tenant has its
+own data keys, and each data key is stored wrapped by the master key, the secret named MasterKey,
+so the secrets holding data keys are of no use without it. A tenant's data keys are numbered: the
+current one encrypts, and every earlier one is kept so that what it encrypted can still be read
+until it is encrypted again. Rotate makes a new key current.
+
+A tenant's first data key is created the first time it is needed. The secrets manager cannot
+create a secret only if it is absent, so the id of every data key ends in a random suffix, as in
+acme/2-1f0c9a3e: instances creating or rotating a tenant's key at once each write a secret of
+their own, and none overwrites a key another has encrypted with. Each then reads back which key is
+current, and the last to name itself current wins. An instance keeps using the key it last found
+current until it rotates or refreshes, which is harmless, as what it encrypts stays readable and
+re-encryption moves it to the current key.
+
+A tenant also has a blind index key, which is never rotated, as rotating it would leave every
+blind index stale at once. It is derived from the master key rather than stored, so that every
+instance holds the same one without having to agree on who creates it. The key wrapping data keys
+and the keys of blind indexes are derived from the master key apart, under labels of their own, so
+that neither can be learnt from the other.
+*/
+type KeyRing struct {
+	Secrets components.SecretsManager
+	// MasterKey names the secret holding the master key. Any secret serves, as the keys are
+	// derived from it.
+	MasterKey string
+	// Prefix is the prefix of the names of the secrets data keys are kept in.
+	Prefix string
+
+	mu      sync.Mutex
+	master  cipher.AEAD
+	indexes []byte
+	keys    map[string]cipher.AEAD
+	current map[string]string
+	index   map[string][]byte
+}
+
+// NewKeyRing creates a key ring keeping its keys in secrets, wrapped by the master key named
+// masterKey, under prefix or DefaultKeyPrefix when it is empty.
+func NewKeyRing(secrets components.SecretsManager, masterKey string, prefix string) *KeyRing {
+	if prefix == "" {
+		prefix = DefaultKeyPrefix
+	}
+	return &KeyRing{Secrets: secrets, MasterKey: masterKey, Prefix: prefix}
+}
+
+// keyTenant returns the tenant whose keys encrypt the records of tenant.
+func keyTenant(tenant string) string {
+	if tenant == "" {
+		return DefaultKeyTenant
+	}
+	return tenant
+}
+
+// secretName returns the name of the secret holding part of tenant's keys.
+func (kr *KeyRing) secretName(tenant string, part string) string {
+	return kr.Prefix + "/" + tenant + "/" + part
+}
+
+// masterKey returns the master key, loading it on first use. The lock is held by the caller.
+func (kr *KeyRing) masterKey(ctx core.ServerContext) (cipher.AEAD, error) {
+	if kr.master != nil {
+		return kr.master, nil
+	}
+	secret, ok, err := kr.Secrets.Get(ctx, kr.MasterKey)
+	if err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	if !ok || len(secret) == 0 {
+		return nil, errors.BadConf(ctx, CONF_DATA_ENCRYPTION_MASTERKEY, slog.String("Secret", kr.MasterKey))
+	}
+	wrapping, err := hkdf.Key(sha256.New, secret, nil, keyWrappingLabel, 32)
+	if err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	if kr.indexes, err = hkdf.Key(sha256.New, secret, nil, indexKeysLabel, 32); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	kr.master, err = newAEAD(ctx, wrapping)
+	if err != nil {
+		return nil, err
+	}
+	return kr.master, nil
+}
+
+func newAEAD(ctx core.ServerContext, key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	return aead, nil
+}
+
+// unwrap returns the key kept in the secret name, and false when there is no such secret.
+func (kr *KeyRing) unwrap(ctx core.ServerContext, name string) ([]byte, bool, error) {
+	wrapped, ok, err := kr.Secrets.Get(ctx, name)
+	if err != nil {
+		return nil, false, errors.WrapError(ctx, err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	master, err := kr.masterKey(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	size := master.NonceSize()
+	if len(wrapped) < size {
+		return nil, false, errors.BadConf(ctx, CONF_DATA_ENCRYPTION_MASTERKEY, slog.String("Secret", name))
+	}
+	key, err := master.Open(nil, wrapped[:size], wrapped[size:], []byte(name))
+	if err != nil {
+		return nil, false, errors.BadConf(ctx, CONF_DATA_ENCRYPTION_MASTERKEY, slog.String("Secret", name))
+	}
+	return key, true, nil
+}
+
+// wrapNew creates a key, and keeps it in the secret name wrapped by the master key. The secret is
+// read back, so that a key the secrets manager did not keep is never used.
+func (kr *KeyRing) wrapNew(ctx core.ServerContext, name string) ([]byte, error) {
+	master, err := kr.masterKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	if err := kr.Secrets.Put(ctx, name, master.Seal(nonce, nonce, key, []byte(name))); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	stored, ok, err := kr.unwrap(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !hmac.Equal(stored, key) {
+		return nil, errors.InternalError(ctx, slog.String("Secret", name))
+	}
+	return key, nil
+}
+
+// currentKey returns the id and the version of tenant's current data key, or an empty id and 0
+// when it has none.
+func (kr *KeyRing) currentKey(ctx core.ServerContext, tenant string) (string, int, error) {
+	val, ok, err := kr.Secrets.Get(ctx, kr.secretName(tenant, "current"))
+	if err != nil {
+		return "", 0, errors.WrapError(ctx, err)
+	}
+	if !ok {
+		return "", 0, nil
+	}
+	number, _, _ := strings.Cut(string(val), "-")
+	version, err := strconv.Atoi(number)
+	if err != nil {
+		return "", 0, errors.BadConf(ctx, CONF_DATA_ENCRYPTION_KEYPREFIX, slog.String("Tenant", tenant))
+	}
+	return tenant + "/" + string(val), version, nil
+}
+
+// CurrentKey returns the id of the data key the records of tenant are encrypted with, creating
+// the tenant's first key if it has none.
+func (kr *KeyRing) CurrentKey(ctx core.ServerContext, tenant string) (string, error) {
+	tenant = keyTenant(tenant)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if keyId, ok := kr.current[tenant]; ok {
+		return keyId, nil
+	}
+	keyId, version, err := kr.currentKey(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	if keyId == "" {
+		return kr.rotate(ctx, tenant, version)
+	}
+	kr.setCurrent(tenant, keyId)
+	return keyId, nil
+}
+
+// Rotate creates a data key for tenant and makes it current, returning its id. The earlier keys
+// are kept to read what they encrypted.
+func (kr *KeyRing) Rotate(ctx core.ServerContext, tenant string) (string, error) {
+	tenant = keyTenant(tenant)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	_, version, err := kr.currentKey(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	return kr.rotate(ctx, tenant, version)
+}
+
+// rotate creates tenant's data key numbered after version and names it current, returning the id
+// of the key current once it has, which is another instance's when it named its own after.
+func (kr *KeyRing) rotate(ctx core.ServerContext, tenant string, version int) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errors.WrapError(ctx, err)
+	}
+	name := strconv.Itoa(version+1) + "-" + hex.EncodeToString(suffix)
+	keyId := tenant + "/" + name
+	key, err := kr.wrapNew(ctx, kr.Prefix+"/"+keyId)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if kr.keys == nil {
+		kr.keys = map[string]cipher.AEAD{}
+	}
+	kr.keys[keyId] = aead
+	if err := kr.Secrets.Put(ctx, kr.secretName(tenant, "current"), []byte(name)); err != nil {
+		return "", errors.WrapError(ctx, err)
+	}
+	current, _, err := kr.currentKey(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	if current == "" {
+		return "", errors.InternalError(ctx, slog.String("Secret", kr.secretName(tenant, "current")))
+	}
+	kr.setCurrent(tenant, current)
+	return current, nil
+}
+
+// Refresh forgets which keys are current, so that they are read again from the secrets, and a key
+// another instance rotated to is used.
+func (kr *KeyRing) Refresh() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.current = nil
+}
+
+func (kr *KeyRing) setCurrent(tenant string, keyId string) {
+	if kr.current == nil {
+		kr.current = map[string]string{}
+	}
+	kr.current[tenant] = keyId
+}
+
+// dataKey returns the data key keyId.
+func (kr *KeyRing) dataKey(ctx core.ServerContext, keyId string) (cipher.AEAD, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if aead, ok := kr.keys[keyId]; ok {
+		return aead, nil
+	}
+	key, ok, err := kr.unwrap(ctx, kr.Prefix+"/"+keyId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.NotFound(ctx, "Key", slog.String("Key", keyId))
+	}
+	aead, err := newAEAD(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if kr.keys == nil {
+		kr.keys = map[string]cipher.AEAD{}
+	}
+	kr.keys[keyId] = aead
+	return aead, nil
+}
+
+// indexKey returns tenant's blind index key: the one kept in its secret, where an earlier key ring
+// stored one, and otherwise the key derived from the master key for the tenant.
+func (kr *KeyRing) indexKey(ctx core.ServerContext, tenant string) ([]byte, error) {
+	tenant = keyTenant(tenant)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if key, ok := kr.index[tenant]; ok {
+		return key, nil
+	}
+	name := kr.secretName(tenant, "index")
+	key, ok, err := kr.unwrap(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if _, err = kr.masterKey(ctx); err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, kr.indexes)
+		mac.Write([]byte(name))
+		key = mac.Sum(nil)
+	}
+	if kr.index == nil {
+		kr.index = map[string][]byte{}
+	}
+	kr.index[tenant] = key
+	return key, nil
+}
+
+// sealedData returns the data a value of field in a record of tenant is authenticated with, so
+// that it cannot be read as the value of another field, or of another tenant's record.
+func sealedData(tenant string, field string) []byte {
+	return []byte(tenant + "\x00" + field)
+}
+
+// Seal encrypts val, the value of field in a record of tenant, with the tenant's current key.
+func (kr *KeyRing) Seal(ctx core.ServerContext, tenant string, field string, val string) (string, error) {
+	keyId, err := kr.CurrentKey(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	aead, err := kr.dataKey(ctx, keyId)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.WrapError(ctx, err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(val), sealedData(keyTenant(tenant), field))
+	return sealedPrefix + keyId + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts val, the value of field in a record of tenant, with the key it was encrypted with.
+// It fails for a value encrypted for another field or another tenant's record. A record that does
+// not tell its tenant is given as the empty tenant, and its value is taken to be of the tenant of
+// the key it was encrypted with. A value that is not encrypted, written before the field was, is
+// returned as it is.
+func (kr *KeyRing) Open(ctx core.ServerContext, tenant string, field string, val string) (string, error) {
+	keyId, payload, ok := parseSealed(val)
+	if !ok {
+		return val, nil
+	}
+	if tenant == "" {
+		tenant, _, _ = strings.Cut(keyId, "/")
+	}
+	aead, err := kr.dataKey(ctx, keyId)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.BadArg(ctx, field, slog.String("Key", keyId))
+	}
+	size := aead.NonceSize()
+	plain, err := aead.Open(nil, sealed[:size], sealed[size:], sealedData(keyTenant(tenant), field))
+	if err != nil {
+		return "", errors.BadArg(ctx, field, slog.String("Key", keyId))
+	}
+	return string(plain), nil
+}
+
+// Blind returns the blind index of val, the value of field in a record of tenant: a keyed hash
+// that is equal for equal values, and tells nothing of the value without the tenant's index key.
+func (kr *KeyRing) Blind(ctx core.ServerContext, tenant string, field string, val string) (string, error) {
+	key, err := kr.indexKey(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(val))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseSealed splits an encrypted value into the id of its key and its ciphertext, returning false
+// when val is not encrypted.
+func parseSealed(val string) (string, string, bool) {
+	if !strings.HasPrefix(val, sealedPrefix) {
+		return "", "", false
+	}
+	rest := val[len(sealedPrefix):]
+	sep := strings.LastIndex(rest, ":")
+	if sep < 0 {
+		return "", "", false
+	}
+	return rest[:sep], rest[sep+1:], true
+}
@@ -0,0 +1,954 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_DATA_ENCRYPTION_MASTERKEY names the secret holding the master key data keys are wrapped by.
+	CONF_DATA_ENCRYPTION_MASTERKEY = "encryptionmasterkey"
+	// CONF_DATA_ENCRYPTION_KEYPREFIX is the prefix of the secrets data keys are kept in.
+	CONF_DATA_ENCRYPTION_KEYPREFIX = "encryptionkeyprefix"
+)
+
+// blindParamPrefix prefixes the parameters a query rewritten for blind indexes is bound with.
+const blindParamPrefix = "encrypt_blind_"
+
+var _ DataComponent = (*EncryptionPlugin)(nil)
+
+/*
+EncryptionPlugin stores the encrypted fields of the entity under it encrypted, so that the data
+service underneath, and whatever reads the store directly, sees only ciphertext. The fields are
+those the entity tags TAG_ENCRYPT or declares in the Encrypted of its StorableConfig; each must be a
+string or a *string.
+
+Items written by Save, Put, PutMulti and CreateMulti are encrypted for the write and hold their
+plaintext again once it returns, and the values written by Update, UpdateMulti, UpsertId, Upsert
+and UpdateAll are encrypted as well. Every record read is decrypted before it is returned, as are
+the records an iterator walks and those data events carry. A value that is not encrypted, written
+before its field was, is read as it is; ReEncrypt encrypts it.
+
+Values are encrypted with AES-GCM under the data keys of the record's tenant, kept by the plugin's
+KeyRing: the record's own TenantId when it is Multitenant and has one, else the request's tenant.
+Values written by id or by condition are encrypted for each record they are written to, under the
+tenant it is stored with, or the tenant the values move it to; a write reaching the records of
+several tenants is made for each tenant in one transaction. The tenant is authenticated with the
+value, so a value copied into another tenant's record cannot be read there. Rotating a tenant's
+key leaves what the earlier key encrypted readable, and ReEncrypt, or a KeyRotationJob, encrypts
+it again with the current key.
+
+An encrypted field with a blind index can still be compared for equality: the plugin keeps a keyed
+hash of its value in the blind index field, and a condition or compiled query comparing the field
+with eq or ne, or testing its membership of a set, compares the blind index with the hash of the
+value instead. The hash is the request's tenant's, so a query made without a tenant finds only the
+records of no tenant. Any other use of an encrypted field in a query, or comparing one without a
+blind index, fails with a bad argument error, as the store cannot evaluate it over ciphertext.
+*/
+type EncryptionPlugin struct {
+	DataPlugin
+	Keys *KeyRing
+}
+
+// encryptedQuery is a query compiled through the plugin, with the blind indexes it compares.
+type encryptedQuery struct {
+	blinds   []blindParam
+	compiled interface{}
+}
+
+// blindParam is a parameter bound with the blind index of a value an encrypted field is compared to.
+type blindParam struct {
+	name   string
+	field  string
+	source Operand
+	// list is set for a membership operand, whose parameter may hold a list of values.
+	list bool
+}
+
+// sealedWrite is the values of a write encrypted for the records of one tenant, and the ids of
+// those records.
+type sealedWrite struct {
+	ids     []string
+	newVals utils.StringMap
+}
+
+// restoreValue is a field of an item that was encrypted for a write, and its plaintext.
+type restoreValue struct {
+	item  core.Storable
+	field sealedField
+	val   string
+}
+
+func NewEncryptionPlugin(ctx core.ServerContext) *EncryptionPlugin {
+	return &EncryptionPlugin{}
+}
+
+// NewEncryptionPluginWithBase creates a plugin over comp encrypting with the keys of keys.
+func NewEncryptionPluginWithBase(ctx core.ServerContext, comp DataComponent, keys *KeyRing) *EncryptionPlugin {
+	return &EncryptionPlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, Keys: keys}
+}
+
+func (svc *EncryptionPlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.Keys == nil {
+		svc.AddStringConfiguration(ctx, CONF_DATA_ENCRYPTION_MASTERKEY, "Secret holding the master key data keys are wrapped by", "")
+		svc.AddStringConfiguration(ctx, CONF_DATA_ENCRYPTION_KEYPREFIX, "Prefix of the secrets data keys are kept in", DefaultKeyPrefix)
+	}
+	return nil
+}
+
+func (svc *EncryptionPlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.Keys == nil {
+		masterKey, ok := svc.GetStringConfiguration(ctx, CONF_DATA_ENCRYPTION_MASTERKEY)
+		if !ok || masterKey == "" {
+			return errors.MissingConf(ctx, CONF_DATA_ENCRYPTION_MASTERKEY)
+		}
+		prefix, _ := svc.GetStringConfiguration(ctx, CONF_DATA_ENCRYPTION_KEYPREFIX)
+		secrets, ok := ctx.GetServerElement(core.ServerElementSecretsManager).(components.SecretsManager)
+		if !ok {
+			return errors.MissingService(ctx, "SecretsManager")
+		}
+		svc.Keys = NewKeyRing(secrets, masterKey, prefix)
+	}
+	if _, err := svc.sealedFields(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sealedFields returns the encrypted fields of the entity the plugin stores.
+func (svc *EncryptionPlugin) sealedFields(c ctx.Context) ([]sealedField, error) {
+	factory := svc.PluginDataComponent.GetObjectFactory()
+	if factory == nil {
+		return nil, nil
+	}
+	stor, ok := factory.CreateObject(c).(core.Storable)
+	if !ok {
+		return nil, nil
+	}
+	return encryptedFields(c, stor)
+}
+
+// requestTenant returns the id of the request's tenant, or the empty string when it has none.
+func requestTenant(ctx core.RequestContext) string {
+	if tenant := ctx.GetTenant(); tenant != nil {
+		return tenant.GetTenantId()
+	}
+	return ""
+}
+
+// itemTenant returns the tenant whose keys encrypt item.
+func itemTenant(ctx core.RequestContext, item core.Storable) string {
+	if tenant, ok := tenantOfItem(item); ok && tenant != "" {
+		return tenant
+	}
+	return requestTenant(ctx)
+}
+
+// seal encrypts the encrypted fields of items in place, and returns their plaintext for restore.
+func (svc *EncryptionPlugin) seal(ctx core.RequestContext, items ...core.Storable) ([]restoreValue, error) {
+	fields, err := svc.sealedFields(ctx)
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	var restores []restoreValue
+	for _, item := range items {
+		tenant := itemTenant(ctx, item)
+		for _, field := range fields {
+			val, ok := field.value(item)
+			if field.BlindIndex != "" {
+				blind := ""
+				if ok {
+					if blind, err = svc.Keys.Blind(ctx.ServerContext(), tenant, field.Field, val); err != nil {
+						restore(restores)
+						return nil, err
+					}
+				}
+				field.setIndex(item, blind)
+			}
+			if !ok {
+				continue
+			}
+			sealed, err := svc.Keys.Seal(ctx.ServerContext(), tenant, field.Field, val)
+			if err != nil {
+				restore(restores)
+				return nil, err
+			}
+			field.set(item, sealed)
+			restores = append(restores, restoreValue{item: item, field: field, val: val})
+		}
+	}
+	return restores, nil
+}
+
+// restore puts back the plaintext of fields encrypted for a write.
+func restore(restores []restoreValue) {
+	for _, r := range restores {
+		r.field.set(r.item, r.val)
+	}
+}
+
+// seals reports whether newVals write an encrypted field.
+func (svc *EncryptionPlugin) seals(ctx core.RequestContext, newVals utils.StringMap) (bool, error) {
+	fields, err := svc.sealedFields(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, field := range fields {
+		if _, ok := newVals[field.Field]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// valuesTenant returns the tenant whose keys encrypt newVals written to a record stored with
+// tenant: the tenant newVals move it to, else tenant, else the request's tenant.
+func valuesTenant(ctx core.RequestContext, tenant string, newVals utils.StringMap) string {
+	if val, ok := newVals[FIELD_TENANTID].(string); ok && val != "" {
+		return val
+	}
+	if tenant != "" {
+		return tenant
+	}
+	return requestTenant(ctx)
+}
+
+// sealFor returns newVals encrypted for the stored records with ids, one write for each tenant
+// they are encrypted for. An id with no stored record is encrypted for the tenant of the record
+// newVals would create.
+func (svc *EncryptionPlugin) sealFor(ctx core.RequestContext, ids []string, newVals utils.StringMap) ([]sealedWrite, error) {
+	if ok, err := svc.seals(ctx, newVals); err != nil || !ok {
+		return []sealedWrite{{ids: ids, newVals: newVals}}, err
+	}
+	stored, err := svc.PluginDataComponent.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return nil, err
+	}
+	var writes []sealedWrite
+	tenants := map[string]int{}
+	for _, id := range ids {
+		stamped := ""
+		if item, ok := stored[id]; ok && item != nil {
+			stamped, _ = tenantOfItem(item)
+		}
+		tenant := valuesTenant(ctx, stamped, newVals)
+		i, ok := tenants[tenant]
+		if !ok {
+			sealed, err := svc.sealValues(ctx, tenant, newVals)
+			if err != nil {
+				return nil, err
+			}
+			i = len(writes)
+			tenants[tenant] = i
+			writes = append(writes, sealedWrite{newVals: sealed})
+		}
+		writes[i].ids = append(writes[i].ids, id)
+	}
+	return writes, nil
+}
+
+// updateSealed writes newVals to the records with ids, encrypted for each record's tenant, in one
+// transaction when they are of several, which joins the caller's when it has one open.
+func (svc *EncryptionPlugin) updateSealed(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	writes, err := svc.sealFor(ctx, ids, newVals)
+	if err != nil {
+		return err
+	}
+	if len(writes) == 1 {
+		return svc.PluginDataComponent.UpdateMulti(ctx, ids, writes[0].newVals)
+	}
+	return svc.PluginDataComponent.Transaction(ctx, func(txCtx core.RequestContext) error {
+		for _, write := range writes {
+			if err := svc.PluginDataComponent.UpdateMulti(txCtx, write.ids, write.newVals); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateMatching writes newVals to the records matching queryCond, encrypted for each record's
+// tenant. A write reaching the records of one tenant, or of none, is made by update with the values
+// encrypted for it; one reaching several is made by id for each tenant, in one transaction, which
+// joins the caller's when it has one open.
+func (svc *EncryptionPlugin) updateMatching(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool,
+	update func(ctx core.RequestContext, newVals utils.StringMap) ([]string, error)) ([]string, error) {
+	ok, err := svc.seals(ctx, newVals)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return update(ctx, newVals)
+	}
+	var updated []string
+	err = svc.PluginDataComponent.Transaction(ctx, func(txCtx core.RequestContext) error {
+		var ids []string
+		if queryCond != nil {
+			var err error
+			if _, ids, _, _, err = svc.PluginDataComponent.Get(txCtx, nil, queryCond, -1, 1, "", nil, ""); err != nil {
+				return err
+			}
+		}
+		writes, err := svc.sealFor(txCtx, ids, newVals)
+		if err != nil {
+			return err
+		}
+		if len(writes) > 1 {
+			for _, write := range writes {
+				if err := svc.PluginDataComponent.UpdateMulti(txCtx, write.ids, write.newVals); err != nil {
+					return err
+				}
+			}
+			if getids {
+				updated = ids
+			}
+			return nil
+		}
+		var sealed utils.StringMap
+		if len(writes) == 1 {
+			sealed = writes[0].newVals
+		} else if sealed, err = svc.sealValues(txCtx, valuesTenant(txCtx, "", newVals), newVals); err != nil {
+			return err
+		}
+		updated, err = update(txCtx, sealed)
+		return err
+	})
+	return updated, err
+}
+
+// sealValues returns newVals with the values of encrypted fields encrypted for a record of
+// tenant, and their blind indexes set.
+func (svc *EncryptionPlugin) sealValues(ctx core.RequestContext, tenant string, newVals utils.StringMap) (utils.StringMap, error) {
+	fields, err := svc.sealedFields(ctx)
+	if err != nil || len(fields) == 0 {
+		return newVals, err
+	}
+	var sealed utils.StringMap
+	for _, field := range fields {
+		raw, ok := newVals[field.Field]
+		if !ok {
+			continue
+		}
+		if sealed == nil {
+			sealed = make(utils.StringMap, len(newVals)+1)
+			for name, val := range newVals {
+				sealed[name] = val
+			}
+		}
+		var val string
+		switch v := raw.(type) {
+		case nil:
+		case string:
+			val = v
+		case *string:
+			if v != nil {
+				val = *v
+			}
+		default:
+			return nil, errors.BadArg(ctx, field.Field, slog.String("Object", svc.GetObject()))
+		}
+		if field.BlindIndex != "" {
+			blind := ""
+			if val != "" {
+				if blind, err = svc.Keys.Blind(ctx.ServerContext(), tenant, field.Field, val); err != nil {
+					return nil, err
+				}
+			}
+			sealed[field.BlindIndex] = blind
+		}
+		if val == "" {
+			continue
+		}
+		if sealed[field.Field], err = svc.Keys.Seal(ctx.ServerContext(), tenant, field.Field, val); err != nil {
+			return nil, err
+		}
+	}
+	if sealed == nil {
+		return newVals, nil
+	}
+	return sealed, nil
+}
+
+// open decrypts the encrypted fields of items in place.
+func (svc *EncryptionPlugin) open(ctx core.RequestContext, items ...core.Storable) error {
+	fields, err := svc.sealedFields(ctx)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		tenant, _ := tenantOfItem(item)
+		for _, field := range fields {
+			val, ok := field.value(item)
+			if !ok {
+				continue
+			}
+			plain, err := svc.Keys.Open(ctx.ServerContext(), tenant, field.Field, val)
+			if err != nil {
+				return err
+			}
+			field.set(item, plain)
+		}
+	}
+	return nil
+}
+
+// opened returns a decrypted copy of item, leaving item as it is.
+func (svc *EncryptionPlugin) opened(ctx core.RequestContext, item core.Storable) (core.Storable, error) {
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	copied, ok := svc.PluginDataComponent.GetObjectFactory().CreateObject(ctx).(core.Storable)
+	if !ok {
+		return nil, errors.TypeMismatch(ctx, slog.String("Object", svc.GetObject()))
+	}
+	if err := json.Unmarshal(encoded, copied); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	if err := svc.open(ctx, copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// blindQuery returns query with the comparisons of encrypted fields rewritten to compare their
+// blind indexes, and the parameters the blind indexes are bound with.
+func (svc *EncryptionPlugin) blindQuery(c ctx.Context, query *Query) (*Query, []blindParam, error) {
+	fields, err := svc.sealedFields(c)
+	if err != nil || len(fields) == 0 || query == nil {
+		return query, nil, err
+	}
+	rw := &blindRewriter{fields: make(map[string]sealedField, len(fields))}
+	for _, field := range fields {
+		rw.fields[field.Field] = field
+	}
+	for _, term := range query.OrderBy {
+		if _, ok := rw.fields[term.Field]; ok {
+			return nil, nil, errors.BadArg(c, "OrderBy", slog.String("Field", term.Field))
+		}
+	}
+	for _, group := range query.GroupBy {
+		if _, ok := rw.fields[group]; ok {
+			return nil, nil, errors.BadArg(c, "GroupBy", slog.String("Field", group))
+		}
+	}
+	for _, agg := range query.Aggregates {
+		if _, ok := rw.fields[agg.Field]; ok {
+			return nil, nil, errors.BadArg(c, "Aggregates", slog.String("Field", agg.Field))
+		}
+	}
+	rewritten := *query
+	if rewritten.Filter, err = rw.rewrite(c, query.Filter); err != nil {
+		return nil, nil, err
+	}
+	return &rewritten, rw.params, nil
+}
+
+// blindRewriter rewrites the predicates of a query comparing encrypted fields.
+type blindRewriter struct {
+	fields map[string]sealedField
+	params []blindParam
+}
+
+func (rw *blindRewriter) rewrite(c ctx.Context, predicate Predicate) (Predicate, error) {
+	switch node := predicate.(type) {
+	case *Logical:
+		operands := make([]Predicate, len(node.Operands))
+		for i, operand := range node.Operands {
+			rewritten, err := rw.rewrite(c, operand)
+			if err != nil {
+				return nil, err
+			}
+			operands[i] = rewritten
+		}
+		return &Logical{Optionality: node.Optionality, Operator: node.Operator, Operands: operands}, nil
+	case *Not:
+		operand, err := rw.rewrite(c, node.Operand)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Optionality: node.Optionality, Operand: operand}, nil
+	case *Comparison:
+		field, ok := rw.fields[node.Field]
+		if node.Value.Kind == OperandField {
+			if _, sealed := rw.fields[node.Value.Name]; ok || sealed {
+				return nil, errors.BadArg(c, node.Field, slog.String("Operand", node.Value.Name))
+			}
+			return node, nil
+		}
+		if !ok {
+			return node, nil
+		}
+		if field.BlindIndex == "" || (node.Operator != OpEqual && node.Operator != OpNotEqual) {
+			return nil, errors.BadArg(c, node.Field, slog.String("Operator", string(node.Operator)))
+		}
+		value := node.Value
+		if value.Kind != OperandLiteral || value.Value != nil {
+			value = rw.blind(field, value, false)
+		}
+		return &Comparison{Optionality: node.Optionality, Field: field.BlindIndex, Operator: node.Operator, Value: value}, nil
+	case *Membership:
+		field, ok := rw.fields[node.Field]
+		if !ok {
+			return node, nil
+		}
+		if field.BlindIndex == "" {
+			return nil, errors.BadArg(c, node.Field, slog.String("Predicate", string(node.Kind())))
+		}
+		values := make([]Operand, len(node.Values))
+		for i, value := range node.Values {
+			if value.Kind == OperandField {
+				return nil, errors.BadArg(c, node.Field, slog.String("Operand", value.Name))
+			}
+			values[i] = rw.blind(field, value, value.Kind == OperandParameter)
+		}
+		return &Membership{Optionality: node.Optionality, Field: field.BlindIndex, Values: values, Negated: node.Negated}, nil
+	case *FunctionCall:
+		if _, ok := rw.fields[node.Field]; ok {
+			return nil, errors.BadArg(c, node.Field, slog.String("Function", string(node.Function)))
+		}
+	}
+	return predicate, nil
+}
+
+// blind returns the parameter the blind index of source is bound to.
+func (rw *blindRewriter) blind(field sealedField, source Operand, list bool) Operand {
+	name := blindParamPrefix + strconv.Itoa(len(rw.params))
+	rw.params = append(rw.params, blindParam{name: name, field: field.Field, source: source, list: list})
+	return ParameterOperand(name)
+}
+
+// bindBlinds returns params with the blind indexes of the values the query compares bound. A
+// blind index whose value comes from a parameter that is not supplied is left unbound, so that an
+// optional comparison drops out.
+func (svc *EncryptionPlugin) bindBlinds(ctx core.RequestContext, blinds []blindParam, params utils.StringsMap) (utils.StringsMap, error) {
+	if len(blinds) == 0 {
+		return params, nil
+	}
+	tenant := requestTenant(ctx)
+	bound := make(utils.StringsMap, len(params)+len(blinds))
+	for name, val := range params {
+		bound[name] = val
+	}
+	for _, blind := range blinds {
+		var values []string
+		if blind.source.Kind == OperandLiteral {
+			values = []string{fmt.Sprint(blind.source.Value)}
+		} else {
+			val, ok := params[blind.source.Name]
+			if !ok {
+				continue
+			}
+			values = []string{val}
+			if blind.list {
+				list, err := paramList(ctx, blind.source.Name, val)
+				if err != nil {
+					return nil, err
+				}
+				values = list
+			}
+		}
+		hashes := make([]string, len(values))
+		for i, val := range values {
+			hash, err := svc.Keys.Blind(ctx.ServerContext(), tenant, blind.field, val)
+			if err != nil {
+				return nil, err
+			}
+			hashes[i] = hash
+		}
+		if !blind.list {
+			bound[blind.name] = hashes[0]
+			continue
+		}
+		encoded, err := json.Marshal(hashes)
+		if err != nil {
+			return nil, errors.WrapError(ctx, err)
+		}
+		bound[blind.name] = string(encoded)
+	}
+	return bound, nil
+}
+
+// paramList splits a list-valued parameter, given as a JSON array or comma separated text.
+func paramList(ctx core.RequestContext, name string, val string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(val), "[") {
+		parts := strings.Split(val, ",")
+		for i, part := range parts {
+			parts[i] = strings.TrimSpace(part)
+		}
+		return parts, nil
+	}
+	var list []interface{}
+	if err := json.Unmarshal([]byte(val), &list); err != nil {
+		return nil, errors.BadArg(ctx, name, slog.String("Error", err.Error()))
+	}
+	values := make([]string, len(list))
+	for i, item := range list {
+		values[i] = fmt.Sprint(item)
+	}
+	return values, nil
+}
+
+// ReEncrypt encrypts again every record whose encrypted fields are not encrypted with its tenant's
+// current key, or are not encrypted at all, and refreshes their blind indexes. It returns the
+// number of records it wrote. The current keys are read again from the secrets first, so that no
+// record is moved back to a key another instance has rotated from.
+func (svc *EncryptionPlugin) ReEncrypt(ctx core.RequestContext) (int, error) {
+	fields, err := svc.sealedFields(ctx)
+	if err != nil || len(fields) == 0 {
+		return 0, err
+	}
+	svc.Keys.Refresh()
+	it, err := svc.PluginDataComponent.Iterate(ctx, nil, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	written := 0
+	for it.Next() {
+		item := it.Item()
+		tenant := itemTenant(ctx, item)
+		current, err := svc.Keys.CurrentKey(ctx.ServerContext(), tenant)
+		if err != nil {
+			return written, err
+		}
+		newVals := utils.StringMap{}
+		for _, field := range fields {
+			val, ok := field.value(item)
+			if !ok {
+				continue
+			}
+			keyId, _, sealed := parseSealed(val)
+			stale := !sealed || keyId != current
+			if !stale && field.BlindIndex == "" {
+				continue
+			}
+			stamped, _ := tenantOfItem(item)
+			plain, err := svc.Keys.Open(ctx.ServerContext(), stamped, field.Field, val)
+			if err != nil {
+				return written, err
+			}
+			if stale {
+				if newVals[field.Field], err = svc.Keys.Seal(ctx.ServerContext(), tenant, field.Field, plain); err != nil {
+					return written, err
+				}
+			}
+			if field.BlindIndex != "" {
+				blind, err := svc.Keys.Blind(ctx.ServerContext(), tenant, field.Field, plain)
+				if err != nil {
+					return written, err
+				}
+				if stored, _ := FieldValue(item, field.BlindIndex); stored != blind {
+					newVals[field.BlindIndex] = blind
+				}
+			}
+		}
+		if len(newVals) == 0 {
+			continue
+		}
+		if err := svc.PluginDataComponent.Update(ctx, item.GetId(), newVals); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, it.Err()
+}
+
+func (svc *EncryptionPlugin) CreateCondition(ctx core.RequestContext, args utils.StringMap) (interface{}, error) {
+	return svc.CreateQueryCondition(ctx, NewEqualityQuery(args), nil)
+}
+
+func (svc *EncryptionPlugin) CreateQueryCondition(ctx core.RequestContext, query *Query, params utils.StringsMap) (interface{}, error) {
+	rewritten, blinds, err := svc.blindQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	bound, err := svc.bindBlinds(ctx, blinds, params)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.CreateQueryCondition(ctx, rewritten, bound)
+}
+
+func (svc *EncryptionPlugin) CompileQuery(ctx core.ServerContext, query *Query) (interface{}, error) {
+	rewritten, blinds, err := svc.blindQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := svc.PluginDataComponent.CompileQuery(ctx, rewritten)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedQuery{blinds: blinds, compiled: compiled}, nil
+}
+
+// bindQuery returns the query of the service underneath compiled, and params with its blind
+// indexes bound.
+func (svc *EncryptionPlugin) bindQuery(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (interface{}, utils.StringsMap, error) {
+	query, ok := compiled.(*encryptedQuery)
+	if !ok {
+		return nil, nil, errors.BadArg(ctx, "compiled")
+	}
+	bound, err := svc.bindBlinds(ctx, query.blinds, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query.compiled, bound, nil
+}
+
+func (svc *EncryptionPlugin) BindQuery(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (interface{}, error) {
+	query, bound, err := svc.bindQuery(ctx, compiled, params)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.BindQuery(ctx, query, bound)
+}
+
+func (svc *EncryptionPlugin) Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*QueryPage, error) {
+	query, bound, err := svc.bindQuery(ctx, compiled, params)
+	if err != nil {
+		return nil, err
+	}
+	page, err := svc.PluginDataComponent.Query(ctx, query, bound)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.open(ctx, page.Items...); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (svc *EncryptionPlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	restores, err := svc.seal(ctx, item)
+	if err != nil {
+		return err
+	}
+	defer restore(restores)
+	return svc.PluginDataComponent.Save(ctx, item)
+}
+
+func (svc *EncryptionPlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	restores, err := svc.seal(ctx, item)
+	if err != nil {
+		return err
+	}
+	defer restore(restores)
+	return svc.PluginDataComponent.Put(ctx, id, item)
+}
+
+func (svc *EncryptionPlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	restores, err := svc.seal(ctx, items...)
+	if err != nil {
+		return err
+	}
+	defer restore(restores)
+	return svc.PluginDataComponent.PutMulti(ctx, items)
+}
+
+func (svc *EncryptionPlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	restores, err := svc.seal(ctx, items...)
+	if err != nil {
+		return err
+	}
+	defer restore(restores)
+	return svc.PluginDataComponent.CreateMulti(ctx, items)
+}
+
+func (svc *EncryptionPlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	writes, err := svc.sealFor(ctx, []string{id}, newVals)
+	if err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.UpsertId(ctx, id, writes[0].newVals)
+}
+
+func (svc *EncryptionPlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	writes, err := svc.sealFor(ctx, []string{id}, newVals)
+	if err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.Update(ctx, id, writes[0].newVals)
+}
+
+func (svc *EncryptionPlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	return svc.updateSealed(ctx, ids, newVals)
+}
+
+func (svc *EncryptionPlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return svc.updateMatching(ctx, queryCond, newVals, getids, func(ctx core.RequestContext, sealed utils.StringMap) ([]string, error) {
+		return svc.PluginDataComponent.Upsert(ctx, queryCond, sealed, getids)
+	})
+}
+
+func (svc *EncryptionPlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return svc.updateMatching(ctx, queryCond, newVals, getids, func(ctx core.RequestContext, sealed utils.StringMap) ([]string, error) {
+		return svc.PluginDataComponent.UpdateAll(ctx, queryCond, sealed, getids)
+	})
+}
+
+func (svc *EncryptionPlugin) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	item, err := svc.PluginDataComponent.GetById(ctx, id, dao)
+	if err != nil {
+		return nil, err
+	}
+	return item, svc.open(ctx, item)
+}
+
+func (svc *EncryptionPlugin) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	items, err := svc.PluginDataComponent.GetMulti(ctx, props, ids, orderBy, dao)
+	if err != nil {
+		return nil, err
+	}
+	return items, svc.open(ctx, items...)
+}
+
+func (svc *EncryptionPlugin) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	items, err := svc.PluginDataComponent.GetMultiHash(ctx, props, ids, dao)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := svc.open(ctx, item); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (svc *EncryptionPlugin) Get(ctx core.RequestContext, props []string, queryCond interface{}, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	items, ids, total, count, err := svc.PluginDataComponent.Get(ctx, props, queryCond, pageSize, pageNum, mode, orderBy, dao)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return items, ids, total, count, svc.open(ctx, items...)
+}
+
+func (svc *EncryptionPlugin) GetOne(ctx core.RequestContext, props []string, queryCond interface{}, dao string) (core.Storable, error) {
+	item, err := svc.PluginDataComponent.GetOne(ctx, props, queryCond, dao)
+	if err != nil {
+		return nil, err
+	}
+	return item, svc.open(ctx, item)
+}
+
+func (svc *EncryptionPlugin) GetList(ctx core.RequestContext, props []string, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	items, ids, total, count, err := svc.PluginDataComponent.GetList(ctx, props, pageSize, pageNum, mode, orderBy, dao)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return items, ids, total, count, svc.open(ctx, items...)
+}
+
+func (svc *EncryptionPlugin) ListDeleted(ctx core.RequestContext, props []string, pageSize int, pageNum int, orderBy []string) ([]core.Storable, []string, int, int, error) {
+	items, ids, total, count, err := svc.PluginDataComponent.ListDeleted(ctx, props, pageSize, pageNum, orderBy)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return items, ids, total, count, svc.open(ctx, items...)
+}
+
+func (svc *EncryptionPlugin) GetAsOf(ctx core.RequestContext, id string, at time.Time) (core.Storable, error) {
+	item, err := svc.PluginDataComponent.GetAsOf(ctx, id, at)
+	if err != nil {
+		return nil, err
+	}
+	return item, svc.open(ctx, item)
+}
+
+func (svc *EncryptionPlugin) GetRevisions(ctx core.RequestContext, id string) ([]Revision, error) {
+	revs, err := svc.PluginDataComponent.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, rev := range revs {
+		if err := svc.open(ctx, rev.Item); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
+
+func (svc *EncryptionPlugin) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (StorableIterator, error) {
+	it, err := svc.PluginDataComponent.Iterate(ctx, props, queryCond, orderBy, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	return &openingIterator{StorableIterator: it, ctx: ctx, plugin: svc}, nil
+}
+
+func (svc *EncryptionPlugin) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]VectorResult, error) {
+	results, err := svc.PluginDataComponent.VectorSearch(ctx, vector, limit, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range results {
+		if err := svc.open(ctx, res.Item); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Subscribe hands handler the records of data events decrypted. The record an event carries is
+// copied before it is decrypted, as it may be the one the service underneath holds.
+func (svc *EncryptionPlugin) Subscribe(ctx core.RequestContext, obj string, eventType DataEventType, handler core.MessageListener) error {
+	return svc.PluginDataComponent.Subscribe(ctx, obj, eventType, func(ctx core.RequestContext, message *core.Message, info utils.StringMap) error {
+		item, ok := message.Data.(core.Storable)
+		if !ok {
+			return handler(ctx, message, info)
+		}
+		opened, err := svc.opened(ctx, item)
+		if err != nil {
+			return err
+		}
+		msg := *message
+		msg.Data = opened
+		return handler(ctx, &msg, info)
+	})
+}
+
+// openingIterator decrypts the records an iterator of the service underneath walks.
+type openingIterator struct {
+	StorableIterator
+	ctx    core.RequestContext
+	plugin *EncryptionPlugin
+	err    error
+}
+
+func (it *openingIterator) Next() bool {
+	if it.err != nil || !it.StorableIterator.Next() {
+		return false
+	}
+	if it.err = it.plugin.open(it.ctx, it.StorableIterator.Item()); it.err != nil {
+		return false
+	}
+	return true
+}
+
+func (it *openingIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.StorableIterator.Err()
+}
@@ -0,0 +1,345 @@
+package data_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+type contact struct {
+	data.StorageInfo
+	data.TenantInfo
+	Email      string  `json:"Email" encrypt:"EmailIndex"`
+	EmailIndex string  `json:"EmailIndex"`
+	Notes      *string `json:"Notes" encrypt:""`
+}
+
+func (c *contact) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "contact", Collection: "contact"}
+}
+
+func (c *contact) ReadAll(cx ctx.Context, cdc datatypes.Codec, rdr datatypes.SerializableReader) error {
+	if err := c.TenantInfo.ReadAll(cx, cdc, rdr); err != nil {
+		return err
+	}
+	return c.StorageInfo.ReadAll(cx, cdc, rdr)
+}
+
+func (c *contact) WriteAll(cx ctx.Context, cdc datatypes.Codec, wtr datatypes.SerializableWriter) error {
+	if err := c.TenantInfo.WriteAll(cx, cdc, wtr); err != nil {
+		return err
+	}
+	return c.StorageInfo.WriteAll(cx, cdc, wtr)
+}
+
+type secretStore map[string][]byte
+
+func (s secretStore) Get(ctx core.ServerContext, key string) ([]byte, bool, error) {
+	val, ok := s[key]
+	return val, ok, nil
+}
+
+func (s secretStore) Put(ctx core.ServerContext, key string, val []byte) error {
+	s[key] = val
+	return nil
+}
+
+// racingSecrets hides the current key of a tenant from the reads numbered in hidden, as though
+// they had been made before another instance wrote it.
+type racingSecrets struct {
+	secretStore
+	reads  int
+	hidden map[int]bool
+}
+
+func (s *racingSecrets) Get(ctx core.ServerContext, key string) ([]byte, bool, error) {
+	if strings.HasSuffix(key, "/current") {
+		s.reads++
+		if s.hidden[s.reads] {
+			return nil, false, nil
+		}
+	}
+	return s.secretStore.Get(ctx, key)
+}
+
+func TestKeyRingRace(t *testing.T) {
+	server := datatest.NewServerContext()
+	// the second instance reads that there is no key before the first has made its own current
+	secrets := &racingSecrets{secretStore: secretStore{"master": []byte("correct horse battery staple")}, hidden: map[int]bool{1: true, 3: true}}
+	first, second := data.NewKeyRing(secrets, "master", ""), data.NewKeyRing(secrets, "master", "")
+	sealed, err := first.Seal(server, "acme", "Email", "a@example.com")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if _, err = second.Seal(server, "acme", "Email", "b@example.com"); err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	firstKey, _ := first.CurrentKey(server, "acme")
+	secondKey, _ := second.CurrentKey(server, "acme")
+	if firstKey == secondKey || !strings.HasPrefix(firstKey, "acme/1-") || !strings.HasPrefix(secondKey, "acme/1-") {
+		t.Errorf("the instances made keys %q and %q", firstKey, secondKey)
+	}
+	if plain, err := data.NewKeyRing(secrets, "master", "").Open(server, "acme", "Email", sealed); err != nil || plain != "a@example.com" {
+		t.Errorf("what the first instance encrypted cannot be read: %q %v", plain, err)
+	}
+	if key, _ := data.NewKeyRing(secrets, "master", "").CurrentKey(server, "acme"); key != secondKey {
+		t.Errorf("the key current is %q, want the last named %q", key, secondKey)
+	}
+	blind, _ := first.Blind(server, "acme", "Email", "a@example.com")
+	if other, _ := second.Blind(server, "acme", "Email", "a@example.com"); other != blind {
+		t.Errorf("the instances hold different blind index keys")
+	}
+}
+
+// scopedContact is a contact its store scopes by tenant.
+type scopedContact struct {
+	contact
+}
+
+func (c *scopedContact) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "contact", Collection: "contact", Multitenant: true}
+}
+
+func TestEncryptionPlugin(t *testing.T) {
+	notes := "prefers email"
+	// setup stores contacts a, with notes, and b through the plugin for acme
+	setup := func(t *testing.T) (*data.EncryptionPlugin, data.DataComponent, *datatest.RequestContext, *contact, *contact) {
+		t.Helper()
+		server := datatest.NewServerContext()
+		acme := datatest.NewRequestContext(server, "u1", "acme")
+		base := memory.NewMemoryDataComponentForObject(server, "contact", datatest.EntityFactory[contact]{})
+		svc := data.NewEncryptionPluginWithBase(server, base, data.NewKeyRing(secretStore{"master": []byte("correct horse battery staple")}, "master", ""))
+		a, b := &contact{Email: "a@example.com", Notes: &notes}, &contact{Email: "b@example.com"}
+		for _, item := range []*contact{a, b} {
+			if err := svc.Save(acme, item); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		return svc, base, acme, a, b
+	}
+	raw := func(t *testing.T, base data.DataComponent, c core.RequestContext, id string) *contact {
+		t.Helper()
+		item, err := base.GetById(c, id, "")
+		if err != nil {
+			t.Fatalf("GetById: %v", err)
+		}
+		return item.(*contact)
+	}
+	count := func(t *testing.T, svc data.DataComponent, c core.RequestContext, email string) int {
+		t.Helper()
+		cond, err := svc.CreateCondition(c, utils.StringMap{"Email": email})
+		if err != nil {
+			t.Fatalf("CreateCondition: %v", err)
+		}
+		n, err := svc.Count(c, cond)
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		return n
+	}
+
+	t.Run("writes and reads", func(t *testing.T) {
+		svc, base, acme, a, _ := setup(t)
+		if a.Email != "a@example.com" || *a.Notes != notes {
+			t.Errorf("the saved item was left encrypted: %q %q", a.Email, *a.Notes)
+		}
+		if stored := raw(t, base, acme, a.Id); !strings.HasPrefix(stored.Email, "enc:v1:acme/1-") || strings.HasPrefix(*stored.Notes, notes) || stored.EmailIndex == "" {
+			t.Errorf("stored in the clear: %+v", stored)
+		}
+		if item, err := svc.GetById(acme, a.Id, ""); err != nil || item.(*contact).Email != "a@example.com" || *item.(*contact).Notes != notes {
+			t.Errorf("GetById was not decrypted: %+v %v", item, err)
+		}
+	})
+
+	t.Run("conditions", func(t *testing.T) {
+		svc, _, acme, _, _ := setup(t)
+		if n := count(t, svc, acme, "a@example.com"); n != 1 {
+			t.Errorf("equality on an encrypted field counts %d", n)
+		}
+		query := data.NewShapedQuery()
+		query.Filter = &data.Membership{Field: "Email", Values: []data.Operand{data.ParameterOperand("emails")}}
+		compiled, err := svc.CompileQuery(acme.ServerContext(), query)
+		if err != nil {
+			t.Fatalf("CompileQuery: %v", err)
+		}
+		page, err := svc.Query(acme, compiled, utils.StringsMap{"emails": `["a@example.com","b@example.com"]`})
+		if err != nil || page.Total != 2 {
+			t.Fatalf("membership on an encrypted field: %v %v", page, err)
+		}
+		for _, item := range page.Items {
+			if strings.HasPrefix(item.(*contact).Email, "enc:") {
+				t.Errorf("Query was not decrypted: %q", item.(*contact).Email)
+			}
+		}
+		query = data.NewQuery()
+		query.Filter = &data.Comparison{Field: "Email", Operator: data.OpGreater, Value: data.LiteralOperand("a")}
+		if _, err = svc.CreateQueryCondition(acme, query, nil); !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) {
+			t.Errorf("ordering an encrypted field: want bad argument, got %v", err)
+		}
+	})
+
+	// another tenant's blind index does not match, whether the store scopes the records by tenant or
+	// is shared by tenants and leaves them to the blind index to tell apart
+	for _, tc := range []struct {
+		name    string
+		factory core.ObjectFactory
+		contact func(email string) core.Storable
+		shared  bool
+	}{
+		{"tenants of a scoped store", datatest.EntityFactory[scopedContact]{}, func(email string) core.Storable {
+			return &scopedContact{contact{Email: email}}
+		}, false},
+		{"tenants of a shared store", datatest.EntityFactory[contact]{}, func(email string) core.Storable {
+			return &contact{Email: email}
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := datatest.NewServerContext()
+			acme := datatest.NewRequestContext(server, "u1", "acme")
+			globex := datatest.NewRequestContext(server, "u2", "globex")
+			base := memory.NewMemoryDataComponentForObject(server, "contact", tc.factory)
+			svc := data.NewEncryptionPluginWithBase(server, base, data.NewKeyRing(secretStore{"master": []byte("correct horse battery staple")}, "master", ""))
+			item := tc.contact("a@example.com")
+			if err := svc.Save(acme, item); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			if _, err := base.GetById(globex, item.GetId(), ""); (err == nil) != tc.shared {
+				t.Fatalf("globex reading acme's record from the store: %v", err)
+			}
+			if n := count(t, svc, acme, "a@example.com"); n != 1 {
+				t.Errorf("acme's blind index matched %d", n)
+			}
+			if n := count(t, svc, globex, "a@example.com"); n != 0 {
+				t.Errorf("another tenant's blind index matched %d", n)
+			}
+		})
+	}
+
+	t.Run("updates", func(t *testing.T) {
+		svc, base, acme, _, b := setup(t)
+		if err := svc.Update(acme, b.Id, utils.StringMap{"Email": "c@example.com"}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if stored := raw(t, base, acme, b.Id); !strings.HasPrefix(stored.Email, "enc:") || count(t, svc, acme, "c@example.com") != 1 || count(t, svc, acme, "b@example.com") != 0 {
+			t.Errorf("Update was not encrypted and indexed: %+v", stored)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		svc, base, acme, a, _ := setup(t)
+		job := data.NewKeyRotationJobWithPlugins(acme.ServerContext(), svc)
+		report, err := job.Run(acme, nil, true)
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if !strings.HasPrefix(report.Keys["acme"], "acme/2-") || report.ReEncrypted["contact"] != 2 {
+			t.Errorf("rotation reported %+v", report)
+		}
+		if stored := raw(t, base, acme, a.Id); !strings.HasPrefix(stored.Email, "enc:v1:"+report.Keys["acme"]+":") {
+			t.Errorf("not re-encrypted with the current key: %q", stored.Email)
+		}
+		if n := count(t, svc, acme, "a@example.com"); n != 1 {
+			t.Errorf("the blind index did not survive rotation: %d", n)
+		}
+		if report, err = job.Run(acme, nil, false); err != nil || report.ReEncrypted["contact"] != 0 {
+			t.Errorf("re-encrypting records already current: %+v %v", report, err)
+		}
+	})
+
+	// a system request's write is encrypted for each record's own tenant, and a value copied from
+	// acme's record into globex's cannot be read there
+	t.Run("system writes", func(t *testing.T) {
+		svc, base, acme, a, _ := setup(t)
+		system := core.NewSystemRequest(acme.ServerContext(), "Notes", nil, nil, nil)
+		g := &contact{Email: "g@example.com", TenantInfo: data.TenantInfo{TenantId: "globex"}}
+		if err := svc.Save(system, g); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		all, _ := svc.CreateQueryCondition(system, data.NewQuery(), nil)
+		if ids, err := svc.UpdateAll(system, all, utils.StringMap{"Notes": "shared"}, true); err != nil || len(ids) != 3 {
+			t.Fatalf("UpdateAll: %v %v", ids, err)
+		}
+		if stored := raw(t, base, system, g.Id); !strings.HasPrefix(*stored.Notes, "enc:v1:globex/") {
+			t.Errorf("globex's record was encrypted for another tenant: %q", *stored.Notes)
+		}
+		for _, id := range []string{a.Id, g.Id} {
+			if item, err := svc.GetById(system, id, ""); err != nil || *item.(*contact).Notes != "shared" {
+				t.Errorf("GetById after UpdateAll: %+v %v", item, err)
+			}
+		}
+		if err := base.Update(system, g.Id, utils.StringMap{"Email": raw(t, base, system, a.Id).Email}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if _, err := svc.GetById(system, g.Id, ""); !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) {
+			t.Errorf("reading another tenant's value: want bad argument, got %v", err)
+		}
+	})
+}
+
+func TestEncryptionPluginInTransaction(t *testing.T) {
+	server := datatest.NewServerContext()
+	base := memory.NewMemoryDataComponentForObject(server, "contact", datatest.EntityFactory[contact]{})
+	svc := data.NewEncryptionPluginWithBase(server, base, data.NewKeyRing(secretStore{"master": []byte("correct horse battery staple")}, "master", ""))
+	system := core.NewSystemRequest(server, "Contacts", nil, nil, nil)
+	a := &contact{Email: "a@example.com", TenantInfo: data.TenantInfo{TenantId: "acme"}}
+	g := &contact{Email: "g@example.com", TenantInfo: data.TenantInfo{TenantId: "globex"}}
+	for _, item := range []*contact{a, g} {
+		if err := svc.Save(system, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	// writes reaching the records of several tenants join the caller's transaction
+	writes := []struct {
+		name  string
+		write func(tx core.RequestContext) error
+	}{
+		{"Update", func(tx core.RequestContext) error {
+			return svc.Update(tx, a.Id, utils.StringMap{"Notes": "one"})
+		}},
+		{"UpdateMulti", func(tx core.RequestContext) error {
+			return svc.UpdateMulti(tx, []string{a.Id, g.Id}, utils.StringMap{"Notes": "multi"})
+		}},
+		{"UpdateAll", func(tx core.RequestContext) error {
+			all, _ := svc.CreateQueryCondition(tx, data.NewQuery(), nil)
+			_, err := svc.UpdateAll(tx, all, utils.StringMap{"Notes": "all"}, true)
+			return err
+		}},
+		{"Upsert", func(tx core.RequestContext) error {
+			all, _ := svc.CreateQueryCondition(tx, data.NewQuery(), nil)
+			_, err := svc.Upsert(tx, all, utils.StringMap{"Notes": "upsert"}, true)
+			return err
+		}},
+	}
+	for _, tc := range writes {
+		t.Run(tc.name, func(t *testing.T) {
+			done := make(chan error)
+			go func() {
+				done <- svc.Transaction(system, tc.write)
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Transaction: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s inside a transaction did not return", tc.name)
+			}
+			if item, err := svc.GetById(system, a.Id, ""); err != nil || item.(*contact).Notes == nil {
+				t.Errorf("GetById after %s: %+v %v", tc.name, item, err)
+			}
+		})
+	}
+	if item, _ := base.GetById(system, g.Id, ""); !strings.HasPrefix(*item.(*contact).Notes, "enc:v1:globex/") {
+		t.Errorf("globex's record was not encrypted for it: %q", *item.(*contact).Notes)
+	}
+}
@@ -9,6 +9,10 @@ const (
 	DATA_ERROR_OPERATION       = "Data_Error_Operation"
 	DATA_ERROR_NOT_IMPLEMENTED = "Data_Error_Not_Implemented"
 	DATA_ERROR_ID_NOT_FOUND    = "Data_Error_ID_Not_Found"
+	// DATA_ERROR_MIGRATION_LOCKED is raised by a migration of a module another instance is migrating.
+	DATA_ERROR_MIGRATION_LOCKED = "Data_Error_Migration_Locked"
+	// DATA_ERROR_DUPLICATE is raised by a write that would break a unique index.
+	DATA_ERROR_DUPLICATE = "Data_Error_Duplicate"
 )
 
 func init() {
@@ -16,4 +20,6 @@ func init() {
 	errors.RegisterCode(DATA_ERROR_NOT_IMPLEMENTED, "Method not implemented for the service.")
 	errors.RegisterCode(DATA_ERROR_OPERATION, "Error occured while executing a database operation.")
 	errors.RegisterCode(DATA_ERROR_ID_NOT_FOUND, "Id not provided for the entity.")
+	errors.RegisterCode(DATA_ERROR_MIGRATION_LOCKED, "Another instance is migrating the module.")
+	errors.RegisterCode(DATA_ERROR_DUPLICATE, "A record with the same unique key already exists.")
 }
@@ -0,0 +1,552 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// The evaluator below is the reference semantics of a predicate tree. It runs a filter against an
+// object in memory — a cache hit to post-filter, a data event to check against a subscription, or
+// the rows a provider fetched with the part of a filter it could compile natively — so that every
+// such caller treats null, missing fields and mismatched types the same way.
+//
+// A field that does not exist on the object, or holds a nil pointer, slice, map or interface, is
+// null: it equals only a null operand, is unequal to everything else, and is neither greater nor
+// less than anything. An operand is coerced to the type of the field it is compared with, since
+// parameters always arrive as strings and literals are often a different width of number.
+//
+// A collection field is compared element by element, as Validate expects: Tags eq 'a' holds when
+// any element of Tags is 'a', and so do the other comparisons and membership, while Tags ne 'a' and
+// a negated membership hold when no element would match them unnegated.
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Evaluate reports whether item satisfies predicate, with params supplying the parameter operands.
+// item is a struct, a map with string keys such as utils.StringMap, or a pointer to either. A nil
+// predicate is unconstrained and accepts every item.
+//
+// The predicate is evaluated as it stands; optional predicates are not elided here, so a caller
+// holding an unresolved filter uses Query.Matches instead. An extension is run by the evaluator
+// registered for it with RegisterExtension, and one with none is an error.
+func Evaluate(ctx ctx.Context, predicate Predicate, item interface{}, params utils.StringsMap) (bool, error) {
+	if predicate == nil {
+		return true, nil
+	}
+	return evaluator{params: params}.evaluate(ctx, predicate, reflect.ValueOf(item))
+}
+
+// Matches resolves the query against params and reports whether item satisfies what remains of
+// its filter. A required parameter that is not supplied is an error.
+func (q *Query) Matches(ctx ctx.Context, item interface{}, params utils.StringsMap) (bool, error) {
+	resolved := q.Resolve(params)
+	for _, name := range resolved.Parameters() {
+		if _, ok := params[name]; !ok {
+			return false, errors.MissingArg(ctx, name)
+		}
+	}
+	return Evaluate(ctx, resolved.Filter, item, params)
+}
+
+// FieldValue returns the value at a dotted field path in item, and false when the path does not
+// exist or ends in a null. Struct fields are matched by Go name and then by json tag.
+func FieldValue(item interface{}, path string) (interface{}, bool) {
+	val, ok := lookupField(reflect.ValueOf(item), path)
+	if !ok {
+		return nil, false
+	}
+	return val.Interface(), true
+}
+
+// CompareValues orders a field's non-null value against an operand coerced to the field's type,
+// returning a negative number, zero or a positive number. Strings, numbers of any width, booleans
+// and times are coerced; anything else is equal only when deeply equal and otherwise ordered by
+// its printed form.
+func CompareValues(ctx ctx.Context, field string, value interface{}, operand interface{}) (int, error) {
+	return compareValues(ctx, field, indirect(reflect.ValueOf(value)), operand)
+}
+
+// AsFloat converts a number of any width, or text holding one, to a float64.
+func AsFloat(value interface{}) (float64, error) {
+	if text, ok := value.(string); ok {
+		return strconv.ParseFloat(text, 64)
+	}
+	val := indirect(reflect.ValueOf(value))
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return floatValue(val), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// evaluator carries the bound parameters through one evaluation.
+type evaluator struct {
+	params utils.StringsMap
+}
+
+func (ev evaluator) evaluate(ctx ctx.Context, predicate Predicate, item reflect.Value) (bool, error) {
+	switch node := predicate.(type) {
+	case *Comparison:
+		fieldVal, ok := lookupField(item, node.Field)
+		operand, isNull, err := ev.operandValue(ctx, node.Value, item)
+		if err != nil {
+			return false, err
+		}
+		if !ok || isNull {
+			bothNull := !ok && isNull
+			switch node.Operator {
+			case OpEqual:
+				return bothNull, nil
+			case OpNotEqual:
+				return !bothNull, nil
+			}
+			return false, nil
+		}
+		elems, collection := elements(fieldVal)
+		if !collection {
+			return compareOperator(ctx, node.Field, node.Operator, fieldVal, operand)
+		}
+		operator := node.Operator
+		if operator == OpNotEqual {
+			operator = OpEqual
+		}
+		for _, elem := range elems {
+			match, err := compareOperator(ctx, node.Field, operator, elem, operand)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				return node.Operator != OpNotEqual, nil
+			}
+		}
+		return node.Operator == OpNotEqual, nil
+	case *Logical:
+		for _, operand := range node.Operands {
+			res, err := ev.evaluate(ctx, operand, item)
+			if err != nil {
+				return false, err
+			}
+			if node.Operator == LogicalOr && res {
+				return true, nil
+			}
+			if node.Operator == LogicalAnd && !res {
+				return false, nil
+			}
+		}
+		return node.Operator == LogicalAnd, nil
+	case *Not:
+		res, err := ev.evaluate(ctx, node.Operand, item)
+		return !res, err
+	case *Membership:
+		fieldVal, ok := lookupField(item, node.Field)
+		if !ok {
+			return node.Negated, nil
+		}
+		elems, collection := elements(fieldVal)
+		if !collection {
+			elems = []reflect.Value{fieldVal}
+		}
+		for _, value := range node.Values {
+			candidates, err := ev.operandValues(ctx, value, item)
+			if err != nil {
+				return false, err
+			}
+			for _, candidate := range candidates {
+				for _, elem := range elems {
+					res, err := compareValues(ctx, node.Field, elem, candidate)
+					if err != nil {
+						return false, err
+					}
+					if res == 0 {
+						return !node.Negated, nil
+					}
+				}
+			}
+		}
+		return node.Negated, nil
+	case *NullTest:
+		_, ok := lookupField(item, node.Field)
+		return ok == node.Negated, nil
+	case *FunctionCall:
+		if len(node.Arguments) != 1 {
+			return false, errors.BadArg(ctx, "Arguments", slog.String("Function", string(node.Function)))
+		}
+		fieldVal, ok := lookupField(item, node.Field)
+		if !ok {
+			return false, nil
+		}
+		operand, isNull, err := ev.operandValue(ctx, node.Arguments[0], item)
+		if err != nil || isNull {
+			return false, err
+		}
+		text, arg := fmt.Sprint(fieldVal.Interface()), fmt.Sprint(operand)
+		switch node.Function {
+		case FuncContains:
+			return strings.Contains(text, arg), nil
+		case FuncStartsWith:
+			return strings.HasPrefix(text, arg), nil
+		case FuncEndsWith:
+			return strings.HasSuffix(text, arg), nil
+		}
+	case *Extension:
+		if evaluator, ok := LookupExtension(node.Namespace, node.Name); ok {
+			var val interface{}
+			if item.IsValid() && item.CanInterface() {
+				val = item.Interface()
+			}
+			return evaluator(ctx, node, val, ev.params)
+		}
+		return false, errors.BadArg(ctx, "Extension", slog.String("Namespace", node.Namespace), slog.String("Name", node.Name))
+	}
+	return false, errors.BadArg(ctx, "Predicate", slog.String("Kind", string(predicate.Kind())))
+}
+
+// operandValue returns the value an operand stands for, and whether it is null.
+func (ev evaluator) operandValue(ctx ctx.Context, operand Operand, item reflect.Value) (interface{}, bool, error) {
+	switch operand.Kind {
+	case OperandLiteral:
+		return operand.Value, operand.Value == nil, nil
+	case OperandParameter:
+		val, ok := ev.params[operand.Name]
+		if !ok {
+			return nil, false, errors.MissingArg(ctx, operand.Name)
+		}
+		return val, false, nil
+	case OperandField:
+		fieldVal, ok := lookupField(item, operand.Name)
+		if !ok {
+			return nil, true, nil
+		}
+		return fieldVal.Interface(), false, nil
+	}
+	return nil, false, errors.BadArg(ctx, "Operand", slog.String("Kind", string(operand.Kind)))
+}
+
+// operandValues expands a membership operand into the values it stands for. A parameter supplies
+// a list either as a JSON array or as comma separated text, since parameters arrive as strings.
+func (ev evaluator) operandValues(ctx ctx.Context, operand Operand, item reflect.Value) ([]interface{}, error) {
+	val, isNull, err := ev.operandValue(ctx, operand, item)
+	if err != nil || isNull {
+		return nil, err
+	}
+	if operand.Kind == OperandParameter {
+		text := val.(string)
+		if strings.HasPrefix(strings.TrimSpace(text), "[") {
+			var list []interface{}
+			if err := json.Unmarshal([]byte(text), &list); err != nil {
+				return nil, errors.BadArg(ctx, operand.Name, slog.String("Error", err.Error()))
+			}
+			return list, nil
+		}
+		parts := strings.Split(text, ",")
+		list := make([]interface{}, len(parts))
+		for i, part := range parts {
+			list[i] = strings.TrimSpace(part)
+		}
+		return list, nil
+	}
+	listVal := reflect.ValueOf(val)
+	if listVal.Kind() == reflect.Slice && listVal.Type().Elem().Kind() != reflect.Uint8 {
+		list := make([]interface{}, listVal.Len())
+		for i := range list {
+			list[i] = listVal.Index(i).Interface()
+		}
+		return list, nil
+	}
+	return []interface{}{val}, nil
+}
+
+// lookupField follows a dotted path through an object, returning false when the path does not
+// exist or ends in a null. A path that passes through a collection is followed into each of its
+// elements, and ends in the collection of the values it reaches, which is null when it reaches
+// none.
+func lookupField(item reflect.Value, path string) (reflect.Value, bool) {
+	current := item
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		current = indirect(current)
+		if !current.IsValid() {
+			return current, false
+		}
+		if elems, ok := elements(current); ok {
+			rest := strings.Join(names[i:], ".")
+			var vals []interface{}
+			for _, elem := range elems {
+				if val, ok := lookupField(elem, rest); ok {
+					vals = append(vals, val.Interface())
+				}
+			}
+			return reflect.ValueOf(vals), vals != nil
+		}
+		switch current.Kind() {
+		case reflect.Struct:
+			field := current.FieldByName(name)
+			if !field.IsValid() {
+				field = fieldByJSONName(current, name)
+			}
+			current = field
+		case reflect.Map:
+			if current.Type().Key().Kind() != reflect.String {
+				return reflect.Value{}, false
+			}
+			current = current.MapIndex(reflect.ValueOf(name).Convert(current.Type().Key()))
+		default:
+			return reflect.Value{}, false
+		}
+	}
+	current = indirect(current)
+	if !current.IsValid() {
+		return current, false
+	}
+	if (current.Kind() == reflect.Slice || current.Kind() == reflect.Map) && current.IsNil() {
+		return current, false
+	}
+	return current, true
+}
+
+// indirect follows pointers and interfaces, returning an invalid value at a nil.
+func indirect(val reflect.Value) reflect.Value {
+	for val.IsValid() && (val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface) {
+		if val.IsNil() {
+			return reflect.Value{}
+		}
+		val = val.Elem()
+	}
+	return val
+}
+
+// fieldByJSONName finds a field by its json tag, for the few fields whose stored name differs
+// from their Go name.
+func fieldByJSONName(val reflect.Value, name string) reflect.Value {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		tag := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if tag == name {
+			return val.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// compareOperator reports whether a field's non-null value stands in relation operator to operand.
+func compareOperator(ctx ctx.Context, field string, operator CompareOperator, fieldVal reflect.Value, operand interface{}) (bool, error) {
+	res, err := compareValues(ctx, field, fieldVal, operand)
+	if err != nil {
+		return false, err
+	}
+	switch operator {
+	case OpEqual:
+		return res == 0, nil
+	case OpNotEqual:
+		return res != 0, nil
+	case OpGreater:
+		return res > 0, nil
+	case OpGreaterEqual:
+		return res >= 0, nil
+	case OpLess:
+		return res < 0, nil
+	case OpLessEqual:
+		return res <= 0, nil
+	}
+	return false, errors.BadArg(ctx, field, slog.String("Operator", string(operator)))
+}
+
+// elements returns the non-null elements of a collection field, and false when the field is not a
+// collection. A byte slice is a single value rather than a collection.
+func elements(val reflect.Value) ([]reflect.Value, bool) {
+	if (val.Kind() != reflect.Slice && val.Kind() != reflect.Array) || val.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	elems := make([]reflect.Value, 0, val.Len())
+	for i := 0; i < val.Len(); i++ {
+		if elem := indirect(val.Index(i)); elem.IsValid() {
+			elems = append(elems, elem)
+		}
+	}
+	return elems, true
+}
+
+func compareValues(ctx ctx.Context, field string, fieldVal reflect.Value, operand interface{}) (int, error) {
+	switch fieldVal.Kind() {
+	case reflect.String:
+		return strings.Compare(fieldVal.String(), fmt.Sprint(operand)), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		num, err := AsFloat(operand)
+		if err != nil {
+			return 0, errors.BadArg(ctx, field, slog.String("Error", err.Error()))
+		}
+		return compareFloats(floatValue(fieldVal), num), nil
+	case reflect.Bool:
+		b, err := asBool(operand)
+		if err != nil {
+			return 0, errors.BadArg(ctx, field, slog.String("Error", err.Error()))
+		}
+		if fieldVal.Bool() == b {
+			return 0, nil
+		}
+		if b {
+			return -1, nil
+		}
+		return 1, nil
+	case reflect.Struct:
+		if fieldVal.Type() == timeType {
+			t, err := asTime(operand)
+			if err != nil {
+				return 0, errors.BadArg(ctx, field, slog.String("Error", err.Error()))
+			}
+			return fieldVal.Interface().(time.Time).Compare(t), nil
+		}
+	}
+	if reflect.DeepEqual(fieldVal.Interface(), operand) {
+		return 0, nil
+	}
+	return strings.Compare(fmt.Sprint(fieldVal.Interface()), fmt.Sprint(operand)), nil
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func floatValue(val reflect.Value) float64 {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint())
+	}
+	return val.Float()
+}
+
+func asBool(operand interface{}) (bool, error) {
+	switch val := operand.(type) {
+	case bool:
+		return val, nil
+	case string:
+		return strconv.ParseBool(val)
+	}
+	return false, fmt.Errorf("%v is not a boolean", operand)
+}
+
+func asTime(operand interface{}) (time.Time, error) {
+	switch val := operand.(type) {
+	case time.Time:
+		return val, nil
+	case *time.Time:
+		if val != nil {
+			return *val, nil
+		}
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+			if t, err := time.Parse(layout, val); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%v is not a time", operand)
+}
+
+// PredicateCapabilities lists the query capabilities a predicate tree uses. A logical node below
+// the root uses nesting.
+func PredicateCapabilities(predicate Predicate) []QueryCapability {
+	found := make(map[QueryCapability]bool)
+	collectCapabilities(predicate, true, found)
+	capabilities := make([]QueryCapability, 0, len(found))
+	for _, capability := range []QueryCapability{CapabilityComparison, CapabilityDisjunction, CapabilityNegation,
+		CapabilityMembership, CapabilityNullTest, CapabilityStringFunctions, CapabilityNesting} {
+		if found[capability] {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities
+}
+
+func collectCapabilities(predicate Predicate, root bool, found map[QueryCapability]bool) {
+	switch node := predicate.(type) {
+	case *Comparison:
+		if node.Operator != OpEqual && node.Operator != OpNotEqual {
+			found[CapabilityComparison] = true
+		}
+	case *Logical:
+		if node.Operator == LogicalOr {
+			found[CapabilityDisjunction] = true
+		}
+		if !root {
+			found[CapabilityNesting] = true
+		}
+		for _, operand := range node.Operands {
+			collectCapabilities(operand, false, found)
+		}
+	case *Not:
+		found[CapabilityNegation] = true
+		collectCapabilities(node.Operand, false, found)
+	case *Membership:
+		found[CapabilityMembership] = true
+	case *NullTest:
+		found[CapabilityNullTest] = true
+	case *FunctionCall:
+		found[CapabilityStringFunctions] = true
+	}
+}
+
+// SplitFilter divides a filter into the part a provider can compile natively, as judged by
+// supports, and a residual the provider evaluates itself with Evaluate over the rows the native
+// part returns. A conjunction is split operand by operand; any other node is native or residual as
+// a whole. Either part may be nil.
+//
+// A provider that emulates this way must apply the residual before paging and counting, or its
+// pages come back short and its totals overstated. Extensions are always native, since only the
+// provider can know whether it recognises them.
+func SplitFilter(predicate Predicate, supports func(QueryCapability) bool) (native Predicate, residual Predicate) {
+	supported := func(predicate Predicate, root bool) bool {
+		for _, capability := range PredicateCapabilities(predicate) {
+			if !supports(capability) {
+				return false
+			}
+		}
+		_, logical := predicate.(*Logical)
+		return root || !logical || supports(CapabilityNesting)
+	}
+	if predicate == nil || supported(predicate, true) {
+		return predicate, nil
+	}
+	conjunction, ok := predicate.(*Logical)
+	if !ok || conjunction.Operator != LogicalAnd {
+		return nil, predicate
+	}
+	var natives, residuals []Predicate
+	for _, operand := range conjunction.Operands {
+		if supported(operand, false) {
+			natives = append(natives, operand)
+		} else {
+			residuals = append(residuals, operand)
+		}
+	}
+	join := func(operands []Predicate) Predicate {
+		switch len(operands) {
+		case 0:
+			return nil
+		case 1:
+			return operands[0]
+		}
+		return &Logical{Optionality: conjunction.Optionality, Operator: LogicalAnd, Operands: operands}
+	}
+	return join(natives), join(residuals)
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/utils"
+)
+
+// testContext satisfies ctx.Context for the errors the evaluator raises.
+type testContext struct {
+	ctx.Context
+}
+
+func newTestContext() ctx.Context {
+	return &testContext{}
+}
+
+func (c *testContext) GetName() string { return "test" }
+
+func (c *testContext) GetPath() string { return "test" }
+
+func (c *testContext) GetId() string { return "test" }
+
+func TestEvaluateStringMap(t *testing.T) {
+	c := newTestContext()
+	item := utils.StringMap{"Name": "widget", "Size": float64(3), "Owner": map[string]interface{}{"Name": "ann"}, "Colour": nil,
+		"Parts": []interface{}{map[string]interface{}{"Name": "nut"}, map[string]interface{}{"Name": "bolt", "Size": float64(2)}}}
+	cases := []struct {
+		text string
+		want bool
+	}{
+		{"Size gt 2 and Size le 3", true},
+		{"Size eq @size", true},
+		{"Owner/Name in ('ann','bob')", true},
+		{"Colour eq null and Missing eq null", true},
+		{"Colour ne 'red'", true},
+		{"Colour lt 'red' or Colour gt 'red'", false},
+		{"startswith(Name,'wid') and not endswith(Name,'x')", true},
+		{"Name in @names", false},
+		{"Parts/Name eq 'bolt' and Parts/Size lt 3", true},
+		{"Parts/Name in ('washer','screw')", false},
+		{"Parts/Colour eq null and Parts/Name ne null", true},
+	}
+	params := utils.StringsMap{"size": "3", "names": `["gadget","gizmo"]`}
+	for _, tc := range cases {
+		query, err := ParseODataFilter(tc.text)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.text, err)
+		}
+		got, err := query.Matches(c, item, params)
+		if err != nil {
+			t.Errorf("%s: %v", tc.text, err)
+		} else if got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.text, tc.want, got)
+		}
+	}
+}
+
+func TestMatchesResolvesOptionalPredicates(t *testing.T) {
+	c := newTestContext()
+	query := NewQuery()
+	query.Filter = &Comparison{Optionality: Optionality{Optional: true}, Field: "Size", Operator: OpGreater, Value: ParameterOperand("min")}
+	item := struct{ Size int }{Size: 1}
+	if ok, err := query.Matches(c, item, nil); err != nil || !ok {
+		t.Fatalf("an optional predicate without its parameter must drop out, got %v (%v)", ok, err)
+	}
+	if ok, err := query.Matches(c, &item, utils.StringsMap{"min": "1"}); err != nil || ok {
+		t.Fatalf("bound to 1, Size gt 1 must not match 1, got %v (%v)", ok, err)
+	}
+	query.Filter = &Comparison{Field: "Size", Operator: OpGreater, Value: ParameterOperand("min")}
+	if _, err := query.Matches(c, item, nil); err == nil {
+		t.Fatal("a required parameter that is not supplied must fail")
+	}
+}
+
+func TestSplitFilter(t *testing.T) {
+	equality := func(capability QueryCapability) bool {
+		return capability == CapabilityComparison
+	}
+	query, err := ParseODataFilter("Size gt 1 and contains(Name,'x') and (A eq 1 or B eq 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, residual := SplitFilter(query.Filter, equality)
+	if fmt.Sprint(PredicateCapabilities(native)) != "[comparison]" {
+		t.Errorf("native part uses %v", PredicateCapabilities(native))
+	}
+	if got := PredicateCapabilities(residual); fmt.Sprint(got) != "[disjunction stringfunctions nesting]" {
+		t.Errorf("residual part uses %v", got)
+	}
+	query, _ = ParseODataFilter("A eq 1 or B eq 2")
+	if native, residual = SplitFilter(query.Filter, equality); native != nil || residual != query.Filter {
+		t.Errorf("an unsupported disjunction must be residual as a whole")
+	}
+}
@@ -0,0 +1,31 @@
+package data
+
+import (
+	"sync"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/utils"
+)
+
+// ExtensionEvaluator runs an extension predicate against an item in memory, as Evaluate runs the
+// rest of the grammar, so that an extension can be composed into an ordinary query by any caller
+// that evaluates one.
+type ExtensionEvaluator func(ctx ctx.Context, ext *Extension, item interface{}, params utils.StringsMap) (bool, error)
+
+var extensionEvaluators sync.Map
+
+// RegisterExtension makes the extension name of namespace evaluable by Evaluate. A provider that
+// filters in memory accepts the registered extensions and rejects the rest; one that compiles
+// queries natively still decides for itself which extensions it recognises.
+func RegisterExtension(namespace string, name string, evaluator ExtensionEvaluator) {
+	extensionEvaluators.Store(namespace+"."+name, evaluator)
+}
+
+// LookupExtension returns the evaluator registered for the extension name of namespace.
+func LookupExtension(namespace string, name string) (ExtensionEvaluator, bool) {
+	evaluator, ok := extensionEvaluators.Load(namespace + "." + name)
+	if !ok {
+		return nil, false
+	}
+	return evaluator.(ExtensionEvaluator), true
+}
@@ -0,0 +1,365 @@
+package data
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// VECTOR_NAMESPACE is the extension namespace of the similarity and keyword predicates, which
+// compose vector and keyword search into ordinary queries.
+const VECTOR_NAMESPACE = "vector"
+
+const (
+	// EXT_VECTOR_SIMILAR matches the records whose vector is at least as similar to a given one as
+	// a threshold. Its payload is a *SimilarityPredicate.
+	EXT_VECTOR_SIMILAR = "similar"
+	// EXT_VECTOR_KEYWORDS matches the records whose text holds any of a set of keywords. Its
+	// payload is a *KeywordPredicate.
+	EXT_VECTOR_KEYWORDS = "keywords"
+)
+
+const (
+	// DefaultHybridCandidates is how many records each of a hybrid search's rankings holds when
+	// the search does not say.
+	DefaultHybridCandidates = 100
+	// DefaultRankConstant is the constant of reciprocal rank fusion when a search does not say.
+	// It damps the weight of the first few ranks, and 60 is the value it was published with.
+	DefaultRankConstant = 60
+)
+
+func init() {
+	RegisterExtension(VECTOR_NAMESPACE, EXT_VECTOR_SIMILAR, evaluateSimilar)
+	RegisterExtension(VECTOR_NAMESPACE, EXT_VECTOR_KEYWORDS, evaluateKeywords)
+}
+
+// SimilarityPredicate is the payload of a vector.similar extension.
+type SimilarityPredicate struct {
+	Field    string
+	Vector   []float32
+	Metric   core.VectorMetric
+	MinScore float64
+}
+
+// KeywordPredicate is the payload of a vector.keywords extension.
+type KeywordPredicate struct {
+	Fields []string
+	Text   string
+}
+
+// Similar builds a predicate matching the records whose vector in field scores at least minScore
+// against vector by metric, cosine when it is empty.
+func Similar(field string, vector []float32, metric core.VectorMetric, minScore float64) *Extension {
+	return &Extension{Namespace: VECTOR_NAMESPACE, Name: EXT_VECTOR_SIMILAR,
+		Payload: &SimilarityPredicate{Field: field, Vector: vector, Metric: metric, MinScore: minScore}}
+}
+
+// Keywords builds a predicate matching the records that hold any word of text in one of fields.
+func Keywords(text string, fields ...string) *Extension {
+	return &Extension{Namespace: VECTOR_NAMESPACE, Name: EXT_VECTOR_KEYWORDS, Payload: &KeywordPredicate{Fields: fields, Text: text}}
+}
+
+func evaluateSimilar(c ctx.Context, ext *Extension, item interface{}, params utils.StringsMap) (bool, error) {
+	pred, ok := ext.Payload.(*SimilarityPredicate)
+	if !ok {
+		return false, errors.BadArg(c, "Payload", slog.String("Extension", ext.Namespace+"."+ext.Name))
+	}
+	val, ok := FieldValue(item, pred.Field)
+	if !ok {
+		return false, nil
+	}
+	vector, ok := val.([]float32)
+	if !ok {
+		return false, errors.TypeMismatch(c, slog.String("Field", pred.Field))
+	}
+	score, _ := VectorSimilarity(pred.Metric, pred.Vector, vector)
+	return score >= pred.MinScore, nil
+}
+
+func evaluateKeywords(c ctx.Context, ext *Extension, item interface{}, params utils.StringsMap) (bool, error) {
+	pred, ok := ext.Payload.(*KeywordPredicate)
+	if !ok {
+		return false, errors.BadArg(c, "Payload", slog.String("Extension", ext.Namespace+"."+ext.Name))
+	}
+	terms := utils.NewStringSet(Tokenize(pred.Text))
+	for _, token := range Tokenize(documentText(item, pred.Fields)) {
+		if terms.Contains(token) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// VectorSimilarity scores b against a by metric, cosine when it is empty, and returns the score,
+// higher for closer vectors, and the distance the metric measures. Vectors of different lengths
+// score zero.
+func VectorSimilarity(metric core.VectorMetric, a []float32, b []float32) (float64, float64) {
+	if len(a) != len(b) {
+		return 0, math.Inf(1)
+	}
+	var dot, na, nb, sq float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		na += x * x
+		nb += y * y
+		sq += (x - y) * (x - y)
+	}
+	switch metric {
+	case core.VectorDot:
+		return dot, -dot
+	case core.VectorEuclidean:
+		dist := math.Sqrt(sq)
+		return 1 / (1 + dist), dist
+	}
+	if na == 0 || nb == 0 {
+		return 0, 1
+	}
+	cos := dot / (math.Sqrt(na) * math.Sqrt(nb))
+	return cos, 1 - cos
+}
+
+// HybridSearch is a search ranking records both by the similarity of their vectors to Vector and
+// by the relevance of their text to Keywords, fusing the two rankings by reciprocal rank. Either
+// may be left out, to rank by the other alone.
+type HybridSearch struct {
+	// Filter narrows the records searched before either ranking, and is bound with Params. A nil
+	// filter searches every record.
+	Filter *Query
+	Params utils.StringsMap
+	// Vector is ranked against the field of the entity's vector index.
+	Vector []float32
+	// Keywords are ranked by BM25 over the text of KeywordFields.
+	Keywords      string
+	KeywordFields []string
+	// MinScore is the least similarity to Vector a record ranks by; a record below it is ranked by
+	// its keywords alone.
+	MinScore float64
+	// Candidates is how many records each ranking holds before they are fused.
+	Candidates int
+	// RankConstant is the constant of the fusion, which scores a record 1/(RankConstant+rank) in
+	// each ranking it is in.
+	RankConstant int
+	Skip         int
+	Top          int
+}
+
+// HybridResult is one record a hybrid search found, with its fused score and its rank and score in
+// each of the rankings. A rank of 0 is a ranking the record is not in.
+type HybridResult struct {
+	Item         core.Storable
+	Score        float64
+	VectorRank   int
+	VectorScore  float64
+	KeywordRank  int
+	KeywordScore float64
+}
+
+// HybridPage is one page of a hybrid search, with the number of records it found in all.
+type HybridPage struct {
+	Results []HybridResult
+	Total   int
+}
+
+// HybridSearcher is implemented by a data component that runs a hybrid search in its store.
+type HybridSearcher interface {
+	HybridSearch(ctx core.RequestContext, search *HybridSearch) (*HybridPage, error)
+}
+
+// SearchHybrid runs search on comp: natively when comp is a HybridSearcher, and otherwise through
+// comp's VectorSearch for the vector ranking and by reading the filtered records for the keyword
+// ranking, which is ranked here.
+func SearchHybrid(ctx core.RequestContext, comp DataComponent, search *HybridSearch) (*HybridPage, error) {
+	if searcher, ok := comp.(HybridSearcher); ok {
+		return searcher.HybridSearch(ctx, search)
+	}
+	if len(search.Vector) == 0 && search.Keywords == "" {
+		return nil, errors.MissingArg(ctx, "Vector")
+	}
+	filter := search.Filter
+	if filter == nil {
+		filter = NewQuery()
+	}
+	cond, err := comp.CreateQueryCondition(ctx, filter, search.Params)
+	if err != nil {
+		return nil, err
+	}
+	var similar []VectorResult
+	if len(search.Vector) > 0 {
+		if similar, err = comp.VectorSearch(ctx, search.Vector, candidatesOf(search), cond); err != nil {
+			return nil, err
+		}
+	}
+	var docs []core.Storable
+	if search.Keywords != "" {
+		if docs, _, _, _, err = comp.Get(ctx, nil, cond, -1, 1, "", nil, ""); err != nil {
+			return nil, err
+		}
+	}
+	return RankHybrid(ctx, search, similar, docs)
+}
+
+// RankHybrid fuses similar, a vector ranking most similar first, with the BM25 ranking of docs by
+// the search's keywords, and returns the page of the fused ranking the search asks for. It is the
+// fusion every provider without a native one shares.
+func RankHybrid(ctx ctx.Context, search *HybridSearch, similar []VectorResult, docs []core.Storable) (*HybridPage, error) {
+	if search.Keywords != "" && len(search.KeywordFields) == 0 {
+		return nil, errors.MissingArg(ctx, "KeywordFields")
+	}
+	candidates := candidatesOf(search)
+	k := search.RankConstant
+	if k <= 0 {
+		k = DefaultRankConstant
+	}
+	fused := make(map[string]*HybridResult)
+	var order []string
+	result := func(item core.Storable) *HybridResult {
+		res, ok := fused[item.GetId()]
+		if !ok {
+			res = &HybridResult{Item: item}
+			fused[item.GetId()] = res
+			order = append(order, item.GetId())
+		}
+		return res
+	}
+	rank := 0
+	for _, candidate := range similar {
+		if candidate.Score < search.MinScore || rank == candidates {
+			continue
+		}
+		rank++
+		res := result(candidate.Item)
+		res.VectorRank, res.VectorScore = rank, candidate.Score
+		res.Score += 1 / float64(k+rank)
+	}
+	for i, scored := range rankKeywords(search, docs) {
+		if i == candidates {
+			break
+		}
+		res := result(scored.item)
+		res.KeywordRank, res.KeywordScore = i+1, scored.score
+		res.Score += 1 / float64(k+i+1)
+	}
+	results := make([]HybridResult, len(order))
+	for i, id := range order {
+		results[i] = *fused[id]
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	first, last := pageBounds(len(results), search.Skip, search.Top)
+	return &HybridPage{Results: results[first:last], Total: len(results)}, nil
+}
+
+func candidatesOf(search *HybridSearch) int {
+	if search.Candidates > 0 {
+		return search.Candidates
+	}
+	return DefaultHybridCandidates
+}
+
+// pageBounds returns the slice of n results that skip and top select; top of zero or less
+// selects every result after skip.
+func pageBounds(n int, skip int, top int) (int, int) {
+	first := skip
+	if first < 0 {
+		first = 0
+	}
+	if first > n {
+		first = n
+	}
+	last := n
+	if top > 0 && first+top < n {
+		last = first + top
+	}
+	return first, last
+}
+
+type keywordScore struct {
+	item  core.Storable
+	score float64
+}
+
+// rankKeywords ranks docs by the BM25 relevance of their keyword fields to the search's keywords,
+// with the usual k1 of 1.2 and b of 0.75. A record holding none of the keywords is not ranked.
+func rankKeywords(search *HybridSearch, docs []core.Storable) []keywordScore {
+	terms := Tokenize(search.Keywords)
+	if len(terms) == 0 || len(docs) == 0 {
+		return nil
+	}
+	const k1, b = 1.2, 0.75
+	tokens := make([][]string, len(docs))
+	frequencies := make(map[string]int)
+	total := 0
+	for i, doc := range docs {
+		tokens[i] = Tokenize(documentText(doc, search.KeywordFields))
+		total += len(tokens[i])
+		seen := make(map[string]bool)
+		for _, token := range tokens[i] {
+			if !seen[token] {
+				seen[token] = true
+				frequencies[token]++
+			}
+		}
+	}
+	avgLength := float64(total) / float64(len(docs))
+	if avgLength == 0 {
+		return nil
+	}
+	var ranked []keywordScore
+	for i, doc := range docs {
+		counts := make(map[string]int)
+		for _, token := range tokens[i] {
+			counts[token]++
+		}
+		score := 0.0
+		for _, term := range terms {
+			tf := float64(counts[term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(frequencies[term])
+			idf := math.Log(1 + (float64(len(docs))-df+0.5)/(df+0.5))
+			score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(len(tokens[i]))/avgLength))
+		}
+		if score > 0 {
+			ranked = append(ranked, keywordScore{item: doc, score: score})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].score > ranked[j].score
+	})
+	return ranked
+}
+
+// Tokenize splits text into the lower-cased words keyword search matches, dropping punctuation.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// documentText joins the text in fields of item: strings, and the strings of string slices.
+func documentText(item interface{}, fields []string) string {
+	var parts []string
+	for _, field := range fields {
+		val, ok := FieldValue(item, field)
+		if !ok {
+			continue
+		}
+		switch text := val.(type) {
+		case string:
+			parts = append(parts, text)
+		case []string:
+			parts = append(parts, text...)
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,152 @@
+package data_test
+
+import (
+	"strings"
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+type passage struct {
+	data.StorageInfo
+	Title     string    `json:"Title"`
+	Body      string    `json:"Body"`
+	Topic     string    `json:"Topic"`
+	Embedding []float32 `json:"Embedding"`
+}
+
+func (p *passage) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "passage", Collection: "passage", Indexes: []core.IndexSpec{
+		{Fields: []string{"Embedding"}, Vector: &core.VectorIndex{Dimension: 2, Metric: core.VectorCosine}},
+	}}
+}
+
+// withoutVectors is a store that cannot search by vector, as stores without a vector index cannot.
+type withoutVectors struct {
+	data.DataComponent
+}
+
+func (w *withoutVectors) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]data.VectorResult, error) {
+	return nil, errors.NotImplemented(ctx, "VectorSearch")
+}
+
+func TestHybridSearch(t *testing.T) {
+	// setup stores two passages on go and two on rust, each with an embedding leaning to its topic
+	setup := func(t *testing.T) (data.DataComponent, *datatest.RequestContext) {
+		t.Helper()
+		server := datatest.NewServerContext()
+		c := datatest.NewRequestContext(server, "user1", "")
+		svc := memory.NewMemoryDataComponentForObject(server, "passage", datatest.EntityFactory[passage]{})
+		if err := svc.CreateDBCollection(server); err != nil {
+			t.Fatalf("CreateDBCollection: %v", err)
+		}
+		for _, p := range []*passage{
+			{Title: "Go channels", Body: "channels and goroutines", Topic: "go", Embedding: []float32{1, 0}},
+			{Title: "Rust ownership", Body: "the borrow checker", Topic: "rust", Embedding: []float32{0, 1}},
+			{Title: "Go generics", Body: "type parameters", Topic: "go", Embedding: []float32{0.9, 0.1}},
+			{Title: "Channels in Rust", Body: "crossbeam channels", Topic: "rust", Embedding: []float32{0.1, 0.9}},
+		} {
+			if err := svc.Save(c, p); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		return svc, c
+	}
+	titles := func(page *data.HybridPage) string {
+		got := make([]string, len(page.Results))
+		for i, res := range page.Results {
+			got[i] = res.Item.(*passage).Title
+		}
+		return strings.Join(got, ", ")
+	}
+	fields := []string{"Title", "Body"}
+	rust := data.NewQuery()
+	rust.Filter = &data.Comparison{Field: "Topic", Operator: data.OpEqual, Value: data.LiteralOperand("rust")}
+
+	// the filter applies before either ranking, and the threshold to the vector ranking alone
+	for _, tc := range []struct {
+		name   string
+		search data.HybridSearch
+		total  int
+		want   string
+	}{
+		{"fused", data.HybridSearch{Vector: []float32{1, 0}, Keywords: "channels", KeywordFields: fields}, 4, "Go channels, Channels in Rust, Go generics, Rust ownership"},
+		{"paged", data.HybridSearch{Vector: []float32{1, 0}, Keywords: "channels", KeywordFields: fields, Skip: 1, Top: 1}, 4, "Channels in Rust"},
+		{"filtered", data.HybridSearch{Filter: rust, Vector: []float32{1, 0}, Keywords: "channels", KeywordFields: fields}, 2, "Channels in Rust, Rust ownership"},
+		{"thresholded", data.HybridSearch{Vector: []float32{1, 0}, MinScore: 0.5, Keywords: "channels", KeywordFields: fields}, 3, "Go channels, Go generics, Channels in Rust"},
+		{"keywords alone", data.HybridSearch{Keywords: "channels", KeywordFields: fields}, 2, "Go channels, Channels in Rust"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, c := setup(t)
+			search := tc.search
+			page, err := data.SearchHybrid(c, svc, &search)
+			if err != nil {
+				t.Fatalf("SearchHybrid: %v", err)
+			}
+			if got := titles(page); page.Total != tc.total || got != tc.want {
+				t.Errorf("want %d: %s, got %d: %s", tc.total, tc.want, page.Total, got)
+			}
+		})
+	}
+
+	t.Run("ranks", func(t *testing.T) {
+		svc, c := setup(t)
+		page, err := data.SearchHybrid(c, svc, &data.HybridSearch{Vector: []float32{1, 0}, Keywords: "channels", KeywordFields: fields})
+		if err != nil {
+			t.Fatalf("SearchHybrid: %v", err)
+		}
+		if first := page.Results[0]; first.VectorRank != 1 || first.KeywordRank != 1 || first.KeywordScore <= 0 {
+			t.Errorf("want the first result first in both rankings, got %+v", first)
+		}
+	})
+
+	// a store that cannot search by vector still ranks by keywords, and fails a search by vector
+	// rather than leave its ranking out
+	t.Run("without vector search", func(t *testing.T) {
+		comp, c := setup(t)
+		svc := &withoutVectors{comp}
+		page, err := data.SearchHybrid(c, svc, &data.HybridSearch{Keywords: "channels", KeywordFields: fields})
+		if err != nil {
+			t.Fatalf("SearchHybrid: %v", err)
+		}
+		if got := titles(page); got != "Go channels, Channels in Rust" {
+			t.Errorf("ranked by keywords: %s", got)
+		}
+		if _, err = data.SearchHybrid(c, svc, &data.HybridSearch{Vector: []float32{1, 0}, Keywords: "channels", KeywordFields: fields}); !errors.HasErrorCode(err, errors.CORE_ERROR_NOT_IMPLEMENTED) {
+			t.Errorf("searching by vector: want not implemented, got %v", err)
+		}
+	})
+
+	// the vector namespace composes into ordinary queries
+	t.Run("predicates", func(t *testing.T) {
+		svc, c := setup(t)
+		for filter, want := range map[data.Predicate]string{
+			data.Similar("Embedding", []float32{1, 0}, "", 0.8): "Go channels, Go generics",
+			data.Keywords("borrow", "Body"):                     "Rust ownership",
+		} {
+			query := data.NewQuery()
+			query.Filter = filter
+			cond, err := svc.CreateQueryCondition(c, query, nil)
+			if err != nil {
+				t.Fatalf("CreateQueryCondition: %v", err)
+			}
+			items, _, _, _, _ := svc.Get(c, nil, cond, -1, 1, "", []string{"Title"}, "")
+			got := make([]string, len(items))
+			for i, item := range items {
+				got[i] = item.(*passage).Title
+			}
+			if strings.Join(got, ", ") != want {
+				t.Errorf("want %s, got %v", want, got)
+			}
+		}
+		query := data.NewQuery()
+		query.Filter = &data.Extension{Namespace: "other", Name: "similar"}
+		if _, err := svc.CreateQueryCondition(c, query, nil); err == nil {
+			t.Errorf("an unregistered extension was accepted")
+		}
+	})
+}
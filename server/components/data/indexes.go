@@ -0,0 +1,242 @@
+package data
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// IndexManager is implemented by a data component that can list, create and drop the indexes of
+// its collection. The indexes it lists are those it created, under the names they were created
+// with.
+type IndexManager interface {
+	Indexes(ctx core.ServerContext) ([]core.IndexSpec, error)
+	CreateIndex(ctx core.ServerContext, index core.IndexSpec) error
+	DropIndex(ctx core.ServerContext, name string) error
+}
+
+// IndexName returns the name of an index: its Name, or its fields joined by underscores.
+func IndexName(index core.IndexSpec) string {
+	if index.Name != "" {
+		return index.Name
+	}
+	fields := make([]string, len(index.Fields))
+	for i, field := range index.Fields {
+		fields[i] = strings.Replace(strings.TrimPrefix(field, "-"), ".", "_", -1)
+		if strings.HasPrefix(field, "-") {
+			fields[i] += "_desc"
+		}
+	}
+	return strings.Join(fields, "_")
+}
+
+// IndexField returns the field an entry of an index's Fields names, and whether it is indexed
+// descending.
+func IndexField(field string) (string, bool) {
+	return strings.TrimPrefix(field, "-"), strings.HasPrefix(field, "-")
+}
+
+// IndexFilter returns the query an index is limited to, or nil for an index of every record.
+func IndexFilter(c ctx.Context, index core.IndexSpec) (*Query, error) {
+	if index.Filter == nil {
+		return nil, nil
+	}
+	query, ok := index.Filter.(*Query)
+	if !ok {
+		return nil, errors.BadArg(c, "Filter", slog.String("Index", IndexName(index)))
+	}
+	return query, nil
+}
+
+// ValidateIndex checks that an index can be created: it has fields, a TTL or vector index has
+// exactly one, a vector index has a dimension and a known metric, and a filter is a *Query.
+func ValidateIndex(c ctx.Context, index core.IndexSpec) error {
+	name := slog.String("Index", IndexName(index))
+	if len(index.Fields) == 0 {
+		return errors.BadArg(c, "Fields", name)
+	}
+	if (index.TTL > 0 || index.Vector != nil) && len(index.Fields) != 1 {
+		return errors.BadArg(c, "Fields", name)
+	}
+	if index.TTL < 0 {
+		return errors.BadArg(c, "TTL", name)
+	}
+	if index.Vector != nil {
+		if index.Vector.Dimension <= 0 || index.Unique || index.TTL > 0 {
+			return errors.BadArg(c, "Vector", name)
+		}
+		switch index.Vector.Metric {
+		case core.VectorCosine, core.VectorEuclidean, core.VectorDot:
+		default:
+			return errors.BadArg(c, "Metric", name, slog.String("Metric", string(index.Vector.Metric)))
+		}
+	}
+	_, err := IndexFilter(c, index)
+	return err
+}
+
+// IndexDiff compares the indexes an entity declares with those its collection has. Missing are
+// declared and absent, Changed are declared under the name of an index defined differently, and
+// Extra are in the collection without being declared.
+type IndexDiff struct {
+	Missing []core.IndexSpec
+	Changed []core.IndexSpec
+	Extra   []core.IndexSpec
+}
+
+// Empty reports whether the collection's indexes are those declared.
+func (diff *IndexDiff) Empty() bool {
+	return len(diff.Missing) == 0 && len(diff.Changed) == 0 && len(diff.Extra) == 0
+}
+
+func (diff *IndexDiff) String() string {
+	names := func(indexes []core.IndexSpec) string {
+		list := make([]string, len(indexes))
+		for i, index := range indexes {
+			list[i] = IndexName(index)
+		}
+		return strings.Join(list, ", ")
+	}
+	return fmt.Sprintf("missing [%s] changed [%s] extra [%s]", names(diff.Missing), names(diff.Changed), names(diff.Extra))
+}
+
+// DiffIndexes compares declared indexes with existing ones by name.
+func DiffIndexes(declared []core.IndexSpec, existing []core.IndexSpec) *IndexDiff {
+	diff := &IndexDiff{}
+	byName := make(map[string]core.IndexSpec, len(existing))
+	for _, index := range existing {
+		byName[IndexName(index)] = index
+	}
+	for _, index := range declared {
+		name := IndexName(index)
+		current, ok := byName[name]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, index)
+		case !sameIndex(index, current):
+			diff.Changed = append(diff.Changed, index)
+		}
+		delete(byName, name)
+	}
+	for _, index := range existing {
+		if _, ok := byName[IndexName(index)]; ok {
+			diff.Extra = append(diff.Extra, index)
+		}
+	}
+	return diff
+}
+
+// sameIndex reports whether two specs describe the same index, whatever their names. Their filters
+// are compared by filterKey rather than as the trees they hold, which a filter read back from a
+// collection seldom matches node for node.
+func sameIndex(a core.IndexSpec, b core.IndexSpec) bool {
+	if filterKey(a.Filter) != filterKey(b.Filter) {
+		return false
+	}
+	a.Name, b.Name = "", ""
+	a.Filter, b.Filter = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// filterKey identifies an index filter by the fingerprint of its normalized form, with its literals
+// lifted out and listed in their canonical text so that a literal 5 matches a literal 5.0. A filter
+// that is not a *Query is identified by its printed value.
+func filterKey(filter interface{}) string {
+	query, ok := filter.(*Query)
+	if !ok {
+		if filter == nil {
+			return ""
+		}
+		return fmt.Sprintf("%#v", filter)
+	}
+	if query == nil || query.Filter == nil {
+		return ""
+	}
+	lifted, values := liftLiterals(&Query{Version: QueryV1, Filter: query.Normalize().Filter})
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := Fingerprint(lifted)
+	for _, name := range names {
+		key += fmt.Sprintf("|%s=%q", name, values[name])
+	}
+	return key
+}
+
+// DeclaredIndexes returns the indexes declared by the entity comp stores.
+func DeclaredIndexes(c ctx.Context, comp DataComponent) []core.IndexSpec {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return nil
+	}
+	stor, ok := factory.CreateObject(c).(core.Storable)
+	if !ok || stor.Config() == nil {
+		return nil
+	}
+	return stor.Config().Indexes
+}
+
+// CheckIndexes compares the indexes the entity comp stores declares with those of its collection,
+// without changing them.
+func CheckIndexes(ctx core.ServerContext, comp DataComponent) (*IndexDiff, error) {
+	im, ok := comp.(IndexManager)
+	if !ok {
+		return nil, errors.NotImplemented(ctx, "Indexes", slog.String("Object", comp.GetObject()))
+	}
+	existing, err := im.Indexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return DiffIndexes(DeclaredIndexes(ctx, comp), existing), nil
+}
+
+// ReconcileIndexes brings the indexes of comp's collection in line with those its entity declares:
+// it creates the missing ones, recreates the changed ones and, when dropExtra is set, drops the
+// ones not declared. It returns the differences it found. A provider calls it when it starts,
+// without dropExtra, as an index created by hand or by a migration is not an error.
+func ReconcileIndexes(ctx core.ServerContext, comp DataComponent, dropExtra bool) (*IndexDiff, error) {
+	diff, err := CheckIndexes(ctx, comp)
+	if err != nil {
+		return nil, err
+	}
+	im := comp.(IndexManager)
+	for _, index := range diff.Changed {
+		if err = im.DropIndex(ctx, IndexName(index)); err != nil {
+			return diff, err
+		}
+	}
+	for _, indexes := range [][]core.IndexSpec{diff.Missing, diff.Changed} {
+		for _, index := range indexes {
+			if err = im.CreateIndex(ctx, index); err != nil {
+				return diff, err
+			}
+		}
+	}
+	if dropExtra {
+		for _, index := range diff.Extra {
+			if err = im.DropIndex(ctx, IndexName(index)); err != nil {
+				return diff, err
+			}
+		}
+	}
+	return diff, nil
+}
+
+// Duplicate is the error of a write that would give two records of object the same key in the
+// unique index named index.
+func Duplicate(c ctx.Context, object string, index string, info ...slog.Attr) error {
+	return errors.ThrowError(c, "duplicate key in unique index "+index+" of "+object, DATA_ERROR_DUPLICATE, append(info, slog.String("Object", object), slog.String("Index", index))...)
+}
+
+// IsDuplicate reports whether err is a Duplicate error.
+func IsDuplicate(err error) bool {
+	return errors.HasErrorCode(err, DATA_ERROR_DUPLICATE)
+}
@@ -0,0 +1,31 @@
+package data
+
+import (
+	"testing"
+
+	"laatoo.io/sdk/server/core"
+)
+
+func TestDiffIndexesComparesFilters(t *testing.T) {
+	parsed, err := ParseODataFilter("Size gt 5 and Name eq 'a'")
+	if err != nil {
+		t.Fatalf("ParseODataFilter: %v", err)
+	}
+	// the same filter as a collection might hand it back: nested, with a float for the number
+	built := NewQuery()
+	built.Filter = &Logical{Operator: LogicalAnd, Operands: []Predicate{
+		&Logical{Operator: LogicalAnd, Operands: []Predicate{&Comparison{Field: "Size", Operator: OpGreater, Value: LiteralOperand(float64(5))}}},
+		&Comparison{Field: "Name", Operator: OpEqual, Value: LiteralOperand("a")},
+	}}
+	other, err := ParseODataFilter("Size gt 6 and Name eq 'a'")
+	if err != nil {
+		t.Fatalf("ParseODataFilter: %v", err)
+	}
+	declared := []core.IndexSpec{{Name: "small", Fields: []string{"Name"}, Filter: parsed}}
+	if diff := DiffIndexes(declared, []core.IndexSpec{{Name: "small", Fields: []string{"Name"}, Filter: built}}); !diff.Empty() {
+		t.Errorf("the same filter read back differently was taken for a change: %s", diff)
+	}
+	if diff := DiffIndexes(declared, []core.IndexSpec{{Name: "small", Fields: []string{"Name"}, Filter: other}}); len(diff.Changed) != 1 {
+		t.Errorf("a changed filter was not found: %s", diff)
+	}
+}
@@ -0,0 +1,174 @@
+package data
+
+import (
+	"log/slog"
+	"strings"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// StorableIterator walks the records of a condition one at a time, fetching them from the store
+// in batches, so that a job over millions of records holds one batch in memory rather than all
+// of them. Batches are fetched by keyset — each one starts after the last record of the one
+// before — so records stored or deleted during the walk never shift it. A nil condition walks
+// every record, where it matches nothing elsewhere; see DataComponent.Iterate.
+//
+//	it, err := comp.Iterate(ctx, nil, cond, []string{"Name"}, 500)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		process(it.Item())
+//		checkpoint(it.Token())
+//	}
+//	return it.Err()
+type StorableIterator interface {
+	// Next advances to the next record, fetching another batch when the current one is used up.
+	// It returns false when the records are exhausted, an error has occurred, or the iterator has
+	// been closed.
+	Next() bool
+	// Item returns the record Next advanced to.
+	Item() core.Storable
+	// Err returns the error that stopped the iterator, if any.
+	Err() error
+	// Close releases the iterator. Next returns false once it has been called.
+	Close() error
+	// Token returns a continuation token for the position after the current record, or the
+	// token passed to Resume before Next has been called.
+	Token() string
+	// Resume positions an iterator that has not yet been advanced after the record a token was
+	// taken at, so that a job interrupted mid-walk continues where it stopped. The token must
+	// come from an iterator over the same condition and order.
+	Resume(token string) error
+}
+
+// BatchFetch fetches up to limit records of an iteration in its order, starting after the
+// position after marks, or from the first record when after is nil.
+type BatchFetch func(ctx core.RequestContext, after *Cursor, limit int) ([]core.Storable, error)
+
+// DefaultBatchSize is the batch size an iterator uses when it is asked for none.
+const DefaultBatchSize = 100
+
+// batchIterator is a StorableIterator over a provider's BatchFetch.
+type batchIterator struct {
+	ctx       core.RequestContext
+	fetch     BatchFetch
+	terms     []OrderTerm
+	batchSize int
+	batch     []core.Storable
+	pos       int
+	after     *Cursor
+	started   bool
+	exhausted bool
+	closed    bool
+	err       error
+}
+
+// NewBatchIterator creates an iterator fetching batchSize records at a time with fetch, in the
+// order of terms and then of id. Records whose position the iterator passes are marked with
+// CursorAt, so fetch must order by exactly those terms and break ties by id.
+func NewBatchIterator(ctx core.RequestContext, fetch BatchFetch, terms []OrderTerm, batchSize int) StorableIterator {
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	return &batchIterator{ctx: ctx, fetch: fetch, terms: terms, batchSize: batchSize}
+}
+
+func (it *batchIterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	it.started = true
+	if it.pos < len(it.batch) {
+		it.after = CursorAt(it.batch[it.pos], it.terms)
+		it.pos++
+	}
+	if it.pos < len(it.batch) {
+		return true
+	}
+	if it.exhausted {
+		it.batch, it.pos = nil, 0
+		return false
+	}
+	it.batch, it.err = it.fetch(it.ctx, it.after, it.batchSize)
+	it.pos = 0
+	if it.err != nil {
+		it.batch = nil
+		return false
+	}
+	it.exhausted = len(it.batch) < it.batchSize
+	return len(it.batch) > 0
+}
+
+func (it *batchIterator) Item() core.Storable {
+	if it.pos < len(it.batch) {
+		return it.batch[it.pos]
+	}
+	return nil
+}
+
+func (it *batchIterator) Err() error {
+	return it.err
+}
+
+func (it *batchIterator) Close() error {
+	it.closed, it.batch = true, nil
+	return nil
+}
+
+func (it *batchIterator) Token() string {
+	if it.pos < len(it.batch) {
+		return CursorAt(it.batch[it.pos], it.terms).Token()
+	}
+	if it.after == nil {
+		return ""
+	}
+	return it.after.Token()
+}
+
+func (it *batchIterator) Resume(token string) error {
+	if it.started {
+		return errors.BadArg(it.ctx, "token", slog.String("Reason", "iterator already advanced"))
+	}
+	cursor, err := ParseCursor(token)
+	if err != nil {
+		return errors.BadArg(it.ctx, "token", slog.String("Error", err.Error()))
+	}
+	if len(cursor.Values) != len(it.terms) {
+		return errors.BadArg(it.ctx, "token", slog.Int("Values", len(cursor.Values)), slog.Int("OrderBy", len(it.terms)))
+	}
+	it.after = cursor
+	return nil
+}
+
+// CursorAt returns the cursor marking item's position in the order of terms.
+func CursorAt(item core.Storable, terms []OrderTerm) *Cursor {
+	cursor := &Cursor{Values: make([]interface{}, len(terms)), Id: item.GetId()}
+	for i, term := range terms {
+		cursor.Values[i], _ = FieldValue(item, term.Field)
+	}
+	return cursor
+}
+
+// ParseOrderBy reads the orderBy of the page-based reads: each entry names a field, optionally
+// prefixed with "-" or followed by "desc" to sort descending.
+func ParseOrderBy(orderBy []string) []OrderTerm {
+	terms := make([]OrderTerm, 0, len(orderBy))
+	for _, entry := range orderBy {
+		parts := strings.Fields(entry)
+		if len(parts) == 0 {
+			continue
+		}
+		term := OrderTerm{Field: parts[0]}
+		if strings.HasPrefix(term.Field, "-") {
+			term.Field, term.Descending = term.Field[1:], true
+		}
+		if len(parts) > 1 {
+			term.Descending = strings.EqualFold(parts[1], string(SORTDESC))
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
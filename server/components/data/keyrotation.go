@@ -0,0 +1,140 @@
+package data
+
+import (
+	"log/slog"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+const (
+	// KEYROTATION_PARAM_TENANTS names the tenants whose keys a KeyRotationJob rotates, as a list.
+	// The request's tenant, or the records of no tenant, are rotated when it is omitted.
+	KEYROTATION_PARAM_TENANTS = "tenants"
+	// KEYROTATION_PARAM_ROTATE makes a KeyRotationJob rotate the keys before re-encrypting. Without
+	// it the job only moves records to the keys already current.
+	KEYROTATION_PARAM_ROTATE = "rotate"
+)
+
+// KeyRotationReport is what a KeyRotationJob did: the keys it made current, by tenant, and the
+// records it encrypted again, by object.
+type KeyRotationReport struct {
+	Keys        map[string]string
+	ReEncrypted map[string]int
+}
+
+/*
+KeyRotationJob rotates the data keys of EncryptionPlugins and encrypts the records they store again
+with the keys made current. Plugins sharing a KeyRing rotate it once. It is run as a service, or
+through Run:
+
+	job := data.NewKeyRotationJobWithPlugins(ctx, customers, orders)
+	report, err := job.Run(core.NewSystemRequest(ctx, "RotateKeys", nil, nil, nil), []string{"acme"}, true)
+
+Re-encryption walks every record of the plugins' data services, so a job run by a system request
+re-encrypts the records of every tenant, each with its own tenant's current key.
+*/
+type KeyRotationJob struct {
+	core.Service
+	Plugins []*EncryptionPlugin
+}
+
+func NewKeyRotationJob(ctx core.ServerContext) *KeyRotationJob {
+	return &KeyRotationJob{}
+}
+
+// NewKeyRotationJobWithPlugins creates a job rotating the keys of plugins.
+func NewKeyRotationJobWithPlugins(ctx core.ServerContext, plugins ...*EncryptionPlugin) *KeyRotationJob {
+	return &KeyRotationJob{Plugins: plugins}
+}
+
+func (svc *KeyRotationJob) Describe(ctx core.ServerContext) error {
+	if svc.Plugins == nil {
+		svc.AddConfiguration(ctx, CONF_DATA_SVCS, "Encryption plugins whose keys are rotated", datatypes.Stringarr, nil)
+	}
+	svc.AddOptionalParamWithType(ctx, KEYROTATION_PARAM_TENANTS, "Tenants whose keys are rotated, the request's when omitted", datatypes.Stringarr)
+	svc.AddOptionalParamWithType(ctx, KEYROTATION_PARAM_ROTATE, "Rotate the keys before re-encrypting", datatypes.Bool)
+	return nil
+}
+
+func (svc *KeyRotationJob) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if svc.Plugins != nil {
+		return nil
+	}
+	names, _ := svc.GetStringArrayConfiguration(ctx, CONF_DATA_SVCS)
+	for _, name := range names {
+		s, err := ctx.GetService(name)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		plugin, ok := s.(*EncryptionPlugin)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		svc.Plugins = append(svc.Plugins, plugin)
+	}
+	return nil
+}
+
+// Invoke runs the job for the tenants named by the request's parameters, and responds with the
+// report.
+func (svc *KeyRotationJob) Invoke(ctx core.RequestContext) error {
+	var tenants []string
+	if val, ok := ctx.GetParamValue(KEYROTATION_PARAM_TENANTS); ok {
+		switch v := val.(type) {
+		case []string:
+			tenants = v
+		case []interface{}:
+			for _, tenant := range v {
+				if name, ok := tenant.(string); ok {
+					tenants = append(tenants, name)
+				}
+			}
+		}
+	}
+	rotate := false
+	if val, ok := ctx.GetParamValue(KEYROTATION_PARAM_ROTATE); ok {
+		rotate, _ = val.(bool)
+	}
+	report, err := svc.Run(ctx, tenants, rotate)
+	if err != nil {
+		return err
+	}
+	ctx.SetResponse(core.SuccessResponse(report))
+	return nil
+}
+
+// Run rotates the keys of tenants when rotate is set, the request's tenant's when tenants is
+// empty, and then re-encrypts the records of every plugin.
+func (svc *KeyRotationJob) Run(ctx core.RequestContext, tenants []string, rotate bool) (*KeyRotationReport, error) {
+	report := &KeyRotationReport{Keys: map[string]string{}, ReEncrypted: map[string]int{}}
+	if rotate {
+		if len(tenants) == 0 {
+			tenants = []string{requestTenant(ctx)}
+		}
+		rotated := map[*KeyRing]bool{}
+		for _, plugin := range svc.Plugins {
+			if rotated[plugin.Keys] {
+				continue
+			}
+			rotated[plugin.Keys] = true
+			for _, tenant := range tenants {
+				keyId, err := plugin.Keys.Rotate(ctx.ServerContext(), tenant)
+				if err != nil {
+					return report, err
+				}
+				report.Keys[keyTenant(tenant)] = keyId
+			}
+		}
+	}
+	for _, plugin := range svc.Plugins {
+		written, err := plugin.ReEncrypt(ctx)
+		report.ReEncrypted[plugin.GetObject()] += written
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,204 @@
+package memory
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+)
+
+var _ data.IndexManager = (*MemoryDataComponent)(nil)
+
+// The store has no indexes to speed up a read, so an index here is only the constraint it puts on
+// writes: a unique index refuses a duplicate key, and a TTL index hides a record once it expires,
+// as a database would remove it.
+
+// Start creates the declared indexes the collection does not have yet.
+func (svc *MemoryDataComponent) Start(ctx core.ServerContext) error {
+	diff, err := data.ReconcileIndexes(ctx, svc, false)
+	if err != nil {
+		return err
+	}
+	if !diff.Empty() {
+		log.Info(ctx, "Reconciled indexes", slog.String("Object", svc.object), slog.String("Indexes", diff.String()))
+	}
+	return nil
+}
+
+// Indexes returns the indexes created, ordered by name.
+func (svc *MemoryDataComponent) Indexes(ctx core.ServerContext) ([]core.IndexSpec, error) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	indexes := make([]core.IndexSpec, 0, len(svc.indexes))
+	for _, index := range svc.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes, nil
+}
+
+// CreateIndex creates an index, replacing one with the same name. A unique index is refused when
+// the records stored already hold a duplicate key.
+func (svc *MemoryDataComponent) CreateIndex(ctx core.ServerContext, index core.IndexSpec) error {
+	if err := data.ValidateIndex(ctx, index); err != nil {
+		return err
+	}
+	index.Name = data.IndexName(index)
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if index.Unique {
+		req := core.NewSystemRequest(ctx, "CreateIndex", nil, nil, nil)
+		if err := svc.checkIndex(req, index, nil); err != nil {
+			return err
+		}
+	}
+	svc.indexes[index.Name] = index
+	svc.expireAll()
+	return nil
+}
+
+// DropIndex drops the index named name. Dropping an index that is not there is not an error.
+func (svc *MemoryDataComponent) DropIndex(ctx core.ServerContext, name string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	delete(svc.indexes, name)
+	svc.expireAll()
+	return nil
+}
+
+// checkUnique fails when storing items would give two live records the same key in a unique index.
+// The caller holds the write lock.
+func (svc *MemoryDataComponent) checkUnique(ctx core.RequestContext, items []core.Storable) error {
+	for _, index := range svc.indexes {
+		if !index.Unique {
+			continue
+		}
+		if err := svc.checkIndex(ctx, index, items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIndex checks the keys of a unique index across the live records and items, which replace
+// the records with their ids. The caller holds the lock.
+func (svc *MemoryDataComponent) checkIndex(ctx core.RequestContext, index core.IndexSpec, items []core.Storable) error {
+	writing := make(map[string]core.Storable, len(items))
+	for _, item := range items {
+		writing[item.GetId()] = item
+	}
+	now := time.Now()
+	keys := make(map[string]string)
+	add := func(id string, item core.Storable) error {
+		key, ok, err := indexKey(ctx, index, item)
+		if err != nil || !ok {
+			return err
+		}
+		if other, taken := keys[key]; taken && other != id {
+			return data.Duplicate(ctx, svc.object, index.Name, slog.String("Id", id), slog.String("Duplicate", other))
+		}
+		keys[key] = id
+		return nil
+	}
+	for _, id := range svc.sortedIds() {
+		rec := svc.records[id]
+		if _, ok := writing[id]; ok || rec.deleted || rec.expired(now) {
+			continue
+		}
+		item, err := svc.decode(ctx, rec)
+		if err != nil {
+			return err
+		}
+		if err = add(id, item); err != nil {
+			return err
+		}
+	}
+	for _, item := range items {
+		if err := add(item.GetId(), item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKey returns the key of item in a unique index, and false when the index's filter excludes
+// it or it has no value for one of the index's fields.
+func indexKey(ctx core.RequestContext, index core.IndexSpec, item core.Storable) (string, bool, error) {
+	filter, err := data.IndexFilter(ctx, index)
+	if err != nil {
+		return "", false, err
+	}
+	if filter != nil {
+		ok, err := data.Evaluate(ctx, filter.Filter, item, nil)
+		if err != nil || !ok {
+			return "", false, err
+		}
+	}
+	values := make([]interface{}, len(index.Fields))
+	for i, field := range index.Fields {
+		name, _ := data.IndexField(field)
+		val, ok := data.FieldValue(item, name)
+		if !ok {
+			return "", false, nil
+		}
+		values[i] = val
+	}
+	key, err := json.Marshal(values)
+	if err != nil {
+		return "", false, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+	}
+	return string(key), true, nil
+}
+
+// expired reports whether a TTL index has expired the record by now.
+func (rec *record) expired(now time.Time) bool {
+	return !rec.expiresAt.IsZero() && !now.Before(rec.expiresAt)
+}
+
+// expiry returns when the TTL indexes expire a record, or the zero time when none does. The
+// caller holds the lock.
+func (svc *MemoryDataComponent) expiry(rec *record) time.Time {
+	var expiresAt time.Time
+	var fields map[string]interface{}
+	for _, index := range svc.indexes {
+		if index.TTL <= 0 {
+			continue
+		}
+		if fields == nil {
+			if err := json.Unmarshal(rec.data, &fields); err != nil {
+				return time.Time{}
+			}
+		}
+		name, _ := data.IndexField(index.Fields[0])
+		text, ok := fields[name].(string)
+		if !ok {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil || at.IsZero() {
+			continue
+		}
+		if at = at.Add(index.TTL); expiresAt.IsZero() || at.Before(expiresAt) {
+			expiresAt = at
+		}
+	}
+	return expiresAt
+}
+
+// expireAll sets when every record expires, after the TTL indexes change. Records are replaced
+// rather than changed in place, as an open transaction holds the records it would restore. The
+// caller holds the write lock.
+func (svc *MemoryDataComponent) expireAll() {
+	for id, rec := range svc.records {
+		if expiresAt := svc.expiry(rec); !expiresAt.Equal(rec.expiresAt) {
+			replaced := *rec
+			replaced.expiresAt = expiresAt
+			svc.records[id] = &replaced
+		}
+	}
+}
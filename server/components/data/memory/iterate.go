@@ -0,0 +1,49 @@
+package memory
+
+import (
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+// Iterate walks the records matching queryCond, or every visible record when it is nil. Each batch
+// is selected afresh and resumes after the last record of the one before, so the store is not
+// locked between batches. The ordered fields are loaded even when props leaves them out, since
+// the iterator's positions are read from them.
+func (svc *MemoryDataComponent) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (data.StorableIterator, error) {
+	terms := data.ParseOrderBy(orderBy)
+	cond, err := toCondition(ctx, queryCond)
+	if err != nil {
+		return nil, err
+	}
+	if len(props) > 0 {
+		props = append([]string(nil), props...)
+		for _, term := range terms {
+			props = append(props, term.Field)
+		}
+	}
+	fetch := func(ctx core.RequestContext, after *data.Cursor, limit int) ([]core.Storable, error) {
+		items, err := svc.selectItems(ctx, func(id string, item core.Storable) (bool, error) {
+			if after != nil {
+				res, err := compareToCursor(ctx, item, terms, after)
+				if err != nil || res <= 0 {
+					return false, err
+				}
+			}
+			if cond == nil {
+				return true, nil
+			}
+			return cond.matches(ctx, item)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = sortByTerms(ctx, items, terms, true); err != nil {
+			return nil, err
+		}
+		if len(items) > limit {
+			items = items[:limit]
+		}
+		return svc.project(ctx, items, props)
+	}
+	return data.NewBatchIterator(ctx, fetch, terms, batchSize), nil
+}
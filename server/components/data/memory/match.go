@@ -0,0 +1,12 @@
+package memory
+
+import (
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+)
+
+// matches evaluates a bound condition against an object with the data package's evaluator, whose
+// semantics for null, missing fields and type coercion every reader of this store relies on.
+func (cond *condition) matches(ctx core.RequestContext, item core.Storable) (bool, error) {
+	return data.Evaluate(ctx, cond.filter, item, cond.params)
+}
@@ -0,0 +1,196 @@
+// Package memory is an in-process implementation of data.DataComponent.
+//
+// It exists for two audiences. Modules get a data service that needs no database, so their tests
+// run hermetically; provider authors get a behavioural reference for every method of the
+// contract — what a nil condition returns, how soft-deleted and other tenants' records are hidden,
+// when data events fire — written in the simplest code that honours it.
+//
+// Records are held as JSON snapshots rather than as the objects handed in. A caller that mutates
+// an object after saving it therefore does not mutate the store, which is what every real provider
+// guarantees and what a test relying on this one must be able to assume.
+package memory
+
+import (
+	"sync"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_MEMORY_VECTORFIELD names the []float32 field VectorSearch ranks records by.
+	CONF_MEMORY_VECTORFIELD = "vectorfield"
+)
+
+var _ data.DataComponent = (*MemoryDataComponent)(nil)
+
+// Function is a named operation run by Execute against the component's own records.
+type Function func(ctx core.RequestContext, svc *MemoryDataComponent, data interface{}, params utils.StringMap) (interface{}, error)
+
+// MemoryDataComponent holds the records of one object type in memory.
+type MemoryDataComponent struct {
+	core.Service
+	// VectorField names the []float32 field VectorSearch ranks records by. Empty disables vector
+	// search, which then fails rather than returning an empty result.
+	VectorField string
+
+	object     string
+	factory    core.ObjectFactory
+	conf       *core.StorableConfig
+	meta       *data.EntityMetadata
+	mu         sync.RWMutex
+	records    map[string]*record
+	revisions  map[string][]*revision
+	values     map[string]interface{}
+	seq        uint64
+	created    bool
+	indexes    map[string]core.IndexSpec
+	functions  map[string]Function
+	listeners  map[data.DataEventType][]core.MessageListener
+	txLock     sync.Mutex
+	inTx       bool
+	pending    []*dataEvent
+	collection string
+}
+
+// NewMemoryDataComponent creates a component configured from the service configuration when it is
+// initialized, for use as a declared data service.
+func NewMemoryDataComponent(ctx core.ServerContext) *MemoryDataComponent {
+	return &MemoryDataComponent{}
+}
+
+// NewMemoryDataComponentForObject creates a component for object whose instances are created by
+// factory. It needs no initialization, which is what a test wants.
+func NewMemoryDataComponentForObject(ctx core.ServerContext, object string, factory core.ObjectFactory) *MemoryDataComponent {
+	svc := &MemoryDataComponent{}
+	svc.setObject(ctx, object, factory)
+	return svc
+}
+
+func (svc *MemoryDataComponent) Describe(ctx core.ServerContext) error {
+	if svc.factory == nil {
+		svc.AddStringConfiguration(ctx, data.CONF_DATA_OBJECT, "Object stored by this service", "")
+		svc.AddStringConfiguration(ctx, data.CONF_DATA_COLLECTION, "Collection name reported by this service", "")
+		svc.AddStringConfiguration(ctx, CONF_MEMORY_VECTORFIELD, "Field holding the vector used by vector search", "")
+	}
+	return nil
+}
+
+func (svc *MemoryDataComponent) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if svc.factory != nil {
+		return nil
+	}
+	object, ok := svc.GetStringConfiguration(ctx, data.CONF_DATA_OBJECT)
+	if !ok || object == "" {
+		return errors.MissingConf(ctx, data.CONF_DATA_OBJECT)
+	}
+	factory, ok := ctx.GetObjectFactory(object)
+	if !ok {
+		return errors.BadConf(ctx, data.CONF_DATA_OBJECT)
+	}
+	svc.setObject(ctx, object, factory)
+	if collection, ok := svc.GetStringConfiguration(ctx, data.CONF_DATA_COLLECTION); ok && collection != "" {
+		svc.collection = collection
+	}
+	if field, ok := svc.GetStringConfiguration(ctx, CONF_MEMORY_VECTORFIELD); ok {
+		svc.VectorField = field
+	}
+	return nil
+}
+
+func (svc *MemoryDataComponent) setObject(ctx core.ServerContext, object string, factory core.ObjectFactory) {
+	svc.object = object
+	svc.factory = factory
+	svc.conf = &core.StorableConfig{}
+	if stor, ok := factory.CreateObject(ctx).(core.Storable); ok && stor.Config() != nil {
+		svc.conf = stor.Config()
+	}
+	svc.meta = data.EntityMetadataFor(ctx, object, factory)
+	svc.collection = svc.conf.Collection
+	if svc.collection == "" {
+		svc.collection = object
+	}
+	svc.records = make(map[string]*record)
+	svc.revisions = make(map[string][]*revision)
+	svc.values = make(map[string]interface{})
+	svc.indexes = make(map[string]core.IndexSpec)
+	svc.functions = make(map[string]Function)
+	svc.listeners = make(map[data.DataEventType][]core.MessageListener)
+}
+
+// RegisterFunction makes fn available to Execute under name.
+func (svc *MemoryDataComponent) RegisterFunction(name string, fn Function) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.functions[name] = fn
+}
+
+func (svc *MemoryDataComponent) GetDataServiceType() string {
+	return data.DATASERVICE_TYPE_NOSQL
+}
+
+func (svc *MemoryDataComponent) GetObject() string {
+	return svc.object
+}
+
+func (svc *MemoryDataComponent) GetCollection() string {
+	return svc.collection
+}
+
+func (svc *MemoryDataComponent) CreateObject(ctx core.RequestContext) interface{} {
+	return svc.factory.CreateObject(ctx)
+}
+
+func (svc *MemoryDataComponent) CreateObjectCollection(ctx core.RequestContext, len int) interface{} {
+	return svc.factory.CreateObjectCollection(ctx, len)
+}
+
+func (svc *MemoryDataComponent) CreateObjectPointersCollection(ctx core.RequestContext, len int) interface{} {
+	return svc.factory.CreateObjectPointersCollection(ctx, len)
+}
+
+func (svc *MemoryDataComponent) GetObjectFactory() core.ObjectFactory {
+	return svc.factory
+}
+
+// Supports reports membership queries only: the store has no ancestry and no embedded documents
+// of its own to search.
+func (svc *MemoryDataComponent) Supports(feature data.Feature) bool {
+	return feature == data.InQueries
+}
+
+// CreateDBCollection creates the collection with the indexes its entity declares.
+func (svc *MemoryDataComponent) CreateDBCollection(ctx core.ServerContext) error {
+	for _, index := range svc.conf.Indexes {
+		if err := svc.CreateIndex(ctx, index); err != nil {
+			return err
+		}
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.created = true
+	return nil
+}
+
+// DropDBCollection discards every record, key value and index, as dropping a table would.
+func (svc *MemoryDataComponent) DropDBCollection(ctx core.ServerContext) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.created = false
+	svc.records = make(map[string]*record)
+	svc.revisions = make(map[string][]*revision)
+	svc.values = make(map[string]interface{})
+	svc.indexes = make(map[string]core.IndexSpec)
+	return nil
+}
+
+// DBCollectionExists reports whether the collection was created and not dropped since. Writing
+// to a collection that was never created still succeeds, as it does on the schemaless stores.
+func (svc *MemoryDataComponent) DBCollectionExists(ctx core.ServerContext) (bool, error) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	return svc.created, nil
+}
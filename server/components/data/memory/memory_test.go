@@ -0,0 +1,364 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+func TestConformance(t *testing.T) {
+	datatest.Run(t, func(t *testing.T, ctx core.ServerContext, object string, objects core.ObjectFactory) data.DataComponent {
+		return NewMemoryDataComponentForObject(ctx, object, objects)
+	})
+}
+
+func newWidgets(t *testing.T, conf core.StorableConfig) (*MemoryDataComponent, *datatest.ObjectFactory, *datatest.RequestContext) {
+	t.Helper()
+	server := datatest.NewServerContext()
+	objects := datatest.NewObjectFactory("widget", conf)
+	return NewMemoryDataComponentForObject(server, "widget", objects), objects, datatest.NewRequestContext(server, "user1", "")
+}
+
+func saveWidgets(t *testing.T, svc *MemoryDataComponent, objects *datatest.ObjectFactory, c core.RequestContext, names ...string) {
+	t.Helper()
+	for i, name := range names {
+		if err := svc.Save(c, objects.NewRecord(name, i+1)); err != nil {
+			t.Fatalf("Save %s: %v", name, err)
+		}
+	}
+}
+
+func TestSaveIsASnapshot(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	item := objects.NewRecord("a", 1)
+	if err := svc.Save(c, item); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	item.Name = "changed"
+	got, err := svc.GetById(c, item.Id, "")
+	if err != nil {
+		t.Fatalf("GetById: %v", err)
+	}
+	if got.(*datatest.Record).Name != "a" {
+		t.Fatalf("stored record changed with the caller's object: %q", got.(*datatest.Record).Name)
+	}
+	if _, err = svc.GetById(c, "missing", ""); !errors.IsNotFound(err) {
+		t.Fatalf("missing id: want not found, got %v", err)
+	}
+}
+
+func TestQueryPagingAndOrdering(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	saveWidgets(t, svc, objects, c, "alpha", "beta", "gamma", "delta", "epsilon")
+
+	query := data.NewQuery()
+	query.Filter = &data.Logical{Operator: data.LogicalOr, Operands: []data.Predicate{
+		&data.Comparison{Field: "Size", Operator: data.OpGreaterEqual, Value: data.ParameterOperand("min")},
+		&data.FunctionCall{Function: data.FuncStartsWith, Field: "Name", Arguments: []data.Operand{data.LiteralOperand("al")}},
+	}}
+	cond, err := svc.CreateQueryCondition(c, query, utils.StringsMap{"min": "4"})
+	if err != nil {
+		t.Fatalf("CreateQueryCondition: %v", err)
+	}
+	items, ids, total, returned, err := svc.Get(c, nil, cond, 2, 1, "", []string{"Name desc"}, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if total != 3 || returned != 2 || len(ids) != 2 {
+		t.Fatalf("want 3 total and 2 returned, got %d and %d", total, returned)
+	}
+	if items[0].(*datatest.Record).Name != "epsilon" || items[1].(*datatest.Record).Name != "delta" {
+		t.Fatalf("unexpected order: %s, %s", items[0].(*datatest.Record).Name, items[1].(*datatest.Record).Name)
+	}
+	if n, err := svc.Count(c, nil); err != nil || n != 0 {
+		t.Fatalf("a nil condition must match nothing, got %d (%v)", n, err)
+	}
+	if _, err = svc.CreateQueryCondition(c, query, nil); err == nil {
+		t.Fatal("a required parameter that is not supplied must fail")
+	}
+}
+
+func TestNullSemantics(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	red := "red"
+	first := objects.NewRecord("a", 1)
+	first.Colour = &red
+	for _, item := range []*datatest.Record{first, objects.NewRecord("b", 2)} {
+		if err := svc.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	cases := []struct {
+		want   string
+		filter data.Predicate
+	}{
+		{"a", &data.Comparison{Field: "Colour", Operator: data.OpEqual, Value: data.LiteralOperand("red")}},
+		{"b", &data.NullTest{Field: "Colour"}},
+		{"a,b", &data.Comparison{Field: "Colour", Operator: data.OpNotEqual, Value: data.LiteralOperand("blue")}},
+		{"a", &data.Comparison{Field: "Colour", Operator: data.OpLess, Value: data.LiteralOperand("zzz")}},
+		{"b", &data.Comparison{Field: "Colour", Operator: data.OpEqual, Value: data.LiteralOperand(nil)}},
+	}
+	for _, tc := range cases {
+		want, filter := tc.want, tc.filter
+		query := data.NewQuery()
+		query.Filter = filter
+		cond, err := svc.CreateQueryCondition(c, query, nil)
+		if err != nil {
+			t.Fatalf("CreateQueryCondition: %v", err)
+		}
+		items, _, _, _, err := svc.Get(c, nil, cond, 0, 0, "", []string{"Name"}, "")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		got := ""
+		for i, item := range items {
+			if i > 0 {
+				got += ","
+			}
+			got += item.(*datatest.Record).Name
+		}
+		if got != want {
+			t.Errorf("%s: want %q, got %q", filter.Kind(), want, got)
+		}
+	}
+}
+
+// TestCollectionFields checks that a filter Validate accepts for a collection field matches element
+// by element.
+func TestCollectionFields(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	both, one, none := objects.NewRecord("both", 1), objects.NewRecord("one", 2), objects.NewRecord("none", 3)
+	both.Tags, one.Tags = []string{"a", "b"}, []string{"c"}
+	for _, item := range []*datatest.Record{both, one, none} {
+		if err := svc.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	meta := data.NewEntityMetadata("widget", &datatest.Record{})
+	cases := []struct {
+		filter string
+		want   string
+	}{
+		{"Tags eq 'a'", "both"},
+		{"Tags eq 'a' and Tags eq 'b'", "both"},
+		{"Tags ne 'a'", "none,one"},
+		{"Tags gt 'b'", "one"},
+		{"Tags in ('b','c')", "both,one"},
+		{"not (Tags in ('b'))", "none,one"},
+	}
+	for _, tc := range cases {
+		query, err := data.ParseODataFilter(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.filter, err)
+		}
+		if err = query.Validate(c, meta); err != nil {
+			t.Fatalf("%s: Validate: %v", tc.filter, err)
+		}
+		cond, err := svc.CreateQueryCondition(c, query, nil)
+		if err != nil {
+			t.Fatalf("%s: CreateQueryCondition: %v", tc.filter, err)
+		}
+		items, _, _, _, err := svc.Get(c, nil, cond, 0, 0, "", []string{"Name"}, "")
+		if err != nil {
+			t.Fatalf("%s: Get: %v", tc.filter, err)
+		}
+		names := make([]string, len(items))
+		for i, item := range items {
+			names[i] = item.(*datatest.Record).Name
+		}
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.filter, tc.want, got)
+		}
+	}
+}
+
+func TestSoftDeleteTenancyAndTracking(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{SoftDelete: true, Multitenant: true, Trackable: true})
+	c1, c2 := datatest.NewRequestContext(c.Server, "user1", "t1"), datatest.NewRequestContext(c.Server, "user2", "t2")
+	saveWidgets(t, svc, objects, c1, "one")
+	saveWidgets(t, svc, objects, c2, "two")
+
+	all, _, total, _, err := svc.GetList(c1, nil, 0, 0, "", nil, "")
+	if err != nil || total != 1 {
+		t.Fatalf("tenant t1 should see one record, got %d (%v)", total, err)
+	}
+	item := all[0].(*datatest.Record)
+	if item.TenantId != "t1" || item.CreatedBy != "user1" || item.CreatedAt.IsZero() {
+		t.Fatalf("record was not stamped: %+v", item)
+	}
+	if err = svc.Update(c2, item.Id, utils.StringMap{"Name": "stolen"}); !errors.IsNotFound(err) {
+		t.Fatalf("cross-tenant update: want not found, got %v", err)
+	}
+	if err = svc.Delete(c1, item.Id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = svc.GetById(c1, item.Id, ""); !errors.IsNotFound(err) {
+		t.Fatalf("soft-deleted record must not be found, got %v", err)
+	}
+	if len(svc.records) != 2 {
+		t.Fatalf("soft delete removed the record")
+	}
+}
+
+func TestTransactionRollbackAndEvents(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	var events []string
+	listener := func(ctx core.RequestContext, msg *core.Message, info utils.StringMap) error {
+		events = append(events, info["event"].(string)+":"+msg.Data.(*datatest.Record).Name)
+		return nil
+	}
+	for _, evt := range []data.DataEventType{data.EventDataCreated, data.EventDataUpdated, data.EventDataDeleted} {
+		if err := svc.Subscribe(c, "widget", evt, listener); err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+	saveWidgets(t, svc, objects, c, "kept")
+	failure := fmt.Errorf("abort")
+	err := svc.Transaction(c, func(ctx core.RequestContext) error {
+		saveWidgets(t, svc, objects, ctx, "discarded")
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Transaction: want the callback's error, got %v", err)
+	}
+	if n, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", nil, ""); len(n) != 1 {
+		t.Fatalf("rollback left %d records", len(n))
+	}
+	err = svc.Transaction(c, func(ctx core.RequestContext) error {
+		saveWidgets(t, svc, objects, ctx, "committed")
+		if len(events) != 1 {
+			t.Errorf("event delivered before commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Transaction: %v", err)
+	}
+	want := []string{"data.object.created:kept", "data.object.created:committed"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("want events %v, got %v", want, events)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("the callback's panic was not passed on")
+			}
+		}()
+		svc.Transaction(c, func(ctx core.RequestContext) error {
+			saveWidgets(t, svc, objects, ctx, "panicked")
+			panic("abort")
+		})
+	}()
+	saveWidgets(t, svc, objects, c, "after")
+	if items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", nil, ""); len(items) != 3 {
+		t.Errorf("a panicking transaction left %d records, want 3", len(items))
+	}
+	if want = append(want, "data.object.created:after"); fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("after a panicking transaction: want events %v, got %v", want, events)
+	}
+
+	// a refused write leaves the caller's items as they were
+	kept, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", nil, "")
+	fresh := objects.NewRecord("fresh", 9)
+	if err = svc.CreateMulti(c, []core.Storable{fresh, kept[0]}); err == nil {
+		t.Fatalf("CreateMulti of an existing id succeeded")
+	}
+	if fresh.Id != "" {
+		t.Errorf("a refused write gave the caller's item the id %q", fresh.Id)
+	}
+}
+
+// hookedWidget is a widget whose PostSave fails.
+type hookedWidget struct {
+	datatest.Record
+}
+
+func (w *hookedWidget) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "widget", Collection: "widget", PostSave: true}
+}
+
+func (w *hookedWidget) PostSave(cx ctx.Context) error {
+	return fmt.Errorf("hook failed")
+}
+
+func TestPostSaveFailureKeepsTheWrite(t *testing.T) {
+	server := datatest.NewServerContext()
+	c := datatest.NewRequestContext(server, "user1", "")
+	svc := NewMemoryDataComponentForObject(server, "widget", datatest.EntityFactory[hookedWidget]{})
+	var events []string
+	svc.Subscribe(c, "widget", data.EventDataCreated, func(ctx core.RequestContext, msg *core.Message, info utils.StringMap) error {
+		events = append(events, info["id"].(string))
+		return nil
+	})
+	item := &hookedWidget{}
+	item.Name = "a"
+	if err := svc.Save(c, item); err == nil {
+		t.Fatalf("the PostSave failure was not reported")
+	}
+	if _, err := svc.GetById(c, item.Id, ""); err != nil {
+		t.Errorf("the stored item was lost: %v", err)
+	}
+	if len(events) != 1 || events[0] != item.Id {
+		t.Errorf("the stored item's event was not delivered: %v", events)
+	}
+}
+
+func TestPurgeKeepsRevision(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{SoftDelete: true, Temporal: true})
+	item := objects.NewRecord("a", 1)
+	if err := svc.Save(c, item); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := svc.Delete(c, item.Id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if n, err := svc.Purge(c, time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Fatalf("Purge: %d %v", n, err)
+	}
+	revs, err := svc.GetRevisions(c, item.Id)
+	if err != nil {
+		t.Fatalf("GetRevisions: %v", err)
+	}
+	if last := revs[len(revs)-1]; !last.Purged || !last.Deleted || last.Item.(*datatest.Record).Name != "a" {
+		t.Errorf("want a last revision marking the purge, got %+v", last)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	// a collection that exists gets its missing indexes when the service starts
+	svc, objects, c := newWidgets(t, core.StorableConfig{Trackable: true, Indexes: []core.IndexSpec{{Fields: []string{"Name"}}}})
+	if err := svc.Start(c.Server); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if indexes, _ := svc.Indexes(c.Server); len(indexes) != 1 || indexes[0].Name != "Name" {
+		t.Fatalf("indexes after start: %v", indexes)
+	}
+	if err := svc.CreateIndex(c.Server, core.IndexSpec{Fields: []string{"Tags"}, Vector: &core.VectorIndex{Metric: core.VectorCosine}}); err == nil {
+		t.Errorf("created a vector index with no dimension")
+	}
+
+	// a TTL index hides the records it has expired
+	saveWidgets(t, svc, objects, c, "alpha", "beta")
+	if err := svc.CreateIndex(c.Server, core.IndexSpec{Fields: []string{"UpdatedAt"}, TTL: time.Hour}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if items, _, _, _, _ := svc.GetList(c, nil, -1, 1, "", nil, ""); len(items) != 2 {
+		t.Fatalf("records expired before their time: %d left", len(items))
+	}
+	if err := svc.CreateIndex(c.Server, core.IndexSpec{Fields: []string{"UpdatedAt"}, TTL: time.Millisecond}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if items, _, _, _, _ := svc.GetList(c, nil, -1, 1, "", nil, ""); len(items) != 0 {
+		t.Errorf("want expired records hidden, %d left", len(items))
+	}
+}
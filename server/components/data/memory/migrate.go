@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"encoding/json"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+var _ data.FieldMigrator = (*MemoryDataComponent)(nil)
+
+// The field migrations rewrite the stored snapshots directly, across every tenant and including
+// soft-deleted records, as a migration changes what is stored rather than what a request sees.
+// They raise no data events, and leave versions and revisions as they were.
+
+// AddField stores value in field on every record where it is missing or null.
+func (svc *MemoryDataComponent) AddField(ctx core.RequestContext, field string, value interface{}) (int, error) {
+	return svc.rewrite(ctx, func(fields map[string]interface{}) bool {
+		if current, ok := fields[field]; ok && current != nil {
+			return false
+		}
+		fields[field] = value
+		return true
+	})
+}
+
+// RenameField moves the value of from to to on every record that has from.
+func (svc *MemoryDataComponent) RenameField(ctx core.RequestContext, from string, to string) (int, error) {
+	return svc.rewrite(ctx, func(fields map[string]interface{}) bool {
+		val, ok := fields[from]
+		if !ok {
+			return false
+		}
+		delete(fields, from)
+		fields[to] = val
+		return true
+	})
+}
+
+// DropField removes field from every record that has it.
+func (svc *MemoryDataComponent) DropField(ctx core.RequestContext, field string) (int, error) {
+	return svc.rewrite(ctx, func(fields map[string]interface{}) bool {
+		if _, ok := fields[field]; !ok {
+			return false
+		}
+		delete(fields, field)
+		return true
+	})
+}
+
+// rewrite applies change to the fields of every snapshot, replacing the records it changes rather
+// than changing them in place, as an open transaction holds the records it would restore.
+func (svc *MemoryDataComponent) rewrite(ctx core.RequestContext, change func(fields map[string]interface{}) bool) (int, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	rewritten := make(map[string]*record)
+	for id, rec := range svc.records {
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(rec.data, &fields); err != nil {
+			return 0, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+		}
+		if !change(fields) {
+			continue
+		}
+		bytes, err := json.Marshal(fields)
+		if err != nil {
+			return 0, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+		}
+		replaced := *rec
+		replaced.data = bytes
+		replaced.expiresAt = svc.expiry(&replaced)
+		rewritten[id] = &replaced
+	}
+	for id, rec := range rewritten {
+		svc.records[id] = rec
+	}
+	return len(rewritten), nil
+}
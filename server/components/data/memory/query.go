@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"log/slog"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// compiledQuery is this provider's compiled form. There is nothing to translate a query into, so
+// compiling is checking: every node is one the evaluator understands, and the query is retained
+// for binding.
+type compiledQuery struct {
+	query *data.Query
+}
+
+// condition is a bound query: the predicates that survived parameter resolution, and the values
+// their parameters are compared against. A condition with no filter matches every record.
+type condition struct {
+	filter data.Predicate
+	params utils.StringsMap
+}
+
+// CreateCondition lowers field/value pairs into an equality query and binds it.
+func (svc *MemoryDataComponent) CreateCondition(ctx core.RequestContext, args utils.StringMap) (interface{}, error) {
+	return svc.CreateQueryCondition(ctx, data.NewEqualityQuery(args), nil)
+}
+
+// CreateQueryCondition compiles and binds a query in one step.
+func (svc *MemoryDataComponent) CreateQueryCondition(ctx core.RequestContext, query *data.Query, params utils.StringsMap) (interface{}, error) {
+	compiled, err := svc.CompileQuery(ctx.ServerContext(), query)
+	if err != nil {
+		return nil, err
+	}
+	return svc.BindQuery(ctx, compiled, params)
+}
+
+// CompileQuery validates the query against the object's fields, rejects extensions, and retains
+// the query for binding.
+func (svc *MemoryDataComponent) CompileQuery(ctx core.ServerContext, query *data.Query) (interface{}, error) {
+	if err := query.Validate(ctx, svc.meta); err != nil {
+		return nil, err
+	}
+	if err := checkExtensions(ctx, query.Filter); err != nil {
+		return nil, err
+	}
+	return &compiledQuery{query: query}, nil
+}
+
+// BindQuery resolves a compiled query against params, dropping optional predicates whose
+// parameters are absent. A required predicate whose parameter is absent fails here, rather than
+// being compared against an empty value and silently matching nothing.
+func (svc *MemoryDataComponent) BindQuery(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (interface{}, error) {
+	cq, ok := compiled.(*compiledQuery)
+	if !ok {
+		return nil, errors.BadArg(ctx, "compiled")
+	}
+	resolved := cq.query.Resolve(params)
+	for _, name := range resolved.Parameters() {
+		if _, ok := params[name]; !ok {
+			return nil, errors.MissingArg(ctx, name)
+		}
+	}
+	return &condition{filter: resolved.Filter, params: params}, nil
+}
+
+// SupportsQuery reports every capability: the evaluator implements the whole predicate grammar
+// and every shaping clause.
+// Extensions are not capabilities: those registered with data.RegisterExtension are evaluated
+// like the rest of the grammar, and any other is rejected at compile time.
+func (svc *MemoryDataComponent) SupportsQuery(capability data.QueryCapability) bool {
+	switch capability {
+	case data.CapabilityComparison, data.CapabilityDisjunction, data.CapabilityNegation,
+		data.CapabilityMembership, data.CapabilityNullTest, data.CapabilityStringFunctions,
+		data.CapabilityNesting, data.CapabilityProjection, data.CapabilityOrdering, data.CapabilityPaging,
+		data.CapabilityKeyset, data.CapabilityAggregation:
+		return true
+	}
+	return false
+}
+
+// checkExtensions rejects the extensions with no registered evaluator. Everything else the
+// evaluator runs, and Validate has already checked it.
+func checkExtensions(ctx core.ServerContext, predicate data.Predicate) error {
+	switch node := predicate.(type) {
+	case *data.Logical:
+		for _, operand := range node.Operands {
+			if err := checkExtensions(ctx, operand); err != nil {
+				return err
+			}
+		}
+	case *data.Not:
+		return checkExtensions(ctx, node.Operand)
+	case *data.Extension:
+		if _, ok := data.LookupExtension(node.Namespace, node.Name); !ok {
+			return errors.BadArg(ctx, "Extension", slog.String("Namespace", node.Namespace), slog.String("Name", node.Name))
+		}
+	}
+	return nil
+}
+
+// toCondition asserts a condition produced by this provider. nil is permitted and reported as
+// such, because a nil condition matches nothing rather than everything.
+func toCondition(ctx core.RequestContext, queryCond interface{}) (*condition, error) {
+	if queryCond == nil {
+		return nil, nil
+	}
+	cond, ok := queryCond.(*condition)
+	if !ok {
+		return nil, errors.BadArg(ctx, "queryCond")
+	}
+	return cond, nil
+}
@@ -0,0 +1,310 @@
+package memory
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// sortedIds lists record ids in the order the records were first stored, which is the order every
+// read returns when no ordering is asked for. The caller holds the lock.
+func (svc *MemoryDataComponent) sortedIds() []string {
+	ids := make([]string, 0, len(svc.records))
+	for id := range svc.records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return svc.records[ids[i]].seq < svc.records[ids[j]].seq
+	})
+	return ids
+}
+
+// selectItems decodes every visible record accepted by match, in storage order.
+func (svc *MemoryDataComponent) selectItems(ctx core.RequestContext, match func(string, core.Storable) (bool, error)) ([]core.Storable, error) {
+	tenant := svc.tenantOf(ctx)
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	var items []core.Storable
+	for _, id := range svc.sortedIds() {
+		rec := svc.records[id]
+		if !rec.visible(tenant) {
+			continue
+		}
+		item, err := svc.decode(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := match(id, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// selectWhere decodes every visible record matching a condition. A nil condition matches nothing.
+func (svc *MemoryDataComponent) selectWhere(ctx core.RequestContext, queryCond interface{}) ([]core.Storable, error) {
+	cond, err := toCondition(ctx, queryCond)
+	if err != nil || cond == nil {
+		return nil, err
+	}
+	return svc.selectItems(ctx, func(id string, item core.Storable) (bool, error) {
+		return cond.matches(ctx, item)
+	})
+}
+
+// GetById returns the record with id. A record that does not exist, is soft-deleted or belongs to
+// another tenant is not found.
+func (svc *MemoryDataComponent) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	tenant := svc.tenantOf(ctx)
+	svc.mu.RLock()
+	rec, ok := svc.records[id]
+	svc.mu.RUnlock()
+	if !ok || !rec.visible(tenant) {
+		return nil, errors.NotFound(ctx, svc.object, slog.String("Id", id))
+	}
+	return svc.decode(ctx, rec)
+}
+
+// GetMultiHash returns the records with ids keyed by id. Ids with no visible record are absent
+// from the result rather than an error.
+func (svc *MemoryDataComponent) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	items, err := svc.GetMulti(ctx, props, ids, nil, dao)
+	if err != nil {
+		return nil, err
+	}
+	return data.StorableArrayToMap(items), nil
+}
+
+// GetMulti returns the records with ids, in the order of ids unless orderBy is given. Ids with no
+// visible record are skipped.
+func (svc *MemoryDataComponent) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	items, err := svc.selectItems(ctx, func(id string, item core.Storable) (bool, error) {
+		return utils.StrContains(ids, id) >= 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(orderBy) == 0 {
+		byId := data.StorableArrayToMap(items)
+		items = items[:0]
+		for _, id := range ids {
+			if item, ok := byId[id]; ok {
+				items = append(items, item)
+				delete(byId, id)
+			}
+		}
+	} else if err = svc.order(ctx, items, orderBy); err != nil {
+		return nil, err
+	}
+	return svc.project(ctx, items, props)
+}
+
+// Get returns one page of the records matching queryCond. pageNum counts from 1, and a pageSize
+// of zero or less returns every match. totalrecs counts every match, not just the page. A nil
+// condition matches nothing.
+func (svc *MemoryDataComponent) Get(ctx core.RequestContext, props []string, queryCond interface{}, pageSize int, pageNum int, mode string, orderBy []string, dao string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error) {
+	items, err := svc.selectWhere(ctx, queryCond)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	return svc.page(ctx, items, props, pageSize, pageNum, orderBy)
+}
+
+// GetOne returns the first record matching queryCond, and a not found error when there is none.
+func (svc *MemoryDataComponent) GetOne(ctx core.RequestContext, props []string, queryCond interface{}, dao string) (dataToReturn core.Storable, err error) {
+	items, err := svc.selectWhere(ctx, queryCond)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.NotFound(ctx, svc.object)
+	}
+	items, err = svc.project(ctx, items[:1], props)
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// GetList returns one page of every visible record.
+func (svc *MemoryDataComponent) GetList(ctx core.RequestContext, props []string, pageSize int, pageNum int, mode string, orderBy []string, dao string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error) {
+	items, err := svc.selectItems(ctx, func(id string, item core.Storable) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	return svc.page(ctx, items, props, pageSize, pageNum, orderBy)
+}
+
+func (svc *MemoryDataComponent) page(ctx core.RequestContext, items []core.Storable, props []string, pageSize int, pageNum int, orderBy []string) ([]core.Storable, []string, int, int, error) {
+	if err := svc.order(ctx, items, orderBy); err != nil {
+		return nil, nil, -1, -1, err
+	}
+	totalrecs := len(items)
+	if pageSize > 0 {
+		if pageNum < 1 {
+			pageNum = 1
+		}
+		start := (pageNum - 1) * pageSize
+		if start > len(items) {
+			start = len(items)
+		}
+		end := start + pageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		items = items[start:end]
+	}
+	items, err := svc.project(ctx, items, props)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.GetId()
+	}
+	return items, ids, totalrecs, len(items), nil
+}
+
+// order sorts items by orderBy, as data.ParseOrderBy reads it. Nulls sort first.
+func (svc *MemoryDataComponent) order(ctx core.RequestContext, items []core.Storable, orderBy []string) error {
+	return sortByTerms(ctx, items, data.ParseOrderBy(orderBy), false)
+}
+
+// project reduces items to the fields in props, keeping the id. An empty props returns items
+// whole.
+func (svc *MemoryDataComponent) project(ctx core.RequestContext, items []core.Storable, props []string) ([]core.Storable, error) {
+	if len(props) == 0 {
+		return items, nil
+	}
+	res := make([]core.Storable, len(items))
+	for i, item := range items {
+		projected, err := svc.newObject(ctx)
+		if err != nil {
+			return nil, err
+		}
+		projected.SetId(item.GetId())
+		src, dst := reflect.ValueOf(item).Elem(), reflect.ValueOf(projected).Elem()
+		for _, prop := range props {
+			field := src.FieldByName(prop)
+			if !field.IsValid() {
+				return nil, errors.BadArg(ctx, "props", slog.String("Field", prop))
+			}
+			dst.FieldByName(prop).Set(field)
+		}
+		res[i] = projected
+	}
+	return res, nil
+}
+
+// Count counts the records matching queryCond. A nil condition matches nothing.
+func (svc *MemoryDataComponent) Count(ctx core.RequestContext, queryCond interface{}) (count int, err error) {
+	items, err := svc.selectWhere(ctx, queryCond)
+	if err != nil {
+		return -1, err
+	}
+	return len(items), nil
+}
+
+// CountGroups counts the records matching queryCond by the value of the group field. Every id in
+// groupids is present in the result, with zero when no record has that value; a nil or empty
+// groupids counts every value found.
+func (svc *MemoryDataComponent) CountGroups(ctx core.RequestContext, queryCond interface{}, groupids []string, group string) (res utils.StringMap, err error) {
+	items, err := svc.selectWhere(ctx, queryCond)
+	if err != nil {
+		return nil, err
+	}
+	res = make(utils.StringMap, len(groupids))
+	for _, id := range groupids {
+		res[id] = 0
+	}
+	for _, item := range items {
+		val, ok := data.FieldValue(item, group)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprint(val)
+		if len(groupids) > 0 && utils.StrContains(groupids, key) < 0 {
+			continue
+		}
+		count, _ := res[key].(int)
+		res[key] = count + 1
+	}
+	return res, nil
+}
+
+// VectorSearch ranks the records matching filter by the similarity of their vectors to vector, most
+// similar first, by the metric of the field's vector index or by cosine similarity when it has
+// none. The field is VectorField, or the field of the vector index when that is not set. Unlike the
+// other reads, a nil filter here means no filter, since narrowing a similarity search is optional.
+func (svc *MemoryDataComponent) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]data.VectorResult, error) {
+	field, metric := svc.vectorIndex()
+	if field == "" {
+		return nil, errors.NotImplemented(ctx, "VectorSearch", slog.String("Object", svc.object))
+	}
+	var items []core.Storable
+	var err error
+	if filter == nil {
+		items, err = svc.selectItems(ctx, func(id string, item core.Storable) (bool, error) {
+			return true, nil
+		})
+	} else {
+		items, err = svc.selectWhere(ctx, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := make([]data.VectorResult, 0, len(items))
+	for _, item := range items {
+		val, ok := data.FieldValue(item, field)
+		if !ok {
+			continue
+		}
+		candidate, ok := val.([]float32)
+		if !ok {
+			return nil, errors.TypeMismatch(ctx, slog.String("Field", field))
+		}
+		score, dist := data.VectorSimilarity(metric, vector, candidate)
+		results = append(results, data.VectorResult{Item: item, Score: score, Dist: dist})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// vectorIndex returns the field vector search ranks records by and the metric it ranks them with.
+func (svc *MemoryDataComponent) vectorIndex() (string, core.VectorMetric) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	field := svc.VectorField
+	names := make([]string, 0, len(svc.indexes))
+	for name := range svc.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		index := svc.indexes[name]
+		if index.Vector == nil {
+			continue
+		}
+		if indexed, _ := data.IndexField(index.Fields[0]); field == "" || indexed == field {
+			return indexed, index.Vector.Metric
+		}
+	}
+	return field, core.VectorCosine
+}
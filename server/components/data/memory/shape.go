@@ -0,0 +1,277 @@
+package memory
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// Query binds params to a compiled query and runs it. Entities are ordered by OrderBy and then by
+// id; group rows by OrderBy and then in the order their groups were first met.
+func (svc *MemoryDataComponent) Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*data.QueryPage, error) {
+	queryCond, err := svc.BindQuery(ctx, compiled, params)
+	if err != nil {
+		return nil, err
+	}
+	query := compiled.(*compiledQuery).query
+	items, err := svc.selectWhere(ctx, queryCond)
+	if err != nil {
+		return nil, err
+	}
+	if query.Grouped() {
+		groups, err := aggregate(ctx, items, query)
+		if err != nil {
+			return nil, err
+		}
+		if err = sortGroups(ctx, groups, query.OrderBy); err != nil {
+			return nil, err
+		}
+		total := len(groups)
+		start, end := pageBounds(len(groups), query.Skip, query.Top)
+		return &data.QueryPage{Groups: groups[start:end], Total: total}, nil
+	}
+	if err = sortByTerms(ctx, items, query.OrderBy, true); err != nil {
+		return nil, err
+	}
+	page := &data.QueryPage{Total: len(items)}
+	after := query.After
+	if token, ok := params[data.CursorParameter]; ok {
+		if after, err = data.ParseCursor(token); err != nil {
+			return nil, errors.BadArg(ctx, data.CursorParameter, slog.String("Error", err.Error()))
+		}
+	}
+	if after != nil {
+		first := len(items)
+		for i, item := range items {
+			res, err := compareToCursor(ctx, item, query.OrderBy, after)
+			if err != nil {
+				return nil, err
+			}
+			if res > 0 {
+				first = i
+				break
+			}
+		}
+		items = items[first:]
+	}
+	start, end := pageBounds(len(items), query.Skip, query.Top)
+	if query.Top > 0 && end < len(items) {
+		page.Next = data.CursorAt(items[end-1], query.OrderBy)
+	}
+	if page.Items, err = svc.project(ctx, items[start:end], query.Select); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// pageBounds returns the slice bounds of the rows skip and top leave out of n.
+func pageBounds(n int, skip int, top int) (int, int) {
+	start := skip
+	if start > n {
+		start = n
+	}
+	end := n
+	if top > 0 && start+top < n {
+		end = start + top
+	}
+	return start, end
+}
+
+// sortByTerms sorts items by terms, nulls first, breaking ties by id when byId is set and by
+// storage order otherwise.
+func sortByTerms(ctx core.RequestContext, items []core.Storable, terms []data.OrderTerm, byId bool) error {
+	if len(terms) == 0 && !byId {
+		return nil
+	}
+	var sortErr error
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, term := range terms {
+			right, rok := data.FieldValue(items[j], term.Field)
+			res, err := compareTerm(ctx, items[i], term, right, rok)
+			if err != nil && sortErr == nil {
+				sortErr = err
+			}
+			if res != 0 {
+				return res < 0
+			}
+		}
+		return byId && items[i].GetId() < items[j].GetId()
+	})
+	return sortErr
+}
+
+// compareTerm orders item's value of a term's field against another value of that field, which is
+// null when ok is false. Nulls sort first; a descending term reverses the result.
+func compareTerm(ctx core.RequestContext, item interface{}, term data.OrderTerm, other interface{}, ok bool) (int, error) {
+	val, found := data.FieldValue(item, term.Field)
+	var res int
+	switch {
+	case !found && !ok:
+	case !found:
+		res = -1
+	case !ok:
+		res = 1
+	default:
+		var err error
+		if res, err = data.CompareValues(ctx, term.Field, val, other); err != nil {
+			return 0, err
+		}
+	}
+	if term.Descending {
+		res = -res
+	}
+	return res, nil
+}
+
+// compareToCursor orders item against the position a cursor marks.
+func compareToCursor(ctx core.RequestContext, item core.Storable, terms []data.OrderTerm, cursor *data.Cursor) (int, error) {
+	if len(cursor.Values) != len(terms) {
+		return 0, errors.BadArg(ctx, "After", slog.Int("Values", len(cursor.Values)), slog.Int("OrderBy", len(terms)))
+	}
+	for i, term := range terms {
+		res, err := compareTerm(ctx, item, term, cursor.Values[i], cursor.Values[i] != nil)
+		if err != nil || res != 0 {
+			return res, err
+		}
+	}
+	return strings.Compare(item.GetId(), cursor.Id), nil
+}
+
+// accumulator gathers one aggregate over the rows of a group.
+type accumulator struct {
+	aggregate data.Aggregate
+	count     int
+	sum       float64
+	extreme   interface{}
+}
+
+func (acc *accumulator) add(ctx core.RequestContext, item core.Storable) error {
+	if acc.aggregate.Field == "" {
+		acc.count++
+		return nil
+	}
+	val, ok := data.FieldValue(item, acc.aggregate.Field)
+	if !ok {
+		return nil
+	}
+	acc.count++
+	switch acc.aggregate.Function {
+	case data.AggregateSum, data.AggregateAvg:
+		num, err := data.AsFloat(val)
+		if err != nil {
+			return errors.BadArg(ctx, acc.aggregate.Field, slog.String("Error", err.Error()))
+		}
+		acc.sum += num
+	case data.AggregateMin, data.AggregateMax:
+		if acc.count == 1 {
+			acc.extreme = val
+			return nil
+		}
+		res, err := data.CompareValues(ctx, acc.aggregate.Field, val, acc.extreme)
+		if err != nil {
+			return err
+		}
+		if (acc.aggregate.Function == data.AggregateMin && res < 0) || (acc.aggregate.Function == data.AggregateMax && res > 0) {
+			acc.extreme = val
+		}
+	}
+	return nil
+}
+
+// result returns the aggregate's value. Every function but count is null over no values.
+func (acc *accumulator) result() interface{} {
+	if acc.aggregate.Function == data.AggregateCount {
+		return acc.count
+	}
+	if acc.count == 0 {
+		return nil
+	}
+	switch acc.aggregate.Function {
+	case data.AggregateSum:
+		return acc.sum
+	case data.AggregateAvg:
+		return acc.sum / float64(acc.count)
+	}
+	return acc.extreme
+}
+
+// aggregate groups items by the query's GroupBy fields and computes its aggregates over each
+// group. Without GroupBy every item is in one group, which is reported even when it is empty.
+func aggregate(ctx core.RequestContext, items []core.Storable, query *data.Query) ([]utils.StringMap, error) {
+	type group struct {
+		row          utils.StringMap
+		accumulators []*accumulator
+	}
+	newGroup := func(item core.Storable) *group {
+		g := &group{row: make(utils.StringMap, len(query.GroupBy)+len(query.Aggregates))}
+		for _, field := range query.GroupBy {
+			g.row[field], _ = data.FieldValue(item, field)
+		}
+		for _, agg := range query.Aggregates {
+			g.accumulators = append(g.accumulators, &accumulator{aggregate: agg})
+		}
+		return g
+	}
+	var groups []*group
+	byKey := make(map[string]*group)
+	if len(query.GroupBy) == 0 {
+		groups = append(groups, newGroup(nil))
+	}
+	for _, item := range items {
+		var g *group
+		if len(query.GroupBy) == 0 {
+			g = groups[0]
+		} else {
+			key := make([]string, len(query.GroupBy))
+			for i, field := range query.GroupBy {
+				if val, ok := data.FieldValue(item, field); ok {
+					key[i] = fmt.Sprintf("%T:%v", val, val)
+				}
+			}
+			joined := strings.Join(key, "\x00")
+			if g = byKey[joined]; g == nil {
+				g = newGroup(item)
+				byKey[joined] = g
+				groups = append(groups, g)
+			}
+		}
+		for _, acc := range g.accumulators {
+			if err := acc.add(ctx, item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	rows := make([]utils.StringMap, len(groups))
+	for i, g := range groups {
+		for _, acc := range g.accumulators {
+			g.row[acc.aggregate.Name()] = acc.result()
+		}
+		rows[i] = g.row
+	}
+	return rows, nil
+}
+
+// sortGroups orders group rows by terms naming their fields and aggregates, nulls first.
+func sortGroups(ctx core.RequestContext, groups []utils.StringMap, terms []data.OrderTerm) error {
+	var sortErr error
+	sort.SliceStable(groups, func(i, j int) bool {
+		for _, term := range terms {
+			right, rok := data.FieldValue(groups[j], term.Field)
+			res, err := compareTerm(ctx, groups[i], term, right, rok)
+			if err != nil && sortErr == nil {
+				sortErr = err
+			}
+			if res != 0 {
+				return res < 0
+			}
+		}
+		return false
+	})
+	return sortErr
+}
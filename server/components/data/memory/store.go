@@ -0,0 +1,239 @@
+package memory
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+// record is one stored object. The tenant, deletion and version are copied out of the snapshot
+// when it is written, so that hiding, purging or checking a record never needs it decoded.
+type record struct {
+	data      []byte
+	seq       uint64
+	tenant    string
+	deleted   bool
+	deletedAt time.Time
+	version   string
+	expiresAt time.Time
+}
+
+// revision is one stored state of a record of a Temporal object, and when it was written.
+type revision struct {
+	rec     *record
+	at      time.Time
+	deleted bool
+	purged  bool
+}
+
+// dataEvent is a write waiting to be reported to the listeners subscribed to its type.
+type dataEvent struct {
+	eventType data.DataEventType
+	id        string
+	item      core.Storable
+}
+
+// tenantOf returns the tenant a request is scoped to, or the empty string when the object is not
+// multitenant or the request carries no tenant — in which case every tenant's records are visible.
+func (svc *MemoryDataComponent) tenantOf(ctx core.RequestContext) string {
+	if !svc.conf.Multitenant {
+		return ""
+	}
+	tenant := ctx.GetTenant()
+	if tenant == nil {
+		return ""
+	}
+	return tenant.GetTenantId()
+}
+
+// userOf returns the id of the user a request is made by, or the empty string when it carries none.
+func userOf(ctx core.RequestContext) string {
+	if user := ctx.GetUser(); user != nil {
+		return user.GetId()
+	}
+	return ""
+}
+
+// visible reports whether a record may be returned to a request scoped to tenant. Soft-deleted
+// records are never visible, whether or not the object is configured for soft deletes, matching
+// what CastToStorableCollection does for every other provider; nor are records a TTL index has
+// expired.
+func (rec *record) visible(tenant string) bool {
+	if rec == nil || rec.deleted || rec.expired(time.Now()) {
+		return false
+	}
+	return tenant == "" || rec.tenant == tenant
+}
+
+// newObject creates an empty instance of the object through its factory.
+func (svc *MemoryDataComponent) newObject(ctx core.RequestContext) (core.Storable, error) {
+	stor, ok := svc.factory.CreateObject(ctx).(core.Storable)
+	if !ok {
+		return nil, errors.TypeMismatch(ctx, slog.String("Object", svc.object))
+	}
+	return stor, nil
+}
+
+// decode materialises a snapshot as a new object, running PostLoad when the object asks for it.
+func (svc *MemoryDataComponent) decode(ctx core.RequestContext, rec *record) (core.Storable, error) {
+	stor, err := svc.newObject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(rec.data, stor); err != nil {
+		return nil, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+	}
+	if svc.conf.PostLoad {
+		if err = stor.PostLoad(ctx); err != nil {
+			return nil, errors.WrapError(ctx, err)
+		}
+	}
+	return stor, nil
+}
+
+// encode snapshots an object into a record, without assigning it a position.
+func (svc *MemoryDataComponent) encode(ctx core.RequestContext, item core.Storable) (*record, error) {
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return nil, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+	}
+	rec := &record{data: bytes}
+	if mt, ok := item.(data.Multitenant); ok {
+		rec.tenant = mt.GetTenantId()
+	}
+	if sd, ok := item.(data.SoftDeletable); ok {
+		rec.deleted = sd.IsDeleted()
+	}
+	if dt, ok := item.(data.DeletionTracked); ok {
+		rec.deletedAt = dt.GetDeletedAt()
+	}
+	if v, ok := item.(data.Versionable); ok {
+		rec.version = v.GetVersion()
+	}
+	return rec, nil
+}
+
+// merge applies field values to a snapshot and reads the result back through the object, so that
+// a value of the wrong type fails here rather than being stored.
+func (svc *MemoryDataComponent) merge(ctx core.RequestContext, rec *record, newVals utils.StringMap) (core.Storable, error) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(rec.data, &fields); err != nil {
+		return nil, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+	}
+	for field, val := range newVals {
+		if field == "Id" {
+			continue
+		}
+		fields[field] = val
+	}
+	bytes, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+	}
+	stor, err := svc.newObject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, stor); err != nil {
+		return nil, errors.BadArg(ctx, "newVals", slog.String("Error", err.Error()))
+	}
+	return stor, nil
+}
+
+// prepare readies an object for storage: it gets an id if it has none, is stamped with its tenant
+// and its tracking fields, and runs PreSave.
+func (svc *MemoryDataComponent) prepare(ctx core.RequestContext, item core.Storable) error {
+	if item == nil {
+		return errors.MissingArg(ctx, "item")
+	}
+	if item.GetId() == "" {
+		item.SetId(ctx.CreateUUID())
+	}
+	if svc.conf.Multitenant {
+		if mt, ok := item.(data.Multitenant); ok && ctx.GetTenant() != nil {
+			mt.SetTenantInfo(ctx.GetTenant())
+		}
+	}
+	if svc.conf.Trackable {
+		data.Track(ctx, item)
+	}
+	if svc.conf.PreSave {
+		if err := item.PreSave(ctx); err != nil {
+			return errors.WrapError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// store writes a record under id, keeping the position of the record it replaces. The caller holds
+// the write lock.
+func (svc *MemoryDataComponent) store(id string, rec *record) data.DataEventType {
+	rec.expiresAt = svc.expiry(rec)
+	svc.revise(id, rec, rec.deleted)
+	if existing, ok := svc.records[id]; ok {
+		rec.seq = existing.seq
+		svc.records[id] = rec
+		if existing.deleted {
+			return data.EventDataCreated
+		}
+		return data.EventDataUpdated
+	}
+	svc.seq++
+	rec.seq = svc.seq
+	svc.records[id] = rec
+	return data.EventDataCreated
+}
+
+// revise keeps rec as the latest revision of the record with id, when the object is Temporal. The
+// caller holds the write lock.
+func (svc *MemoryDataComponent) revise(id string, rec *record, deleted bool) {
+	if svc.conf.Temporal {
+		svc.revisions[id] = append(svc.revisions[id], &revision{rec: rec, at: time.Now(), deleted: deleted})
+	}
+}
+
+// latestVersion returns the version of the record with id, or of its last revision when it has
+// been deleted, and reports false when it has never been stored. The caller holds the lock.
+func (svc *MemoryDataComponent) latestVersion(id string) (string, bool) {
+	if rec, ok := svc.records[id]; ok {
+		return rec.version, true
+	}
+	if revs := svc.revisions[id]; len(revs) > 0 {
+		return revs[len(revs)-1].rec.version, true
+	}
+	return "", false
+}
+
+// raise queues an event for delivery once the write lock is released. Inside a transaction the
+// event is held until the transaction commits, and discarded if it does not.
+func (svc *MemoryDataComponent) raise(eventType data.DataEventType, id string, item core.Storable) []*dataEvent {
+	evt := &dataEvent{eventType: eventType, id: id, item: item}
+	if svc.inTx {
+		svc.pending = append(svc.pending, evt)
+		return nil
+	}
+	return []*dataEvent{evt}
+}
+
+// deliver hands events to their listeners. Listener errors are logged rather than returned: the
+// write they report has already happened, and failing it now would tell the caller otherwise.
+func (svc *MemoryDataComponent) deliver(ctx core.RequestContext, events []*dataEvent) {
+	for _, evt := range events {
+		svc.mu.RLock()
+		listeners := svc.listeners[evt.eventType]
+		svc.mu.RUnlock()
+		msg := &core.Message{Data: evt.item, Tenant: ctx.GetTenant(), User: ctx.GetUser()}
+		info := utils.StringMap{"object": svc.object, "id": evt.id, "event": string(evt.eventType)}
+		for _, listener := range listeners {
+			if err := listener(ctx, msg, info); err != nil {
+				log.Error(ctx, "Data event listener failed", slog.String("Object", svc.object), slog.String("Id", evt.id), slog.String("Error", err.Error()))
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"log/slog"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// GetAsOf returns the record with id as it was at a time: its last revision written no later than
+// at. A record with no revision by then, or whose last one deleted it, is not found, as is one
+// belonging to another tenant.
+func (svc *MemoryDataComponent) GetAsOf(ctx core.RequestContext, id string, at time.Time) (core.Storable, error) {
+	revs, err := svc.revisionsOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var found *revision
+	for _, rev := range revs {
+		if rev.at.After(at) {
+			break
+		}
+		found = rev
+	}
+	if found == nil || found.deleted {
+		return nil, errors.NotFound(ctx, svc.object, slog.String("Id", id), slog.Time("At", at))
+	}
+	return svc.decode(ctx, found.rec)
+}
+
+// GetRevisions returns every revision of the record with id, oldest first. A record with none, or
+// belonging to another tenant, is not found.
+func (svc *MemoryDataComponent) GetRevisions(ctx core.RequestContext, id string) ([]data.Revision, error) {
+	revs, err := svc.revisionsOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return nil, errors.NotFound(ctx, svc.object, slog.String("Id", id))
+	}
+	res := make([]data.Revision, len(revs))
+	for i, rev := range revs {
+		item, err := svc.decode(ctx, rev.rec)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = data.Revision{Version: rev.rec.version, At: rev.at, Deleted: rev.deleted, Purged: rev.purged, Item: item}
+	}
+	return res, nil
+}
+
+// revisionsOf returns the revisions of the record with id visible to a request, failing when the
+// object does not keep revisions.
+func (svc *MemoryDataComponent) revisionsOf(ctx core.RequestContext, id string) ([]*revision, error) {
+	if !svc.conf.Temporal {
+		return nil, errors.BadConf(ctx, "Temporal", slog.String("Object", svc.object))
+	}
+	tenant := svc.tenantOf(ctx)
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	revs := svc.revisions[id]
+	if len(revs) > 0 && tenant != "" && revs[len(revs)-1].rec.tenant != tenant {
+		return nil, nil
+	}
+	return revs, nil
+}
@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"log/slog"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+var _ data.TenantRouter = (*MemoryDataComponent)(nil)
+
+// ForTenant returns a component holding the records of tenant apart from this one's. The store
+// has no databases, so a tenant's database is a store of its own as its collection is; only the
+// collection it reports differs, being named for the tenant when each has a collection.
+func (svc *MemoryDataComponent) ForTenant(ctx core.ServerContext, tenant string, strategy data.TenantStrategy) (data.DataComponent, error) {
+	comp := NewMemoryDataComponentForObject(ctx, svc.object, svc.factory)
+	comp.VectorField = svc.VectorField
+	switch strategy {
+	case data.TenantCollection:
+		comp.collection = svc.collection + "_" + tenant
+	case data.TenantDatabase:
+		comp.collection = svc.collection
+	default:
+		return nil, errors.BadArg(ctx, "strategy", slog.String("Strategy", string(strategy)))
+	}
+	svc.mu.RLock()
+	created := svc.created
+	for name, fn := range svc.functions {
+		comp.functions[name] = fn
+	}
+	svc.mu.RUnlock()
+	if created {
+		if err := comp.CreateDBCollection(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return comp, nil
+}
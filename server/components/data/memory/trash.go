@@ -0,0 +1,117 @@
+package memory
+
+import (
+	"log/slog"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// deletedVisible reports whether a soft-deleted record may be returned to a request scoped to
+// tenant.
+func (rec *record) deletedVisible(tenant string) bool {
+	return rec != nil && rec.deleted && (tenant == "" || rec.tenant == tenant)
+}
+
+// Restore clears the deletion of soft-deleted records. It fails without restoring any of them when
+// one is not a deleted record visible to the request.
+func (svc *MemoryDataComponent) Restore(ctx core.RequestContext, ids []string) error {
+	vals := utils.StringMap{data.FIELD_SOFTDELETE: false, data.FIELD_DELETEDAT: time.Time{}, data.FIELD_DELETEDBY: ""}
+	if svc.conf.Trackable {
+		data.Track(ctx, map[string]interface{}(vals))
+	}
+	tenant := svc.tenantOf(ctx)
+	svc.mu.Lock()
+	recs := make([]*record, len(ids))
+	items := make([]core.Storable, len(ids))
+	for i, id := range ids {
+		rec := svc.records[id]
+		if !rec.deletedVisible(tenant) {
+			svc.mu.Unlock()
+			return errors.NotFound(ctx, svc.object, slog.String("Id", id))
+		}
+		if svc.conf.Versioned || svc.conf.Temporal {
+			vals[data.FIELD_VERSION] = data.NextVersion(rec.version)
+		}
+		item, err := svc.merge(ctx, rec, vals)
+		if err != nil {
+			svc.mu.Unlock()
+			return err
+		}
+		newRec, err := svc.encode(ctx, item)
+		if err != nil {
+			svc.mu.Unlock()
+			return err
+		}
+		// cleared whether or not the object embeds DeletionInfo, as a soft delete sets it
+		newRec.deleted, newRec.deletedAt = false, time.Time{}
+		recs[i], items[i] = newRec, item
+	}
+	if err := svc.checkUnique(ctx, items); err != nil {
+		svc.mu.Unlock()
+		return err
+	}
+	var events []*dataEvent
+	for i, id := range ids {
+		svc.store(id, recs[i])
+		events = append(events, svc.raise(data.EventDataRestored, id, items[i])...)
+	}
+	svc.mu.Unlock()
+	svc.deliver(ctx, events)
+	return nil
+}
+
+// ListDeleted returns one page of the soft-deleted records visible to the request.
+func (svc *MemoryDataComponent) ListDeleted(ctx core.RequestContext, props []string, pageSize int, pageNum int, orderBy []string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error) {
+	tenant := svc.tenantOf(ctx)
+	svc.mu.RLock()
+	var items []core.Storable
+	for _, id := range svc.sortedIds() {
+		rec := svc.records[id]
+		if !rec.deletedVisible(tenant) {
+			continue
+		}
+		item, err := svc.decode(ctx, rec)
+		if err != nil {
+			svc.mu.RUnlock()
+			return nil, nil, -1, -1, err
+		}
+		items = append(items, item)
+	}
+	svc.mu.RUnlock()
+	return svc.page(ctx, items, props, pageSize, pageNum, orderBy)
+}
+
+// Purge removes the soft-deleted records visible to the request that were deleted before
+// olderThan, raising EventDataPurged with each as it was, and for a Temporal object keeping a
+// revision that marks it purged. A record deleted before its deletion time was recorded counts as
+// deleted before any time, and is purged too.
+func (svc *MemoryDataComponent) Purge(ctx core.RequestContext, olderThan time.Time) (int, error) {
+	tenant := svc.tenantOf(ctx)
+	svc.mu.Lock()
+	var events []*dataEvent
+	purged := 0
+	for _, id := range svc.sortedIds() {
+		rec := svc.records[id]
+		if !rec.deletedVisible(tenant) || !rec.deletedAt.Before(olderThan) {
+			continue
+		}
+		item, err := svc.decode(ctx, rec)
+		if err != nil {
+			svc.mu.Unlock()
+			return 0, err
+		}
+		if svc.conf.Temporal {
+			svc.revisions[id] = append(svc.revisions[id], &revision{rec: rec, at: time.Now(), deleted: true, purged: true})
+		}
+		delete(svc.records, id)
+		purged++
+		events = append(events, svc.raise(data.EventDataPurged, id, item)...)
+	}
+	svc.mu.Unlock()
+	svc.deliver(ctx, events)
+	return purged, nil
+}
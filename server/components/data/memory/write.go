@@ -0,0 +1,567 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// Save stores an object, creating it or replacing the record with its id.
+func (svc *MemoryDataComponent) Save(ctx core.RequestContext, item core.Storable) error {
+	return svc.putItems(ctx, []core.Storable{item}, false)
+}
+
+// Put stores an object against id, replacing any record with that id.
+func (svc *MemoryDataComponent) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	if item == nil {
+		return errors.MissingArg(ctx, "item")
+	}
+	item.SetId(id)
+	return svc.putItems(ctx, []core.Storable{item}, false)
+}
+
+// CreateMulti stores objects that must not exist yet. It fails without storing any of them when
+// one of them does.
+func (svc *MemoryDataComponent) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.putItems(ctx, items, true)
+}
+
+// PutMulti stores objects, replacing any records with their ids.
+func (svc *MemoryDataComponent) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.putItems(ctx, items, false)
+}
+
+func (svc *MemoryDataComponent) putItems(ctx core.RequestContext, items []core.Storable, create bool) error {
+	for _, item := range items {
+		if item == nil {
+			return errors.MissingArg(ctx, "item")
+		}
+	}
+	// the write is checked before the items are prepared, so that one refused leaves the caller's
+	// items as they were, and again once they are, as PreSave may change what is indexed and the
+	// store may have changed meanwhile
+	svc.mu.RLock()
+	err := svc.checkWrite(ctx, items, create)
+	svc.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	recs := make([]*record, len(items))
+	for i, item := range items {
+		if err := svc.prepare(ctx, item); err != nil {
+			return err
+		}
+		rec, err := svc.encode(ctx, item)
+		if err != nil {
+			return err
+		}
+		recs[i] = rec
+	}
+	svc.mu.Lock()
+	if err := svc.checkWrite(ctx, items, create); err != nil {
+		svc.mu.Unlock()
+		return err
+	}
+	if svc.conf.Versioned || svc.conf.Temporal {
+		if err := svc.bumpVersions(ctx, items, recs); err != nil {
+			svc.mu.Unlock()
+			return err
+		}
+	}
+	var events []*dataEvent
+	for i, item := range items {
+		eventType := svc.store(item.GetId(), recs[i])
+		events = append(events, svc.raise(eventType, item.GetId(), item)...)
+	}
+	svc.mu.Unlock()
+	svc.deliver(ctx, events)
+	return svc.postSave(ctx, items)
+}
+
+// postSave runs PostSave on items that have been stored, when the object asks for it. Every item
+// runs it whether or not another failed, and the first failure is returned: the items stay stored
+// and their events delivered, so the error reports the hook, not the write.
+func (svc *MemoryDataComponent) postSave(ctx core.RequestContext, items []core.Storable) error {
+	if !svc.conf.PostSave {
+		return nil
+	}
+	var failed error
+	for _, item := range items {
+		if err := item.PostSave(ctx); err != nil && failed == nil {
+			failed = errors.WrapError(ctx, err, slog.String("Id", item.GetId()))
+		}
+	}
+	return failed
+}
+
+// checkWrite reports the conflict writing items would meet: an id held by another tenant's record,
+// or by any record when creating, a duplicate key in a unique index, or, when writes are Versioned,
+// a version other than the stored one. The caller holds the lock.
+func (svc *MemoryDataComponent) checkWrite(ctx core.RequestContext, items []core.Storable, create bool) error {
+	tenant := svc.tenantOf(ctx)
+	for _, item := range items {
+		existing, ok := svc.records[item.GetId()]
+		if ok && !existing.deleted && (create || !existing.visible(tenant)) {
+			// a record belonging to another tenant is never overwritten, and is reported as a
+			// conflict rather than as absent so the id is not silently reused
+			return errors.BadArg(ctx, "Id", slog.String("Id", item.GetId()))
+		}
+	}
+	if err := svc.checkUnique(ctx, items); err != nil {
+		return err
+	}
+	if !svc.conf.Versioned {
+		return nil
+	}
+	for _, item := range items {
+		v, ok := item.(data.Versionable)
+		if !ok {
+			continue
+		}
+		stored := ""
+		if existing, ok := svc.records[item.GetId()]; ok && !existing.deleted {
+			stored = existing.version
+		}
+		if err := data.CheckVersion(ctx, svc.object, item.GetId(), stored, v.GetVersion()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bumpVersions stamps each item and its snapshot with the version after the stored record's. The
+// versions items expect have been checked by checkWrite. The caller holds the write lock.
+func (svc *MemoryDataComponent) bumpVersions(ctx core.RequestContext, items []core.Storable, recs []*record) error {
+	for i, item := range items {
+		v, ok := item.(data.Versionable)
+		if !ok {
+			continue
+		}
+		// a deleted record's version is counted on from rather than reused, so a writer still
+		// holding the version it had before the delete cannot match the new record
+		current := v.GetVersion()
+		if latest, ok := svc.latestVersion(item.GetId()); ok {
+			current = latest
+		}
+		expected := v.GetVersion()
+		v.SetVersion(data.NextVersion(current))
+		rec, err := svc.encode(ctx, item)
+		if err != nil {
+			v.SetVersion(expected)
+			return err
+		}
+		recs[i] = rec
+	}
+	return nil
+}
+
+// UpsertId updates the record with id, or creates one from newVals when there is none.
+func (svc *MemoryDataComponent) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	svc.mu.RLock()
+	rec, ok := svc.records[id]
+	exists := ok && rec.visible(svc.tenantOf(ctx))
+	svc.mu.RUnlock()
+	if exists {
+		return svc.Update(ctx, id, newVals)
+	}
+	return svc.createFromValues(ctx, id, newVals)
+}
+
+// Upsert updates every record matching queryCond, or creates one from newVals when none does.
+func (svc *MemoryDataComponent) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	ids, err := svc.UpdateAll(ctx, queryCond, newVals, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		id := ctx.CreateUUID()
+		if err = svc.createFromValues(ctx, id, newVals); err != nil {
+			return nil, err
+		}
+		ids = []string{id}
+	}
+	if !getids {
+		return nil, nil
+	}
+	return ids, nil
+}
+
+func (svc *MemoryDataComponent) createFromValues(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	item, err := svc.newObject(ctx)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(newVals)
+	if err != nil {
+		return errors.BadArg(ctx, "newVals", slog.String("Error", err.Error()))
+	}
+	if err = json.Unmarshal(bytes, item); err != nil {
+		return errors.BadArg(ctx, "newVals", slog.String("Error", err.Error()))
+	}
+	item.SetId(id)
+	return svc.Save(ctx, item)
+}
+
+// Update applies field values to the record with id.
+func (svc *MemoryDataComponent) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.UpdateMulti(ctx, []string{id}, newVals)
+}
+
+// UpdateMulti applies field values to the records with ids. It fails without updating any of them
+// when one does not exist.
+func (svc *MemoryDataComponent) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	tenant := svc.tenantOf(ctx)
+	svc.mu.RLock()
+	for _, id := range ids {
+		if !svc.records[id].visible(tenant) {
+			svc.mu.RUnlock()
+			return errors.NotFound(ctx, svc.object, slog.String("Id", id))
+		}
+	}
+	svc.mu.RUnlock()
+	_, err := svc.updateWhere(ctx, func(id string, item core.Storable) (bool, error) {
+		return utils.StrContains(ids, id) >= 0, nil
+	}, newVals)
+	return err
+}
+
+// UpdateAll applies field values to every record matching queryCond. A nil condition matches
+// nothing, so it updates nothing.
+func (svc *MemoryDataComponent) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	cond, err := toCondition(ctx, queryCond)
+	if err != nil || cond == nil {
+		return nil, err
+	}
+	ids, err := svc.updateWhere(ctx, func(id string, item core.Storable) (bool, error) {
+		return cond.matches(ctx, item)
+	}, newVals)
+	if err != nil || !getids {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// updateWhere applies field values to every visible record selected by match, under one write
+// lock so that no record changes between being selected and being written.
+func (svc *MemoryDataComponent) updateWhere(ctx core.RequestContext, match func(string, core.Storable) (bool, error), newVals utils.StringMap) ([]string, error) {
+	vals := make(map[string]interface{}, len(newVals)+2)
+	for field, val := range newVals {
+		vals[field] = val
+	}
+	// a versioned update is conditional when it names the version it expects; either way, each
+	// record it writes gets the next version
+	expected, conditional := vals[data.FIELD_VERSION]
+	delete(vals, data.FIELD_VERSION)
+	if svc.conf.Trackable {
+		data.Track(ctx, vals)
+	}
+	tenant := svc.tenantOf(ctx)
+	svc.mu.Lock()
+	var ids []string
+	var updated []core.Storable
+	var recs []*record
+	for _, id := range svc.sortedIds() {
+		rec := svc.records[id]
+		if !rec.visible(tenant) {
+			continue
+		}
+		item, err := svc.decode(ctx, rec)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		ok, err := match(id, item)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if svc.conf.Versioned || svc.conf.Temporal {
+			if conditional && svc.conf.Versioned {
+				if err = data.CheckVersion(ctx, svc.object, id, rec.version, fmt.Sprint(expected)); err != nil {
+					svc.mu.Unlock()
+					return nil, err
+				}
+			}
+			vals[data.FIELD_VERSION] = data.NextVersion(rec.version)
+		} else if conditional {
+			vals[data.FIELD_VERSION] = expected
+		}
+		item, err = svc.merge(ctx, rec, vals)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		newRec, err := svc.encode(ctx, item)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		ids = append(ids, id)
+		updated = append(updated, item)
+		recs = append(recs, newRec)
+	}
+	if err := svc.checkUnique(ctx, updated); err != nil {
+		svc.mu.Unlock()
+		return nil, err
+	}
+	var events []*dataEvent
+	for i, id := range ids {
+		svc.store(id, recs[i])
+		events = append(events, svc.raise(data.EventDataUpdated, id, updated[i])...)
+	}
+	svc.mu.Unlock()
+	svc.deliver(ctx, events)
+	return ids, nil
+}
+
+// AddToArray appends item to the array held in fieldName of the record with id.
+func (svc *MemoryDataComponent) AddToArray(ctx core.RequestContext, id string, fieldName string, item interface{}) error {
+	svc.mu.RLock()
+	rec, ok := svc.records[id]
+	visible := ok && rec.visible(svc.tenantOf(ctx))
+	svc.mu.RUnlock()
+	if !visible {
+		return errors.NotFound(ctx, svc.object, slog.String("Id", id))
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(rec.data, &fields); err != nil {
+		return errors.WrapErrorWithCode(ctx, err, data.DATA_ERROR_OPERATION)
+	}
+	arr, _ := fields[fieldName].([]interface{})
+	return svc.Update(ctx, id, utils.StringMap{fieldName: append(arr, item)})
+}
+
+// Delete removes the record with id, or marks it deleted when the object is configured for soft
+// deletes.
+func (svc *MemoryDataComponent) Delete(ctx core.RequestContext, id string) error {
+	return svc.DeleteMulti(ctx, []string{id})
+}
+
+// DeleteMulti removes the records with ids. It fails without deleting any of them when one does
+// not exist.
+func (svc *MemoryDataComponent) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	tenant := svc.tenantOf(ctx)
+	svc.mu.RLock()
+	for _, id := range ids {
+		if !svc.records[id].visible(tenant) {
+			svc.mu.RUnlock()
+			return errors.NotFound(ctx, svc.object, slog.String("Id", id))
+		}
+	}
+	svc.mu.RUnlock()
+	_, err := svc.deleteWhere(ctx, func(id string, item core.Storable) (bool, error) {
+		return utils.StrContains(ids, id) >= 0, nil
+	})
+	return err
+}
+
+// DeleteAll deletes every record matching queryCond. A nil condition matches nothing, so it
+// deletes nothing — emptying a collection takes an explicit unconstrained query.
+func (svc *MemoryDataComponent) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	cond, err := toCondition(ctx, queryCond)
+	if err != nil || cond == nil {
+		return nil, err
+	}
+	ids, err := svc.deleteWhere(ctx, func(id string, item core.Storable) (bool, error) {
+		return cond.matches(ctx, item)
+	})
+	if err != nil || !getids {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (svc *MemoryDataComponent) deleteWhere(ctx core.RequestContext, match func(string, core.Storable) (bool, error)) ([]string, error) {
+	var softDelete utils.StringMap
+	now := time.Now()
+	if svc.conf.SoftDelete {
+		softDelete = utils.StringMap{data.FIELD_SOFTDELETE: true, data.FIELD_DELETEDAT: now, data.FIELD_DELETEDBY: userOf(ctx)}
+		if svc.conf.Trackable {
+			data.Track(ctx, map[string]interface{}(softDelete))
+		}
+	}
+	tenant := svc.tenantOf(ctx)
+	svc.mu.Lock()
+	var ids []string
+	var events []*dataEvent
+	for _, id := range svc.sortedIds() {
+		rec := svc.records[id]
+		if !rec.visible(tenant) {
+			continue
+		}
+		item, err := svc.decode(ctx, rec)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		ok, err := match(id, item)
+		if err != nil {
+			svc.mu.Unlock()
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if softDelete != nil {
+			if svc.conf.Versioned || svc.conf.Temporal {
+				softDelete[data.FIELD_VERSION] = data.NextVersion(rec.version)
+			}
+			deleted, err := svc.merge(ctx, rec, softDelete)
+			if err != nil {
+				svc.mu.Unlock()
+				return nil, err
+			}
+			newRec, err := svc.encode(ctx, deleted)
+			if err != nil {
+				svc.mu.Unlock()
+				return nil, err
+			}
+			// the flag is set on the record whether or not the object embeds DeletionInfo, so that
+			// a soft delete hides the record on every object type
+			newRec.deleted, newRec.deletedAt = true, now
+			svc.store(id, newRec)
+		} else {
+			delete(svc.records, id)
+			tombstone := *rec
+			tombstone.version = data.NextVersion(rec.version)
+			svc.revise(id, &tombstone, true)
+		}
+		ids = append(ids, id)
+		events = append(events, svc.raise(data.EventDataDeleted, id, item)...)
+	}
+	svc.mu.Unlock()
+	svc.deliver(ctx, events)
+	return ids, nil
+}
+
+// GetValue returns the value stored under key.
+func (svc *MemoryDataComponent) GetValue(ctx core.RequestContext, key string) (interface{}, error) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	val, ok := svc.values[key]
+	if !ok {
+		return nil, errors.NotFound(ctx, key)
+	}
+	return val, nil
+}
+
+// PutValue stores value under key.
+func (svc *MemoryDataComponent) PutValue(ctx core.RequestContext, key string, value interface{}) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.values[key] = value
+	return nil
+}
+
+// DeleteValue removes key. Removing a key that is not there is not an error.
+func (svc *MemoryDataComponent) DeleteValue(ctx core.RequestContext, key string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	delete(svc.values, key)
+	return nil
+}
+
+// Transaction runs callback atomically: if it returns an error, every record and key value is
+// restored to what it was before the callback ran, and the data events it raised are discarded
+// instead of delivered.
+//
+// Transactions are serialised. The store has one writer while a transaction is open, so a write
+// made outside the callback during that time is part of the transaction and is rolled back with it.
+// A callback that panics is rolled back too, before the panic is passed on.
+//
+// A transaction opened with the context of one already open on the component joins it: callback
+// runs in the open transaction, and its writes are committed or rolled back with it.
+func (svc *MemoryDataComponent) Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error {
+	if _, ok := ctx.Get(svc.txKey()); ok {
+		return callback(ctx)
+	}
+	svc.txLock.Lock()
+	defer svc.txLock.Unlock()
+	svc.mu.Lock()
+	records := make(map[string]*record, len(svc.records))
+	for id, rec := range svc.records {
+		records[id] = rec
+	}
+	values := make(map[string]interface{}, len(svc.values))
+	for key, val := range svc.values {
+		values[key] = val
+	}
+	revisions := make(map[string][]*revision, len(svc.revisions))
+	for id, revs := range svc.revisions {
+		revisions[id] = revs
+	}
+	seq := svc.seq
+	svc.inTx = true
+	svc.pending = nil
+	svc.mu.Unlock()
+
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		// the callback panicked: the transaction is rolled back before the panic goes on
+		svc.mu.Lock()
+		svc.records, svc.values, svc.revisions, svc.seq = records, values, revisions, seq
+		svc.inTx, svc.pending = false, nil
+		svc.mu.Unlock()
+	}()
+	txCtx := ctx.SubContext("Transaction")
+	txCtx.Set(svc.txKey(), true)
+	err := callback(txCtx)
+	done = true
+
+	svc.mu.Lock()
+	events := svc.pending
+	svc.inTx = false
+	svc.pending = nil
+	if err != nil {
+		svc.records, svc.values, svc.revisions, svc.seq = records, values, revisions, seq
+		svc.mu.Unlock()
+		return err
+	}
+	svc.mu.Unlock()
+	svc.deliver(ctx, events)
+	return nil
+}
+
+// Subscribe registers handler for events of eventType on this component's object. The message
+// carries the object as it was written — or, for a delete, as it was before — and the info map
+// carries its object type, id and event type.
+func (svc *MemoryDataComponent) Subscribe(ctx core.RequestContext, obj string, eventType data.DataEventType, handler core.MessageListener) error {
+	if obj != "" && obj != svc.object {
+		return errors.BadArg(ctx, "obj", slog.String("Object", obj))
+	}
+	if handler == nil {
+		return errors.MissingArg(ctx, "handler")
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.listeners[eventType] = append(svc.listeners[eventType], handler)
+	return nil
+}
+
+// Execute runs the function registered under name.
+func (svc *MemoryDataComponent) Execute(ctx core.RequestContext, name string, data interface{}, params utils.StringMap) (interface{}, error) {
+	svc.mu.RLock()
+	fn, ok := svc.functions[name]
+	svc.mu.RUnlock()
+	if !ok {
+		return nil, errors.NotImplemented(ctx, "Execute", slog.String("Function", name))
+	}
+	return fn(ctx, svc, data, params)
+}
+
+// txKey is the key a context carries while a transaction of the component is open on it.
+func (svc *MemoryDataComponent) txKey() string {
+	return fmt.Sprintf("data.memory.tx:%p", svc)
+}
@@ -0,0 +1,296 @@
+package data
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// MIGRATION_OBJECT is the object type migration history is stored as.
+const MIGRATION_OBJECT = "data.MigrationRecord"
+
+// Migration is one version of a module's schema: the steps that take the records of an object from
+// the version before it to this one. Versions are counted from 1 within a module, and a module's
+// migrations are applied in the order of their versions.
+//
+// Steps are not run in a transaction, as a step may change a collection's indexes as well as its
+// records. A migration that fails part way is not recorded as applied and leaves its earlier steps
+// done, so every step is written to be run again: each one skips the records it has already
+// changed.
+type Migration struct {
+	Version     int
+	Object      string
+	Description string
+	Steps       []MigrationStep
+}
+
+// MigrationStep is one change to the stored records of an object. Up makes the change and Down
+// undoes it.
+type MigrationStep interface {
+	// Describe says what the step does, for the plan a dry run reports.
+	Describe() string
+	Up(ctx core.RequestContext, comp DataComponent) error
+	Down(ctx core.RequestContext, comp DataComponent) error
+}
+
+// FieldMigrator is implemented by a data component that can rewrite the fields of its stored
+// records in place rather than through its entity, whose fields are those after a migration. A
+// value can only be moved out of a field the entity no longer has this way. Each method returns
+// how many records it rewrote.
+type FieldMigrator interface {
+	// AddField stores value in field on every record that has no value for it.
+	AddField(ctx core.RequestContext, field string, value interface{}) (int, error)
+	// RenameField moves the value of from to to on every record that has one.
+	RenameField(ctx core.RequestContext, from string, to string) (int, error)
+	// DropField removes field from every record.
+	DropField(ctx core.RequestContext, field string) (int, error)
+}
+
+// AddField gives every record without a value for Field the value Default. Down removes the field.
+// Without a FieldMigrator, a record has no value when the field is null, so a field that is not a
+// pointer is only filled in by a provider that can tell it is missing.
+type AddField struct {
+	Field   string
+	Default interface{}
+}
+
+func (step AddField) Describe() string {
+	return fmt.Sprintf("add field %s with default %v", step.Field, step.Default)
+}
+
+func (step AddField) Up(ctx core.RequestContext, comp DataComponent) error {
+	if fm, ok := comp.(FieldMigrator); ok {
+		_, err := fm.AddField(ctx, step.Field, step.Default)
+		return err
+	}
+	query := NewQuery()
+	query.Filter = &Comparison{Field: step.Field, Operator: OpEqual, Value: LiteralOperand(nil)}
+	cond, err := comp.CreateQueryCondition(ctx, query, nil)
+	if err != nil {
+		return err
+	}
+	_, err = comp.UpdateAll(ctx, cond, utils.StringMap{step.Field: step.Default}, false)
+	return err
+}
+
+func (step AddField) Down(ctx core.RequestContext, comp DataComponent) error {
+	if fm, ok := comp.(FieldMigrator); ok {
+		_, err := fm.DropField(ctx, step.Field)
+		return err
+	}
+	cond, err := comp.CreateQueryCondition(ctx, NewQuery(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = comp.UpdateAll(ctx, cond, utils.StringMap{step.Field: nil}, false)
+	return err
+}
+
+// RenameField moves the value of From to To on every record. It needs a FieldMigrator.
+type RenameField struct {
+	From string
+	To   string
+}
+
+func (step RenameField) Describe() string {
+	return fmt.Sprintf("rename field %s to %s", step.From, step.To)
+}
+
+func (step RenameField) Up(ctx core.RequestContext, comp DataComponent) error {
+	return renameField(ctx, comp, step.From, step.To)
+}
+
+func (step RenameField) Down(ctx core.RequestContext, comp DataComponent) error {
+	return renameField(ctx, comp, step.To, step.From)
+}
+
+func renameField(ctx core.RequestContext, comp DataComponent, from string, to string) error {
+	fm, ok := comp.(FieldMigrator)
+	if !ok {
+		return errors.NotImplemented(ctx, "RenameField", slog.String("Object", comp.GetObject()))
+	}
+	_, err := fm.RenameField(ctx, from, to)
+	return err
+}
+
+// Backfill computes values for existing records. Script names a function the data service runs
+// with Execute, for a provider that backfills inside the store; otherwise Fill is called for every
+// record and returns the values to update it with, or nil to leave it as it is. Down runs
+// UndoScript when there is one, and otherwise leaves the backfilled values.
+type Backfill struct {
+	Description string
+	Script      string
+	UndoScript  string
+	Params      utils.StringMap
+	Fill        func(ctx core.RequestContext, item core.Storable) (utils.StringMap, error)
+}
+
+func (step Backfill) Describe() string {
+	desc := "backfill"
+	if step.Script != "" {
+		desc += " with " + step.Script
+	}
+	if step.Description != "" {
+		desc += ": " + step.Description
+	}
+	return desc
+}
+
+func (step Backfill) Up(ctx core.RequestContext, comp DataComponent) error {
+	if step.Script != "" {
+		_, err := comp.Execute(ctx, step.Script, nil, step.Params)
+		return err
+	}
+	if step.Fill == nil {
+		return errors.MissingArg(ctx, "Fill")
+	}
+	it, err := comp.Iterate(ctx, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		item := it.Item()
+		vals, err := step.Fill(ctx, item)
+		if err != nil {
+			return err
+		}
+		if len(vals) == 0 {
+			continue
+		}
+		if err = comp.Update(ctx, item.GetId(), vals); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (step Backfill) Down(ctx core.RequestContext, comp DataComponent) error {
+	if step.UndoScript == "" {
+		return nil
+	}
+	_, err := comp.Execute(ctx, step.UndoScript, nil, step.Params)
+	return err
+}
+
+// AddIndex creates Index. Down drops it. It needs an IndexManager.
+type AddIndex struct {
+	Index core.IndexSpec
+}
+
+func (step AddIndex) Describe() string {
+	desc := fmt.Sprintf("add index %s on (%s)", IndexName(step.Index), strings.Join(step.Index.Fields, ", "))
+	if step.Index.Unique {
+		desc += " unique"
+	}
+	return desc
+}
+
+func (step AddIndex) Up(ctx core.RequestContext, comp DataComponent) error {
+	im, ok := comp.(IndexManager)
+	if !ok {
+		return errors.NotImplemented(ctx, "CreateIndex", slog.String("Object", comp.GetObject()))
+	}
+	return im.CreateIndex(ctx.ServerContext(), step.Index)
+}
+
+func (step AddIndex) Down(ctx core.RequestContext, comp DataComponent) error {
+	im, ok := comp.(IndexManager)
+	if !ok {
+		return errors.NotImplemented(ctx, "DropIndex", slog.String("Object", comp.GetObject()))
+	}
+	return im.DropIndex(ctx.ServerContext(), IndexName(step.Index))
+}
+
+// MigrationRecord is a migration applied to a module's schema. The record with version 0 is the
+// lock held by the instance migrating the module, and Owner names that instance.
+type MigrationRecord struct {
+	StorageInfo
+	Module      string    `json:"Module" bson:"Module"`
+	Version     int       `json:"Version" bson:"Version"`
+	Object      string    `json:"Object" bson:"Object"`
+	Description string    `json:"Description" bson:"Description"`
+	AppliedAt   time.Time `json:"AppliedAt" bson:"AppliedAt"`
+	Owner       string    `json:"Owner" bson:"Owner"`
+}
+
+func (mr *MigrationRecord) Config() *core.StorableConfig {
+	return &core.StorableConfig{
+		ObjectType: MIGRATION_OBJECT,
+		LabelField: "Id",
+		Collection: "MigrationHistory",
+	}
+}
+
+func (mr *MigrationRecord) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatypes.SerializableReader) error {
+	var err error
+	if err = rdr.ReadString(c, cdc, "Module", &mr.Module); err != nil {
+		return err
+	}
+	if err = rdr.ReadInt(c, cdc, "Version", &mr.Version); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "Object", &mr.Object); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "Description", &mr.Description); err != nil {
+		return err
+	}
+	if err = rdr.ReadTime(c, cdc, "AppliedAt", &mr.AppliedAt); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "Owner", &mr.Owner); err != nil {
+		return err
+	}
+	return mr.StorageInfo.ReadAll(c, cdc, rdr)
+}
+
+func (mr *MigrationRecord) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr datatypes.SerializableWriter) error {
+	var err error
+	if err = wtr.WriteString(c, cdc, "Module", &mr.Module); err != nil {
+		return err
+	}
+	if err = wtr.WriteInt(c, cdc, "Version", &mr.Version); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "Object", &mr.Object); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "Description", &mr.Description); err != nil {
+		return err
+	}
+	if err = wtr.WriteTime(c, cdc, "AppliedAt", &mr.AppliedAt); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "Owner", &mr.Owner); err != nil {
+		return err
+	}
+	return mr.StorageInfo.WriteAll(c, cdc, wtr)
+}
+
+// MigrationRecordFactory creates MigrationRecords, for registering the history object with a
+// server or for handing to a data component directly.
+type MigrationRecordFactory struct{}
+
+func (f MigrationRecordFactory) CreateObject(ctx.Context) interface{} {
+	return &MigrationRecord{}
+}
+
+func (f MigrationRecordFactory) CreateObjectCollection(cx ctx.Context, length int) interface{} {
+	return make([]MigrationRecord, length)
+}
+
+func (f MigrationRecordFactory) CreateObjectPointersCollection(cx ctx.Context, length int) interface{} {
+	return make([]*MigrationRecord, length)
+}
+
+func (f MigrationRecordFactory) Info() core.Info {
+	return core.NewInfo("Applied schema migration", MIGRATION_OBJECT, "1.0", nil)
+}
@@ -0,0 +1,499 @@
+package data
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_DATA_MIGRATION_SVC names the data service migration history is kept in.
+	CONF_DATA_MIGRATION_SVC = "migrationhistory"
+	// CONF_DATA_MIGRATION_LOCKTIMEOUT is how long a migration lock may go without being refreshed
+	// before another instance may take it over, as a duration such as "15m".
+	CONF_DATA_MIGRATION_LOCKTIMEOUT = "migrationlocktimeout"
+
+	// MIGRATION_PARAM_MODULE, MIGRATION_PARAM_TARGET and MIGRATION_PARAM_DRYRUN are the request
+	// parameters of a Migrator invoked as a service.
+	MIGRATION_PARAM_MODULE = "module"
+	MIGRATION_PARAM_TARGET = "target"
+	MIGRATION_PARAM_DRYRUN = "dryrun"
+)
+
+// LatestVersion is the target of a migration to a module's last registered version.
+const LatestVersion = -1
+
+// DefaultMigrationLockTimeout is how long a migration lock may go without being refreshed when it
+// is not configured.
+const DefaultMigrationLockTimeout = 15 * time.Minute
+
+// MigrationDirection is whether a migration was applied or reverted.
+type MigrationDirection string
+
+const (
+	MigrationUp   MigrationDirection = "up"
+	MigrationDown MigrationDirection = "down"
+)
+
+// MigrationRun is a migration a Migrator applied or reverted, or would have in a dry run.
+type MigrationRun struct {
+	Version     int
+	Direction   MigrationDirection
+	Description string
+	Steps       []string
+}
+
+// MigrationReport is what a Migrator did to a module's schema: the version it found, the version it
+// left, and the migrations it ran to get there. A dry run reports what it would have run.
+type MigrationReport struct {
+	Module string
+	From   int
+	To     int
+	DryRun bool
+	Runs   []MigrationRun
+}
+
+/*
+Migrator applies the schema migrations modules register with it to the data services that store
+their objects, and keeps the versions it has applied in a history data service. Migrate takes a
+module to a target version: up through the migrations it has not applied, or down by reverting those
+after the target, newest first. A dry run reports the plan without running it.
+
+Only one instance migrates a module at a time. The instance that migrates creates a lock record
+in the history, so the history service must refuse to create a record whose id it already holds,
+as CreateMulti is documented to, and refreshes it a few times every LockTimeout while it migrates.
+A lock not refreshed for LockTimeout is taken to be left by an instance that died, and is taken
+over by an update conditioned on the owner it was read with, so that of two instances finding it
+stale only one takes it. An instance that finds its lock taken over stops before its next
+migration, and releases the lock only while it still owns it.
+
+A module migrates from its Start, once it has registered its migrations:
+
+	migrator.Register(ctx, "orders", migrations...)
+	_, err := migrator.Migrate(core.NewSystemRequest(ctx, "Migrate", nil, nil, nil), "orders", data.LatestVersion, false)
+
+or the Migrator is invoked as a service, with the module, target and dryrun parameters. The data
+services it migrates are the stores themselves rather than plugins layered over them, so that a
+migration raises no data events and is not audited or published as a write.
+*/
+type Migrator struct {
+	core.Service
+	HistoryDataComponent DataComponent
+	Components           []DataComponent
+	LockTimeout          time.Duration
+	mu                   sync.RWMutex
+	migrations           map[string][]*Migration
+}
+
+func NewMigrator(ctx core.ServerContext) *Migrator {
+	return &Migrator{}
+}
+
+// NewMigratorWithServices creates a migrator keeping its history in history and migrating the
+// objects stored by comps.
+func NewMigratorWithServices(ctx core.ServerContext, history DataComponent, comps ...DataComponent) *Migrator {
+	return &Migrator{HistoryDataComponent: history, Components: comps}
+}
+
+func (svc *Migrator) Describe(ctx core.ServerContext) error {
+	if svc.HistoryDataComponent == nil {
+		svc.AddStringConfiguration(ctx, CONF_DATA_MIGRATION_SVC, "Data service migration history is kept in", "")
+		svc.AddConfiguration(ctx, CONF_DATA_SVCS, "Data services whose objects are migrated", datatypes.Stringarr, nil)
+		svc.AddStringConfiguration(ctx, CONF_DATA_MIGRATION_LOCKTIMEOUT, "How long a migration lock is held before it is broken", DefaultMigrationLockTimeout.String())
+	}
+	svc.AddStringParam(ctx, MIGRATION_PARAM_MODULE, "Module to migrate")
+	svc.AddOptionalParamWithType(ctx, MIGRATION_PARAM_TARGET, "Version to migrate to, the latest when omitted", datatypes.Int)
+	svc.AddOptionalParamWithType(ctx, MIGRATION_PARAM_DRYRUN, "Report the plan without running it", datatypes.Bool)
+	return nil
+}
+
+func (svc *Migrator) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if svc.HistoryDataComponent != nil {
+		return nil
+	}
+	historySvc, ok := svc.GetStringConfiguration(ctx, CONF_DATA_MIGRATION_SVC)
+	if !ok || historySvc == "" {
+		return errors.MissingConf(ctx, CONF_DATA_MIGRATION_SVC)
+	}
+	s, err := ctx.GetService(historySvc)
+	if err != nil {
+		return errors.BadConf(ctx, CONF_DATA_MIGRATION_SVC)
+	}
+	history, ok := s.(DataComponent)
+	if !ok {
+		return errors.BadConf(ctx, CONF_DATA_MIGRATION_SVC)
+	}
+	svc.HistoryDataComponent = history
+	names, _ := svc.GetStringArrayConfiguration(ctx, CONF_DATA_SVCS)
+	for _, name := range names {
+		s, err := ctx.GetService(name)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		dc, ok := s.(DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		svc.Components = append(svc.Components, dc)
+	}
+	if timeout, ok := svc.GetStringConfiguration(ctx, CONF_DATA_MIGRATION_LOCKTIMEOUT); ok && timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return errors.BadConf(ctx, CONF_DATA_MIGRATION_LOCKTIMEOUT)
+		}
+		svc.LockTimeout = d
+	}
+	return nil
+}
+
+// Register declares the migrations of module. Registering a version twice, a version below 1, or a
+// migration of an object none of the migrator's data services stores is refused.
+func (svc *Migrator) Register(ctx ctx.Context, module string, migrations ...*Migration) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.migrations == nil {
+		svc.migrations = make(map[string][]*Migration)
+	}
+	registered := svc.migrations[module]
+	versions := make(map[int]bool, len(registered))
+	for _, m := range registered {
+		versions[m.Version] = true
+	}
+	for _, m := range migrations {
+		if m == nil || m.Version < 1 || versions[m.Version] {
+			return errors.BadArg(ctx, "migrations", slog.String("Module", module))
+		}
+		if svc.componentOf(m.Object) == nil {
+			return errors.BadArg(ctx, "migrations", slog.String("Module", module), slog.String("Object", m.Object))
+		}
+		versions[m.Version] = true
+		registered = append(registered, m)
+	}
+	sort.Slice(registered, func(i, j int) bool { return registered[i].Version < registered[j].Version })
+	svc.migrations[module] = registered
+	return nil
+}
+
+// componentOf returns the data service storing object, or nil when there is none.
+func (svc *Migrator) componentOf(object string) DataComponent {
+	for _, comp := range svc.Components {
+		if comp.GetObject() == object {
+			return comp
+		}
+	}
+	return nil
+}
+
+// Invoke migrates the module named by the request's parameters, and responds with the report.
+func (svc *Migrator) Invoke(ctx core.RequestContext) error {
+	module, ok := ctx.GetStringParam(MIGRATION_PARAM_MODULE)
+	if !ok || module == "" {
+		return errors.MissingArg(ctx, MIGRATION_PARAM_MODULE)
+	}
+	target, ok := ctx.GetIntParam(MIGRATION_PARAM_TARGET)
+	if !ok {
+		target = LatestVersion
+	}
+	dryRun := false
+	if val, ok := ctx.GetParamValue(MIGRATION_PARAM_DRYRUN); ok {
+		dryRun, _ = val.(bool)
+	}
+	report, err := svc.Migrate(ctx, module, target, dryRun)
+	if err != nil {
+		return err
+	}
+	ctx.SetResponse(core.SuccessResponse(report))
+	return nil
+}
+
+// Applied returns the migrations of module that have been applied, by version.
+func (svc *Migrator) Applied(ctx core.RequestContext, module string) (map[int]*MigrationRecord, error) {
+	cond, err := svc.HistoryDataComponent.CreateCondition(ctx, utils.StringMap{"Module": module})
+	if err != nil {
+		return nil, err
+	}
+	items, _, _, _, err := svc.HistoryDataComponent.Get(ctx, nil, cond, -1, 1, "", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]*MigrationRecord, len(items))
+	for _, item := range items {
+		rec, ok := item.(*MigrationRecord)
+		if !ok {
+			return nil, errors.TypeMismatch(ctx, slog.String("Object", MIGRATION_OBJECT))
+		}
+		if rec.Version > 0 {
+			applied[rec.Version] = rec
+		}
+	}
+	return applied, nil
+}
+
+// Migrate takes module to version target, or to its last registered version for LatestVersion; a
+// target of 0 reverts every migration. A dry run takes no lock and changes nothing. When a migration
+// fails, the report holds the ones run before it along with the error.
+func (svc *Migrator) Migrate(ctx core.RequestContext, module string, target int, dryRun bool) (*MigrationReport, error) {
+	svc.mu.RLock()
+	migrations := svc.migrations[module]
+	svc.mu.RUnlock()
+	if len(migrations) == 0 {
+		return nil, errors.BadArg(ctx, MIGRATION_PARAM_MODULE, slog.String("Module", module))
+	}
+	if target == LatestVersion {
+		target = migrations[len(migrations)-1].Version
+	} else if target != 0 && migrationOf(migrations, target) == nil {
+		return nil, errors.BadArg(ctx, MIGRATION_PARAM_TARGET, slog.Int("Target", target))
+	}
+	var lease *migrationLease
+	if !dryRun {
+		var err error
+		if lease, err = svc.lock(ctx, module, ctx.CreateUUID()); err != nil {
+			return nil, err
+		}
+		defer svc.unlock(ctx, lease)
+	}
+	applied, err := svc.Applied(ctx, module)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrationReport{Module: module, From: latestApplied(applied), DryRun: dryRun}
+	report.To = report.From
+
+	var down []*Migration
+	for version := range applied {
+		if version <= target {
+			continue
+		}
+		m := migrationOf(migrations, version)
+		if m == nil {
+			// a version applied by code that has since dropped it cannot be reverted
+			return report, errors.NotFound(ctx, "Migration", slog.String("Module", module), slog.Int("Version", version))
+		}
+		down = append(down, m)
+	}
+	sort.Slice(down, func(i, j int) bool { return down[i].Version > down[j].Version })
+	for _, m := range down {
+		if err = lease.check(ctx); err != nil {
+			return report, err
+		}
+		if err = svc.run(ctx, module, m, MigrationDown, report); err != nil {
+			return report, err
+		}
+		delete(applied, m.Version)
+		report.To = latestApplied(applied)
+	}
+	for _, m := range migrations {
+		if m.Version > target || applied[m.Version] != nil {
+			continue
+		}
+		if err = lease.check(ctx); err != nil {
+			return report, err
+		}
+		if err = svc.run(ctx, module, m, MigrationUp, report); err != nil {
+			return report, err
+		}
+		applied[m.Version] = &MigrationRecord{Module: module, Version: m.Version}
+		report.To = latestApplied(applied)
+	}
+	return report, nil
+}
+
+// run applies or reverts a migration and records it in the history, or only reports it in a dry
+// run.
+func (svc *Migrator) run(ctx core.RequestContext, module string, m *Migration, direction MigrationDirection, report *MigrationReport) error {
+	comp := svc.componentOf(m.Object)
+	run := MigrationRun{Version: m.Version, Direction: direction, Description: m.Description}
+	for _, step := range m.Steps {
+		run.Steps = append(run.Steps, step.Describe())
+	}
+	if !report.DryRun {
+		id := migrationId(module, m.Version)
+		if direction == MigrationUp {
+			for _, step := range m.Steps {
+				if err := step.Up(ctx, comp); err != nil {
+					return err
+				}
+			}
+			rec := &MigrationRecord{Module: module, Version: m.Version, Object: m.Object, Description: m.Description, AppliedAt: time.Now()}
+			rec.SetId(id)
+			if err := svc.HistoryDataComponent.Save(ctx, rec); err != nil {
+				return err
+			}
+		} else {
+			for i := len(m.Steps) - 1; i >= 0; i-- {
+				if err := m.Steps[i].Down(ctx, comp); err != nil {
+					return err
+				}
+			}
+			if err := svc.HistoryDataComponent.Delete(ctx, id); err != nil {
+				return err
+			}
+		}
+	}
+	report.Runs = append(report.Runs, run)
+	return nil
+}
+
+// migrationLease is a migration lock held by an owner, refreshed in the background until it is
+// released or found taken over.
+type migrationLease struct {
+	module string
+	owner  string
+	lost   atomic.Bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// check fails when the lease has been taken over by another instance. A nil lease, taken by a dry
+// run, holds nothing to lose.
+func (lease *migrationLease) check(ctx core.RequestContext) error {
+	if lease == nil || !lease.lost.Load() {
+		return nil
+	}
+	return MigrationLocked(ctx, lease.module, slog.String("Owner", lease.owner))
+}
+
+// lock takes the migration lock of module for owner, taking over a lock not refreshed within the
+// lock timeout, and refreshes it until it is released.
+func (svc *Migrator) lock(ctx core.RequestContext, module string, owner string) (*migrationLease, error) {
+	timeout := svc.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultMigrationLockTimeout
+	}
+	id := migrationId(module, 0)
+	for attempt := 0; ; attempt++ {
+		rec := &MigrationRecord{Module: module, Description: "lock", AppliedAt: time.Now(), Owner: owner}
+		rec.SetId(id)
+		err := svc.HistoryDataComponent.CreateMulti(ctx, []core.Storable{rec})
+		if err == nil {
+			break
+		}
+		if attempt > 0 {
+			return nil, MigrationLocked(ctx, module)
+		}
+		held, err := svc.HistoryDataComponent.GetById(ctx, id, "")
+		if errors.IsNotFound(err) {
+			// released since the create failed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		heldRec, ok := held.(*MigrationRecord)
+		if !ok {
+			return nil, errors.TypeMismatch(ctx, slog.String("Id", id))
+		}
+		if time.Since(heldRec.AppliedAt) < timeout {
+			return nil, MigrationLocked(ctx, module, slog.String("Owner", heldRec.Owner))
+		}
+		taken, err := svc.swapLock(ctx, id, heldRec.Owner, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			return nil, MigrationLocked(ctx, module)
+		}
+		break
+	}
+	lease := &migrationLease{module: module, owner: owner, stop: make(chan struct{}), done: make(chan struct{})}
+	go svc.refresh(ctx, lease, id, timeout/3)
+	return lease, nil
+}
+
+// refresh keeps the lease's lock fresh every interval until the lease is released, and stops when
+// the lock is found taken over.
+func (svc *Migrator) refresh(ctx core.RequestContext, lease *migrationLease, id string, interval time.Duration) {
+	defer close(lease.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+			held, err := svc.swapLock(ctx, id, lease.owner, lease.owner)
+			if err != nil {
+				log.Error(ctx, "Refreshing the migration lock failed", slog.String("Module", lease.module), slog.String("Error", err.Error()))
+				continue
+			}
+			if !held {
+				lease.lost.Store(true)
+				return
+			}
+		}
+	}
+}
+
+// swapLock gives the lock with id to owner, refreshing it, when it is still held by from, and
+// reports whether it was.
+func (svc *Migrator) swapLock(ctx core.RequestContext, id string, from string, owner string) (bool, error) {
+	cond, err := svc.HistoryDataComponent.CreateCondition(ctx, utils.StringMap{"Id": id, "Owner": from})
+	if err != nil {
+		return false, err
+	}
+	ids, err := svc.HistoryDataComponent.UpdateAll(ctx, cond, utils.StringMap{"Owner": owner, "AppliedAt": time.Now()}, true)
+	if err != nil {
+		return false, err
+	}
+	return len(ids) == 1, nil
+}
+
+// unlock stops refreshing the lease and releases its lock, when its owner still holds it.
+func (svc *Migrator) unlock(ctx core.RequestContext, lease *migrationLease) {
+	close(lease.stop)
+	<-lease.done
+	cond, err := svc.HistoryDataComponent.CreateCondition(ctx, utils.StringMap{"Id": migrationId(lease.module, 0), "Owner": lease.owner})
+	if err == nil {
+		_, err = svc.HistoryDataComponent.DeleteAll(ctx, cond, false)
+	}
+	if err != nil {
+		log.Error(ctx, "Releasing the migration lock failed", slog.String("Module", lease.module), slog.String("Error", err.Error()))
+	}
+}
+
+// MigrationLocked is the error of a migration of module while another instance is migrating it.
+func MigrationLocked(c ctx.Context, module string, info ...slog.Attr) error {
+	return errors.ThrowError(c, "module is being migrated by another instance: "+module, DATA_ERROR_MIGRATION_LOCKED, info...)
+}
+
+// IsMigrationLocked reports whether err is a MigrationLocked error.
+func IsMigrationLocked(err error) bool {
+	return errors.HasErrorCode(err, DATA_ERROR_MIGRATION_LOCKED)
+}
+
+func migrationId(module string, version int) string {
+	if version == 0 {
+		return module + "/lock"
+	}
+	return module + "/" + strconv.Itoa(version)
+}
+
+func migrationOf(migrations []*Migration, version int) *Migration {
+	for _, m := range migrations {
+		if m.Version == version {
+			return m
+		}
+	}
+	return nil
+}
+
+func latestApplied(applied map[int]*MigrationRecord) int {
+	latest := 0
+	for version := range applied {
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
@@ -0,0 +1,264 @@
+package data_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// titledWidget is a widget that reads back the field its name is renamed to.
+type titledWidget struct {
+	datatest.Record
+	Title string `json:"Title"`
+}
+
+func (w *titledWidget) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "widget", Collection: "widget"}
+}
+
+// withoutFieldMigrator is a store that cannot rewrite fields in place, leaving the migration steps
+// to make do with the data component's own writes.
+type withoutFieldMigrator struct {
+	data.DataComponent
+}
+
+func TestMigrator(t *testing.T) {
+	colours := data.Migration{Version: 1, Object: "widget", Description: "colours", Steps: []data.MigrationStep{data.AddField{Field: "Colour", Default: "red"}}}
+	sizes := data.Migration{Version: 2, Object: "widget", Description: "sizes", Steps: []data.MigrationStep{data.Backfill{Fill: func(c core.RequestContext, item core.Storable) (utils.StringMap, error) {
+		return utils.StringMap{"Size": item.(*titledWidget).Size * 10}, nil
+	}}}}
+	titles := data.Migration{Version: 3, Object: "widget", Description: "titles", Steps: []data.MigrationStep{data.RenameField{From: "Name", To: "Title"}}}
+	// setup stores alpha and beta in comp, or in the store comp wraps, and registers the three
+	// migrations of widgets
+	setup := func(t *testing.T, wrap func(data.DataComponent) data.DataComponent) (*data.Migrator, data.DataComponent, data.DataComponent, *datatest.RequestContext) {
+		t.Helper()
+		_, objects, c := newWidgets(t, core.StorableConfig{})
+		var svc data.DataComponent = memory.NewMemoryDataComponentForObject(c.Server, "widget", datatest.EntityFactory[titledWidget]{})
+		saveWidgets(t, svc, objects, c, "alpha", "beta")
+		if wrap != nil {
+			svc = wrap(svc)
+		}
+		history := memory.NewMemoryDataComponentForObject(c.Server, data.MIGRATION_OBJECT, data.MigrationRecordFactory{})
+		migrator := data.NewMigratorWithServices(c.Server, history, svc)
+		first, second, third := colours, sizes, titles
+		if err := migrator.Register(c, "widgets", &first, &second, &third); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+		return migrator, svc, history, c
+	}
+	widgets := func(t *testing.T, svc data.DataComponent, c core.RequestContext) string {
+		t.Helper()
+		items, _, _, _, _ := svc.GetList(c, nil, -1, 1, "", []string{"Size"}, "")
+		var got []string
+		for _, item := range items {
+			rec := item.(*titledWidget)
+			colour := "nil"
+			if rec.Colour != nil {
+				colour = *rec.Colour
+			}
+			got = append(got, fmt.Sprintf("%s:%s:%d:%s", rec.Name, rec.Title, rec.Size, colour))
+		}
+		return strings.Join(got, ", ")
+	}
+
+	t.Run("register", func(t *testing.T) {
+		migrator, _, _, c := setup(t, nil)
+		if err := migrator.Register(c, "gadgets", &data.Migration{Version: 1, Object: "gadget"}); err == nil {
+			t.Errorf("registered a migration of an object no service stores")
+		}
+		if err := migrator.Register(c, "widgets", &data.Migration{Version: 2, Object: "widget"}); err == nil {
+			t.Errorf("registered a version twice")
+		}
+	})
+
+	// a dry run reports the plan and changes nothing
+	t.Run("dry run", func(t *testing.T) {
+		migrator, svc, _, c := setup(t, nil)
+		report, err := migrator.Migrate(c, "widgets", data.LatestVersion, true)
+		if err != nil || report.From != 0 || report.To != 3 || len(report.Runs) != 3 {
+			t.Fatalf("dry run: %+v, %v", report, err)
+		}
+		if report.Runs[2].Steps[0] != "rename field Name to Title" {
+			t.Errorf("dry run steps: %v", report.Runs[2].Steps)
+		}
+		if got := widgets(t, svc, c); got != "alpha::1:nil, beta::2:nil" {
+			t.Errorf("a dry run changed records: %s", got)
+		}
+		if _, err = migrator.Migrate(c, "widgets", 7, true); err == nil {
+			t.Errorf("migrated to a version that is not registered")
+		}
+	})
+
+	// a lock held by another instance stops a migration until it goes stale
+	t.Run("locked", func(t *testing.T) {
+		migrator, _, history, c := setup(t, nil)
+		lock := &data.MigrationRecord{Module: "widgets", AppliedAt: time.Now(), Owner: "other"}
+		lock.SetId("widgets/lock")
+		if err := history.CreateMulti(c, []core.Storable{lock}); err != nil {
+			t.Fatalf("CreateMulti: %v", err)
+		}
+		if _, err := migrator.Migrate(c, "widgets", data.LatestVersion, false); !data.IsMigrationLocked(err) {
+			t.Fatalf("want a locked migration, got %v", err)
+		}
+		migrator.LockTimeout = time.Millisecond
+		time.Sleep(2 * time.Millisecond)
+		if report, err := migrator.Migrate(c, "widgets", data.LatestVersion, false); err != nil || report.To != 3 {
+			t.Fatalf("once the lock went stale: %+v, %v", report, err)
+		}
+	})
+
+	t.Run("up and down", func(t *testing.T) {
+		migrator, svc, history, c := setup(t, nil)
+		report, err := migrator.Migrate(c, "widgets", data.LatestVersion, false)
+		if err != nil || report.To != 3 || len(report.Runs) != 3 {
+			t.Fatalf("Migrate: %+v, %v", report, err)
+		}
+		if got := widgets(t, svc, c); got != ":alpha:10:red, :beta:20:red" {
+			t.Fatalf("after migrating: %s", got)
+		}
+		if applied, _ := migrator.Applied(c, "widgets"); len(applied) != 3 {
+			t.Errorf("want 3 migrations in the history, got %d", len(applied))
+		}
+		if _, err = history.GetById(c, "widgets/lock", ""); !errors.IsNotFound(err) {
+			t.Errorf("lock not released: %v", err)
+		}
+		if report, err = migrator.Migrate(c, "widgets", data.LatestVersion, false); err != nil || len(report.Runs) != 0 {
+			t.Errorf("a migrated module migrated again: %+v, %v", report, err)
+		}
+
+		// down steps revert newest first; a backfill without an undo script keeps its values
+		report, err = migrator.Migrate(c, "widgets", 1, false)
+		if err != nil || report.From != 3 || report.To != 1 || len(report.Runs) != 2 || report.Runs[0].Version != 3 {
+			t.Fatalf("Migrate down: %+v, %v", report, err)
+		}
+		if got := widgets(t, svc, c); got != "alpha::10:red, beta::20:red" {
+			t.Fatalf("after reverting to 1: %s", got)
+		}
+		if report, err = migrator.Migrate(c, "widgets", 0, false); err != nil || report.To != 0 {
+			t.Fatalf("Migrate to 0: %+v, %v", report, err)
+		}
+		if got := widgets(t, svc, c); got != "alpha::10:nil, beta::20:nil" {
+			t.Errorf("after reverting every migration: %s", got)
+		}
+	})
+
+	// a store that cannot rewrite fields in place has fields added by update, and cannot have them
+	// renamed, which stops the migration at the version before
+	t.Run("without a field migrator", func(t *testing.T) {
+		migrator, svc, _, c := setup(t, func(comp data.DataComponent) data.DataComponent {
+			return &withoutFieldMigrator{comp}
+		})
+		report, err := migrator.Migrate(c, "widgets", data.LatestVersion, false)
+		if !errors.HasErrorCode(err, errors.CORE_ERROR_NOT_IMPLEMENTED) || report.To != 2 {
+			t.Fatalf("want a migration stopped at 2 by the rename, got %+v, %v", report, err)
+		}
+		if got := widgets(t, svc, c); got != "alpha::10:red, beta::20:red" {
+			t.Errorf("after migrating to 2: %s", got)
+		}
+		if applied, _ := migrator.Applied(c, "widgets"); len(applied) != 2 {
+			t.Errorf("want 2 migrations in the history, got %d", len(applied))
+		}
+	})
+}
+
+// stepFunc is a migration step running a function up and doing nothing down.
+type stepFunc func(ctx core.RequestContext) error
+
+func (f stepFunc) Describe() string { return "step" }
+func (f stepFunc) Up(ctx core.RequestContext, comp data.DataComponent) error {
+	return f(ctx)
+}
+func (f stepFunc) Down(ctx core.RequestContext, comp data.DataComponent) error { return nil }
+
+func TestMigrationLock(t *testing.T) {
+	svc, _, c := newWidgets(t, core.StorableConfig{})
+	history := memory.NewMemoryDataComponentForObject(c.Server, data.MIGRATION_OBJECT, data.MigrationRecordFactory{})
+	migrator := data.NewMigratorWithServices(c.Server, history, svc)
+	migrator.LockTimeout = 30 * time.Millisecond
+	rival := data.NewMigratorWithServices(c.Server, history, svc)
+	rival.LockTimeout = migrator.LockTimeout
+	owner := func() string {
+		held, err := history.GetById(c, "widgets/lock", "")
+		if err != nil {
+			return ""
+		}
+		return held.(*data.MigrationRecord).Owner
+	}
+
+	// a migration running longer than the lock timeout keeps its lock fresh, and a rival finds it
+	// held throughout
+	var rivalErr error
+	slow := stepFunc(func(ctx core.RequestContext) error {
+		time.Sleep(2 * migrator.LockTimeout)
+		_, rivalErr = rival.Migrate(c, "widgets", data.LatestVersion, false)
+		return nil
+	})
+	for _, m := range []*data.Migrator{migrator, rival} {
+		if err := m.Register(c, "widgets", &data.Migration{Version: 1, Object: "widget", Steps: []data.MigrationStep{slow}}); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+	if _, err := migrator.Migrate(c, "widgets", data.LatestVersion, false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if !data.IsMigrationLocked(rivalErr) {
+		t.Fatalf("a rival took a lock being refreshed: %v", rivalErr)
+	}
+	if held := owner(); held != "" {
+		t.Fatalf("lock not released, held by %s", held)
+	}
+
+	// an instance whose lock is taken over stops before its next migration, and leaves the lock
+	// to the instance that took it
+	taken := stepFunc(func(ctx core.RequestContext) error {
+		if err := history.Update(c, "lost/lock", utils.StringMap{"Owner": "rival", "AppliedAt": time.Now()}); err != nil {
+			return err
+		}
+		time.Sleep(migrator.LockTimeout)
+		return nil
+	})
+	if err := migrator.Register(c, "lost", &data.Migration{Version: 1, Object: "widget", Steps: []data.MigrationStep{taken}},
+		&data.Migration{Version: 2, Object: "widget"}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	report, err := migrator.Migrate(c, "lost", data.LatestVersion, false)
+	if !data.IsMigrationLocked(err) || report.To != 1 {
+		t.Fatalf("want a migration stopped at 1 by its lost lock, got %+v, %v", report, err)
+	}
+	if held, err := history.GetById(c, "lost/lock", ""); err != nil || held.(*data.MigrationRecord).Owner != "rival" {
+		t.Fatalf("the lock taken over was released: %v", err)
+	}
+
+	// of two instances finding a lock stale, one takes it over
+	stale := &data.MigrationRecord{Module: "widgets", AppliedAt: time.Now().Add(-time.Hour), Owner: "dead"}
+	stale.SetId("widgets/lock")
+	if err = history.CreateMulti(c, []core.Storable{stale}); err != nil {
+		t.Fatalf("CreateMulti: %v", err)
+	}
+	results := make(chan error, 2)
+	for _, m := range []*data.Migrator{migrator, rival} {
+		go func(m *data.Migrator) {
+			_, err := m.Migrate(c, "widgets", 0, false)
+			results <- err
+		}(m)
+	}
+	locked := 0
+	for i := 0; i < 2; i++ {
+		if err := <-results; data.IsMigrationLocked(err) {
+			locked++
+		} else if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+	}
+	if locked > 1 {
+		t.Errorf("neither instance took over the stale lock")
+	}
+}
@@ -0,0 +1,257 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Normalize returns a copy of the query with its filter in a canonical form, so that filters that
+// mean the same thing reach a provider — and a compiled-query cache — as the same tree:
+//
+//   - a logical node's operands of the same operator are lifted into it, so (a and b) and c
+//     becomes a and b and c;
+//   - not is pushed inward by De Morgan's laws until it rests on a single test, where it is folded
+//     into the test when the test has an exact opposite: eq and ne, in and not in, null and not
+//     null. Ordered comparisons and functions keep their not, since a null field fails both
+//     Size gt 5 and Size le 5, and so neither is the other's opposite;
+//   - a logical node with one operand is replaced by that operand;
+//   - a comparison with a null literal becomes a null test.
+//
+// The query itself is not changed, and the elision of optional predicates is unaffected.
+func (q *Query) Normalize() *Query {
+	if q == nil {
+		return nil
+	}
+	normalized := *q
+	normalized.Filter = normalizePredicate(q.Filter, false)
+	return &normalized
+}
+
+// normalizePredicate returns predicate in canonical form, negated when negate is set.
+func normalizePredicate(predicate Predicate, negate bool) Predicate {
+	switch node := predicate.(type) {
+	case nil:
+		return nil
+	case *Logical:
+		operator := node.Operator
+		if negate {
+			operator = LogicalAnd
+			if node.Operator == LogicalAnd {
+				operator = LogicalOr
+			}
+		}
+		operands := make([]Predicate, 0, len(node.Operands))
+		for _, operand := range node.Operands {
+			normalized := normalizePredicate(operand, negate)
+			if inner, ok := normalized.(*Logical); ok && inner.Operator == operator {
+				operands = append(operands, inner.Operands...)
+				continue
+			}
+			operands = append(operands, normalized)
+		}
+		if len(operands) == 1 {
+			return operands[0]
+		}
+		return &Logical{Optionality: node.Optionality, Operator: operator, Operands: operands}
+	case *Not:
+		return normalizePredicate(node.Operand, !negate)
+	case *Comparison:
+		if node.Value.Kind == OperandLiteral && node.Value.Value == nil && (node.Operator == OpEqual || node.Operator == OpNotEqual) {
+			return normalizePredicate(&NullTest{Optionality: node.Optionality, Field: node.Field, Negated: node.Operator == OpNotEqual}, negate)
+		}
+		comparison := *node
+		if !negate {
+			return &comparison
+		}
+		switch node.Operator {
+		case OpEqual:
+			comparison.Operator = OpNotEqual
+		case OpNotEqual:
+			comparison.Operator = OpEqual
+		default:
+			return &Not{Operand: &comparison}
+		}
+		return &comparison
+	case *Membership:
+		membership := *node
+		membership.Negated = node.Negated != negate
+		return &membership
+	case *NullTest:
+		test := *node
+		test.Negated = node.Negated != negate
+		return &test
+	}
+	if negate {
+		return &Not{Operand: predicate}
+	}
+	return predicate
+}
+
+// fieldBounds gathers what the operands of one conjunction require of a field.
+type fieldBounds struct {
+	null, notNull        bool
+	equal                interface{}
+	lower, upper         interface{}
+	lowerIncl, upperIncl bool
+	unequal              []interface{}
+}
+
+// contradiction reports whether a normalized filter can never match, because a conjunction in it
+// has literal tests that cannot all hold, and returns the field they contradict each other on. A
+// disjunction can never match only when none of its branches can. Only direct tests against
+// literals are considered, so a contradiction it misses is one a provider runs to an empty result.
+// Fields for which skip is true are not considered at all.
+func contradiction(predicate Predicate, skip func(field string) bool) (string, bool) {
+	logical, ok := predicate.(*Logical)
+	if !ok {
+		return "", false
+	}
+	if logical.Operator == LogicalOr {
+		first := ""
+		for i, operand := range logical.Operands {
+			field, found := contradiction(operand, skip)
+			if !found {
+				return "", false
+			}
+			if i == 0 {
+				first = field
+			}
+		}
+		return first, len(logical.Operands) > 0
+	}
+	for _, operand := range logical.Operands {
+		if field, found := contradiction(operand, skip); found {
+			return field, true
+		}
+	}
+	if logical.Operator != LogicalAnd {
+		return "", false
+	}
+	bounds := make(map[string]*fieldBounds)
+	var order []string
+	boundsOf := func(field string) *fieldBounds {
+		if b, ok := bounds[field]; ok {
+			return b
+		}
+		bounds[field] = &fieldBounds{}
+		order = append(order, field)
+		return bounds[field]
+	}
+	for _, operand := range logical.Operands {
+		switch node := operand.(type) {
+		case *NullTest:
+			if skip(node.Field) {
+				continue
+			}
+			b := boundsOf(node.Field)
+			b.null, b.notNull = b.null || !node.Negated, b.notNull || node.Negated
+		case *Membership:
+			if !node.Negated && !skip(node.Field) {
+				boundsOf(node.Field).notNull = true
+			}
+		case *Comparison:
+			if node.Value.Kind != OperandLiteral || node.Value.Value == nil || skip(node.Field) {
+				continue
+			}
+			if b := boundsOf(node.Field); !b.add(node.Operator, node.Value.Value) {
+				return node.Field, true
+			}
+		}
+	}
+	for _, field := range order {
+		if !bounds[field].satisfiable() {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// add records a comparison with a literal, and reports false when it contradicts an equality
+// already recorded.
+func (b *fieldBounds) add(operator CompareOperator, value interface{}) bool {
+	if operator == OpNotEqual {
+		b.unequal = append(b.unequal, value)
+		return true
+	}
+	b.notNull = true
+	switch operator {
+	case OpEqual:
+		if b.equal != nil {
+			res, comparable := compareLiterals(b.equal, value)
+			return !comparable || res == 0
+		}
+		b.equal = value
+	case OpGreater, OpGreaterEqual:
+		inclusive := operator == OpGreaterEqual
+		if b.lower == nil {
+			b.lower, b.lowerIncl = value, inclusive
+		} else if res, comparable := compareLiterals(value, b.lower); comparable && (res > 0 || (res == 0 && !inclusive)) {
+			b.lower, b.lowerIncl = value, inclusive
+		}
+	case OpLess, OpLessEqual:
+		inclusive := operator == OpLessEqual
+		if b.upper == nil {
+			b.upper, b.upperIncl = value, inclusive
+		} else if res, comparable := compareLiterals(value, b.upper); comparable && (res < 0 || (res == 0 && !inclusive)) {
+			b.upper, b.upperIncl = value, inclusive
+		}
+	}
+	return true
+}
+
+func (b *fieldBounds) satisfiable() bool {
+	if b.null && b.notNull {
+		return false
+	}
+	if b.lower != nil && b.upper != nil {
+		if res, comparable := compareLiterals(b.lower, b.upper); comparable && (res > 0 || (res == 0 && !(b.lowerIncl && b.upperIncl))) {
+			return false
+		}
+	}
+	if b.equal == nil {
+		return true
+	}
+	if b.lower != nil {
+		if res, comparable := compareLiterals(b.equal, b.lower); comparable && (res < 0 || (res == 0 && !b.lowerIncl)) {
+			return false
+		}
+	}
+	if b.upper != nil {
+		if res, comparable := compareLiterals(b.equal, b.upper); comparable && (res > 0 || (res == 0 && !b.upperIncl)) {
+			return false
+		}
+	}
+	for _, value := range b.unequal {
+		if res, comparable := compareLiterals(b.equal, value); comparable && res == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// compareLiterals orders two literals of the same class, and reports false when they are not of
+// the same class and so cannot be ordered without knowing the field they are compared with.
+func compareLiterals(a, b interface{}) (int, bool) {
+	classA, classB := literalClass(a), literalClass(b)
+	switch {
+	case classA == classNumber && classB == classNumber:
+		x, _ := AsFloat(a)
+		y, _ := AsFloat(b)
+		return compareFloats(x, y), true
+	case classA == classString && classB == classString:
+		return strings.Compare(reflect.ValueOf(a).String(), reflect.ValueOf(b).String()), true
+	case classA == classTime || classB == classTime:
+		x, errA := asTime(a)
+		y, errB := asTime(b)
+		if errA != nil || errB != nil {
+			return 0, false
+		}
+		return x.Compare(y), true
+	case classA == classBool && classB == classBool:
+		if reflect.ValueOf(a).Bool() == reflect.ValueOf(b).Bool() {
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
@@ -0,0 +1,640 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ODataSyntaxError reports OData filter text that could not be parsed, and where.
+type ODataSyntaxError struct {
+	// Offset is the byte offset into the filter text at which parsing failed.
+	Offset int
+	// Message describes what was found there, or what was expected instead.
+	Message string
+}
+
+func (err *ODataSyntaxError) Error() string {
+	return fmt.Sprintf("odata filter: %s at offset %d", err.Message, err.Offset)
+}
+
+// odataTokenKind classifies a lexed token of filter text.
+type odataTokenKind int
+
+const (
+	odataEOF odataTokenKind = iota + 1
+	odataIdent
+	odataString
+	odataLiteral
+	odataAlias
+	odataOpenParen
+	odataCloseParen
+	odataComma
+)
+
+// odataToken is one lexed token and the offset it began at.
+type odataToken struct {
+	kind   odataTokenKind
+	text   string
+	offset int
+}
+
+// odataLex splits filter text into tokens. Literals that are not strings — numbers, dates, times —
+// are lexed as one run and classified by the parser, since OData writes them unquoted.
+func odataLex(text string) ([]odataToken, error) {
+	var tokens []odataToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, odataToken{odataOpenParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, odataToken{odataCloseParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, odataToken{odataComma, ",", i})
+			i++
+		case c == '\'':
+			// a quote inside a string is written twice
+			var value strings.Builder
+			start := i
+			i++
+			for {
+				if i >= len(text) {
+					return nil, &ODataSyntaxError{Offset: start, Message: "unterminated string"}
+				}
+				if text[i] == '\'' {
+					if i+1 < len(text) && text[i+1] == '\'' {
+						value.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteByte(text[i])
+				i++
+			}
+			tokens = append(tokens, odataToken{odataString, value.String(), start})
+		case c == '@':
+			start := i
+			i++
+			for i < len(text) && isODataIdentChar(text[i]) {
+				i++
+			}
+			if i == start+1 {
+				return nil, &ODataSyntaxError{Offset: start, Message: "parameter alias has no name"}
+			}
+			tokens = append(tokens, odataToken{odataAlias, text[start+1 : i], start})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(text) && isODataLiteralChar(text[i]) {
+				i++
+			}
+			tokens = append(tokens, odataToken{odataLiteral, text[start:i], start})
+		case isODataIdentStart(c):
+			start := i
+			for i < len(text) && (isODataIdentChar(text[i]) || text[i] == '/') {
+				i++
+			}
+			tokens = append(tokens, odataToken{odataIdent, text[start:i], start})
+		default:
+			return nil, &ODataSyntaxError{Offset: i, Message: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, odataToken{odataEOF, "", len(text)}), nil
+}
+
+func isODataIdentStart(c byte) bool {
+	return c == '_' || unicode.IsLetter(rune(c))
+}
+
+func isODataIdentChar(c byte) bool {
+	return isODataIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isODataLiteralChar(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		c == '.' || c == ':' || c == '+' || c == '-'
+}
+
+// odataParser is a recursive descent parser over lexed filter text. Precedence, loosest first, is
+// or, and, not, then comparison — the OData grammar's own.
+type odataParser struct {
+	tokens []odataToken
+	pos    int
+}
+
+// ParseODataFilter lowers the text of an OData $filter into a query.
+//
+// Comparisons, and, or, not, in, null tests and the contains, startswith and endswith functions
+// are understood. A parameter alias (@name) becomes a parameter operand, so a filter parsed once
+// can be compiled once and bound per request. A field path's segments are separated by "/" in the
+// text and by "." in the query.
+//
+// Two forms are folded into the dedicated node the query has for them: a comparison against null
+// becomes a NullTest, and not applied directly to an in becomes a negated Membership. A comparison
+// written with the literal on the left is turned around, since a Comparison names its field first.
+//
+// Errors are *ODataSyntaxError and carry the byte offset of the token that could not be parsed.
+func ParseODataFilter(text string) (*Query, error) {
+	tokens, err := odataLex(text)
+	if err != nil {
+		return nil, err
+	}
+	parser := &odataParser{tokens: tokens}
+	query := NewQuery()
+	if parser.peek().kind == odataEOF {
+		return query, nil
+	}
+	if query.Filter, err = parser.parseOr(); err != nil {
+		return nil, err
+	}
+	if tok := parser.peek(); tok.kind != odataEOF {
+		return nil, parser.unexpected(tok, "end of filter")
+	}
+	return query, nil
+}
+
+func (p *odataParser) peek() odataToken {
+	return p.tokens[p.pos]
+}
+
+func (p *odataParser) next() odataToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != odataEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword reports whether the next token is the given keyword, consuming it when it is.
+func (p *odataParser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == odataIdent && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *odataParser) expect(kind odataTokenKind, what string) (odataToken, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, p.unexpected(tok, what)
+	}
+	return tok, nil
+}
+
+func (p *odataParser) unexpected(tok odataToken, expected string) error {
+	found := strconv.Quote(tok.text)
+	if tok.kind == odataEOF {
+		found = "end of filter"
+	}
+	return &ODataSyntaxError{Offset: tok.offset, Message: fmt.Sprintf("expected %s, found %s", expected, found)}
+}
+
+func (p *odataParser) parseOr() (Predicate, error) {
+	return p.parseLogical(LogicalOr, p.parseAnd)
+}
+
+func (p *odataParser) parseAnd() (Predicate, error) {
+	return p.parseLogical(LogicalAnd, p.parseUnary)
+}
+
+// parseLogical parses a run of operands joined by one operator into a single node.
+func (p *odataParser) parseLogical(operator LogicalOperator, operand func() (Predicate, error)) (Predicate, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	operands := []Predicate{first}
+	for p.keyword(string(operator)) {
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, next)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return &Logical{Operator: operator, Operands: operands}, nil
+}
+
+func (p *odataParser) parseUnary() (Predicate, error) {
+	if !p.keyword("not") {
+		return p.parsePrimary()
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if membership, ok := operand.(*Membership); ok && !membership.Negated {
+		membership.Negated = true
+		return membership, nil
+	}
+	return &Not{Operand: operand}, nil
+}
+
+func (p *odataParser) parsePrimary() (Predicate, error) {
+	tok := p.peek()
+	if tok.kind == odataOpenParen {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(odataCloseParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	if tok.kind == odataIdent && p.tokens[p.pos+1].kind == odataOpenParen {
+		return p.parseFunction()
+	}
+	return p.parseComparison()
+}
+
+// parseFunction parses a string function call, optionally compared with a boolean as OData
+// permits: contains(Name,'x') eq true is contains(Name,'x'), and eq false is its negation.
+func (p *odataParser) parseFunction() (Predicate, error) {
+	nameTok := p.next()
+	var function FilterFunction
+	switch strings.ToLower(nameTok.text) {
+	case string(FuncContains):
+		function = FuncContains
+	case string(FuncStartsWith):
+		function = FuncStartsWith
+	case string(FuncEndsWith):
+		function = FuncEndsWith
+	default:
+		return nil, &ODataSyntaxError{Offset: nameTok.offset, Message: fmt.Sprintf("unsupported function %q", nameTok.text)}
+	}
+	p.next()
+	fieldTok, err := p.expect(odataIdent, "field name")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.expect(odataComma, "\",\""); err != nil {
+		return nil, err
+	}
+	argument, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.expect(odataCloseParen, "\")\""); err != nil {
+		return nil, err
+	}
+	call := &FunctionCall{Function: function, Field: odataFieldPath(fieldTok.text), Arguments: []Operand{argument}}
+	opTok := p.peek()
+	if opTok.kind != odataIdent || !(strings.EqualFold(opTok.text, string(OpEqual)) || strings.EqualFold(opTok.text, string(OpNotEqual))) {
+		return call, nil
+	}
+	p.next()
+	valueTok := p.next()
+	value, isBool := odataBool(valueTok)
+	if !isBool {
+		return nil, p.unexpected(valueTok, "true or false")
+	}
+	if value == strings.EqualFold(opTok.text, string(OpEqual)) {
+		return call, nil
+	}
+	return &Not{Operand: call}, nil
+}
+
+func (p *odataParser) parseComparison() (Predicate, error) {
+	leftTok := p.peek()
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("in") {
+		if left.Kind != OperandField {
+			return nil, &ODataSyntaxError{Offset: leftTok.offset, Message: "in must be applied to a field"}
+		}
+		values, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return &Membership{Field: left.Name, Values: values}, nil
+	}
+	opTok := p.next()
+	operator, ok := odataOperator(opTok)
+	if !ok {
+		return nil, p.unexpected(opTok, "comparison operator")
+	}
+	rightTok := p.peek()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if left.Kind != OperandField {
+		if right.Kind != OperandField {
+			return nil, &ODataSyntaxError{Offset: leftTok.offset, Message: "comparison must name a field"}
+		}
+		left, right, operator = right, left, operator.converse()
+		rightTok = leftTok
+	}
+	if right.Kind == OperandLiteral && right.Value == nil {
+		switch operator {
+		case OpEqual:
+			return &NullTest{Field: left.Name}, nil
+		case OpNotEqual:
+			return &NullTest{Field: left.Name, Negated: true}, nil
+		}
+		return nil, &ODataSyntaxError{Offset: rightTok.offset, Message: fmt.Sprintf("null cannot be compared with %s", operator)}
+	}
+	return &Comparison{Field: left.Name, Operator: operator, Value: right}, nil
+}
+
+// parseSet parses the parenthesised list after in, or a single list-valued parameter alias.
+func (p *odataParser) parseSet() ([]Operand, error) {
+	if tok := p.peek(); tok.kind == odataAlias {
+		p.next()
+		return []Operand{ParameterOperand(tok.text)}, nil
+	}
+	if _, err := p.expect(odataOpenParen, "\"(\""); err != nil {
+		return nil, err
+	}
+	var values []Operand
+	for {
+		valueTok := p.peek()
+		value, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if value.Kind == OperandField {
+			return nil, &ODataSyntaxError{Offset: valueTok.offset, Message: "in lists values, not fields"}
+		}
+		values = append(values, value)
+		tok := p.next()
+		if tok.kind == odataCloseParen {
+			return values, nil
+		}
+		if tok.kind != odataComma {
+			return nil, p.unexpected(tok, "\",\" or \")\"")
+		}
+	}
+}
+
+// parseOperand parses a field path, parameter alias or literal.
+func (p *odataParser) parseOperand() (Operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case odataString:
+		return LiteralOperand(tok.text), nil
+	case odataAlias:
+		return ParameterOperand(tok.text), nil
+	case odataLiteral:
+		value, err := odataLiteralValue(tok)
+		if err != nil {
+			return Operand{}, err
+		}
+		return LiteralOperand(value), nil
+	case odataIdent:
+		if value, ok := odataBool(tok); ok {
+			return LiteralOperand(value), nil
+		}
+		if strings.EqualFold(tok.text, "null") {
+			return LiteralOperand(nil), nil
+		}
+		if _, isOperator := odataOperator(tok); isOperator || odataReserved(tok.text) {
+			return Operand{}, p.unexpected(tok, "operand")
+		}
+		return FieldOperand(odataFieldPath(tok.text)), nil
+	}
+	return Operand{}, p.unexpected(tok, "operand")
+}
+
+func odataReserved(word string) bool {
+	switch strings.ToLower(word) {
+	case "and", "or", "not", "in":
+		return true
+	}
+	return false
+}
+
+func odataOperator(tok odataToken) (CompareOperator, bool) {
+	if tok.kind != odataIdent {
+		return "", false
+	}
+	operator := CompareOperator(strings.ToLower(tok.text))
+	switch operator {
+	case OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		return operator, true
+	}
+	return "", false
+}
+
+func odataBool(tok odataToken) (bool, bool) {
+	if tok.kind != odataIdent {
+		return false, false
+	}
+	switch strings.ToLower(tok.text) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+// odataLiteralValue classifies an unquoted literal: an integer becomes an int64, a decimal a float64,
+// and a date or date-time a time.Time.
+func odataLiteralValue(tok odataToken) (interface{}, error) {
+	if i, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+		return f, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+		if t, err := time.Parse(layout, tok.text); err == nil {
+			return t, nil
+		}
+	}
+	return nil, &ODataSyntaxError{Offset: tok.offset, Message: fmt.Sprintf("invalid literal %q", tok.text)}
+}
+
+func odataFieldPath(text string) string {
+	return strings.ReplaceAll(text, "/", ".")
+}
+
+// converse returns the operator that gives the same result with its operands swapped.
+func (op CompareOperator) converse() CompareOperator {
+	switch op {
+	case OpGreater:
+		return OpLess
+	case OpGreaterEqual:
+		return OpLessEqual
+	case OpLess:
+		return OpGreater
+	case OpLessEqual:
+		return OpGreaterEqual
+	}
+	return op
+}
+
+// ToODataFilter prints the query's filter as OData filter text, which ParseODataFilter reads back
+// into the same tree. An unconstrained query prints as the empty string.
+//
+// What OData cannot carry is refused rather than dropped: an Extension has no OData form, and a
+// literal of a type OData has no syntax for cannot be printed. The Optional flag is not carried
+// either, since OData has no syntax for it; a parsed filter's predicates are all required.
+func (q *Query) ToODataFilter() (string, error) {
+	if q == nil || q.Filter == nil {
+		return "", nil
+	}
+	var out strings.Builder
+	if err := printODataPredicate(&out, q.Filter, odataPrecedenceNone); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// precedence of printed nodes, loosest first, to decide where parentheses are needed
+const (
+	odataPrecedenceNone = iota
+	odataPrecedenceOr
+	odataPrecedenceAnd
+)
+
+func printODataPredicate(out *strings.Builder, predicate Predicate, context int) error {
+	switch node := predicate.(type) {
+	case *Comparison:
+		out.WriteString(odataPrintPath(node.Field))
+		out.WriteString(" " + string(node.Operator) + " ")
+		return printODataOperand(out, node.Value)
+	case *Logical:
+		if len(node.Operands) == 1 {
+			return printODataPredicate(out, node.Operands[0], context)
+		}
+		precedence := odataPrecedenceOr
+		if node.Operator == LogicalAnd {
+			precedence = odataPrecedenceAnd
+		}
+		// an operand of the same operator is parenthesised too, so that the tree's grouping
+		// survives the round trip instead of being flattened by the parser
+		if context >= precedence {
+			out.WriteString("(")
+		}
+		for i, operand := range node.Operands {
+			if i > 0 {
+				out.WriteString(" " + string(node.Operator) + " ")
+			}
+			if err := printODataPredicate(out, operand, precedence); err != nil {
+				return err
+			}
+		}
+		if context >= precedence {
+			out.WriteString(")")
+		}
+		return nil
+	case *Not:
+		out.WriteString("not ")
+		return printODataParenthesised(out, node.Operand)
+	case *Membership:
+		if node.Negated {
+			out.WriteString("not ")
+		}
+		out.WriteString("(" + odataPrintPath(node.Field) + " in ")
+		if len(node.Values) == 1 && node.Values[0].Kind == OperandParameter {
+			out.WriteString("@" + node.Values[0].Name + ")")
+			return nil
+		}
+		out.WriteString("(")
+		for i, value := range node.Values {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			if err := printODataOperand(out, value); err != nil {
+				return err
+			}
+		}
+		out.WriteString("))")
+		return nil
+	case *NullTest:
+		operator := OpEqual
+		if node.Negated {
+			operator = OpNotEqual
+		}
+		out.WriteString(odataPrintPath(node.Field) + " " + string(operator) + " null")
+		return nil
+	case *FunctionCall:
+		if len(node.Arguments) != 1 {
+			return fmt.Errorf("odata filter: %s takes one argument, has %d", node.Function, len(node.Arguments))
+		}
+		out.WriteString(string(node.Function) + "(" + odataPrintPath(node.Field) + ",")
+		if err := printODataOperand(out, node.Arguments[0]); err != nil {
+			return err
+		}
+		out.WriteString(")")
+		return nil
+	case *Extension:
+		return fmt.Errorf("odata filter: extension %s.%s has no OData form", node.Namespace, node.Name)
+	}
+	return fmt.Errorf("odata filter: cannot print a %T", predicate)
+}
+
+func printODataParenthesised(out *strings.Builder, predicate Predicate) error {
+	out.WriteString("(")
+	if err := printODataPredicate(out, predicate, odataPrecedenceNone); err != nil {
+		return err
+	}
+	out.WriteString(")")
+	return nil
+}
+
+func printODataOperand(out *strings.Builder, operand Operand) error {
+	switch operand.Kind {
+	case OperandParameter:
+		out.WriteString("@" + operand.Name)
+		return nil
+	case OperandField:
+		out.WriteString(odataPrintPath(operand.Name))
+		return nil
+	}
+	switch value := operand.Value.(type) {
+	case nil:
+		out.WriteString("null")
+	case string:
+		out.WriteString("'" + strings.ReplaceAll(value, "'", "''") + "'")
+	case bool:
+		out.WriteString(strconv.FormatBool(value))
+	case int:
+		out.WriteString(strconv.Itoa(value))
+	case int32:
+		out.WriteString(strconv.FormatInt(int64(value), 10))
+	case int64:
+		out.WriteString(strconv.FormatInt(value, 10))
+	case float32:
+		out.WriteString(odataFormatFloat(float64(value), 32))
+	case float64:
+		out.WriteString(odataFormatFloat(value, 64))
+	case time.Time:
+		out.WriteString(value.Format(time.RFC3339Nano))
+	default:
+		return fmt.Errorf("odata filter: no literal form for %T", operand.Value)
+	}
+	return nil
+}
+
+// odataFormatFloat prints a float so that it reads back as a float rather than an integer.
+func odataFormatFloat(value float64, bits int) string {
+	text := strconv.FormatFloat(value, 'g', -1, bits)
+	if !strings.ContainsAny(text, ".eEIN") {
+		text += ".0"
+	}
+	return text
+}
+
+func odataPrintPath(field string) string {
+	return strings.ReplaceAll(field, ".", "/")
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseODataFilter(t *testing.T) {
+	cases := []struct {
+		text string
+		want Predicate
+	}{
+		{"Name eq 'o''brien'", &Comparison{Field: "Name", Operator: OpEqual, Value: LiteralOperand("o'brien")}},
+		{"5 lt Size", &Comparison{Field: "Size", Operator: OpGreater, Value: LiteralOperand(int64(5))}},
+		{"Owner/Name ne @owner", &Comparison{Field: "Owner.Name", Operator: OpNotEqual, Value: ParameterOperand("owner")}},
+		{"Colour eq null", &NullTest{Field: "Colour"}},
+		{"not (Size in (1,2.5))", &Membership{Field: "Size", Values: []Operand{LiteralOperand(int64(1)), LiteralOperand(2.5)}, Negated: true}},
+		{"Tags in @tags", &Membership{Field: "Tags", Values: []Operand{ParameterOperand("tags")}}},
+		{"contains(Name,'x') eq false", &Not{Operand: &FunctionCall{Function: FuncContains, Field: "Name", Arguments: []Operand{LiteralOperand("x")}}}},
+		{"Due le 2024-03-01", &Comparison{Field: "Due", Operator: OpLessEqual, Value: LiteralOperand(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))}},
+		{"A eq 1 or B eq 2 and not startswith(C,'c')", &Logical{Operator: LogicalOr, Operands: []Predicate{
+			&Comparison{Field: "A", Operator: OpEqual, Value: LiteralOperand(int64(1))},
+			&Logical{Operator: LogicalAnd, Operands: []Predicate{
+				&Comparison{Field: "B", Operator: OpEqual, Value: LiteralOperand(int64(2))},
+				&Not{Operand: &FunctionCall{Function: FuncStartsWith, Field: "C", Arguments: []Operand{LiteralOperand("c")}}},
+			}},
+		}}},
+	}
+	for _, tc := range cases {
+		query, err := ParseODataFilter(tc.text)
+		if err != nil {
+			t.Errorf("%s: %v", tc.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(query.Filter, tc.want) {
+			t.Errorf("%s: got %#v", tc.text, query.Filter)
+			continue
+		}
+		// printing and parsing again must give the same tree
+		text, err := query.ToODataFilter()
+		if err != nil {
+			t.Errorf("%s: ToODataFilter: %v", tc.text, err)
+			continue
+		}
+		again, err := ParseODataFilter(text)
+		if err != nil || !reflect.DeepEqual(again.Filter, tc.want) {
+			t.Errorf("%s: printed as %q, which does not round trip (%v)", tc.text, text, err)
+		}
+	}
+}
+
+func TestParseODataFilterErrors(t *testing.T) {
+	cases := []struct {
+		text   string
+		offset int
+	}{
+		{"Name eq 'open", 8},
+		{"Name eq", 7},
+		{"Name lk 1", 5},
+		{"(Name eq 1", 10},
+		{"1 eq 2", 0},
+		{"Size gt null", 8},
+		{"length(Name) eq 1", 0},
+		{"Name eq 1 Size", 10},
+		{"Name in (Size)", 9},
+		{"Name eq #", 8},
+	}
+	for _, tc := range cases {
+		_, err := ParseODataFilter(tc.text)
+		syntaxErr, ok := err.(*ODataSyntaxError)
+		if !ok {
+			t.Errorf("%s: want a syntax error, got %v", tc.text, err)
+			continue
+		}
+		if syntaxErr.Offset != tc.offset {
+			t.Errorf("%s: want offset %d, got %d (%s)", tc.text, tc.offset, syntaxErr.Offset, syntaxErr.Message)
+		}
+	}
+}
+
+func TestToODataFilterGrouping(t *testing.T) {
+	query := NewQuery()
+	query.Filter = &Logical{Operator: LogicalAnd, Operands: []Predicate{
+		&Logical{Operator: LogicalOr, Operands: []Predicate{&NullTest{Field: "A"}, &NullTest{Field: "B", Negated: true}}},
+		&Comparison{Field: "C", Operator: OpGreater, Value: LiteralOperand(2.0)},
+	}}
+	text, err := query.ToODataFilter()
+	if err != nil {
+		t.Fatalf("ToODataFilter: %v", err)
+	}
+	if want := "(A eq null or B ne null) and C gt 2.0"; text != want {
+		t.Fatalf("want %q, got %q", want, text)
+	}
+	query.Filter = &Extension{Namespace: "geo", Name: "within"}
+	if _, err = query.ToODataFilter(); err == nil {
+		t.Fatal("an extension has no OData form and must not print")
+	}
+}
@@ -0,0 +1,117 @@
+package data
+
+import (
+	"time"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+)
+
+// OUTBOX_OBJECT is the object type outbox entries are stored as.
+const OUTBOX_OBJECT = "data.OutboxEntry"
+
+// Publisher publishes a message to a topic. elements.MessagingManager is one; a data component
+// holds it by this interface, as the elements package depends on this one.
+type Publisher interface {
+	Publish(ctx core.RequestContext, topic string, message *core.Message) error
+}
+
+// OutboxEntry is a data event written in the transaction of the write that raised it, and held
+// until it has been published. Its id is the id of the message it is published as, so a topic
+// deduplicating on message ids publishes it once however often it is relayed. It is also the data
+// of that message.
+type OutboxEntry struct {
+	StorageInfo
+	Object   string        `json:"Object" bson:"Object"`
+	EntityId string        `json:"EntityId" bson:"EntityId"`
+	Event    DataEventType `json:"Event" bson:"Event"`
+	User     string        `json:"User" bson:"User"`
+	Tenant   string        `json:"Tenant" bson:"Tenant"`
+	At       time.Time     `json:"At" bson:"At"`
+	// Payload is the record as written — or, for a delete, as it was before — in JSON.
+	Payload string `json:"Payload" bson:"Payload"`
+}
+
+func (oe *OutboxEntry) Config() *core.StorableConfig {
+	return &core.StorableConfig{
+		ObjectType: OUTBOX_OBJECT,
+		LabelField: "Id",
+		Collection: "OutboxEntry",
+	}
+}
+
+func (oe *OutboxEntry) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatypes.SerializableReader) error {
+	var err error
+	if err = rdr.ReadString(c, cdc, "Object", &oe.Object); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "EntityId", &oe.EntityId); err != nil {
+		return err
+	}
+	event := string(oe.Event)
+	if err = rdr.ReadString(c, cdc, "Event", &event); err != nil {
+		return err
+	}
+	oe.Event = DataEventType(event)
+	if err = rdr.ReadString(c, cdc, "User", &oe.User); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "Tenant", &oe.Tenant); err != nil {
+		return err
+	}
+	if err = rdr.ReadTime(c, cdc, "At", &oe.At); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, "Payload", &oe.Payload); err != nil {
+		return err
+	}
+	return oe.StorageInfo.ReadAll(c, cdc, rdr)
+}
+
+func (oe *OutboxEntry) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr datatypes.SerializableWriter) error {
+	var err error
+	if err = wtr.WriteString(c, cdc, "Object", &oe.Object); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "EntityId", &oe.EntityId); err != nil {
+		return err
+	}
+	event := string(oe.Event)
+	if err = wtr.WriteString(c, cdc, "Event", &event); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "User", &oe.User); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "Tenant", &oe.Tenant); err != nil {
+		return err
+	}
+	if err = wtr.WriteTime(c, cdc, "At", &oe.At); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, "Payload", &oe.Payload); err != nil {
+		return err
+	}
+	return oe.StorageInfo.WriteAll(c, cdc, wtr)
+}
+
+// OutboxEntryFactory creates OutboxEntries, for registering the outbox object with a server or for
+// handing to a data component directly.
+type OutboxEntryFactory struct{}
+
+func (f OutboxEntryFactory) CreateObject(ctx.Context) interface{} {
+	return &OutboxEntry{}
+}
+
+func (f OutboxEntryFactory) CreateObjectCollection(cx ctx.Context, length int) interface{} {
+	return make([]OutboxEntry, length)
+}
+
+func (f OutboxEntryFactory) CreateObjectPointersCollection(cx ctx.Context, length int) interface{} {
+	return make([]*OutboxEntry, length)
+}
+
+func (f OutboxEntryFactory) Info() core.Info {
+	return core.NewInfo("Data event awaiting publication", OUTBOX_OBJECT, "1.0", nil)
+}
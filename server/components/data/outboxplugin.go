@@ -0,0 +1,363 @@
+package data
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_DATA_OUTBOX_SVC names the data service an OutboxPlugin writes its outbox entries to.
+	CONF_DATA_OUTBOX_SVC = "outboxservice"
+	// CONF_DATA_OUTBOX_TOPIC names the topic an OutboxPlugin publishes its entries to. It should be
+	// durable, as a transient topic neither deduplicates nor keeps what it is sent.
+	CONF_DATA_OUTBOX_TOPIC = "outboxtopic"
+)
+
+var _ DataComponent = (*OutboxPlugin)(nil)
+
+/*
+OutboxPlugin publishes the data events of a transaction if and only if it commits. Each write made
+through the plugin inside Transaction adds an outbox entry per record it created, updated or
+deleted, and the entries are written to the outbox data service as the last step of the
+transaction, so they commit or roll back with the writes. Once the transaction has committed they
+are published to the outbox topic and removed; any that fail to publish are left for Relay, which
+publishes what is left in the outbox in the order it was written.
+
+An entry is published as a message whose id is the entry's, so a durable topic drops the copy a
+relay after a partial failure sends again. For the writes and their entries to commit together the
+outbox data service must share the transaction of the data service, as two collections of one
+database do. Writes outside a transaction pass straight through with no entries.
+*/
+type OutboxPlugin struct {
+	DataPlugin
+	OutboxDataComponent DataComponent
+	Publisher           Publisher
+	Topic               string
+	mu                  sync.Mutex
+	lastAt              time.Time
+	relayMu             sync.Mutex
+}
+
+// outboxTx collects the entries of one open transaction. It is carried on the context the
+// transaction's callback is given, under the plugin's txKey.
+type outboxTx struct {
+	entries []*OutboxEntry
+}
+
+func NewOutboxPlugin(ctx core.ServerContext) *OutboxPlugin {
+	return &OutboxPlugin{}
+}
+
+// NewOutboxPluginWithBase creates a plugin over comp writing its entries to outbox and publishing
+// them to topic.
+func NewOutboxPluginWithBase(ctx core.ServerContext, comp DataComponent, outbox DataComponent, publisher Publisher, topic string) *OutboxPlugin {
+	return &OutboxPlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, OutboxDataComponent: outbox, Publisher: publisher, Topic: topic}
+}
+
+func (svc *OutboxPlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.OutboxDataComponent == nil {
+		svc.AddStringConfiguration(ctx, CONF_DATA_OUTBOX_SVC, "Data service outbox entries are written to", "")
+		svc.AddStringConfiguration(ctx, CONF_DATA_OUTBOX_TOPIC, "Durable topic outbox entries are published to", "")
+	}
+	return nil
+}
+
+func (svc *OutboxPlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.OutboxDataComponent == nil {
+		outboxSvc, _ := svc.GetStringConfiguration(ctx, CONF_DATA_OUTBOX_SVC)
+		s, err := ctx.GetService(outboxSvc)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_OUTBOX_SVC)
+		}
+		dc, ok := s.(DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_OUTBOX_SVC)
+		}
+		svc.OutboxDataComponent = dc
+		svc.Topic, _ = svc.GetStringConfiguration(ctx, CONF_DATA_OUTBOX_TOPIC)
+	}
+	if svc.Topic == "" {
+		return errors.MissingConf(ctx, CONF_DATA_OUTBOX_TOPIC)
+	}
+	if svc.Publisher == nil {
+		publisher, ok := ctx.GetServerElement(core.ServerElementMessagingManager).(Publisher)
+		if !ok {
+			return errors.MissingService(ctx, "MessagingManager")
+		}
+		svc.Publisher = publisher
+	}
+	return nil
+}
+
+// Transaction runs callback in a transaction of the data service, writing the outbox entries of
+// the writes it made through the plugin as its last step, and publishes them once it has
+// committed. A failure to publish is logged and left for Relay rather than returned, as the
+// transaction has committed.
+func (svc *OutboxPlugin) Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error {
+	var entries []*OutboxEntry
+	err := svc.PluginDataComponent.Transaction(ctx, func(txCtx core.RequestContext) error {
+		tx := &outboxTx{}
+		txCtx = txCtx.SubContext("OutboxTransaction")
+		txCtx.Set(svc.txKey(), tx)
+		if err := callback(txCtx); err != nil {
+			return err
+		}
+		if len(tx.entries) == 0 {
+			return nil
+		}
+		items := make([]core.Storable, len(tx.entries))
+		for i, entry := range tx.entries {
+			items[i] = entry
+		}
+		if err := svc.OutboxDataComponent.CreateMulti(txCtx, items); err != nil {
+			return err
+		}
+		entries = tx.entries
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = svc.publish(ctx, entries); err != nil {
+		log.Error(ctx, "Publishing outbox entries failed", slog.String("Object", svc.GetObject()), slog.String("Error", err.Error()))
+	}
+	return nil
+}
+
+// Relay publishes the entries left in the outbox of the plugin's object, oldest first, and returns
+// how many it published. It stops at the first that fails to publish, so that the topic receives
+// the entries in the order they were written.
+func (svc *OutboxPlugin) Relay(ctx core.RequestContext) (int, error) {
+	svc.relayMu.Lock()
+	defer svc.relayMu.Unlock()
+	query := NewQuery()
+	query.Filter = &Comparison{Field: "Object", Operator: OpEqual, Value: LiteralOperand(svc.GetObject())}
+	cond, err := svc.OutboxDataComponent.CreateQueryCondition(ctx, query, nil)
+	if err != nil {
+		return 0, err
+	}
+	items, _, _, _, err := svc.OutboxDataComponent.Get(ctx, nil, cond, -1, 1, "", []string{"At"}, "")
+	if err != nil {
+		return 0, err
+	}
+	entries := make([]*OutboxEntry, 0, len(items))
+	for _, item := range items {
+		entry, ok := item.(*OutboxEntry)
+		if !ok {
+			return 0, errors.TypeMismatch(ctx)
+		}
+		entries = append(entries, entry)
+	}
+	return svc.publish(ctx, entries)
+}
+
+// publish publishes entries in order and removes each from the outbox once it is published. Each
+// is published with the tenant of the write it records, whichever request relays it. The message
+// carries no user, as the outbox keeps only the id of the writer, which subscribers read from the
+// entry.
+func (svc *OutboxPlugin) publish(ctx core.RequestContext, entries []*OutboxEntry) (int, error) {
+	for i, entry := range entries {
+		msg := &core.Message{Id: entry.Id, Data: entry}
+		if entry.Tenant != "" {
+			msg.Tenant = &TenantInfo{TenantId: entry.Tenant}
+		}
+		if err := svc.Publisher.Publish(ctx, svc.Topic, msg); err != nil {
+			return i, err
+		}
+		if err := svc.OutboxDataComponent.Delete(ctx, entry.Id); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// txKey is the key the plugin carries its open transaction under on a context.
+func (svc *OutboxPlugin) txKey() string {
+	return "data.outbox.tx:" + svc.GetObject()
+}
+
+// txOf returns the transaction ctx has open through the plugin, or nil outside one.
+func (svc *OutboxPlugin) txOf(ctx core.RequestContext) *outboxTx {
+	val, ok := ctx.Get(svc.txKey())
+	if !ok {
+		return nil
+	}
+	tx, _ := val.(*outboxTx)
+	return tx
+}
+
+func (svc *OutboxPlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	return svc.captureItems(ctx, []core.Storable{item}, func() error {
+		return svc.PluginDataComponent.Save(ctx, item)
+	})
+}
+
+func (svc *OutboxPlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	if item != nil {
+		item.SetId(id)
+	}
+	return svc.captureItems(ctx, []core.Storable{item}, func() error {
+		return svc.PluginDataComponent.Put(ctx, id, item)
+	})
+}
+
+func (svc *OutboxPlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.captureItems(ctx, items, func() error {
+		return svc.PluginDataComponent.PutMulti(ctx, items)
+	})
+}
+
+func (svc *OutboxPlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.captureItems(ctx, items, func() error {
+		return svc.PluginDataComponent.CreateMulti(ctx, items)
+	})
+}
+
+func (svc *OutboxPlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.captureIds(ctx, []string{id}, func() error {
+		return svc.PluginDataComponent.UpsertId(ctx, id, newVals)
+	})
+}
+
+func (svc *OutboxPlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.captureIds(ctx, []string{id}, func() error {
+		return svc.PluginDataComponent.Update(ctx, id, newVals)
+	})
+}
+
+func (svc *OutboxPlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	return svc.captureIds(ctx, ids, func() error {
+		return svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+	})
+}
+
+func (svc *OutboxPlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return svc.captureCondition(ctx, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, true)
+	})
+}
+
+func (svc *OutboxPlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	return svc.captureCondition(ctx, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, true)
+	})
+}
+
+func (svc *OutboxPlugin) Delete(ctx core.RequestContext, id string) error {
+	return svc.captureIds(ctx, []string{id}, func() error {
+		return svc.PluginDataComponent.Delete(ctx, id)
+	})
+}
+
+func (svc *OutboxPlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	return svc.captureIds(ctx, ids, func() error {
+		return svc.PluginDataComponent.DeleteMulti(ctx, ids)
+	})
+}
+
+func (svc *OutboxPlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	return svc.captureCondition(ctx, queryCond, getids, func() ([]string, error) {
+		return svc.PluginDataComponent.DeleteAll(ctx, queryCond, true)
+	})
+}
+
+// Restore raises the records' creation, as their delete raised their deletion.
+func (svc *OutboxPlugin) Restore(ctx core.RequestContext, ids []string) error {
+	return svc.captureIds(ctx, ids, func() error {
+		return svc.PluginDataComponent.Restore(ctx, ids)
+	})
+}
+
+// nextAt returns the time an entry is written at, later than any entry before it so that Relay
+// finds them in the order they were written.
+func (svc *OutboxPlugin) nextAt() time.Time {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	at := time.Now()
+	if !at.After(svc.lastAt) {
+		at = svc.lastAt.Add(time.Nanosecond)
+	}
+	svc.lastAt = at
+	return at
+}
+
+// captureItems runs a write of items and adds its entries.
+func (svc *OutboxPlugin) captureItems(ctx core.RequestContext, items []core.Storable, write func() error) error {
+	tx := svc.txOf(ctx)
+	if tx == nil {
+		return write()
+	}
+	return captureItems(ctx, svc.PluginDataComponent, items, write, tx.capture(svc))
+}
+
+// captureIds runs a write of the records with ids and adds its entries.
+func (svc *OutboxPlugin) captureIds(ctx core.RequestContext, ids []string, write func() error) error {
+	tx := svc.txOf(ctx)
+	if tx == nil {
+		return write()
+	}
+	return captureIds(ctx, svc.PluginDataComponent, ids, write, tx.capture(svc))
+}
+
+// captureCondition runs a write of the records matching queryCond, which returns the ids it wrote,
+// and adds its entries.
+func (svc *OutboxPlugin) captureCondition(ctx core.RequestContext, queryCond interface{}, getids bool, write func() ([]string, error)) ([]string, error) {
+	tx := svc.txOf(ctx)
+	if tx == nil {
+		return passCondition(getids, write)
+	}
+	return captureCondition(ctx, svc.PluginDataComponent, queryCond, getids, write, tx.capture(svc))
+}
+
+// capture returns the sink adding to tx an entry for each record a write of svc touched.
+func (tx *outboxTx) capture(svc *OutboxPlugin) changeSink {
+	return func(ctx core.RequestContext, ids []string, before map[string]core.Storable, after map[string]core.Storable) error {
+		return svc.capture(ctx, tx, ids, before, after)
+	}
+}
+
+// capture adds an entry to tx for each of ids stored before or after a write.
+func (svc *OutboxPlugin) capture(ctx core.RequestContext, tx *outboxTx, ids []string, before map[string]core.Storable, after map[string]core.Storable) error {
+	var user, tenant string
+	if u := ctx.GetUser(); u != nil {
+		user = u.GetId()
+	}
+	if t := ctx.GetTenant(); t != nil {
+		tenant = t.GetTenantId()
+	}
+	for _, id := range ids {
+		old, wasStored := before[id]
+		current, isStored := after[id]
+		event := EventDataUpdated
+		switch {
+		case !wasStored && !isStored:
+			continue
+		case !wasStored:
+			event = EventDataCreated
+		case !isStored:
+			event, current = EventDataDeleted, old
+		}
+		payload, err := json.Marshal(current)
+		if err != nil {
+			return errors.WrapError(ctx, err)
+		}
+		entry := &OutboxEntry{Object: svc.GetObject(), EntityId: id, Event: event, User: user, Tenant: tenant, At: svc.nextAt(), Payload: string(payload)}
+		entry.Id = ctx.CreateUUID()
+		tx.entries = append(tx.entries, entry)
+	}
+	return nil
+}
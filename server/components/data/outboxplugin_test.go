@@ -0,0 +1,182 @@
+package data_test
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"laatoo.io/sdk/server/components"
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// topic is a durable topic: it keeps what it is sent and drops a message whose id it has seen.
+type topic struct {
+	messages   []*core.Message
+	seen       map[string]bool
+	fail       bool
+	durability *components.TopicDurability
+}
+
+func (tp *topic) Publish(ctx core.RequestContext, name string, msg *core.Message) error {
+	if tp.fail {
+		return errors.InternalError(ctx, slog.String("Topic", name))
+	}
+	if tp.seen == nil {
+		tp.seen = make(map[string]bool)
+	}
+	if msg.Id == "" || !tp.seen[msg.Id] {
+		tp.seen[msg.Id] = true
+		tp.messages = append(tp.messages, msg)
+		msg.Sequence = uint64(len(tp.messages))
+	}
+	return nil
+}
+
+// EnsureDurableTopic records the durability the topic was provisioned with.
+func (tp *topic) EnsureDurableTopic(ctx core.ServerContext, name string, cfg *components.TopicDurability) error {
+	tp.durability = cfg
+	return nil
+}
+
+// replay delivers the messages from sequence on to listener, as SubscribeFrom does.
+func (tp *topic) replay(c core.RequestContext, from uint64, listener core.MessageListener) error {
+	for _, msg := range tp.messages[from-1:] {
+		if err := listener(c, msg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tp *topic) events() string {
+	var got []string
+	for _, msg := range tp.messages {
+		entry := msg.Data.(*data.OutboxEntry)
+		got = append(got, string(entry.Event)+" "+entry.EntityId)
+	}
+	return strings.Join(got, ", ")
+}
+
+func TestOutboxPlugin(t *testing.T) {
+	outboxOf := func(t *testing.T, conf core.StorableConfig) (*data.OutboxPlugin, *memory.MemoryDataComponent, *memory.MemoryDataComponent, *topic, *datatest.ObjectFactory, *datatest.RequestContext) {
+		t.Helper()
+		svc, objects, c := newWidgets(t, conf)
+		outbox := memory.NewMemoryDataComponentForObject(c.Server, data.OUTBOX_OBJECT, data.OutboxEntryFactory{})
+		published := &topic{}
+		return data.NewOutboxPluginWithBase(c.Server, svc, outbox, published, "widgets"), svc, outbox, published, objects, c
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		widgets, _, outbox, published, objects, c := outboxOf(t, core.StorableConfig{})
+		alpha, beta := objects.NewRecord("alpha", 1), objects.NewRecord("beta", 2)
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			if err := widgets.Save(c, alpha); err != nil {
+				return err
+			}
+			if err := widgets.Save(c, beta); err != nil {
+				return err
+			}
+			return widgets.Update(c, alpha.Id, utils.StringMap{"Size": 3})
+		}); err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+		want := fmt.Sprintf("data.object.created %s, data.object.created %s, data.object.updated %s", alpha.Id, beta.Id, alpha.Id)
+		if got := published.events(); got != want {
+			t.Fatalf("want published %s, got %s", want, got)
+		}
+		if pending, _, _, _, _ := outbox.GetList(c, nil, 0, 0, "", nil, ""); len(pending) != 0 {
+			t.Errorf("published entries left in the outbox: %d", len(pending))
+		}
+	})
+
+	// a transaction that rolls back publishes nothing and leaves nothing to relay
+	t.Run("rolled back", func(t *testing.T) {
+		widgets, svc, _, published, objects, c := outboxOf(t, core.StorableConfig{})
+		saveWidgets(t, svc, objects, c, "beta")
+		items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", nil, "")
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			if err := widgets.Delete(c, items[0].GetId()); err != nil {
+				return err
+			}
+			return errors.BadArg(c, "rollback")
+		}); err == nil {
+			t.Fatalf("a failing callback committed")
+		}
+		if n, err := widgets.Relay(c); err != nil || n != 0 || len(published.messages) != 0 {
+			t.Errorf("after a rollback: relayed %d, published %d, %v", n, len(published.messages), err)
+		}
+	})
+
+	// entries that fail to publish stay in the outbox, and a relay publishes them in order
+	t.Run("relay", func(t *testing.T) {
+		widgets, svc, _, published, objects, c := outboxOf(t, core.StorableConfig{})
+		saveWidgets(t, svc, objects, c, "alpha", "beta")
+		items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", []string{"Name"}, "")
+		alpha, beta := items[0].GetId(), items[1].GetId()
+		published.fail = true
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			if err := widgets.Delete(c, beta); err != nil {
+				return err
+			}
+			return widgets.Update(c, alpha, utils.StringMap{"Name": "gamma"})
+		}); err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+		if n, err := widgets.Relay(c); err == nil || n != 0 {
+			t.Fatalf("relay with the topic down: relayed %d, %v", n, err)
+		}
+		published.fail = false
+		if n, err := widgets.Relay(datatest.NewRequestContext(c.Server, "relay", "")); err != nil || n != 2 {
+			t.Fatalf("Relay: relayed %d, %v", n, err)
+		}
+		if got, want := published.events(), fmt.Sprintf("data.object.deleted %s, data.object.updated %s", beta, alpha); got != want {
+			t.Fatalf("want published %s, got %s", want, got)
+		}
+		if payload := published.messages[0].Data.(*data.OutboxEntry).Payload; !strings.Contains(payload, `"Name":"beta"`) {
+			t.Errorf("a deletion carries the record as it was, got %s", payload)
+		}
+		if msg := published.messages[0]; msg.Data.(*data.OutboxEntry).User != c.User.GetId() || msg.User != nil || msg.Tenant != nil {
+			t.Errorf("a relayed entry is published as its writer's, got user %v and tenant %v", msg.User, msg.Tenant)
+		}
+	})
+
+	// the store returns a record it has soft deleted, and its delete is published as a delete all the same
+	t.Run("soft deletes", func(t *testing.T) {
+		svc, objects, c := newWidgets(t, core.StorableConfig{SoftDelete: true})
+		outbox := memory.NewMemoryDataComponentForObject(c.Server, data.OUTBOX_OBJECT, data.OutboxEntryFactory{})
+		published := &topic{}
+		widgets := data.NewOutboxPluginWithBase(c.Server, &showingDeleted{svc}, outbox, published, "widgets")
+		saveWidgets(t, svc, objects, c, "alpha")
+		items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", nil, "")
+		alpha := items[0].GetId()
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			return widgets.Delete(c, alpha)
+		}); err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+		if err := widgets.Transaction(c, func(c core.RequestContext) error {
+			return widgets.Restore(c, []string{alpha})
+		}); err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+		if got, want := published.events(), fmt.Sprintf("data.object.deleted %s, data.object.created %s", alpha, alpha); got != want {
+			t.Errorf("want published %s, got %s", want, got)
+		}
+	})
+
+	t.Run("outside a transaction", func(t *testing.T) {
+		widgets, _, _, published, objects, c := outboxOf(t, core.StorableConfig{})
+		if err := widgets.Save(c, objects.NewRecord("delta", 4)); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if n, _ := widgets.Relay(c); n != 0 || len(published.messages) != 0 {
+			t.Errorf("a write outside a transaction was published")
+		}
+	})
+}
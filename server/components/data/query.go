@@ -17,6 +17,9 @@ const (
 	QueryVersionInvalid QueryVersion = iota
 	// QueryV1 is the predicate-only revision: filters, parameters and extensions.
 	QueryV1
+	// QueryV2 adds shaping to the filter: projection, ordering, paging, keyset cursors and
+	// aggregation. A provider that accepts it also accepts QueryV1.
+	QueryV2
 )
 
 // PredicateKind reports which concrete node a Predicate is, for compilers that prefer a
@@ -296,6 +299,16 @@ const (
 	CapabilityStringFunctions QueryCapability = "stringfunctions"
 	// CapabilityNesting covers arbitrarily nested logical grouping.
 	CapabilityNesting QueryCapability = "nesting"
+	// CapabilityProjection covers Select.
+	CapabilityProjection QueryCapability = "projection"
+	// CapabilityOrdering covers OrderBy.
+	CapabilityOrdering QueryCapability = "ordering"
+	// CapabilityPaging covers Skip and Top.
+	CapabilityPaging QueryCapability = "paging"
+	// CapabilityKeyset covers resuming from a cursor with After.
+	CapabilityKeyset QueryCapability = "keyset"
+	// CapabilityAggregation covers GroupBy and Aggregates.
+	CapabilityAggregation QueryCapability = "aggregation"
 )
 
 // Query is the root of a data-layer query. It is the single representation every front-end
@@ -306,13 +319,40 @@ type Query struct {
 	// Filter is the predicate tree. A nil filter means the query is unconstrained; note that
 	// this is distinct from a nil condition passed to a data service, which returns nothing.
 	Filter Predicate
+
+	// The fields below are QueryV2 shaping, and must be left empty in a QueryV1 query.
+
+	// Select names the fields each row carries, besides its id. Empty selects every field.
+	Select []string
+	// OrderBy sorts the rows. The id always breaks ties last, so the order is total and a
+	// cursor taken from it is unambiguous.
+	OrderBy []OrderTerm
+	// Skip drops that many rows from the front of the result.
+	Skip int
+	// Top limits the result to that many rows. Zero returns every row.
+	Top int
+	// After resumes the result past the row a previous page's cursor was taken from. It
+	// cannot be combined with Skip, and does not apply to a grouped query.
+	After *Cursor
+	// GroupBy groups the rows by these fields. A grouped query returns one row per group,
+	// carrying the group's fields and its aggregates, instead of the entities themselves.
+	GroupBy []string
+	// Aggregates are computed over each group, or over every matching row when GroupBy is
+	// empty.
+	Aggregates []Aggregate
 }
 
-// NewQuery builds an empty query at the current version.
+// NewQuery builds an empty predicate-only query. It is QueryV1, which every provider accepts.
 func NewQuery() *Query {
 	return &Query{Version: QueryV1}
 }
 
+// NewShapedQuery builds an empty query at QueryV2, for callers that project, order, page or
+// aggregate.
+func NewShapedQuery() *Query {
+	return &Query{Version: QueryV2}
+}
+
 // NewEqualityQuery lowers the map shorthand into a query: every entry becomes an equality
 // comparison and the entries are combined with and. This is the form the large majority of
 // callers use, and it exists here so that each consuming module does not rewrite it.
@@ -358,11 +398,10 @@ func (q *Query) Resolve(params utils.StringsMap) *Query {
 	if q == nil {
 		return nil
 	}
-	resolved := &Query{Version: q.Version}
-	if q.Filter != nil {
-		resolved.Filter = resolvePredicate(q.Filter, params)
-	}
-	return resolved
+	// shaping is shared with q rather than copied, since nothing here changes it
+	resolved := *q
+	resolved.Filter = resolvePredicate(q.Filter, params)
+	return &resolved
 }
 
 // resolvePredicate prunes a predicate tree against the supplied parameters, returning nil
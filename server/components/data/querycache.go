@@ -0,0 +1,375 @@
+package data
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// liftedParameterPrefix begins the names of the parameters a query cache lifts literals into.
+// Parameter names from OData aliases are identifiers, so they never begin with it.
+const liftedParameterPrefix = "$"
+
+// CursorParameter is the parameter a query's cursor is bound through. A provider's Query resumes
+// after the cursor whose token it carries, in place of the compiled query's After, so that one
+// compiled query serves every page of a keyset walk.
+const CursorParameter = liftedParameterPrefix + "after"
+
+// QueryCacheStats reports a query cache's size and effectiveness.
+type QueryCacheStats struct {
+	Entries       int
+	Capacity      int
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// CachedQuery is a compiled query from a QueryCache, together with the literal values that were
+// lifted out of the query before it was compiled. It is bound with Bind rather than with the
+// component's BindQuery, so that the lifted values are supplied.
+type CachedQuery struct {
+	Compiled interface{}
+	// Literals are the lifted values, keyed by the parameter names that replaced them.
+	Literals utils.StringsMap
+}
+
+// Bind binds params, and the lifted literals, to the compiled query on comp.
+func (cq *CachedQuery) Bind(ctx core.RequestContext, comp DataComponent, params utils.StringsMap) (interface{}, error) {
+	return comp.BindQuery(ctx, cq.Compiled, cq.params(params))
+}
+
+// Query runs the compiled query on comp with params and the lifted literals, the cursor among them.
+func (cq *CachedQuery) Query(ctx core.RequestContext, comp DataComponent, params utils.StringsMap) (*QueryPage, error) {
+	return comp.Query(ctx, cq.Compiled, cq.params(params))
+}
+
+func (cq *CachedQuery) params(params utils.StringsMap) utils.StringsMap {
+	if len(cq.Literals) == 0 {
+		return params
+	}
+	merged := make(utils.StringsMap, len(params)+len(cq.Literals))
+	for name, value := range params {
+		merged[name] = value
+	}
+	for name, value := range cq.Literals {
+		merged[name] = value
+	}
+	return merged
+}
+
+// queryCacheEntry is one compiled query, and the component it was compiled by.
+type queryCacheEntry struct {
+	key       string
+	object    string
+	component DataComponent
+	compiled  interface{}
+}
+
+// QueryCache holds the provider-native compiled form of queries, so that a query whose shape has
+// been seen before is bound without being compiled again. It is what a data manager keeps to make
+// per-request filters, which arrive as a new tree every time, cost a compile once per shape
+// rather than once per request.
+//
+// A query is keyed by its object and a fingerprint of its normalized structure. Literal values
+// that can be carried as parameters without changing what the query matches — text, numbers,
+// booleans and times — are lifted out of the tree before it is fingerprinted and compiled, so
+// Name eq 'a' and Name eq 'b' share one entry, and are supplied again at binding. A null, a
+// list, a value of any other type, and a text value in a set that could be read as a list are
+// left in place and are part of the fingerprint. A cursor is lifted into CursorParameter, so every
+// page of a keyset walk shares its query's entry; it reaches the provider through Query, as
+// binding a condition does not page.
+//
+// Lifting hides the literals from the provider's compile, so the cache validates every query
+// itself, against the metadata of its object, before looking it up: a literal of the wrong type
+// or a filter that can never match is rejected on every call, hit or miss.
+//
+// The cache is bounded, evicting the least recently used entry, and is safe for concurrent use.
+// An entry compiled by a component other than the one now registered for its object is never
+// returned, so replacing a component is safe even before Invalidate is called for it.
+type QueryCache struct {
+	mu            sync.Mutex
+	capacity      int
+	entries       map[string]*list.Element
+	recent        *list.List
+	metadata      map[string]*EntityMetadata
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+// NewQueryCache creates a cache holding at most capacity compiled queries.
+func NewQueryCache(capacity int) *QueryCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &QueryCache{capacity: capacity, entries: make(map[string]*list.Element), recent: list.New(), metadata: make(map[string]*EntityMetadata)}
+}
+
+// Compile returns the compiled form of query for object on comp, compiling it only when the cache
+// holds no entry for its shape.
+func (c *QueryCache) Compile(ctx core.ServerContext, object string, comp DataComponent, query *Query) (*CachedQuery, error) {
+	if query == nil {
+		return nil, errors.MissingArg(ctx, "query")
+	}
+	c.mu.Lock()
+	meta, ok := c.metadata[object]
+	c.mu.Unlock()
+	if !ok && comp.GetObjectFactory() != nil {
+		meta = EntityMetadataFor(ctx, object, comp.GetObjectFactory())
+	}
+	if err := query.Validate(ctx, meta); err != nil {
+		return nil, err
+	}
+	lifted, literals := liftLiterals(query.Normalize())
+	key := object + "\x00" + Fingerprint(lifted)
+	c.mu.Lock()
+	c.metadata[object] = meta
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*queryCacheEntry)
+		if entry.component == comp {
+			c.recent.MoveToFront(elem)
+			c.hits++
+			c.mu.Unlock()
+			return &CachedQuery{Compiled: entry.compiled, Literals: literals}, nil
+		}
+		c.remove(elem)
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// compiled outside the lock, so one slow compile does not stall every other lookup; two
+	// callers racing on a new shape both compile it, and the later one's result is kept
+	compiled, err := comp.CompileQuery(ctx, lifted)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.recent.PushFront(&queryCacheEntry{key: key, object: object, component: comp, compiled: compiled})
+	for c.recent.Len() > c.capacity {
+		c.remove(c.recent.Back())
+		c.evictions++
+	}
+	return &CachedQuery{Compiled: compiled, Literals: literals}, nil
+}
+
+// Invalidate discards every entry for object, or every entry when object is empty, and returns
+// how many were discarded. A data manager calls it when the component registered for an object
+// is replaced, as it is when the module that declared it is reloaded.
+func (c *QueryCache) Invalidate(object string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if object == "" {
+		c.metadata = make(map[string]*EntityMetadata)
+	} else {
+		delete(c.metadata, object)
+	}
+	discarded := 0
+	for elem := c.recent.Front(); elem != nil; {
+		next := elem.Next()
+		if object == "" || elem.Value.(*queryCacheEntry).object == object {
+			c.remove(elem)
+			discarded++
+		}
+		elem = next
+	}
+	c.invalidations += uint64(discarded)
+	return discarded
+}
+
+// Stats reports the cache's size and its hits, misses, evictions and invalidations so far.
+func (c *QueryCache) Stats() QueryCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return QueryCacheStats{
+		Entries:       c.recent.Len(),
+		Capacity:      c.capacity,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+	}
+}
+
+// remove drops an entry. The caller holds the lock.
+func (c *QueryCache) remove(elem *list.Element) {
+	c.recent.Remove(elem)
+	delete(c.entries, elem.Value.(*queryCacheEntry).key)
+}
+
+// liftLiterals returns a copy of query with its liftable literals replaced by parameters, and its
+// cursor by CursorParameter, and the lifted values by parameter name. Parameters are numbered in
+// the order a depth-first walk meets their literals, so two queries of the same shape lift to the
+// same tree.
+func liftLiterals(query *Query) (*Query, utils.StringsMap) {
+	lifter := &literalLifter{values: utils.StringsMap{}}
+	lifted := *query
+	lifted.Filter = lifter.predicate(query.Filter)
+	if query.After != nil {
+		lifter.values[CursorParameter] = query.After.Token()
+		lifted.After = nil
+	}
+	return &lifted, lifter.values
+}
+
+type literalLifter struct {
+	values utils.StringsMap
+}
+
+func (l *literalLifter) predicate(predicate Predicate) Predicate {
+	switch node := predicate.(type) {
+	case *Comparison:
+		comparison := *node
+		comparison.Value = l.operand(node.Value, false)
+		return &comparison
+	case *Logical:
+		logical := *node
+		logical.Operands = make([]Predicate, len(node.Operands))
+		for i, operand := range node.Operands {
+			logical.Operands[i] = l.predicate(operand)
+		}
+		return &logical
+	case *Not:
+		return &Not{Optionality: node.Optionality, Operand: l.predicate(node.Operand)}
+	case *Membership:
+		membership := *node
+		membership.Values = make([]Operand, len(node.Values))
+		for i, value := range node.Values {
+			membership.Values[i] = l.operand(value, true)
+		}
+		return &membership
+	case *FunctionCall:
+		call := *node
+		call.Arguments = make([]Operand, len(node.Arguments))
+		for i, argument := range node.Arguments {
+			call.Arguments[i] = l.operand(argument, false)
+		}
+		return &call
+	}
+	return predicate
+}
+
+// operand lifts a literal operand into a parameter when its text form means the same thing. In a
+// set a parameter is read as a list, so text that looks like one stays a literal there.
+func (l *literalLifter) operand(operand Operand, inSet bool) Operand {
+	if operand.Kind != OperandLiteral {
+		return operand
+	}
+	var text string
+	switch value := operand.Value.(type) {
+	case string:
+		if inSet && (strings.Contains(value, ",") || strings.HasPrefix(strings.TrimSpace(value), "[")) {
+			return operand
+		}
+		text = value
+	case bool:
+		text = strconv.FormatBool(value)
+	case int:
+		text = strconv.Itoa(value)
+	case int32:
+		text = strconv.FormatInt(int64(value), 10)
+	case int64:
+		text = strconv.FormatInt(value, 10)
+	case float32:
+		text = strconv.FormatFloat(float64(value), 'g', -1, 32)
+	case float64:
+		text = strconv.FormatFloat(value, 'g', -1, 64)
+	case time.Time:
+		text = value.Format(time.RFC3339Nano)
+	default:
+		return operand
+	}
+	name := liftedParameterPrefix + strconv.Itoa(len(l.values))
+	l.values[name] = text
+	return ParameterOperand(name)
+}
+
+// Fingerprint returns a string identifying the query's structure: two queries have the same
+// fingerprint exactly when they are the same tree with the same shaping. Literal values are part
+// of it, so a caller that wants queries differing only in their values to share a fingerprint
+// lifts the values into parameters first, as QueryCache does.
+func Fingerprint(query *Query) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "v%d|", query.Version)
+	fingerprintPredicate(&out, query.Filter)
+	if query.Version >= QueryV2 {
+		fmt.Fprintf(&out, "|select%q|order", query.Select)
+		for _, term := range query.OrderBy {
+			fmt.Fprintf(&out, "(%q,%t)", term.Field, term.Descending)
+		}
+		fmt.Fprintf(&out, "|skip%d|top%d", query.Skip, query.Top)
+		if query.After != nil {
+			out.WriteString("|after" + query.After.Token())
+		}
+		fmt.Fprintf(&out, "|group%q|agg", query.GroupBy)
+		for _, aggregate := range query.Aggregates {
+			fmt.Fprintf(&out, "(%s,%q,%q)", aggregate.Function, aggregate.Field, aggregate.As)
+		}
+	}
+	return out.String()
+}
+
+func fingerprintPredicate(out *strings.Builder, predicate Predicate) {
+	if predicate == nil {
+		out.WriteString("nil")
+		return
+	}
+	out.WriteString(string(predicate.Kind()))
+	if predicate.IsOptional() {
+		out.WriteString("?")
+	}
+	out.WriteString("(")
+	switch node := predicate.(type) {
+	case *Comparison:
+		fmt.Fprintf(out, "%q,%s,", node.Field, node.Operator)
+		fingerprintOperand(out, node.Value)
+	case *Logical:
+		out.WriteString(string(node.Operator))
+		for _, operand := range node.Operands {
+			out.WriteString(",")
+			fingerprintPredicate(out, operand)
+		}
+	case *Not:
+		fingerprintPredicate(out, node.Operand)
+	case *Membership:
+		fmt.Fprintf(out, "%q,%t", node.Field, node.Negated)
+		for _, value := range node.Values {
+			out.WriteString(",")
+			fingerprintOperand(out, value)
+		}
+	case *NullTest:
+		fmt.Fprintf(out, "%q,%t", node.Field, node.Negated)
+	case *FunctionCall:
+		fmt.Fprintf(out, "%s,%q", node.Function, node.Field)
+		for _, argument := range node.Arguments {
+			out.WriteString(",")
+			fingerprintOperand(out, argument)
+		}
+	case *Extension:
+		fmt.Fprintf(out, "%q,%q,%q,%#v", node.Namespace, node.Name, node.Params, node.Payload)
+	default:
+		fmt.Fprintf(out, "%#v", node)
+	}
+	out.WriteString(")")
+}
+
+func fingerprintOperand(out *strings.Builder, operand Operand) {
+	switch operand.Kind {
+	case OperandLiteral:
+		fmt.Fprintf(out, "lit[%T:%#v]", operand.Value, operand.Value)
+	default:
+		fmt.Fprintf(out, "%s[%q]", operand.Kind, operand.Name)
+	}
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/utils"
+)
+
+// OrderTerm sorts rows by one field.
+type OrderTerm struct {
+	Field      string
+	Descending bool
+}
+
+// AggregateFunction is a function computed over the rows of a group.
+type AggregateFunction string
+
+const (
+	// AggregateCount counts rows, or the rows where Field is not null when Field is given.
+	AggregateCount AggregateFunction = "count"
+	AggregateSum   AggregateFunction = "sum"
+	AggregateMin   AggregateFunction = "min"
+	AggregateMax   AggregateFunction = "max"
+	AggregateAvg   AggregateFunction = "avg"
+)
+
+// Aggregate is one value computed over a group. Nulls are skipped by every function.
+type Aggregate struct {
+	Function AggregateFunction
+	// Field is the field the function reads. Only count may leave it empty.
+	Field string
+	// As names the aggregate in a group row. Empty uses Name.
+	As string
+}
+
+// Name returns the key the aggregate is reported under in a group row: As when it is set, and
+// otherwise the function, joined to the field by an underscore when there is one.
+func (a Aggregate) Name() string {
+	if a.As != "" {
+		return a.As
+	}
+	if a.Field == "" {
+		return string(a.Function)
+	}
+	return string(a.Function) + "_" + a.Field
+}
+
+// Cursor marks a position in a query's order: the ordered fields' values on the last row of a
+// page, and that row's id. Values are in OrderBy order, and a null field is a nil value.
+type Cursor struct {
+	Values []interface{} `json:"v"`
+	Id     string        `json:"id"`
+}
+
+// Token encodes the cursor as an opaque string, for handing to a client that asks for the next
+// page.
+func (c *Cursor) Token() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// ParseCursor decodes a token made by Token. Values come back as their JSON types — numbers as
+// float64, times as strings — so a provider coerces each to its field's type before comparing.
+func ParseCursor(token string) (*Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	cursor := &Cursor{}
+	if err = json.Unmarshal(decoded, cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// QueryPage is one page of a query's result.
+type QueryPage struct {
+	// Items are the rows of an ungrouped query, shaped by Select.
+	Items []core.Storable
+	// Groups are the rows of a grouped query, or the single row of aggregates over every match
+	// when the query aggregates without grouping. Each carries the GroupBy fields and every
+	// aggregate under its Name.
+	Groups []utils.StringMap
+	// Total counts every row the filter matches, before Skip, Top and After.
+	Total int
+	// Next is the cursor for the page after this one, or nil when this page is the last. It is
+	// only set for an ungrouped query with a Top.
+	Next *Cursor
+}
+
+// Grouped reports whether the query returns group rows rather than entities.
+func (q *Query) Grouped() bool {
+	return len(q.GroupBy) > 0 || len(q.Aggregates) > 0
+}
+
+// ShapeCapabilities lists the shaping capabilities the query uses, so that a provider can reject
+// the ones it does not support. The filter's own capabilities are not included.
+func (q *Query) ShapeCapabilities() []QueryCapability {
+	var capabilities []QueryCapability
+	if len(q.Select) > 0 {
+		capabilities = append(capabilities, CapabilityProjection)
+	}
+	if len(q.OrderBy) > 0 {
+		capabilities = append(capabilities, CapabilityOrdering)
+	}
+	if q.Skip > 0 || q.Top > 0 {
+		capabilities = append(capabilities, CapabilityPaging)
+	}
+	if q.After != nil {
+		capabilities = append(capabilities, CapabilityKeyset)
+	}
+	if q.Grouped() {
+		capabilities = append(capabilities, CapabilityAggregation)
+	}
+	return capabilities
+}
@@ -0,0 +1,587 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+// CONF_DATA_REF_SVCS names the data services storing entities that refer to a RefIntegrityPlugin's
+// object.
+const CONF_DATA_REF_SVCS = "referringservices"
+
+// refIdsParameter is the list-valued parameter of the query finding the records referring to ids.
+const refIdsParameter = "refids"
+
+// Reference events, raised by a RefIntegrityPlugin for each referring record it changes. The
+// message carries the referring record — for a cascade, as it was before its delete — and the
+// info map carries its object type and id, the event type, the reference field, and the object
+// type and ids of the records it referred to under "refobject" and "refs".
+const (
+	EventRefCascaded  DataEventType = "data.ref.cascaded"
+	EventRefCleared   DataEventType = "data.ref.cleared"
+	EventRefRefreshed DataEventType = "data.ref.refreshed"
+)
+
+var _ DataComponent = (*RefIntegrityPlugin)(nil)
+
+/*
+RefIntegrityPlugin enforces, over the data service of a referenced entity, the reference policies
+declared by the entities referring to it. Before a delete it refuses with CORE_ERROR_REF_RESTRICTED
+when a restrict reference remains; after the delete it deletes cascade referrers and clears setnull
+references. After a write that may relabel records, it refreshes the Name copied into references
+declared with the name option.
+
+The referring entities are those of the referring data services configured with RefOps, and their
+references are found by querying each referring service for the records whose reference field
+holds one of the ids concerned; a service that cannot query membership is read through instead.
+Names are refreshed only for the records whose label a write changed, so a write that leaves the
+label as it was costs no query of the referring services, though a whole-object write reads the
+labels it replaces first. The restrict check, the delete and the cascade run in one transaction of
+the data service, with the reference events raised once it commits; a referring service outside
+what that transaction covers is not rolled back with it. A record soft-deleted and later restored
+does not get back what its delete cascaded to or cleared. Each referring record changed raises a
+reference event, to listeners subscribed through this plugin.
+*/
+type RefIntegrityPlugin struct {
+	DataPlugin
+	ReferringComponents []DataComponent
+	linksOnce           sync.Once
+	links               []refLink
+	linksErr            error
+	labelField          string
+	mu                  sync.RWMutex
+	listeners           map[DataEventType][]core.MessageListener
+}
+
+// refLink is one reference field of a referring service that refers to the plugin's object, and
+// the query finding the records whose field refers to any of a list of ids, which is nil when the
+// service cannot run it.
+type refLink struct {
+	comp     DataComponent
+	field    RefField
+	compiled interface{}
+}
+
+// refEvent is a reference event waiting for the transaction of the change it reports to commit.
+type refEvent struct {
+	eventType DataEventType
+	link      refLink
+	ref       referrer
+}
+
+func NewRefIntegrityPlugin(ctx core.ServerContext) *RefIntegrityPlugin {
+	return &RefIntegrityPlugin{}
+}
+
+// NewRefIntegrityPluginWithBase creates a plugin over comp enforcing the references to its object
+// held by referrers.
+func NewRefIntegrityPluginWithBase(ctx core.ServerContext, comp DataComponent, referrers ...DataComponent) *RefIntegrityPlugin {
+	return &RefIntegrityPlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, ReferringComponents: referrers}
+}
+
+func (svc *RefIntegrityPlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.ReferringComponents == nil {
+		svc.AddConfiguration(ctx, CONF_DATA_REF_SVCS, "Data services whose entities refer to this object", datatypes.Stringarr, nil)
+	}
+	return nil
+}
+
+func (svc *RefIntegrityPlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.ReferringComponents != nil {
+		return nil
+	}
+	names, _ := svc.GetStringArrayConfiguration(ctx, CONF_DATA_REF_SVCS)
+	for _, name := range names {
+		s, err := ctx.GetService(name)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_REF_SVCS, slog.String("Service", name))
+		}
+		dc, ok := s.(DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_REF_SVCS, slog.String("Service", name))
+		}
+		svc.ReferringComponents = append(svc.ReferringComponents, dc)
+	}
+	return nil
+}
+
+// refLinks discovers the reference fields referring to the plugin's object on first use, once
+// every referring service has been initialized, compiling the query for each and reading the
+// object's label field.
+func (svc *RefIntegrityPlugin) refLinks(ctx core.RequestContext) ([]refLink, error) {
+	svc.linksOnce.Do(func() {
+		object := svc.GetObject()
+		if factory := svc.PluginDataComponent.GetObjectFactory(); factory != nil {
+			if stor, ok := factory.CreateObject(ctx).(core.Storable); ok && stor.Config() != nil {
+				svc.labelField = stor.Config().LabelField
+			}
+		}
+		for _, comp := range svc.ReferringComponents {
+			factory := comp.GetObjectFactory()
+			if factory == nil {
+				continue
+			}
+			stor, ok := factory.CreateObject(ctx).(core.Storable)
+			if !ok || stor.Config() == nil || !stor.Config().RefOps {
+				continue
+			}
+			fields, err := RefFields(ctx, stor)
+			if err != nil {
+				svc.linksErr = err
+				return
+			}
+			for _, field := range fields {
+				if field.Object != object {
+					continue
+				}
+				link := refLink{comp: comp, field: field}
+				if comp.SupportsQuery(CapabilityMembership) {
+					query := NewQuery()
+					query.Filter = &Membership{Field: field.Field + ".Id", Values: []Operand{ParameterOperand(refIdsParameter)}}
+					if link.compiled, err = comp.CompileQuery(ctx.ServerContext(), query); err != nil {
+						svc.linksErr = err
+						return
+					}
+				}
+				svc.links = append(svc.links, link)
+			}
+		}
+	})
+	return svc.links, svc.linksErr
+}
+
+func (svc *RefIntegrityPlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	before, err := svc.labels(ctx, []string{item.GetId()})
+	if err != nil {
+		return err
+	}
+	if err = svc.PluginDataComponent.Save(ctx, item); err != nil {
+		return err
+	}
+	return svc.refreshNames(ctx, []string{item.GetId()}, before)
+}
+
+func (svc *RefIntegrityPlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	before, err := svc.labels(ctx, []string{id})
+	if err != nil {
+		return err
+	}
+	if err = svc.PluginDataComponent.Put(ctx, id, item); err != nil {
+		return err
+	}
+	return svc.refreshNames(ctx, []string{id}, before)
+}
+
+func (svc *RefIntegrityPlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.GetId()
+	}
+	before, err := svc.labels(ctx, ids)
+	if err != nil {
+		return err
+	}
+	if err = svc.PluginDataComponent.PutMulti(ctx, items); err != nil {
+		return err
+	}
+	return svc.refreshNames(ctx, ids, before)
+}
+
+func (svc *RefIntegrityPlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	if !svc.relabels(ctx, newVals) {
+		return svc.PluginDataComponent.UpsertId(ctx, id, newVals)
+	}
+	before, err := svc.labels(ctx, []string{id})
+	if err != nil {
+		return err
+	}
+	if err = svc.PluginDataComponent.UpsertId(ctx, id, newVals); err != nil {
+		return err
+	}
+	return svc.refreshNames(ctx, []string{id}, before)
+}
+
+func (svc *RefIntegrityPlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.UpdateMulti(ctx, []string{id}, newVals)
+}
+
+func (svc *RefIntegrityPlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	if !svc.relabels(ctx, newVals) {
+		return svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+	}
+	before, err := svc.labels(ctx, ids)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 1 {
+		err = svc.PluginDataComponent.Update(ctx, ids[0], newVals)
+	} else {
+		err = svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+	}
+	if err != nil {
+		return err
+	}
+	return svc.refreshNames(ctx, ids, before)
+}
+
+func (svc *RefIntegrityPlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	if !svc.relabels(ctx, newVals) {
+		return svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, getids)
+	}
+	ids, err := svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.refreshNames(ctx, ids, nil); err != nil || !getids {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (svc *RefIntegrityPlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	if !svc.relabels(ctx, newVals) {
+		return svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, getids)
+	}
+	ids, err := svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.refreshNames(ctx, ids, nil); err != nil || !getids {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (svc *RefIntegrityPlugin) Delete(ctx core.RequestContext, id string) error {
+	return svc.DeleteMulti(ctx, []string{id})
+}
+
+func (svc *RefIntegrityPlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	var events []refEvent
+	err := svc.PluginDataComponent.Transaction(ctx, func(ctx core.RequestContext) error {
+		if err := svc.restrict(ctx, ids); err != nil {
+			return err
+		}
+		var err error
+		if len(ids) == 1 {
+			err = svc.PluginDataComponent.Delete(ctx, ids[0])
+		} else {
+			err = svc.PluginDataComponent.DeleteMulti(ctx, ids)
+		}
+		if err != nil {
+			return err
+		}
+		events, err = svc.release(ctx, ids)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	svc.raise(ctx, events)
+	return nil
+}
+
+func (svc *RefIntegrityPlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	var ids []string
+	var events []refEvent
+	err := svc.PluginDataComponent.Transaction(ctx, func(ctx core.RequestContext) error {
+		_, matched, _, _, err := svc.PluginDataComponent.Get(ctx, nil, queryCond, -1, 1, "", nil, "")
+		if err != nil {
+			return err
+		}
+		if err = svc.restrict(ctx, matched); err != nil {
+			return err
+		}
+		if ids, err = svc.PluginDataComponent.DeleteAll(ctx, queryCond, true); err != nil {
+			return err
+		}
+		events, err = svc.release(ctx, ids)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	svc.raise(ctx, events)
+	if !getids {
+		return nil, nil
+	}
+	return ids, nil
+}
+
+// Subscribe registers reference event listeners with the plugin, and passes any other
+// subscription through to the data service.
+func (svc *RefIntegrityPlugin) Subscribe(ctx core.RequestContext, obj string, eventType DataEventType, handler core.MessageListener) error {
+	switch eventType {
+	case EventRefCascaded, EventRefCleared, EventRefRefreshed:
+	default:
+		return svc.PluginDataComponent.Subscribe(ctx, obj, eventType, handler)
+	}
+	if obj != "" && obj != svc.GetObject() {
+		return errors.BadArg(ctx, "obj", slog.String("Object", obj))
+	}
+	if handler == nil {
+		return errors.MissingArg(ctx, "handler")
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.listeners == nil {
+		svc.listeners = make(map[DataEventType][]core.MessageListener)
+	}
+	svc.listeners[eventType] = append(svc.listeners[eventType], handler)
+	return nil
+}
+
+// restrict fails when a restrict reference to any of ids remains.
+func (svc *RefIntegrityPlugin) restrict(ctx core.RequestContext, ids []string) error {
+	links, err := svc.refLinks(ctx)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	for _, link := range links {
+		if link.field.OnDelete != RefRestrict {
+			continue
+		}
+		referrers, err := svc.referring(ctx, link, utils.NewStringSet(ids))
+		if err != nil {
+			return err
+		}
+		if len(referrers) > 0 {
+			return errors.RefRestricted(ctx, svc.GetObject(), slog.String("Id", referrers[0].refs[0]),
+				slog.String("Referrer", link.comp.GetObject()), slog.String("ReferrerId", referrers[0].item.GetId()), slog.String("Field", link.field.Field))
+		}
+	}
+	return nil
+}
+
+// release applies the cascade and setnull policies to the references to ids, which were deleted,
+// returning the reference events to raise once the delete commits.
+func (svc *RefIntegrityPlugin) release(ctx core.RequestContext, ids []string) ([]refEvent, error) {
+	links, err := svc.refLinks(ctx)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	deleted := utils.NewStringSet(ids)
+	var events []refEvent
+	for _, link := range links {
+		if link.field.OnDelete != RefCascade && link.field.OnDelete != RefSetNull {
+			continue
+		}
+		referrers, err := svc.referring(ctx, link, deleted)
+		if err != nil {
+			return nil, err
+		}
+		for _, referrer := range referrers {
+			id := referrer.item.GetId()
+			if link.field.OnDelete == RefCascade {
+				if err = link.comp.Delete(ctx, id); err != nil {
+					return nil, err
+				}
+				events = append(events, refEvent{eventType: EventRefCascaded, link: link, ref: referrer})
+				continue
+			}
+			var cleared interface{}
+			if link.field.Many {
+				remaining := []StorableRef{}
+				for _, ref := range link.field.Refs(referrer.item) {
+					if !deleted.Contains(ref.Id) {
+						remaining = append(remaining, ref)
+					}
+				}
+				cleared = remaining
+			}
+			if err = link.comp.Update(ctx, id, utils.StringMap{link.field.Field: cleared}); err != nil {
+				return nil, err
+			}
+			events = append(events, refEvent{eventType: EventRefCleared, link: link, ref: referrer})
+		}
+	}
+	return events, nil
+}
+
+// relabels reports whether a write of newVals may change a record's label, which it cannot when
+// the object has a label field that newVals leaves alone.
+func (svc *RefIntegrityPlugin) relabels(ctx core.RequestContext, newVals utils.StringMap) bool {
+	if _, err := svc.refLinks(ctx); err != nil || svc.labelField == "" {
+		return true
+	}
+	_, ok := newVals[svc.labelField]
+	return ok
+}
+
+// labels reads the labels of the records with ids, ahead of a write that may change them. It reads
+// nothing, and returns nil, when no reference copies the label.
+func (svc *RefIntegrityPlugin) labels(ctx core.RequestContext, ids []string) (map[string]string, error) {
+	links, err := svc.refLinks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refreshed := false
+	for _, link := range links {
+		refreshed = refreshed || link.field.RefreshName
+	}
+	if !refreshed || len(ids) == 0 {
+		return nil, nil
+	}
+	items, err := svc.PluginDataComponent.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(items))
+	for id, item := range items {
+		if label, ok := labelOf(item); ok {
+			labels[id] = label
+		}
+	}
+	return labels, nil
+}
+
+// refreshNames copies the labels of the records with ids, which were written, into the name
+// references to them that hold another name. before holds the labels the records had ahead of the
+// write, as labels read them, and those whose label it left as it was are skipped; a nil before
+// takes every record as relabelled.
+func (svc *RefIntegrityPlugin) refreshNames(ctx core.RequestContext, ids []string, before map[string]string) error {
+	links, err := svc.refLinks(ctx)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	var labels map[string]string
+	relabelled := utils.NewStringSet(nil)
+	for _, link := range links {
+		if !link.field.RefreshName {
+			continue
+		}
+		if labels == nil {
+			labels, err = svc.labels(ctx, ids)
+			if err != nil {
+				return err
+			}
+			for id, label := range labels {
+				if old, ok := before[id]; before == nil || !ok || old != label {
+					relabelled.Add(id)
+				}
+			}
+		}
+		if len(relabelled) == 0 {
+			return nil
+		}
+		referrers, err := svc.referring(ctx, link, relabelled)
+		if err != nil {
+			return err
+		}
+		for _, referrer := range referrers {
+			refs := link.field.Refs(referrer.item)
+			var renamed []string
+			for i, ref := range refs {
+				if label, ok := labels[ref.Id]; ok && ref.Name != label {
+					refs[i].Name = label
+					renamed = append(renamed, ref.Id)
+				}
+			}
+			if len(renamed) == 0 {
+				continue
+			}
+			var val interface{} = refs
+			if !link.field.Many {
+				val = refs[0]
+			}
+			if err = link.comp.Update(ctx, referrer.item.GetId(), utils.StringMap{link.field.Field: val}); err != nil {
+				return err
+			}
+			referrer.refs = renamed
+			svc.raise(ctx, []refEvent{{eventType: EventRefRefreshed, link: link, ref: referrer}})
+		}
+	}
+	return nil
+}
+
+// labelOf returns the value of item's label field, which is what a reference's Name copies, and
+// false when it has none. It reads the field itself rather than through GetLabel, which needs the
+// self reference a record read back from storage may not have been given.
+func labelOf(item core.Storable) (string, bool) {
+	conf := item.Config()
+	if conf == nil || conf.LabelField == "" {
+		return "", false
+	}
+	val, ok := FieldValue(item, conf.LabelField)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(val), true
+}
+
+// referrer is a record holding references to some of the records a write touched.
+type referrer struct {
+	item core.Storable
+	refs []string
+}
+
+// referring finds the records of the service of link whose field refers to any of ids, querying for
+// them when the service can, and reading it through when it cannot.
+func (svc *RefIntegrityPlugin) referring(ctx core.RequestContext, link refLink, ids utils.StringSet) ([]referrer, error) {
+	var cond interface{}
+	if link.compiled != nil {
+		list, err := json.Marshal(ids.Values())
+		if err != nil {
+			return nil, errors.WrapError(ctx, err)
+		}
+		if cond, err = link.comp.BindQuery(ctx, link.compiled, utils.StringsMap{refIdsParameter: string(list)}); err != nil {
+			return nil, err
+		}
+	}
+	it, err := link.comp.Iterate(ctx, nil, cond, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var found []referrer
+	for it.Next() {
+		item := it.Item()
+		var refs []string
+		for _, ref := range link.field.Refs(item) {
+			if ids.Contains(ref.Id) {
+				refs = append(refs, ref.Id)
+			}
+		}
+		if len(refs) > 0 {
+			found = append(found, referrer{item: item, refs: refs})
+		}
+	}
+	return found, it.Err()
+}
+
+// raise delivers reference events to the plugin's listeners. Listener errors are logged rather
+// than returned, as the changes they report have already been made.
+func (svc *RefIntegrityPlugin) raise(ctx core.RequestContext, events []refEvent) {
+	for _, evt := range events {
+		svc.mu.RLock()
+		listeners := svc.listeners[evt.eventType]
+		svc.mu.RUnlock()
+		if len(listeners) == 0 {
+			continue
+		}
+		link, ref := evt.link, evt.ref
+		msg := &core.Message{Data: ref.item, Tenant: ctx.GetTenant(), User: ctx.GetUser()}
+		info := utils.StringMap{"object": link.comp.GetObject(), "id": ref.item.GetId(), "event": string(evt.eventType),
+			"field": link.field.Field, "refobject": svc.GetObject(), "refs": ref.refs}
+		for _, listener := range listeners {
+			if err := listener(ctx, msg, info); err != nil {
+				log.Error(ctx, "Reference event listener failed", slog.String("Object", link.comp.GetObject()), slog.String("Id", ref.item.GetId()), slog.String("Error", err.Error()))
+			}
+		}
+	}
+}
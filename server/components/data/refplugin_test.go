@@ -0,0 +1,239 @@
+package data_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// assignment refers to widgets under each reference policy.
+type assignment struct {
+	data.StorageInfo
+	Owner   data.StorableRef   `json:"Owner" ref:"widget,restrict,name"`
+	Primary data.StorableRef   `json:"Primary" ref:"widget,cascade"`
+	Extras  []data.StorableRef `json:"Extras" ref:"widget,setnull,name"`
+	Parent  data.StorableRef   `json:"Parent"`
+}
+
+func (a *assignment) Config() *core.StorableConfig {
+	return &core.StorableConfig{ObjectType: "assignment", Collection: "assignment", RefOps: true}
+}
+
+// countingIterations counts the iterations made of a component, telling a query from a pass over
+// every record. One made without membership cannot query for references, as some stores cannot.
+type countingIterations struct {
+	data.DataComponent
+	withoutMembership bool
+	queries, scans    int
+}
+
+func (c *countingIterations) SupportsQuery(capability data.QueryCapability) bool {
+	if c.withoutMembership && capability == data.CapabilityMembership {
+		return false
+	}
+	return c.DataComponent.SupportsQuery(capability)
+}
+
+func (c *countingIterations) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (data.StorableIterator, error) {
+	if queryCond == nil {
+		c.scans++
+	} else {
+		c.queries++
+	}
+	return c.DataComponent.Iterate(ctx, props, queryCond, orderBy, batchSize)
+}
+
+func TestRefIntegrityPlugin(t *testing.T) {
+	// setup stores alpha, beta and gamma, and two assignments referring to them: the first owned
+	// by alpha, with beta as primary and alpha and gamma as extras, the second all gamma's
+	setup := func(t *testing.T, assignments *countingIterations) (*data.RefIntegrityPlugin, data.DataComponent, *datatest.RequestContext, []string, *assignment, *assignment, *[]string) {
+		t.Helper()
+		svc, objects, c := newWidgets(t, core.StorableConfig{LabelField: "Name"})
+		assignments.DataComponent = memory.NewMemoryDataComponentForObject(c.Server, "assignment", datatest.EntityFactory[assignment]{})
+		widgets := data.NewRefIntegrityPluginWithBase(c.Server, svc, assignments)
+		events := &[]string{}
+		for _, eventType := range []data.DataEventType{data.EventRefCascaded, data.EventRefCleared, data.EventRefRefreshed} {
+			if err := widgets.Subscribe(c, "", eventType, func(ctx core.RequestContext, msg *core.Message, info utils.StringMap) error {
+				*events = append(*events, fmt.Sprintf("%s %s %s %v", info["event"], info["id"], info["field"], info["refs"]))
+				return nil
+			}); err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+		}
+		saveWidgets(t, svc, objects, c, "alpha", "beta", "gamma")
+		ids := []string{}
+		items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", []string{"Name"}, "")
+		for _, item := range items {
+			ids = append(ids, item.GetId())
+		}
+		alpha, beta, gamma := ids[0], ids[1], ids[2]
+		first := &assignment{Owner: widgetRef(alpha, "alpha"), Primary: widgetRef(beta, "beta"), Extras: []data.StorableRef{widgetRef(alpha, "alpha"), widgetRef(gamma, "gamma")}}
+		second := &assignment{Owner: widgetRef(gamma, "gamma"), Primary: widgetRef(gamma, "gamma")}
+		for _, a := range []*assignment{first, second} {
+			if err := assignments.Save(c, a); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		assignments.queries, assignments.scans = 0, 0
+		return widgets, svc, c, ids, first, second, events
+	}
+
+	t.Run("writes leaving the label", func(t *testing.T) {
+		assignments := &countingIterations{}
+		widgets, svc, c, ids, _, _, _ := setup(t, assignments)
+		if err := widgets.Update(c, ids[0], utils.StringMap{"Size": 5}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		item, err := svc.GetById(c, ids[0], "")
+		if err != nil {
+			t.Fatalf("GetById: %v", err)
+		}
+		if err = widgets.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if assignments.queries != 0 || assignments.scans != 0 {
+			t.Errorf("writes leaving the label alone read the referrers %d times", assignments.queries+assignments.scans)
+		}
+	})
+
+	// a rename is copied into the name references and not into the others, found by a query where
+	// the referring store can make one, and by reading it through where it cannot
+	for _, tc := range []struct {
+		name              string
+		withoutMembership bool
+		queries, scans    int
+	}{
+		{"rename", false, 2, 0},
+		{"rename without membership queries", true, 0, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assignments := &countingIterations{withoutMembership: tc.withoutMembership}
+			widgets, _, c, ids, first, _, events := setup(t, assignments)
+			if err := widgets.Update(c, ids[0], utils.StringMap{"Name": "ALPHA"}); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if assignments.queries != tc.queries || assignments.scans != tc.scans {
+				t.Errorf("want %d queries and %d scans, got %d and %d", tc.queries, tc.scans, assignments.queries, assignments.scans)
+			}
+			item, err := assignments.GetById(c, first.Id, "")
+			if err != nil {
+				t.Fatalf("GetById: %v", err)
+			}
+			if a := item.(*assignment); a.Owner.Name != "ALPHA" || a.Extras[0].Name != "ALPHA" || a.Extras[1].Name != "gamma" {
+				t.Errorf("rename not refreshed: owner %q, extras %v", a.Owner.Name, a.Extras)
+			}
+			want := []string{
+				fmt.Sprintf("data.ref.refreshed %s Owner [%s]", first.Id, ids[0]),
+				fmt.Sprintf("data.ref.refreshed %s Extras [%s]", first.Id, ids[0]),
+			}
+			if strings.Join(*events, "\n") != strings.Join(want, "\n") {
+				t.Errorf("want events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(*events, "\n"))
+			}
+		})
+	}
+
+	t.Run("restrict", func(t *testing.T) {
+		widgets, svc, c, ids, _, _, events := setup(t, &countingIterations{})
+		if err := widgets.Delete(c, ids[0]); !errors.IsRefRestricted(err) {
+			t.Fatalf("deleting an owner: want restricted, got %v", err)
+		}
+		if _, err := svc.GetById(c, ids[0], ""); err != nil {
+			t.Errorf("a restricted delete deleted the record: %v", err)
+		}
+		if len(*events) != 0 {
+			t.Errorf("a restricted delete raised %v", *events)
+		}
+	})
+
+	t.Run("cascade and setnull", func(t *testing.T) {
+		assignments := &countingIterations{}
+		widgets, _, c, ids, first, second, events := setup(t, assignments)
+		alpha, beta, gamma := ids[0], ids[1], ids[2]
+		if err := widgets.Delete(c, beta); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := assignments.GetById(c, first.Id, ""); !errors.IsNotFound(err) {
+			t.Errorf("cascade left the referrer: %v", err)
+		}
+		if err := assignments.Update(c, second.Id, utils.StringMap{"Owner": nil, "Extras": []data.StorableRef{widgetRef(gamma, "gamma"), widgetRef(alpha, "alpha")}}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if err := widgets.DeleteMulti(c, []string{alpha}); err != nil {
+			t.Fatalf("DeleteMulti: %v", err)
+		}
+		item, err := assignments.GetById(c, second.Id, "")
+		if err != nil {
+			t.Fatalf("GetById: %v", err)
+		}
+		if a := item.(*assignment); len(a.Extras) != 1 || a.Extras[0].Id != gamma {
+			t.Errorf("setnull left %v", a.Extras)
+		}
+		want := []string{
+			fmt.Sprintf("data.ref.cascaded %s Primary [%s]", first.Id, beta),
+			fmt.Sprintf("data.ref.cleared %s Extras [%s]", second.Id, alpha),
+		}
+		if strings.Join(*events, "\n") != strings.Join(want, "\n") {
+			t.Errorf("want events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(*events, "\n"))
+		}
+	})
+}
+
+// widgetRef refers to the widget with id, labelled name.
+func widgetRef(id, name string) data.StorableRef {
+	return data.StorableRef{Id: id, Type: "widget", Name: name}
+}
+
+func TestRefIntegrityDeleteInTransaction(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	assignments := memory.NewMemoryDataComponentForObject(c.Server, "assignment", datatest.EntityFactory[assignment]{})
+	widgets := data.NewRefIntegrityPluginWithBase(c.Server, svc, assignments)
+	saveWidgets(t, svc, objects, c, "alpha", "beta")
+	items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", []string{"Name"}, "")
+	alpha, beta := items[0].GetId(), items[1].GetId()
+
+	done := make(chan error)
+	go func() {
+		done <- widgets.Transaction(c, func(tx core.RequestContext) error {
+			if err := widgets.Delete(tx, alpha); err != nil {
+				return err
+			}
+			return widgets.DeleteMulti(tx, []string{beta})
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("deleting inside a transaction did not return")
+	}
+	if items, _, _, _, _ = svc.GetList(c, nil, 0, 0, "", nil, ""); len(items) != 0 {
+		t.Errorf("deletes inside a transaction left %d records", len(items))
+	}
+
+	// the deletes are rolled back with the transaction they joined
+	saveWidgets(t, svc, objects, c, "gamma")
+	items, _, _, _, _ = svc.GetList(c, nil, 0, 0, "", nil, "")
+	failure := fmt.Errorf("abort")
+	err := widgets.Transaction(c, func(tx core.RequestContext) error {
+		if err := widgets.Delete(tx, items[0].GetId()); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Transaction: want the callback's error, got %v", err)
+	}
+	if _, err = svc.GetById(c, items[0].GetId(), ""); err != nil {
+		t.Errorf("a delete was kept after its transaction rolled back: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/errors"
+)
+
+// TAG_REF is the struct tag declaring the reference policy of a StorableRef or []StorableRef
+// field: the object type it refers to, then optionally what happens to it when that record is
+// deleted and whether its Name copy follows the record's label, as in
+//
+//	Owner StorableRef   `json:"Owner" ref:"User,restrict,name"`
+//	Roles []StorableRef `json:"Roles" ref:"Role,setnull"`
+//
+// Policies are enforced only for an entity configured with RefOps.
+const TAG_REF = "ref"
+
+// refOptionName is the TAG_REF option keeping a reference's Name in step with its record's label.
+const refOptionName = "name"
+
+// RefPolicy is what becomes of a reference when the record it refers to is deleted.
+type RefPolicy string
+
+const (
+	// RefKeep leaves the reference dangling, as it was before policies were declared.
+	RefKeep RefPolicy = ""
+	// RefRestrict refuses to delete a record while anything refers to it.
+	RefRestrict RefPolicy = "restrict"
+	// RefCascade deletes the referring record along with the record it refers to.
+	RefCascade RefPolicy = "cascade"
+	// RefSetNull clears a single reference, and drops the reference from a list of them.
+	RefSetNull RefPolicy = "setnull"
+)
+
+// RefField is a reference field of an entity, with the policy its TAG_REF declares.
+type RefField struct {
+	// Field is the field's stored name, which is its json name.
+	Field string
+	// Object is the object type the field refers to.
+	Object string
+	// Many is set for a []StorableRef field.
+	Many bool
+	// OnDelete is what becomes of the reference when the record it refers to is deleted.
+	OnDelete RefPolicy
+	// RefreshName keeps the reference's Name a copy of the record's label.
+	RefreshName bool
+	index       []int
+}
+
+var (
+	storableRefType      = reflect.TypeOf(StorableRef{})
+	storableRefSliceType = reflect.TypeOf([]StorableRef{})
+	refFieldsCache       sync.Map
+)
+
+// RefFields returns the reference fields item declares with TAG_REF, including those of the
+// structs it embeds. A tag on a field that is not a StorableRef or []StorableRef, or naming no
+// object or an unknown option, is a configuration error.
+func RefFields(c ctx.Context, item interface{}) ([]RefField, error) {
+	typ := reflect.TypeOf(item)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	if fields, ok := refFieldsCache.Load(typ); ok {
+		return fields.([]RefField), nil
+	}
+	var fields []RefField
+	for _, sf := range reflect.VisibleFields(typ) {
+		tag, ok := sf.Tag.Lookup(TAG_REF)
+		if !ok {
+			continue
+		}
+		field, err := parseRefTag(c, typ, sf, tag)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	refFieldsCache.Store(typ, fields)
+	return fields, nil
+}
+
+func parseRefTag(c ctx.Context, typ reflect.Type, sf reflect.StructField, tag string) (RefField, error) {
+	field := RefField{Field: sf.Name, index: sf.Index}
+	if name := strings.Split(sf.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		field.Field = name
+	}
+	switch sf.Type {
+	case storableRefType:
+	case storableRefSliceType:
+		field.Many = true
+	default:
+		return field, errors.BadConf(c, TAG_REF, slog.String("Type", typ.String()), slog.String("Field", sf.Name))
+	}
+	opts := strings.Split(tag, ",")
+	field.Object = strings.TrimSpace(opts[0])
+	if field.Object == "" {
+		return field, errors.BadConf(c, TAG_REF, slog.String("Type", typ.String()), slog.String("Field", sf.Name))
+	}
+	for _, opt := range opts[1:] {
+		switch opt = strings.TrimSpace(opt); RefPolicy(opt) {
+		case RefRestrict, RefCascade, RefSetNull:
+			field.OnDelete = RefPolicy(opt)
+		default:
+			if opt != refOptionName {
+				return field, errors.BadConf(c, TAG_REF, slog.String("Type", typ.String()), slog.String("Field", sf.Name), slog.String("Option", opt))
+			}
+			field.RefreshName = true
+		}
+	}
+	return field, nil
+}
+
+// Refs returns the references item holds in the field.
+func (rf RefField) Refs(item interface{}) []StorableRef {
+	val := reflect.ValueOf(item)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	fieldVal, err := val.FieldByIndexErr(rf.index)
+	if err != nil {
+		return nil
+	}
+	if rf.Many {
+		return fieldVal.Interface().([]StorableRef)
+	}
+	ref := fieldVal.Interface().(StorableRef)
+	if ref.Id == "" {
+		return nil
+	}
+	return []StorableRef{ref}
+}
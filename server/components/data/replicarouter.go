@@ -0,0 +1,578 @@
+package data
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+	"laatoo.io/sdk/utils"
+)
+
+const (
+	// CONF_DATA_REPLICAS names the data services the reads of a ReplicaRouter are spread over.
+	CONF_DATA_REPLICAS = "replicas"
+	// CONF_DATA_REPLICA_MAXSTALENESS is how far a replica may lag its primary and still be read, as
+	// a duration such as "5s". Zero reads a replica however far it lags.
+	CONF_DATA_REPLICA_MAXSTALENESS = "replicamaxstaleness"
+	// CONF_DATA_REPLICA_PINWINDOW is how long the reads of whoever wrote are sent to the primary
+	// after the write, as a duration such as "5s". Zero does not pin.
+	CONF_DATA_REPLICA_PINWINDOW = "replicapinwindow"
+	// CONF_DATA_REPLICA_HEALTHINTERVAL is how often the replicas are checked, as a duration.
+	CONF_DATA_REPLICA_HEALTHINTERVAL = "replicahealthinterval"
+	// CONF_DATA_REPLICA_FAILURES is how many checks or reads in a row a replica fails before it is
+	// ejected.
+	CONF_DATA_REPLICA_FAILURES = "replicafailures"
+)
+
+const (
+	// DefaultReplicaPinWindow is how long a writer is pinned to the primary when it is not configured.
+	DefaultReplicaPinWindow = 5 * time.Second
+	// DefaultReplicaHealthInterval is how often the replicas are checked when it is not configured.
+	DefaultReplicaHealthInterval = 10 * time.Second
+	// DefaultReplicaFailures is how many failures in a row eject a replica when it is not configured.
+	DefaultReplicaFailures = 3
+)
+
+// maxReplicaPins is how many pins a router holds before it drops those that have expired.
+const maxReplicaPins = 1024
+
+// ReplicationStatus is implemented by a data component reading from a replica that can tell how far
+// the replica lags its primary. A replica that does not implement it is checked by asking whether
+// its collection exists, and its lag is not known.
+type ReplicationStatus interface {
+	ReplicationLag(ctx core.ServerContext) (time.Duration, error)
+}
+
+var _ DataComponent = (*ReplicaRouter)(nil)
+
+/*
+ReplicaRouter is a data component in front of a primary data service and its read replicas. Writes,
+transactions and everything else go to the primary, while Get, GetOne, GetList, GetById, GetMulti,
+GetMultiHash, Count, CountGroups, Query, Iterate and VectorSearch are spread over the replicas in
+turn. The replicas must be data services of the same provider as the primary, as conditions and
+compiled queries are made by the primary and used on them.
+
+A replica lagging its primary by more than MaxStaleness is passed over, as one that has been
+ejected is, and reads go to the primary when no replica can take them. When MaxStaleness is set, a
+replica whose lag is not known, because it cannot tell it, has not been checked yet or failed to
+answer its last check, is passed over too. CheckHealth, run every HealthInterval once the router is
+started, asks each replica for its lag, and ejects one that fails FailureThreshold times in a row
+until it answers again. A read that cannot reach a replica counts as a failure too, and is made
+again on the primary; a read the replica refuses, such as one with a bad argument or that the
+request may not make, fails as it would on the primary.
+
+A replica may not yet hold what was just written to the primary, so the reads of whoever wrote
+through the router go to the primary for PinWindow after the write, and for as long as a
+transaction of theirs is open: a request is pinned with the others of its user in its tenant, or
+alone when it is made by no user. PinPrimary pins a request that writes some other way.
+
+The router does not fail over writes: when the primary fails, writes fail until it is back.
+*/
+type ReplicaRouter struct {
+	DataPlugin
+	Replicas         []DataComponent
+	MaxStaleness     time.Duration
+	PinWindow        time.Duration
+	HealthInterval   time.Duration
+	FailureThreshold int
+
+	mu       sync.Mutex
+	backends []*replicaBackend
+	next     int
+	pins     map[string]*replicaPin
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+// replicaBackend is a replica and what the router knows of its health.
+type replicaBackend struct {
+	comp     DataComponent
+	failures int
+	ejected  bool
+	lag      time.Duration
+	lagKnown bool
+}
+
+// replicaPin sends the reads of a writer to the primary until a time, and while it has
+// transactions open.
+type replicaPin struct {
+	until time.Time
+	open  int
+}
+
+// ReplicaHealth is what a router knows of a replica's health. Lag is zero when LagKnown is not set.
+type ReplicaHealth struct {
+	Object   string
+	Ejected  bool
+	Failures int
+	Lag      time.Duration
+	LagKnown bool
+}
+
+func NewReplicaRouter(ctx core.ServerContext) *ReplicaRouter {
+	return &ReplicaRouter{}
+}
+
+// NewReplicaRouterWithServices creates a router writing to primary and reading from replicas.
+func NewReplicaRouterWithServices(ctx core.ServerContext, primary DataComponent, replicas ...DataComponent) *ReplicaRouter {
+	svc := &ReplicaRouter{DataPlugin: DataPlugin{PluginDataComponent: primary}, Replicas: replicas, PinWindow: DefaultReplicaPinWindow,
+		HealthInterval: DefaultReplicaHealthInterval, FailureThreshold: DefaultReplicaFailures}
+	svc.setBackends()
+	return svc
+}
+
+func (svc *ReplicaRouter) setBackends() {
+	svc.backends = make([]*replicaBackend, len(svc.Replicas))
+	for i, replica := range svc.Replicas {
+		svc.backends[i] = &replicaBackend{comp: replica}
+	}
+}
+
+func (svc *ReplicaRouter) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.Replicas == nil {
+		svc.AddConfiguration(ctx, CONF_DATA_REPLICAS, "Data services reads are spread over", datatypes.Stringarr, nil)
+		svc.AddStringConfiguration(ctx, CONF_DATA_REPLICA_MAXSTALENESS, "How far a replica may lag and still be read, zero for any", "0s")
+		svc.AddStringConfiguration(ctx, CONF_DATA_REPLICA_PINWINDOW, "How long a writer reads from the primary after writing", DefaultReplicaPinWindow.String())
+		svc.AddStringConfiguration(ctx, CONF_DATA_REPLICA_HEALTHINTERVAL, "How often the replicas are checked", DefaultReplicaHealthInterval.String())
+		svc.AddStringConfiguration(ctx, CONF_DATA_REPLICA_FAILURES, "Failures in a row that eject a replica", strconv.Itoa(DefaultReplicaFailures))
+	}
+	return nil
+}
+
+func (svc *ReplicaRouter) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.Replicas != nil {
+		return nil
+	}
+	names, _ := svc.GetStringArrayConfiguration(ctx, CONF_DATA_REPLICAS)
+	for _, name := range names {
+		s, err := ctx.GetService(name)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_REPLICAS, slog.String("Service", name))
+		}
+		dc, ok := s.(DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_REPLICAS, slog.String("Service", name))
+		}
+		svc.Replicas = append(svc.Replicas, dc)
+	}
+	svc.PinWindow, svc.HealthInterval = DefaultReplicaPinWindow, DefaultReplicaHealthInterval
+	for name, d := range map[string]*time.Duration{CONF_DATA_REPLICA_MAXSTALENESS: &svc.MaxStaleness,
+		CONF_DATA_REPLICA_PINWINDOW: &svc.PinWindow, CONF_DATA_REPLICA_HEALTHINTERVAL: &svc.HealthInterval} {
+		if val, ok := svc.GetStringConfiguration(ctx, name); ok && val != "" {
+			parsed, err := time.ParseDuration(val)
+			if err != nil || parsed < 0 {
+				return errors.BadConf(ctx, name)
+			}
+			*d = parsed
+		}
+	}
+	svc.FailureThreshold = DefaultReplicaFailures
+	if val, ok := svc.GetStringConfiguration(ctx, CONF_DATA_REPLICA_FAILURES); ok && val != "" {
+		failures, err := strconv.Atoi(val)
+		if err != nil || failures < 1 {
+			return errors.BadConf(ctx, CONF_DATA_REPLICA_FAILURES)
+		}
+		svc.FailureThreshold = failures
+	}
+	svc.setBackends()
+	return nil
+}
+
+// Start checks the replicas every HealthInterval until the router is stopped.
+func (svc *ReplicaRouter) Start(ctx core.ServerContext) error {
+	if svc.HealthInterval <= 0 || len(svc.backends) == 0 {
+		return nil
+	}
+	svc.CheckHealth(ctx)
+	svc.stop = make(chan struct{})
+	svc.done.Add(1)
+	go func() {
+		defer svc.done.Done()
+		ticker := time.NewTicker(svc.HealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-svc.stop:
+				return
+			case <-ticker.C:
+				svc.CheckHealth(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+func (svc *ReplicaRouter) Stop(ctx core.ServerContext) error {
+	if svc.stop != nil {
+		close(svc.stop)
+		svc.done.Wait()
+		svc.stop = nil
+	}
+	return nil
+}
+
+// CheckHealth asks every replica for its lag, ejecting those failing FailureThreshold times in a
+// row and readmitting those that answer, and drops the pins that have expired. The lag of a replica
+// failing its check is no longer known.
+func (svc *ReplicaRouter) CheckHealth(ctx core.ServerContext) {
+	for _, backend := range svc.backends {
+		var lag time.Duration
+		var err error
+		status, known := backend.comp.(ReplicationStatus)
+		if known {
+			lag, err = status.ReplicationLag(ctx)
+		} else {
+			_, err = backend.comp.DBCollectionExists(ctx)
+		}
+		svc.mu.Lock()
+		backend.lag, backend.lagKnown = 0, false
+		if err == nil && known {
+			backend.lag, backend.lagKnown = lag, true
+		}
+		svc.mu.Unlock()
+		svc.report(ctx, backend, err)
+	}
+	svc.mu.Lock()
+	svc.prunePins(time.Now())
+	svc.mu.Unlock()
+}
+
+// report records whether a check or read of a replica failed.
+func (svc *ReplicaRouter) report(ctx core.ServerContext, backend *replicaBackend, err error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if err == nil {
+		if backend.ejected {
+			log.Info(ctx, "Replica readmitted", slog.String("Object", backend.comp.GetObject()))
+		}
+		backend.failures, backend.ejected = 0, false
+		return
+	}
+	backend.failures++
+	if !backend.ejected && backend.failures >= svc.FailureThreshold {
+		backend.ejected = true
+		log.Warn(ctx, "Replica ejected", slog.String("Object", backend.comp.GetObject()), slog.Int("Failures", backend.failures), slog.String("Error", err.Error()))
+	}
+}
+
+// Health reports what the router knows of the health of each replica, in the order of Replicas.
+func (svc *ReplicaRouter) Health() []ReplicaHealth {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	health := make([]ReplicaHealth, len(svc.backends))
+	for i, backend := range svc.backends {
+		health[i] = ReplicaHealth{Object: backend.comp.GetObject(), Ejected: backend.ejected, Failures: backend.failures, Lag: backend.lag, LagKnown: backend.lagKnown}
+	}
+	return health
+}
+
+// pinKey returns the key a request is pinned under: its user's in its tenant, or its own when it
+// is made by no user.
+func pinKey(ctx core.RequestContext) string {
+	if user := ctx.GetUser(); user != nil {
+		return "user:" + requestTenant(ctx) + "/" + user.GetId()
+	}
+	return "request:" + ctx.GetId()
+}
+
+// PinPrimary sends the reads of the request, and of the others pinned with it, to the primary for
+// PinWindow.
+func (svc *ReplicaRouter) PinPrimary(ctx core.RequestContext) {
+	if svc.PinWindow <= 0 {
+		return
+	}
+	now := time.Now()
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if len(svc.pins) >= maxReplicaPins {
+		svc.prunePins(now)
+	}
+	if svc.pins == nil {
+		svc.pins = map[string]*replicaPin{}
+	}
+	key := pinKey(ctx)
+	pin, ok := svc.pins[key]
+	if !ok {
+		pin = &replicaPin{}
+		svc.pins[key] = pin
+	}
+	pin.until = now.Add(svc.PinWindow)
+}
+
+// prunePins drops the pins that have expired. The lock is held by the caller.
+func (svc *ReplicaRouter) prunePins(now time.Time) {
+	for key, pin := range svc.pins {
+		if pin.open == 0 && now.After(pin.until) {
+			delete(svc.pins, key)
+		}
+	}
+}
+
+// pick returns the replica the next read of the request goes to, or nil for the primary.
+func (svc *ReplicaRouter) pick(ctx core.RequestContext) *replicaBackend {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if pin, ok := svc.pins[pinKey(ctx)]; ok && (pin.open > 0 || time.Now().Before(pin.until)) {
+		return nil
+	}
+	for range svc.backends {
+		backend := svc.backends[svc.next%len(svc.backends)]
+		svc.next++
+		if !backend.ejected && (svc.MaxStaleness <= 0 || backend.lagKnown && backend.lag <= svc.MaxStaleness) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// unavailable reports whether a read failed because the replica could not be reached, rather than
+// because of the request.
+func unavailable(err error) bool {
+	if errors.HasErrorCode(err, DATA_ERROR_CONNECTION) {
+		return true
+	}
+	if _, ok := err.(*errors.Error); ok {
+		return false
+	}
+	var netErr net.Error
+	return stderrors.As(err, &netErr) || stderrors.Is(err, context.DeadlineExceeded) ||
+		stderrors.Is(err, io.EOF) || stderrors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// read makes a read on a replica, or on the primary when no replica can take it or the replica
+// cannot be reached.
+func (svc *ReplicaRouter) read(ctx core.RequestContext, fn func(comp DataComponent) error) error {
+	backend := svc.pick(ctx)
+	if backend == nil {
+		return fn(svc.PluginDataComponent)
+	}
+	err := fn(backend.comp)
+	if !unavailable(err) {
+		svc.report(ctx.ServerContext(), backend, nil)
+		return err
+	}
+	svc.report(ctx.ServerContext(), backend, err)
+	return fn(svc.PluginDataComponent)
+}
+
+// written pins the writer of a write to the primary.
+func (svc *ReplicaRouter) written(ctx core.RequestContext, err error) error {
+	svc.PinPrimary(ctx)
+	return err
+}
+
+// Transaction runs callback in a transaction of the primary, with the reads of the request pinned
+// to the primary while it is open and for PinWindow after.
+func (svc *ReplicaRouter) Transaction(ctx core.RequestContext, callback func(ctx core.RequestContext) error) error {
+	key := pinKey(ctx)
+	svc.mu.Lock()
+	if svc.pins == nil {
+		svc.pins = map[string]*replicaPin{}
+	}
+	pin, ok := svc.pins[key]
+	if !ok {
+		pin = &replicaPin{}
+		svc.pins[key] = pin
+	}
+	pin.open++
+	svc.mu.Unlock()
+	err := svc.PluginDataComponent.Transaction(ctx, callback)
+	svc.mu.Lock()
+	pin.open--
+	pin.until = time.Now().Add(svc.PinWindow)
+	svc.mu.Unlock()
+	return err
+}
+
+func (svc *ReplicaRouter) Save(ctx core.RequestContext, item core.Storable) error {
+	return svc.written(ctx, svc.PluginDataComponent.Save(ctx, item))
+}
+
+func (svc *ReplicaRouter) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	return svc.written(ctx, svc.PluginDataComponent.Put(ctx, id, item))
+}
+
+func (svc *ReplicaRouter) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.written(ctx, svc.PluginDataComponent.PutMulti(ctx, items))
+}
+
+func (svc *ReplicaRouter) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	return svc.written(ctx, svc.PluginDataComponent.CreateMulti(ctx, items))
+}
+
+func (svc *ReplicaRouter) AddToArray(ctx core.RequestContext, id string, fieldName string, item interface{}) error {
+	return svc.written(ctx, svc.PluginDataComponent.AddToArray(ctx, id, fieldName, item))
+}
+
+func (svc *ReplicaRouter) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.written(ctx, svc.PluginDataComponent.UpsertId(ctx, id, newVals))
+}
+
+func (svc *ReplicaRouter) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.written(ctx, svc.PluginDataComponent.Update(ctx, id, newVals))
+}
+
+func (svc *ReplicaRouter) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	return svc.written(ctx, svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals))
+}
+
+func (svc *ReplicaRouter) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	ids, err := svc.PluginDataComponent.Upsert(ctx, queryCond, newVals, getids)
+	return ids, svc.written(ctx, err)
+}
+
+func (svc *ReplicaRouter) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	ids, err := svc.PluginDataComponent.UpdateAll(ctx, queryCond, newVals, getids)
+	return ids, svc.written(ctx, err)
+}
+
+func (svc *ReplicaRouter) Delete(ctx core.RequestContext, id string) error {
+	return svc.written(ctx, svc.PluginDataComponent.Delete(ctx, id))
+}
+
+func (svc *ReplicaRouter) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	return svc.written(ctx, svc.PluginDataComponent.DeleteMulti(ctx, ids))
+}
+
+func (svc *ReplicaRouter) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	ids, err := svc.PluginDataComponent.DeleteAll(ctx, queryCond, getids)
+	return ids, svc.written(ctx, err)
+}
+
+func (svc *ReplicaRouter) Restore(ctx core.RequestContext, ids []string) error {
+	return svc.written(ctx, svc.PluginDataComponent.Restore(ctx, ids))
+}
+
+func (svc *ReplicaRouter) Purge(ctx core.RequestContext, olderThan time.Time) (int, error) {
+	count, err := svc.PluginDataComponent.Purge(ctx, olderThan)
+	return count, svc.written(ctx, err)
+}
+
+func (svc *ReplicaRouter) PutValue(ctx core.RequestContext, key string, value interface{}) error {
+	return svc.written(ctx, svc.PluginDataComponent.PutValue(ctx, key, value))
+}
+
+func (svc *ReplicaRouter) DeleteValue(ctx core.RequestContext, key string) error {
+	return svc.written(ctx, svc.PluginDataComponent.DeleteValue(ctx, key))
+}
+
+func (svc *ReplicaRouter) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	var item core.Storable
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		item, err = comp.GetById(ctx, id, dao)
+		return err
+	})
+	return item, err
+}
+
+func (svc *ReplicaRouter) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	var items []core.Storable
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		items, err = comp.GetMulti(ctx, props, ids, orderBy, dao)
+		return err
+	})
+	return items, err
+}
+
+func (svc *ReplicaRouter) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	var items map[string]core.Storable
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		items, err = comp.GetMultiHash(ctx, props, ids, dao)
+		return err
+	})
+	return items, err
+}
+
+func (svc *ReplicaRouter) Get(ctx core.RequestContext, props []string, queryCond interface{}, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	var items []core.Storable
+	var ids []string
+	var total, count int
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		items, ids, total, count, err = comp.Get(ctx, props, queryCond, pageSize, pageNum, mode, orderBy, dao)
+		return err
+	})
+	return items, ids, total, count, err
+}
+
+func (svc *ReplicaRouter) GetOne(ctx core.RequestContext, props []string, queryCond interface{}, dao string) (core.Storable, error) {
+	var item core.Storable
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		item, err = comp.GetOne(ctx, props, queryCond, dao)
+		return err
+	})
+	return item, err
+}
+
+func (svc *ReplicaRouter) GetList(ctx core.RequestContext, props []string, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	var items []core.Storable
+	var ids []string
+	var total, count int
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		items, ids, total, count, err = comp.GetList(ctx, props, pageSize, pageNum, mode, orderBy, dao)
+		return err
+	})
+	return items, ids, total, count, err
+}
+
+func (svc *ReplicaRouter) Count(ctx core.RequestContext, queryCond interface{}) (int, error) {
+	var count int
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		count, err = comp.Count(ctx, queryCond)
+		return err
+	})
+	return count, err
+}
+
+func (svc *ReplicaRouter) CountGroups(ctx core.RequestContext, queryCond interface{}, groupids []string, group string) (utils.StringMap, error) {
+	var res utils.StringMap
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		res, err = comp.CountGroups(ctx, queryCond, groupids, group)
+		return err
+	})
+	return res, err
+}
+
+func (svc *ReplicaRouter) Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*QueryPage, error) {
+	var page *QueryPage
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		page, err = comp.Query(ctx, compiled, params)
+		return err
+	})
+	return page, err
+}
+
+// Iterate walks the records on the backend the iteration was begun on, so that a slow walk does
+// not move between replicas lagging by different amounts.
+func (svc *ReplicaRouter) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (StorableIterator, error) {
+	var it StorableIterator
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		it, err = comp.Iterate(ctx, props, queryCond, orderBy, batchSize)
+		return err
+	})
+	return it, err
+}
+
+func (svc *ReplicaRouter) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]VectorResult, error) {
+	var results []VectorResult
+	err := svc.read(ctx, func(comp DataComponent) (err error) {
+		results, err = comp.VectorSearch(ctx, vector, limit, filter)
+		return err
+	})
+	return results, err
+}
@@ -0,0 +1,190 @@
+package data_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+type laggingReplica struct {
+	data.DataComponent
+	lag  time.Duration
+	fail error
+}
+
+func (r *laggingReplica) ReplicationLag(ctx core.ServerContext) (time.Duration, error) {
+	return r.lag, r.fail
+}
+
+func (r *laggingReplica) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	if r.fail != nil {
+		return nil, r.fail
+	}
+	return r.DataComponent.GetById(ctx, id, dao)
+}
+
+func TestReplicaRouter(t *testing.T) {
+	// setup stores a record named primary in the primary and replica in the replica, and routes
+	// between them allowing a second of lag; the replica tells its lag unless blind is set
+	setup := func(t *testing.T, blind bool) (*data.ReplicaRouter, *laggingReplica, *datatest.RequestContext, string) {
+		t.Helper()
+		primary, objects, c := newWidgets(t, core.StorableConfig{})
+		replica := &laggingReplica{DataComponent: memory.NewMemoryDataComponentForObject(c.Server, "widget", objects)}
+		item := objects.NewRecord("primary", 1)
+		if err := primary.Save(c, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		stale := *item
+		stale.Name = "replica"
+		if err := replica.Save(c, &stale); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		var svc *data.ReplicaRouter
+		if blind {
+			svc = data.NewReplicaRouterWithServices(c.Server, primary, replica.DataComponent)
+		} else {
+			svc = data.NewReplicaRouterWithServices(c.Server, primary, replica)
+		}
+		svc.MaxStaleness = time.Second
+		return svc, replica, c, item.Id
+	}
+	name := func(t *testing.T, svc data.DataComponent, c core.RequestContext, id string) string {
+		t.Helper()
+		got, err := svc.GetById(c, id, "")
+		if err != nil {
+			t.Fatalf("GetById: %v", err)
+		}
+		return got.(*datatest.Record).Name
+	}
+
+	t.Run("reads", func(t *testing.T) {
+		svc, replica, c, id := setup(t, false)
+		if got := name(t, svc, c, id); got != "primary" {
+			t.Errorf("a replica whose lag is not known yet was read: %q", got)
+		}
+		svc.CheckHealth(c.Server)
+		if got := name(t, svc, c, id); got != "replica" {
+			t.Errorf("a read went to %q, want the replica", got)
+		}
+		cond, err := svc.CreateCondition(c, utils.StringMap{"Name": "replica"})
+		if err != nil {
+			t.Fatalf("CreateCondition: %v", err)
+		}
+		if n, err := svc.Count(c, cond); err != nil || n != 1 {
+			t.Errorf("Count: %d %v", n, err)
+		}
+		if _, err := svc.GetById(c, "missing", ""); !errors.IsNotFound(err) {
+			t.Errorf("a missing id: want not found, got %v", err)
+		}
+		if svc.Health()[0].Failures != 0 {
+			t.Errorf("a missing id counted as a failure")
+		}
+		replica.fail = errors.BadArg(c, "id")
+		if _, err := svc.GetById(c, id, ""); !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) || svc.Health()[0].Failures != 0 {
+			t.Errorf("a read the replica refused was failed over or counted: %v %+v", err, svc.Health()[0])
+		}
+	})
+
+	// whoever writes reads its writes from the primary, others, and the writer's user in another
+	// tenant, keep reading the replica
+	t.Run("pins", func(t *testing.T) {
+		svc, _, c, id := setup(t, false)
+		svc.CheckHealth(c.Server)
+		if err := svc.Update(c, id, utils.StringMap{"Size": 2}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got := name(t, svc, c, id); got != "primary" {
+			t.Errorf("the writer read %q, want the primary", got)
+		}
+		if got := name(t, svc, datatest.NewRequestContext(c.Server, "user2", ""), id); got != "replica" {
+			t.Errorf("another user read %q, want the replica", got)
+		}
+		if got := name(t, svc, datatest.NewRequestContext(c.Server, "user1", "acme"), id); got != "replica" {
+			t.Errorf("the writer in another tenant read %q, want the replica", got)
+		}
+		svc.PinWindow = 0
+		other := datatest.NewRequestContext(c.Server, "user3", "")
+		err := svc.Transaction(other, func(tx core.RequestContext) error {
+			if got := name(t, svc, other, id); got != "primary" {
+				t.Errorf("a read in a transaction went to %q", got)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Transaction: %v", err)
+		}
+		if got := name(t, svc, other, id); got != "replica" {
+			t.Errorf("a read after the transaction went to %q", got)
+		}
+	})
+
+	t.Run("lag", func(t *testing.T) {
+		svc, replica, c, id := setup(t, false)
+		replica.lag = time.Minute
+		svc.CheckHealth(c.Server)
+		if got := name(t, svc, c, id); got != "primary" {
+			t.Errorf("a lagging replica was read: %q", got)
+		}
+		replica.lag = 0
+		svc.CheckHealth(c.Server)
+		if got := name(t, svc, c, id); got != "replica" {
+			t.Errorf("a replica caught up was not read: %q", got)
+		}
+	})
+
+	// a failing replica fails over to the primary and is ejected, then readmitted once it answers
+	t.Run("failover", func(t *testing.T) {
+		svc, replica, c, id := setup(t, false)
+		svc.CheckHealth(c.Server)
+		replica.fail = errors.WrapErrorWithCode(c.Server, fmt.Errorf("replica down"), data.DATA_ERROR_CONNECTION)
+		if got := name(t, svc, c, id); got != "primary" {
+			t.Errorf("a failed read was not made on the primary: %q", got)
+		}
+		svc.CheckHealth(c.Server)
+		if health := svc.Health()[0]; health.LagKnown || health.Ejected {
+			t.Errorf("a replica failing its check kept its lag: %+v", health)
+		}
+		svc.CheckHealth(c.Server)
+		if health := svc.Health()[0]; !health.Ejected || health.Failures != 3 {
+			t.Errorf("a failing replica was not ejected: %+v", health)
+		}
+		replica.fail = nil
+		if got := name(t, svc, c, id); got != "primary" {
+			t.Errorf("an ejected replica was read: %q", got)
+		}
+		svc.CheckHealth(c.Server)
+		if got := name(t, svc, c, id); got != "replica" || svc.Health()[0].Ejected {
+			t.Errorf("a replica answering again was not readmitted: %q", got)
+		}
+	})
+
+	// a replica that cannot tell its lag is checked by its collection, and read only when any lag
+	// will do
+	for _, tc := range []struct {
+		name         string
+		maxStaleness time.Duration
+		want         string
+	}{
+		{"unknown lag within a bound", time.Second, "primary"},
+		{"unknown lag with any lag allowed", 0, "replica"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, _, c, id := setup(t, true)
+			svc.MaxStaleness = tc.maxStaleness
+			svc.CheckHealth(c.Server)
+			if health := svc.Health()[0]; health.LagKnown || health.Ejected {
+				t.Errorf("a replica that cannot tell its lag was checked as %+v", health)
+			}
+			if got := name(t, svc, c, id); got != tc.want {
+				t.Errorf("a read went to %q, want the %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// DefaultResolveDepth is the deepest reference path a RefResolver follows when its MaxDepth is not
+// set.
+const DefaultResolveDepth = 3
+
+/*
+RefResolver loads the entities StorableRef fields refer to into their Entity, in batches rather
+than one GetById per reference: each level of a resolution groups the references of every item by
+object type and reads each type with one GetMultiHash.
+
+A field is named by its Go or json name, and a dotted path resolves the references of the
+entities loaded for the field before it, so "Owner.Manager" loads each item's Owner and then each
+owner's Manager. A reference whose Type is empty, as one unmarshalled from a plain id is, takes the
+object type from the field's ref tag. A reference to a record that does not exist, or to an
+object type the request lacks the Permission for, is left with no Entity.
+*/
+type RefResolver struct {
+	// Components returns the data component for an object type.
+	Components func(ctx core.RequestContext, obj string) (DataComponent, error)
+	// Permission names the permission a request needs to load entities of an object type, or
+	// returns an empty string when the data service's own checks suffice. Nil checks nothing.
+	Permission func(obj string) string
+	// MaxDepth is the number of fields a path may have. Zero means DefaultResolveDepth.
+	MaxDepth int
+}
+
+// refSlot is one reference to load, in the field holding it.
+type refSlot struct {
+	ref   *StorableRef
+	field string
+}
+
+// Resolve loads the references of items along each of the field paths.
+func (r *RefResolver) Resolve(ctx core.RequestContext, items []core.Storable, fields []string) error {
+	if r.Components == nil {
+		return errors.MissingArg(ctx, "Components")
+	}
+	maxDepth := r.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultResolveDepth
+	}
+	paths := make([][]string, 0, len(fields))
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if len(path) > maxDepth {
+			return errors.BadArg(ctx, "fields", slog.String("Field", field), slog.Int("MaxDepth", maxDepth))
+		}
+		paths = append(paths, path)
+	}
+	loaded := make(map[string]map[string]core.Storable)
+	return r.resolveLevel(ctx, items, paths, loaded)
+}
+
+// resolveLevel loads the first field of each path for items, then resolves the rest of the paths
+// on the entities loaded.
+func (r *RefResolver) resolveLevel(ctx core.RequestContext, items []core.Storable, paths [][]string, loaded map[string]map[string]core.Storable) error {
+	if len(items) == 0 || len(paths) == 0 {
+		return nil
+	}
+	rest := make(map[string][][]string)
+	var order []string
+	for _, path := range paths {
+		if _, ok := rest[path[0]]; !ok {
+			order = append(order, path[0])
+			rest[path[0]] = nil
+		}
+		if len(path) > 1 {
+			rest[path[0]] = append(rest[path[0]], path[1:])
+		}
+	}
+	byType := make(map[string][]refSlot)
+	var types []string
+	for _, item := range items {
+		for _, field := range order {
+			refs, object, err := refsOf(ctx, item, field)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				typ := ref.Type
+				if typ == "" {
+					typ = object
+				}
+				if typ == "" || ref.Id == "" {
+					continue
+				}
+				if _, ok := byType[typ]; !ok {
+					types = append(types, typ)
+				}
+				byType[typ] = append(byType[typ], refSlot{ref: ref, field: field})
+			}
+		}
+	}
+	next := make(map[string][]core.Storable)
+	for _, typ := range types {
+		if r.Permission != nil {
+			if perm := r.Permission(typ); perm != "" && !ctx.HasPermission(perm) {
+				continue
+			}
+		}
+		if err := r.load(ctx, typ, byType[typ], loaded); err != nil {
+			return err
+		}
+		for _, slot := range byType[typ] {
+			if entity := loaded[typ][slot.ref.Id]; entity != nil {
+				slot.ref.Entity = entity
+				if len(rest[slot.field]) > 0 {
+					next[slot.field] = append(next[slot.field], entity)
+				}
+			}
+		}
+	}
+	for _, field := range order {
+		if err := r.resolveLevel(ctx, dedupe(next[field]), rest[field], loaded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the entities of type typ that slots refer to and that were not loaded before.
+func (r *RefResolver) load(ctx core.RequestContext, typ string, slots []refSlot, loaded map[string]map[string]core.Storable) error {
+	if loaded[typ] == nil {
+		loaded[typ] = make(map[string]core.Storable)
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, slot := range slots {
+		id := slot.ref.Id
+		if _, ok := loaded[typ][id]; !ok && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	comp, err := r.Components(ctx, typ)
+	if err != nil {
+		return err
+	}
+	entities, err := comp.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// a missing record is remembered too, so that it is not asked for again
+		loaded[typ][id] = entities[id]
+	}
+	return nil
+}
+
+// refsOf returns the references item holds in the field, addressed so that they can be filled in,
+// with the object type the field's ref tag declares.
+func refsOf(ctx core.RequestContext, item core.Storable, field string) ([]*StorableRef, string, error) {
+	val := reflect.ValueOf(item)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return nil, "", errors.TypeMismatch(ctx, slog.String("Field", field))
+	}
+	val = val.Elem()
+	for _, sf := range reflect.VisibleFields(val.Type()) {
+		if sf.Anonymous || (sf.Name != field && strings.Split(sf.Tag.Get("json"), ",")[0] != field) {
+			continue
+		}
+		object := strings.TrimSpace(strings.Split(sf.Tag.Get(TAG_REF), ",")[0])
+		fieldVal := val.FieldByIndex(sf.Index)
+		switch sf.Type {
+		case storableRefType:
+			return []*StorableRef{fieldVal.Addr().Interface().(*StorableRef)}, object, nil
+		case storableRefSliceType:
+			refs := make([]*StorableRef, fieldVal.Len())
+			for i := range refs {
+				refs[i] = fieldVal.Index(i).Addr().Interface().(*StorableRef)
+			}
+			return refs, object, nil
+		case reflect.PointerTo(storableRefType):
+			if fieldVal.IsNil() {
+				return nil, object, nil
+			}
+			return []*StorableRef{fieldVal.Interface().(*StorableRef)}, object, nil
+		}
+		return nil, "", errors.BadArg(ctx, "fields", slog.String("Field", field), slog.String("Type", val.Type().String()))
+	}
+	return nil, "", errors.BadArg(ctx, "fields", slog.String("Field", field), slog.String("Type", val.Type().String()))
+}
+
+// dedupe drops repeated entities, which several references to one record load only once.
+func dedupe(items []core.Storable) []core.Storable {
+	seen := make(map[core.Storable]bool, len(items))
+	unique := items[:0]
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,112 @@
+package data_test
+
+import (
+	"fmt"
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+)
+
+// countingReads counts the GetMultiHash calls made of a component, and the ids asked for, which
+// it reads however often they repeat.
+type countingReads struct {
+	data.DataComponent
+	reads int
+	asked []string
+}
+
+func (c *countingReads) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	c.reads++
+	c.asked = append(c.asked, ids...)
+	return c.DataComponent.GetMultiHash(ctx, props, ids, dao)
+}
+
+func TestRefResolver(t *testing.T) {
+	svc, objects, c := newWidgets(t, core.StorableConfig{})
+	saveWidgets(t, svc, objects, c, "alpha", "beta")
+	items, _, _, _, _ := svc.GetList(c, nil, 0, 0, "", []string{"Name"}, "")
+	alpha, beta := items[0].GetId(), items[1].GetId()
+	assignmentStore := memory.NewMemoryDataComponentForObject(c.Server, "assignment", datatest.EntityFactory[assignment]{})
+	first := &assignment{Owner: data.StorableRef{Id: alpha, Type: "widget"}, Extras: []data.StorableRef{{Id: alpha, Type: "widget"}, {Id: beta}, {Id: "missing"}}}
+	if err := assignmentStore.Save(c, first); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	resolverOf := func() (*data.RefResolver, *countingReads, *countingReads) {
+		widgets := &countingReads{DataComponent: svc}
+		assignments := &countingReads{DataComponent: assignmentStore}
+		return &data.RefResolver{Components: func(ctx core.RequestContext, obj string) (data.DataComponent, error) {
+			switch obj {
+			case "widget":
+				return widgets, nil
+			case "assignment":
+				return assignments, nil
+			}
+			return nil, errors.NotFound(ctx, obj)
+		}}, widgets, assignments
+	}
+	name := func(ref data.StorableRef) string {
+		if ref.Entity == nil {
+			return "<nil>"
+		}
+		return ref.Entity.(*datatest.Record).Name
+	}
+
+	t.Run("batches", func(t *testing.T) {
+		resolver, widgets, assignments := resolverOf()
+		first := *first
+		first.Extras = append([]data.StorableRef(nil), first.Extras...)
+		// beta's references have no type, which the field's ref tag supplies
+		second := &assignment{Owner: data.StorableRef{Id: beta}, Parent: data.StorableRef{Id: first.Id, Type: "assignment"}}
+		if err := resolver.Resolve(c, []core.Storable{&first, second}, []string{"Owner", "Extras", "Parent.Owner"}); err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if got := fmt.Sprint(name(first.Owner), " ", name(first.Extras[0]), " ", name(first.Extras[1]), " ", name(first.Extras[2]), " ", name(second.Owner)); got != "alpha alpha beta <nil> beta" {
+			t.Errorf("resolved %s", got)
+		}
+		parent, ok := second.Parent.Entity.(*assignment)
+		if !ok || name(parent.Owner) != "alpha" {
+			t.Fatalf("Parent.Owner not resolved: %v", second.Parent.Entity)
+		}
+		if widgets.reads != 1 || assignments.reads != 1 {
+			t.Errorf("want one read per object type, got %d widget and %d assignment reads", widgets.reads, assignments.reads)
+		}
+		// the store reads every id it is given, so an id referred to twice is asked for once
+		if len(widgets.asked) != 3 {
+			t.Errorf("want alpha, beta and the missing id asked for once each, got %v", widgets.asked)
+		}
+	})
+
+	t.Run("paths", func(t *testing.T) {
+		resolver, _, _ := resolverOf()
+		if err := resolver.Resolve(c, []core.Storable{first}, []string{"Parent.Parent.Parent.Owner"}); !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) {
+			t.Errorf("a path deeper than the limit: want bad arg, got %v", err)
+		}
+		if err := resolver.Resolve(c, []core.Storable{first}, []string{"Name"}); !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) {
+			t.Errorf("a field that is not a reference: want bad arg, got %v", err)
+		}
+	})
+
+	// the store checks no permission, so a request without the one for an object type gets its
+	// references unresolved by the resolver
+	t.Run("permissions", func(t *testing.T) {
+		resolver, widgets, _ := resolverOf()
+		resolver.Permission = func(obj string) string { return "View " + obj }
+		restricted := &assignment{Owner: data.StorableRef{Id: alpha, Type: "widget"}}
+		c := datatest.NewRequestContext(c.Server, "user1", "")
+		c.Permissions = []string{"View assignment"}
+		if err := resolver.Resolve(c, []core.Storable{restricted}, []string{"Owner"}); err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if restricted.Owner.Entity != nil || widgets.reads != 0 {
+			t.Errorf("resolved a reference without the permission to")
+		}
+		c.Permissions = append(c.Permissions, "View widget")
+		if err := resolver.Resolve(c, []core.Storable{restricted}, []string{"Owner"}); err != nil || name(restricted.Owner) != "alpha" {
+			t.Errorf("with the permission: %s, %v", name(restricted.Owner), err)
+		}
+	})
+}
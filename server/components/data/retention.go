@@ -0,0 +1,144 @@
+package data
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/datatypes"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/server/log"
+)
+
+// CONF_DATA_RETENTION_INTERVAL is how often a RetentionJob runs, as a duration such as "1h".
+const CONF_DATA_RETENTION_INTERVAL = "retentioninterval"
+
+// DefaultRetentionInterval is how often a RetentionJob runs when it is not configured.
+const DefaultRetentionInterval = time.Hour
+
+/*
+RetentionJob empties the trash of soft-deleted records on a schedule. On every run it purges, from
+each of its data services, the records deleted longer ago than their entity's configured
+Retention; entities with no Retention are left alone.
+
+It runs as a system request with no tenant, so it purges every tenant's records, and it runs from
+Start until Stop. A run that fails on one data service logs the failure and goes on to the next.
+*/
+type RetentionJob struct {
+	core.Service
+	Components []DataComponent
+	Interval   time.Duration
+	stop       chan struct{}
+	done       sync.WaitGroup
+}
+
+func NewRetentionJob(ctx core.ServerContext) *RetentionJob {
+	return &RetentionJob{}
+}
+
+// NewRetentionJobWithServices creates a job purging comps every interval.
+func NewRetentionJobWithServices(ctx core.ServerContext, interval time.Duration, comps ...DataComponent) *RetentionJob {
+	return &RetentionJob{Components: comps, Interval: interval}
+}
+
+func (svc *RetentionJob) Describe(ctx core.ServerContext) error {
+	if svc.Components == nil {
+		svc.AddConfiguration(ctx, CONF_DATA_SVCS, "Data services whose deleted records are purged", datatypes.Stringarr, nil)
+		svc.AddStringConfiguration(ctx, CONF_DATA_RETENTION_INTERVAL, "How often deleted records are purged", DefaultRetentionInterval.String())
+	}
+	return nil
+}
+
+func (svc *RetentionJob) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if svc.Components != nil {
+		return nil
+	}
+	names, _ := svc.GetStringArrayConfiguration(ctx, CONF_DATA_SVCS)
+	for _, name := range names {
+		s, err := ctx.GetService(name)
+		if err != nil {
+			return errors.BadConf(ctx, CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		dc, ok := s.(DataComponent)
+		if !ok {
+			return errors.BadConf(ctx, CONF_DATA_SVCS, slog.String("Service", name))
+		}
+		svc.Components = append(svc.Components, dc)
+	}
+	if interval, ok := svc.GetStringConfiguration(ctx, CONF_DATA_RETENTION_INTERVAL); ok && interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return errors.BadConf(ctx, CONF_DATA_RETENTION_INTERVAL)
+		}
+		svc.Interval = d
+	}
+	return nil
+}
+
+// Start runs the job every Interval until Stop.
+func (svc *RetentionJob) Start(ctx core.ServerContext) error {
+	interval := svc.Interval
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+	svc.stop = make(chan struct{})
+	svc.done.Add(1)
+	go func() {
+		defer svc.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-svc.stop:
+				return
+			case <-ticker.C:
+				svc.Run(core.NewSystemRequest(ctx, "DataRetention", nil, nil, nil), time.Now())
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the job, waiting for a run in progress to finish.
+func (svc *RetentionJob) Stop(ctx core.ServerContext) error {
+	if svc.stop != nil {
+		close(svc.stop)
+		svc.done.Wait()
+		svc.stop = nil
+	}
+	return nil
+}
+
+// Run purges, as of now, every record deleted longer ago than its entity's Retention, and returns
+// how many it purged by object.
+func (svc *RetentionJob) Run(ctx core.RequestContext, now time.Time) map[string]int {
+	purged := make(map[string]int)
+	for _, comp := range svc.Components {
+		retention := retentionOf(ctx, comp)
+		if retention <= 0 {
+			continue
+		}
+		n, err := comp.Purge(ctx, now.Add(-retention))
+		if err != nil {
+			log.Error(ctx, "Purging deleted records failed", slog.String("Object", comp.GetObject()), slog.String("Error", err.Error()))
+			continue
+		}
+		purged[comp.GetObject()] += n
+	}
+	return purged
+}
+
+// retentionOf returns the Retention configured for the entity comp stores.
+func retentionOf(ctx core.RequestContext, comp DataComponent) time.Duration {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return 0
+	}
+	stor, ok := factory.CreateObject(ctx).(core.Storable)
+	if !ok || stor.Config() == nil || !stor.Config().SoftDelete {
+		return 0
+	}
+	return stor.Config().Retention
+}
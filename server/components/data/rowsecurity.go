@@ -0,0 +1,155 @@
+package data
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// The parameters a row policy's filter is bound with, from the request it is enforced for.
+const (
+	// RLS_PARAM_USER is the id of the request's user.
+	RLS_PARAM_USER = "rls_user"
+	// RLS_PARAM_USERNAME is the user name of the request's user.
+	RLS_PARAM_USERNAME = "rls_username"
+	// RLS_PARAM_TENANT is the id of the request's tenant.
+	RLS_PARAM_TENANT = "rls_tenant"
+	// RLS_PARAM_ROLES is the names of the roles the request's user holds, as a JSON array, for a
+	// membership test.
+	RLS_PARAM_ROLES = "rls_roles"
+)
+
+// roleHolder is a user that holds roles, as an rbac.RbacUser does.
+type roleHolder interface {
+	GetRoles() ([]StorableRef, error)
+}
+
+// RowPolicyFilter returns the query a row policy permits, or nil for a policy permitting every
+// record.
+func RowPolicyFilter(ctx core.RequestContext, policy core.RowPolicy) (*Query, error) {
+	if policy.Filter == nil {
+		return nil, nil
+	}
+	query, ok := policy.Filter.(*Query)
+	if !ok {
+		return nil, errors.BadArg(ctx, "Filter", slog.String("Policy", policy.Name))
+	}
+	return query, nil
+}
+
+// RowPolicyParams returns the parameters the row policies are bound with for a request, and the
+// names of the roles its user holds.
+func RowPolicyParams(ctx core.RequestContext) (utils.StringsMap, []string, error) {
+	params := utils.StringsMap{}
+	var roles []string
+	if user := ctx.GetUser(); user != nil {
+		params[RLS_PARAM_USER] = user.GetId()
+		params[RLS_PARAM_USERNAME] = user.GetUserName()
+		if holder, ok := user.(roleHolder); ok {
+			refs, err := holder.GetRoles()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, ref := range refs {
+				if ref.Name != "" {
+					roles = append(roles, ref.Name)
+				} else {
+					roles = append(roles, ref.Id)
+				}
+			}
+		}
+	}
+	if tenant := ctx.GetTenant(); tenant != nil {
+		params[RLS_PARAM_TENANT] = tenant.GetTenantId()
+	}
+	encoded, err := json.Marshal(append([]string{}, roles...))
+	if err != nil {
+		return nil, nil, errors.WrapError(ctx, err)
+	}
+	params[RLS_PARAM_ROLES] = string(encoded)
+	return params, roles, nil
+}
+
+// RowPolicyPredicate combines the policies applying to a request for op into the predicate the
+// records it may touch match. It returns a nil predicate when a policy permits every record, and
+// fails with an unauthorized error when no policy applies. A policy whose filter is bound with the
+// user does not apply to a request made by no user.
+func RowPolicyPredicate(ctx core.RequestContext, policies []core.RowPolicy, op core.RowOperation, roles []string) (Predicate, error) {
+	var operands []Predicate
+	applies := false
+	for _, policy := range policies {
+		if !rowPolicyApplies(policy, op, roles) {
+			continue
+		}
+		filter, err := RowPolicyFilter(ctx, policy)
+		if err != nil {
+			return nil, err
+		}
+		if ctx.GetUser() == nil && boundToUser(filter) {
+			continue
+		}
+		applies = true
+		if filter == nil || filter.Filter == nil {
+			return nil, nil
+		}
+		operands = append(operands, filter.Filter)
+	}
+	if !applies {
+		return nil, errors.Unauthorized(ctx, slog.String("Operation", string(op)))
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &Logical{Operator: LogicalOr, Operands: operands}, nil
+}
+
+// rowPolicyApplies reports whether policy permits op to a user holding roles.
+func rowPolicyApplies(policy core.RowPolicy, op core.RowOperation, roles []string) bool {
+	if len(policy.Operations) > 0 {
+		permitted := false
+		for _, operation := range policy.Operations {
+			permitted = permitted || operation == op
+		}
+		if !permitted {
+			return false
+		}
+	}
+	if len(policy.Roles) == 0 {
+		return true
+	}
+	for _, role := range policy.Roles {
+		if utils.StrContains(roles, role) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// boundToUser reports whether a policy filter is bound with the request's user.
+func boundToUser(filter *Query) bool {
+	if filter == nil {
+		return false
+	}
+	for _, name := range filter.Parameters() {
+		if name == RLS_PARAM_USER || name == RLS_PARAM_USERNAME {
+			return true
+		}
+	}
+	return false
+}
+
+// rowPolicies returns the row policies of the entity comp stores.
+func rowPolicies(ctx core.ServerContext, comp DataComponent) []core.RowPolicy {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return nil
+	}
+	stor, ok := factory.CreateObject(ctx).(core.Storable)
+	if !ok || stor.Config() == nil {
+		return nil
+	}
+	return stor.Config().RowPolicies
+}
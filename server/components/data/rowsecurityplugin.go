@@ -0,0 +1,664 @@
+package data
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// CONF_DATA_RLS_BYPASS optionally names a permission whose holders bypass the row policies.
+const CONF_DATA_RLS_BYPASS = "rlsbypasspermission"
+
+var _ DataComponent = (*RowSecurityPlugin)(nil)
+
+/*
+RowSecurityPlugin enforces the row policies of the entity it stores, so that a service reading or
+writing through it sees only the records its caller may, without filtering by owner or tenant
+itself. The policies are the RowPolicies of the entity's StorableConfig, or those the plugin is
+created with.
+
+A condition made through the plugin keeps its query, and the read policies applying to a request
+are ANDed into it when it is used to Get, GetOne, Count, CountGroups, Iterate or search for
+vectors; the write policies are ANDed into it for UpdateAll, Upsert and DeleteAll. A condition
+made by the data service underneath is refused. A record read by id that the read policies do not
+permit is not found, and is left out of GetMulti.
+
+A write by id fails with an unauthorized error unless the write policies permit the record stored,
+and the record as the write leaves it, so that a write cannot move a record out of the caller's
+reach. Updating by condition checks the records it will leave as well, and an upsert finding no
+record checks the one it creates from its values. Listing the trash, restoring from it and purging
+it are only open to a request whose policies permit every record.
+
+A system request, one marked by core.NewSystemRequest, bypasses the policies, as does a request
+holding the bypass permission when one is configured. Any other request made by no user is held to
+the policies that do not depend on the user, and is refused whatever they do not permit. An entity
+declaring no policies is not restricted.
+*/
+type RowSecurityPlugin struct {
+	DataPlugin
+	Policies         []core.RowPolicy
+	BypassPermission string
+}
+
+// rowCondition is a condition made through the plugin: its query and parameters, to which the
+// policies are added when it is used, and the condition the data service made of them alone.
+type rowCondition struct {
+	query  *Query
+	params utils.StringsMap
+	cond   interface{}
+}
+
+// rowQuery is a query compiled through the plugin.
+type rowQuery struct {
+	query    *Query
+	compiled interface{}
+}
+
+func NewRowSecurityPlugin(ctx core.ServerContext) *RowSecurityPlugin {
+	return &RowSecurityPlugin{}
+}
+
+// NewRowSecurityPluginWithBase creates a plugin over comp enforcing policies, or the entity's own
+// policies when none are given.
+func NewRowSecurityPluginWithBase(ctx core.ServerContext, comp DataComponent, policies ...core.RowPolicy) *RowSecurityPlugin {
+	svc := &RowSecurityPlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, Policies: policies}
+	if svc.Policies == nil {
+		svc.Policies = rowPolicies(ctx, comp)
+	}
+	return svc
+}
+
+func (svc *RowSecurityPlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	svc.AddStringConfiguration(ctx, CONF_DATA_RLS_BYPASS, "Permission whose holders bypass the row policies", "")
+	return nil
+}
+
+func (svc *RowSecurityPlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.BypassPermission == "" {
+		svc.BypassPermission, _ = svc.GetStringConfiguration(ctx, CONF_DATA_RLS_BYPASS)
+	}
+	if svc.Policies == nil {
+		svc.Policies = rowPolicies(ctx, svc.PluginDataComponent)
+	}
+	return nil
+}
+
+// bypass reports whether the request is not subject to the policies.
+func (svc *RowSecurityPlugin) bypass(ctx core.RequestContext) bool {
+	if len(svc.Policies) == 0 || core.IsSystemRequest(ctx) {
+		return true
+	}
+	return svc.BypassPermission != "" && ctx.HasPermission(svc.BypassPermission)
+}
+
+// policy returns the predicate the records the request may touch for op match, nil when it may
+// touch every record, and the parameters the predicate is bound with.
+func (svc *RowSecurityPlugin) policy(ctx core.RequestContext, op core.RowOperation) (Predicate, utils.StringsMap, error) {
+	if svc.bypass(ctx) {
+		return nil, nil, nil
+	}
+	params, roles, err := RowPolicyParams(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	predicate, err := RowPolicyPredicate(ctx, svc.Policies, op, roles)
+	if err != nil {
+		return nil, nil, err
+	}
+	return predicate, params, nil
+}
+
+// restrict returns query with predicate ANDed into its filter, and params with the policy's
+// parameters added.
+func restrict(query *Query, params utils.StringsMap, predicate Predicate, policyParams utils.StringsMap) (*Query, utils.StringsMap) {
+	restricted := *query
+	if restricted.Filter == nil {
+		restricted.Filter = predicate
+	} else {
+		restricted.Filter = &Logical{Operator: LogicalAnd, Operands: []Predicate{query.Filter, predicate}}
+	}
+	merged := make(utils.StringsMap, len(params)+len(policyParams))
+	for name, val := range params {
+		merged[name] = val
+	}
+	for name, val := range policyParams {
+		merged[name] = val
+	}
+	return &restricted, merged
+}
+
+// secure returns the condition of the data service for queryCond, restricted to the records the
+// request may touch for op. A nil queryCond stays nil, unless all is set, when it stands for every
+// record.
+func (svc *RowSecurityPlugin) secure(ctx core.RequestContext, queryCond interface{}, op core.RowOperation, all bool) (interface{}, error) {
+	predicate, policyParams, err := svc.policy(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	if queryCond == nil {
+		if !all || predicate == nil {
+			return nil, nil
+		}
+		query, params := restrict(NewQuery(), nil, predicate, policyParams)
+		return svc.PluginDataComponent.CreateQueryCondition(ctx, query, params)
+	}
+	rc, ok := queryCond.(*rowCondition)
+	if !ok {
+		if svc.bypass(ctx) {
+			return queryCond, nil
+		}
+		return nil, errors.BadArg(ctx, "queryCond", slog.String("Object", svc.GetObject()))
+	}
+	if predicate == nil {
+		return rc.cond, nil
+	}
+	query, params := restrict(rc.query, rc.params, predicate, policyParams)
+	return svc.PluginDataComponent.CreateQueryCondition(ctx, query, params)
+}
+
+// permits reports whether the policies permit the request op on item.
+func (svc *RowSecurityPlugin) permits(ctx core.RequestContext, item core.Storable, op core.RowOperation) (bool, error) {
+	predicate, params, err := svc.policy(ctx, op)
+	if err != nil || predicate == nil {
+		return err == nil, err
+	}
+	return Evaluate(ctx, predicate, item, params)
+}
+
+// check fails unless the policies permit the request to write every one of items.
+func (svc *RowSecurityPlugin) check(ctx core.RequestContext, items ...core.Storable) error {
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		ok, err := svc.permits(ctx, item, core.RowWrite)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.Unauthorized(ctx, slog.String("Object", svc.GetObject()), slog.String("Id", item.GetId()))
+		}
+	}
+	return nil
+}
+
+// checkStored fails unless the policies permit the request to write the stored records with ids,
+// and returns them by id.
+func (svc *RowSecurityPlugin) checkStored(ctx core.RequestContext, ids []string) (map[string]core.Storable, error) {
+	if svc.bypass(ctx) {
+		return nil, nil
+	}
+	stored, err := svc.PluginDataComponent.GetMultiHash(ctx, nil, ids, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if err = svc.check(ctx, stored[id]); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// checkUpdate fails unless the policies permit the request to write the stored records with ids,
+// and the records newVals would leave. When create is set, an id with no stored record stands for
+// the record newVals would create.
+func (svc *RowSecurityPlugin) checkUpdate(ctx core.RequestContext, ids []string, newVals utils.StringMap, create bool) error {
+	stored, err := svc.checkStored(ctx, ids)
+	if err != nil || stored == nil {
+		return err
+	}
+	for _, id := range ids {
+		if item, ok := stored[id]; ok {
+			err = svc.checkUpdated(ctx, item, newVals)
+		} else if create {
+			err = svc.checkCreated(ctx, id, newVals)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCreated fails unless the policies permit the request to write the record newVals would
+// create with id.
+func (svc *RowSecurityPlugin) checkCreated(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	created, ok := svc.PluginDataComponent.CreateObject(ctx).(core.Storable)
+	if !ok {
+		return errors.TypeMismatch(ctx, slog.String("Object", svc.GetObject()))
+	}
+	created.SetId(id)
+	return svc.checkUpdated(ctx, created, newVals)
+}
+
+// checkUpdated fails unless the policies permit the request to write item as newVals leave it.
+func (svc *RowSecurityPlugin) checkUpdated(ctx core.RequestContext, item core.Storable, newVals utils.StringMap) error {
+	updated, err := svc.applyValues(ctx, item, newVals)
+	if err != nil {
+		return err
+	}
+	return svc.check(ctx, updated)
+}
+
+// applyValues returns a copy of item with newVals set, through its JSON form.
+func (svc *RowSecurityPlugin) applyValues(ctx core.RequestContext, item core.Storable, newVals utils.StringMap) (core.Storable, error) {
+	fields := make(map[string]interface{})
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	if err = json.Unmarshal(bytes, &fields); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	for field, val := range newVals {
+		fields[field] = val
+	}
+	if bytes, err = json.Marshal(fields); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	updated, ok := svc.PluginDataComponent.CreateObject(ctx).(core.Storable)
+	if !ok {
+		return nil, errors.TypeMismatch(ctx, slog.String("Object", svc.GetObject()))
+	}
+	if err = json.Unmarshal(bytes, updated); err != nil {
+		return nil, errors.WrapError(ctx, err)
+	}
+	return updated, nil
+}
+
+// checkCondition fails unless the policies permit the request to write the records matching cond,
+// a condition of the data service, as newVals leave them. When create is set and no record
+// matches, it checks the record newVals would create instead.
+func (svc *RowSecurityPlugin) checkCondition(ctx core.RequestContext, cond interface{}, newVals utils.StringMap, create bool) error {
+	if svc.bypass(ctx) {
+		return nil
+	}
+	var items []core.Storable
+	if cond != nil {
+		var err error
+		if items, _, _, _, err = svc.PluginDataComponent.Get(ctx, nil, cond, -1, 1, "", nil, ""); err != nil {
+			return err
+		}
+	}
+	if len(items) == 0 && create {
+		return svc.checkCreated(ctx, "", newVals)
+	}
+	for _, item := range items {
+		if err := svc.checkUpdated(ctx, item, newVals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnrestricted fails unless the request may touch every record for op.
+func (svc *RowSecurityPlugin) checkUnrestricted(ctx core.RequestContext, op core.RowOperation) error {
+	predicate, _, err := svc.policy(ctx, op)
+	if err != nil {
+		return err
+	}
+	if predicate != nil {
+		return errors.Unauthorized(ctx, slog.String("Object", svc.GetObject()), slog.String("Operation", string(op)))
+	}
+	return nil
+}
+
+func (svc *RowSecurityPlugin) CreateCondition(ctx core.RequestContext, args utils.StringMap) (interface{}, error) {
+	return svc.CreateQueryCondition(ctx, NewEqualityQuery(args), nil)
+}
+
+func (svc *RowSecurityPlugin) CreateQueryCondition(ctx core.RequestContext, query *Query, params utils.StringsMap) (interface{}, error) {
+	cond, err := svc.PluginDataComponent.CreateQueryCondition(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	return &rowCondition{query: query, params: params, cond: cond}, nil
+}
+
+func (svc *RowSecurityPlugin) CompileQuery(ctx core.ServerContext, query *Query) (interface{}, error) {
+	compiled, err := svc.PluginDataComponent.CompileQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &rowQuery{query: query, compiled: compiled}, nil
+}
+
+func (svc *RowSecurityPlugin) BindQuery(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (interface{}, error) {
+	rq, ok := compiled.(*rowQuery)
+	if !ok {
+		return nil, errors.BadArg(ctx, "compiled", slog.String("Object", svc.GetObject()))
+	}
+	cond, err := svc.PluginDataComponent.BindQuery(ctx, rq.compiled, params)
+	if err != nil {
+		return nil, err
+	}
+	return &rowCondition{query: rq.query, params: params, cond: cond}, nil
+}
+
+// Query runs a compiled query restricted to the records the request may read. A restricted query
+// is compiled again for every request, as its policy is bound from the request.
+func (svc *RowSecurityPlugin) Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*QueryPage, error) {
+	rq, ok := compiled.(*rowQuery)
+	if !ok {
+		return nil, errors.BadArg(ctx, "compiled", slog.String("Object", svc.GetObject()))
+	}
+	predicate, policyParams, err := svc.policy(ctx, core.RowRead)
+	if err != nil {
+		return nil, err
+	}
+	if predicate == nil {
+		return svc.PluginDataComponent.Query(ctx, rq.compiled, params)
+	}
+	query, merged := restrict(rq.query, params, predicate, policyParams)
+	restricted, err := svc.PluginDataComponent.CompileQuery(ctx.ServerContext(), query)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.Query(ctx, restricted, merged)
+}
+
+func (svc *RowSecurityPlugin) Get(ctx core.RequestContext, props []string, queryCond interface{}, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowRead, false)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	return svc.PluginDataComponent.Get(ctx, props, cond, pageSize, pageNum, mode, orderBy, dao)
+}
+
+func (svc *RowSecurityPlugin) GetList(ctx core.RequestContext, props []string, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	if svc.bypass(ctx) {
+		return svc.PluginDataComponent.GetList(ctx, props, pageSize, pageNum, mode, orderBy, dao)
+	}
+	cond, err := svc.secure(ctx, nil, core.RowRead, true)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	if cond == nil {
+		return svc.PluginDataComponent.GetList(ctx, props, pageSize, pageNum, mode, orderBy, dao)
+	}
+	return svc.PluginDataComponent.Get(ctx, props, cond, pageSize, pageNum, mode, orderBy, dao)
+}
+
+func (svc *RowSecurityPlugin) GetOne(ctx core.RequestContext, props []string, queryCond interface{}, dao string) (core.Storable, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowRead, false)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.GetOne(ctx, props, cond, dao)
+}
+
+func (svc *RowSecurityPlugin) Count(ctx core.RequestContext, queryCond interface{}) (int, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowRead, false)
+	if err != nil {
+		return -1, err
+	}
+	return svc.PluginDataComponent.Count(ctx, cond)
+}
+
+func (svc *RowSecurityPlugin) CountGroups(ctx core.RequestContext, queryCond interface{}, groupids []string, group string) (utils.StringMap, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowRead, false)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.CountGroups(ctx, cond, groupids, group)
+}
+
+func (svc *RowSecurityPlugin) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (StorableIterator, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowRead, true)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.Iterate(ctx, props, cond, orderBy, batchSize)
+}
+
+func (svc *RowSecurityPlugin) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]VectorResult, error) {
+	cond, err := svc.secure(ctx, filter, core.RowRead, true)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.VectorSearch(ctx, vector, limit, cond)
+}
+
+// GetById does not find a record the request may not read.
+func (svc *RowSecurityPlugin) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	item, err := svc.PluginDataComponent.GetById(ctx, id, dao)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := svc.permits(ctx, item, core.RowRead)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.NotFound(ctx, svc.GetObject(), slog.String("Id", id))
+	}
+	return item, nil
+}
+
+func (svc *RowSecurityPlugin) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	items, err := svc.PluginDataComponent.GetMulti(ctx, props, ids, orderBy, dao)
+	if err != nil {
+		return nil, err
+	}
+	permitted := items[:0]
+	for _, item := range items {
+		ok, err := svc.permits(ctx, item, core.RowRead)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			permitted = append(permitted, item)
+		}
+	}
+	return permitted, nil
+}
+
+func (svc *RowSecurityPlugin) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	items, err := svc.PluginDataComponent.GetMultiHash(ctx, props, ids, dao)
+	if err != nil {
+		return nil, err
+	}
+	for id, item := range items {
+		ok, err := svc.permits(ctx, item, core.RowRead)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			delete(items, id)
+		}
+	}
+	return items, nil
+}
+
+// GetAsOf does not find a revision the request may not read.
+func (svc *RowSecurityPlugin) GetAsOf(ctx core.RequestContext, id string, at time.Time) (core.Storable, error) {
+	item, err := svc.PluginDataComponent.GetAsOf(ctx, id, at)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := svc.permits(ctx, item, core.RowRead)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.NotFound(ctx, svc.GetObject(), slog.String("Id", id))
+	}
+	return item, nil
+}
+
+// GetRevisions leaves out the revisions the request may not read.
+func (svc *RowSecurityPlugin) GetRevisions(ctx core.RequestContext, id string) ([]Revision, error) {
+	revs, err := svc.PluginDataComponent.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	permitted := revs[:0]
+	for _, rev := range revs {
+		ok, err := svc.permits(ctx, rev.Item, core.RowRead)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			permitted = append(permitted, rev)
+		}
+	}
+	return permitted, nil
+}
+
+func (svc *RowSecurityPlugin) ListDeleted(ctx core.RequestContext, props []string, pageSize int, pageNum int, orderBy []string) ([]core.Storable, []string, int, int, error) {
+	if err := svc.checkUnrestricted(ctx, core.RowRead); err != nil {
+		return nil, nil, -1, -1, err
+	}
+	return svc.PluginDataComponent.ListDeleted(ctx, props, pageSize, pageNum, orderBy)
+}
+
+func (svc *RowSecurityPlugin) Restore(ctx core.RequestContext, ids []string) error {
+	if err := svc.checkUnrestricted(ctx, core.RowWrite); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.Restore(ctx, ids)
+}
+
+func (svc *RowSecurityPlugin) Purge(ctx core.RequestContext, olderThan time.Time) (int, error) {
+	if err := svc.checkUnrestricted(ctx, core.RowWrite); err != nil {
+		return 0, err
+	}
+	return svc.PluginDataComponent.Purge(ctx, olderThan)
+}
+
+func (svc *RowSecurityPlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	if err := svc.checkItems(ctx, []core.Storable{item}); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.Save(ctx, item)
+}
+
+func (svc *RowSecurityPlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	if item != nil {
+		item.SetId(id)
+	}
+	if err := svc.checkItems(ctx, []core.Storable{item}); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.Put(ctx, id, item)
+}
+
+func (svc *RowSecurityPlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	if err := svc.checkItems(ctx, items); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.PutMulti(ctx, items)
+}
+
+func (svc *RowSecurityPlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	if err := svc.checkItems(ctx, items); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.CreateMulti(ctx, items)
+}
+
+// checkItems fails unless the policies permit the request to write items, and the records they
+// replace.
+func (svc *RowSecurityPlugin) checkItems(ctx core.RequestContext, items []core.Storable) error {
+	if svc.bypass(ctx) {
+		return nil
+	}
+	if err := svc.check(ctx, items...); err != nil {
+		return err
+	}
+	var ids []string
+	for _, item := range items {
+		if item != nil && item.GetId() != "" {
+			ids = append(ids, item.GetId())
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := svc.checkStored(ctx, ids)
+	return err
+}
+
+func (svc *RowSecurityPlugin) AddToArray(ctx core.RequestContext, id string, fieldName string, item interface{}) error {
+	if _, err := svc.checkStored(ctx, []string{id}); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.AddToArray(ctx, id, fieldName, item)
+}
+
+func (svc *RowSecurityPlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	if err := svc.checkUpdate(ctx, []string{id}, newVals, true); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.UpsertId(ctx, id, newVals)
+}
+
+func (svc *RowSecurityPlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	if err := svc.checkUpdate(ctx, []string{id}, newVals, false); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.Update(ctx, id, newVals)
+}
+
+func (svc *RowSecurityPlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	if err := svc.checkUpdate(ctx, ids, newVals, false); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.UpdateMulti(ctx, ids, newVals)
+}
+
+func (svc *RowSecurityPlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowWrite, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.checkCondition(ctx, cond, newVals, true); err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.Upsert(ctx, cond, newVals, getids)
+}
+
+func (svc *RowSecurityPlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowWrite, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.checkCondition(ctx, cond, newVals, false); err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.UpdateAll(ctx, cond, newVals, getids)
+}
+
+func (svc *RowSecurityPlugin) Delete(ctx core.RequestContext, id string) error {
+	if _, err := svc.checkStored(ctx, []string{id}); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.Delete(ctx, id)
+}
+
+func (svc *RowSecurityPlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	if _, err := svc.checkStored(ctx, ids); err != nil {
+		return err
+	}
+	return svc.PluginDataComponent.DeleteMulti(ctx, ids)
+}
+
+func (svc *RowSecurityPlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	cond, err := svc.secure(ctx, queryCond, core.RowWrite, false)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PluginDataComponent.DeleteAll(ctx, cond, getids)
+}
@@ -0,0 +1,260 @@
+package data_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// roleUser is a user holding roles, as an rbac user does.
+type roleUser struct {
+	datatest.User
+	roles []data.StorableRef
+}
+
+func (u *roleUser) GetRoles() ([]data.StorableRef, error) { return u.roles, nil }
+
+// securedWidgets are widgets a1 and a2 owned by alice, b1 owned by bob and pub, which everyone
+// may read, stored through a row security plugin.
+type securedWidgets struct {
+	svc                  *data.RowSecurityPlugin
+	base                 data.DataComponent
+	objects              *datatest.ObjectFactory
+	server               *datatest.ServerContext
+	system, alice, admin core.RequestContext
+}
+
+// widgetPolicies let the owner named by a widget's Colour touch it, everyone read widgets of size 10
+// and more, and admins touch every widget.
+func widgetPolicies() []core.RowPolicy {
+	owned := data.NewQuery()
+	owned.Filter = &data.Comparison{Field: "Colour", Operator: data.OpEqual, Value: data.ParameterOperand(data.RLS_PARAM_USER)}
+	public := data.NewQuery()
+	public.Filter = &data.Comparison{Field: "Size", Operator: data.OpGreaterEqual, Value: data.LiteralOperand(10)}
+	return []core.RowPolicy{
+		{Name: "owner", Filter: owned},
+		{Name: "public", Operations: []core.RowOperation{core.RowRead}, Filter: public},
+		{Name: "admin", Roles: []string{"admin"}},
+	}
+}
+
+// newSecuredWidgets stores the widgets through a plugin enforcing the policies the entity declares,
+// or, when toPlugin is set, the policies given to the plugin over an entity declaring none.
+func newSecuredWidgets(t *testing.T, toPlugin bool) *securedWidgets {
+	t.Helper()
+	conf := core.StorableConfig{RowPolicies: widgetPolicies(), SoftDelete: true}
+	if toPlugin {
+		conf.RowPolicies = nil
+	}
+	base, objects, _ := newWidgets(t, conf)
+	w := &securedWidgets{base: base, objects: objects, server: datatest.NewServerContext()}
+	if toPlugin {
+		w.svc = data.NewRowSecurityPluginWithBase(w.server, base, widgetPolicies()...)
+	} else {
+		w.svc = data.NewRowSecurityPluginWithBase(w.server, base)
+	}
+	w.system = core.NewSystemRequest(w.server, "Seed", nil, nil, nil)
+	w.alice = datatest.NewRequestContext(w.server, "alice", "")
+	admin := datatest.NewRequestContext(w.server, "root", "")
+	admin.User = &roleUser{User: datatest.User{Id: "root"}, roles: []data.StorableRef{{Name: "admin"}}}
+	w.admin = admin
+	for _, item := range []*datatest.Record{w.widget("a1", 1, "alice"), w.widget("a2", 2, "alice"), w.widget("b1", 3, "bob"), w.widget("pub", 10, "bob")} {
+		if err := w.svc.Save(w.system, item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	return w
+}
+
+func (w *securedWidgets) widget(name string, size int, owner string) *datatest.Record {
+	item := w.objects.NewRecord(name, size)
+	item.Colour = &owner
+	return item
+}
+
+// names lists the names of the widgets c reads through the plugin.
+func (w *securedWidgets) names(t *testing.T, c core.RequestContext) string {
+	t.Helper()
+	cond, err := w.svc.CreateQueryCondition(c, data.NewQuery(), nil)
+	if err != nil {
+		t.Fatalf("CreateQueryCondition: %v", err)
+	}
+	items, _, _, _, err := w.svc.Get(c, nil, cond, -1, 1, "", []string{"Name"}, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got := make([]string, len(items))
+	for i, item := range items {
+		got[i] = item.(*datatest.Record).Name
+	}
+	return strings.Join(got, ", ")
+}
+
+func (w *securedWidgets) idOf(t *testing.T, name string) string {
+	t.Helper()
+	cond, _ := w.base.CreateCondition(w.system, utils.StringMap{"Name": name})
+	item, err := w.base.GetOne(w.system, nil, cond, "")
+	if err != nil {
+		t.Fatalf("GetOne %s: %v", name, err)
+	}
+	return item.GetId()
+}
+
+func TestRowSecurityPlugin(t *testing.T) {
+	// the policies are enforced alike whether the entity declares them or they are given to the
+	// plugin over an entity that declares none
+	for _, tc := range []struct {
+		name     string
+		toPlugin bool
+	}{
+		{"reads", false},
+		{"reads by policies given to the plugin", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newSecuredWidgets(t, tc.toPlugin)
+			if got := w.names(t, w.alice); got != "a1, a2, pub" {
+				t.Errorf("alice reads %s", got)
+			}
+			if got := w.names(t, w.admin); got != "a1, a2, b1, pub" {
+				t.Errorf("admin reads %s", got)
+			}
+			if got := w.names(t, w.system); got != "a1, a2, b1, pub" {
+				t.Errorf("a system request reads %s", got)
+			}
+			cond, _ := w.svc.CreateCondition(w.alice, utils.StringMap{"Size": 3})
+			if n, err := w.svc.Count(w.alice, cond); err != nil || n != 0 {
+				t.Errorf("alice counts bob's widget: %d %v", n, err)
+			}
+			if _, err := w.svc.GetById(w.alice, w.idOf(t, "b1"), ""); !errors.IsNotFound(err) {
+				t.Errorf("GetById of bob's widget: want not found, got %v", err)
+			}
+			if _, err := w.svc.GetById(w.alice, w.idOf(t, "pub"), ""); err != nil {
+				t.Errorf("GetById of a public widget: %v", err)
+			}
+			if err := w.svc.Update(w.alice, w.idOf(t, "b1"), utils.StringMap{"Size": 4}); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+				t.Errorf("updating bob's widget: want unauthorized, got %v", err)
+			}
+		})
+	}
+
+	t.Run("conditions of the data service", func(t *testing.T) {
+		w := newSecuredWidgets(t, false)
+		raw, _ := w.base.CreateQueryCondition(w.alice, data.NewQuery(), nil)
+		if _, _, _, _, err := w.svc.Get(w.alice, nil, raw, -1, 1, "", nil, ""); err == nil {
+			t.Errorf("a condition of the data service underneath was accepted")
+		}
+	})
+
+	// writes are limited to alice's own widgets, and cannot give one away
+	t.Run("writes", func(t *testing.T) {
+		w := newSecuredWidgets(t, false)
+		all, _ := w.svc.CreateQueryCondition(w.alice, data.NewQuery(), nil)
+		ids, err := w.svc.UpdateAll(w.alice, all, utils.StringMap{"Size": 5}, true)
+		if err != nil || len(ids) != 2 {
+			t.Fatalf("UpdateAll: %v %v", ids, err)
+		}
+		if item, _ := w.svc.GetById(w.system, w.idOf(t, "pub"), ""); item.(*datatest.Record).Size != 10 {
+			t.Errorf("alice updated a widget she may only read")
+		}
+		if err = w.svc.Update(w.alice, w.idOf(t, "a1"), utils.StringMap{"Colour": "bob"}); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("giving a widget away: want unauthorized, got %v", err)
+		}
+		if err = w.svc.Save(w.alice, w.widget("forged", 1, "bob")); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("saving a widget for bob: want unauthorized, got %v", err)
+		}
+		if err = w.svc.Save(w.alice, w.widget("a3", 1, "alice")); err != nil {
+			t.Errorf("saving her own widget: %v", err)
+		}
+		if err = w.svc.UpsertId(w.alice, "forged-id", utils.StringMap{"Name": "forged", "Colour": "bob"}); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("upserting a new widget for bob: want unauthorized, got %v", err)
+		}
+		bobs, _ := w.svc.CreateCondition(w.alice, utils.StringMap{"Name": "b1"})
+		if _, err = w.svc.Upsert(w.alice, bobs, utils.StringMap{"Name": "b1", "Colour": "bob"}, true); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("upserting over bob's widget: want unauthorized, got %v", err)
+		}
+		if got := w.names(t, w.system); got != "a1, a2, a3, b1, pub" {
+			t.Errorf("after the forged upserts: %s", got)
+		}
+		if ids, err = w.svc.DeleteAll(w.alice, all, true); err != nil || len(ids) != 3 {
+			t.Errorf("DeleteAll: %v %v", ids, err)
+		}
+		if got := w.names(t, w.system); got != "b1, pub" {
+			t.Errorf("left after alice's delete: %s", got)
+		}
+	})
+
+	// a request made by no user that is not the system's is held to the policies not bound to a user
+	t.Run("requests without a user", func(t *testing.T) {
+		w := newSecuredWidgets(t, false)
+		anonymous := datatest.NewRequestContext(w.server, "", "")
+		anonymous.User = nil
+		if got := w.names(t, anonymous); got != "pub" {
+			t.Errorf("a request made by no user reads %s", got)
+		}
+		if got := w.names(t, w.server.CreateSystemRequest("Seed", nil, nil, nil)); got != "pub" {
+			t.Errorf("a system request the server did not mark reads %s", got)
+		}
+		if err := w.svc.Save(anonymous, w.widget("anon", 1, "")); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("saving without a user: want unauthorized, got %v", err)
+		}
+	})
+
+	// the trash holds records of every owner, so only a request permitted them all may use it
+	t.Run("trash", func(t *testing.T) {
+		w := newSecuredWidgets(t, false)
+		ids := []string{w.idOf(t, "a1"), w.idOf(t, "b1")}
+		if err := w.svc.DeleteMulti(w.system, ids); err != nil {
+			t.Fatalf("DeleteMulti: %v", err)
+		}
+		if _, _, _, _, err := w.svc.ListDeleted(w.alice, nil, -1, 1, nil); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("alice listing the trash: want unauthorized, got %v", err)
+		}
+		if err := w.svc.Restore(w.alice, ids[:1]); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("alice restoring from the trash: want unauthorized, got %v", err)
+		}
+		if _, err := w.svc.Purge(w.alice, time.Now()); !errors.HasErrorCode(err, errors.CORE_ERROR_UNAUTHORIZED) {
+			t.Errorf("alice purging the trash: want unauthorized, got %v", err)
+		}
+		if _, _, _, _, err := w.svc.ListDeleted(w.admin, nil, -1, 1, nil); err != nil {
+			t.Errorf("admin listing the trash: %v", err)
+		}
+		if _, err := w.svc.Purge(w.admin, time.Now()); err != nil {
+			t.Errorf("admin purging the trash: %v", err)
+		}
+	})
+
+	// a store returning its trash read by id leaves the plugin to hold the records it returns to
+	// the read policies too
+	t.Run("a store that shows its trash", func(t *testing.T) {
+		base, objects, _ := newWidgets(t, core.StorableConfig{RowPolicies: widgetPolicies(), SoftDelete: true})
+		server := datatest.NewServerContext()
+		svc := data.NewRowSecurityPluginWithBase(server, &showingDeleted{base})
+		system := core.NewSystemRequest(server, "Seed", nil, nil, nil)
+		var ids []string
+		for _, owner := range []string{"alice", "bob"} {
+			item := objects.NewRecord(owner, 1)
+			item.Colour = &owner
+			if err := svc.Save(system, item); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			ids = append(ids, item.GetId())
+		}
+		if err := svc.DeleteMulti(system, ids); err != nil {
+			t.Fatalf("DeleteMulti: %v", err)
+		}
+		alice := datatest.NewRequestContext(server, "alice", "")
+		found, err := svc.GetMultiHash(alice, nil, ids, "")
+		if err != nil {
+			t.Fatalf("GetMultiHash: %v", err)
+		}
+		if _, ok := found[ids[1]]; ok || len(found) != 1 {
+			t.Errorf("alice read %d records of the trash, bob's among them: %v", len(found), ok)
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package data
 
 import (
+	"time"
+
 	"laatoo.io/sdk/ctx"
 	"laatoo.io/sdk/datatypes"
 )
@@ -18,14 +20,31 @@ import (
 // schemaless stores, with no error anywhere.
 const FIELD_SOFTDELETE = "Deleted"
 
+// FIELD_DELETEDAT and FIELD_DELETEDBY are the stored names of when and by whom a record was soft
+// deleted, fixed by DeletionInfo's struct tags as FIELD_SOFTDELETE is. A restore clears them.
+const (
+	FIELD_DELETEDAT = "DeletedAt"
+	FIELD_DELETEDBY = "DeletedBy"
+)
+
 // Object stored by data service
 type SoftDeletable interface {
 	IsDeleted() bool
 	SetDeleted(deleted bool)
 }
 
+// DeletionTracked is a SoftDeletable that records when and by whom it was deleted. DeletionInfo
+// implements it.
+type DeletionTracked interface {
+	SoftDeletable
+	GetDeletedAt() time.Time
+	GetDeletedBy() string
+}
+
 type DeletionInfo struct {
-	Deleted bool `json:"Deleted" bson:"Deleted" protobuf:"bytes,52,opt,name=deleted,proto3"`
+	Deleted   bool      `json:"Deleted" bson:"Deleted" protobuf:"bytes,52,opt,name=deleted,proto3"`
+	DeletedAt time.Time `json:"DeletedAt" bson:"DeletedAt" protobuf:"bytes,75,opt,name=deletedat,proto3" gorm:"column:DeletedAt"`
+	DeletedBy string    `json:"DeletedBy" bson:"DeletedBy" protobuf:"bytes,76,opt,name=deletedby,proto3" gorm:"column:DeletedBy"`
 }
 
 func (di *DeletionInfo) IsDeleted() bool {
@@ -35,11 +54,25 @@ func (di *DeletionInfo) IsDeleted() bool {
 func (di *DeletionInfo) SetDeleted(deleted bool) {
 	di.Deleted = deleted
 }
+
+func (di *DeletionInfo) GetDeletedAt() time.Time {
+	return di.DeletedAt
+}
+
+func (di *DeletionInfo) GetDeletedBy() string {
+	return di.DeletedBy
+}
 func (di *DeletionInfo) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatypes.SerializableReader) error {
 	var err error
 	if err = rdr.ReadBool(c, cdc, FIELD_SOFTDELETE, &di.Deleted); err != nil {
 		return err
 	}
+	if err = rdr.ReadTime(c, cdc, FIELD_DELETEDAT, &di.DeletedAt); err != nil {
+		return err
+	}
+	if err = rdr.ReadString(c, cdc, FIELD_DELETEDBY, &di.DeletedBy); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -48,5 +81,11 @@ func (di *DeletionInfo) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr datatyp
 	if err = wtr.WriteBool(c, cdc, FIELD_SOFTDELETE, &di.Deleted); err != nil {
 		return err
 	}
+	if err = wtr.WriteTime(c, cdc, FIELD_DELETEDAT, &di.DeletedAt); err != nil {
+		return err
+	}
+	if err = wtr.WriteString(c, cdc, FIELD_DELETEDBY, &di.DeletedBy); err != nil {
+		return err
+	}
 	return nil
 }
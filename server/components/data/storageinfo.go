@@ -40,6 +40,8 @@ SerializableBase=71
 collection=72
 tenantname=73
 version=74
+deletedat=75
+deletedby=76
 */
 
 type StorageInfo struct {
@@ -79,6 +81,10 @@ func (si *StorageInfo) GetVersion() string {
 	return si.Version
 }
 
+func (si *StorageInfo) SetVersion(val string) {
+	si.Version = val
+}
+
 func (si *StorageInfo) PreSave(ctx ctx.Context) error {
 	return nil
 }
@@ -119,6 +125,9 @@ func (si *StorageInfo) ReadAll(c ctx.Context, cdc datatypes.Codec, rdr datatypes
 	if err = rdr.ReadString(c, cdc, "Id", &si.Id); err != nil {
 		return err
 	}
+	if err = rdr.ReadString(c, cdc, FIELD_VERSION, &si.Version); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -127,13 +136,20 @@ func (si *StorageInfo) WriteAll(c ctx.Context, cdc datatypes.Codec, wtr datatype
 	if err = wtr.WriteString(c, cdc, "Id", &si.Id); err != nil {
 		return err
 	}
+	// the version is written only once a record has one, so the serialized form of an entity
+	// that is neither Versioned nor Temporal is what it was before versions were kept
+	if si.Version != "" {
+		if err = wtr.WriteString(c, cdc, FIELD_VERSION, &si.Version); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 type StorableRef struct {
-	Id      string   `json:"Id" bson:"Id" protobuf:"bytes,51,opt,name=id,proto3" sql:"type:varchar(100);`
-	Type    string   `json:"Type" bson:"Type" protobuf:"bytes,59,opt,name=type,proto3" sql:"type:varchar(100);`
-	Name    string   `json:"Name" bson:"Name" protobuf:"bytes,60,opt,name=name,proto3" sql:"type:varchar(300);`
+	Id      string   `json:"Id" bson:"Id" protobuf:"bytes,51,opt,name=id,proto3" sql:"type:varchar(100);"`
+	Type    string   `json:"Type" bson:"Type" protobuf:"bytes,59,opt,name=type,proto3" sql:"type:varchar(100);"`
+	Name    string   `json:"Name" bson:"Name" protobuf:"bytes,60,opt,name=name,proto3" sql:"type:varchar(300);"`
 	Version string   `json:"Version" bson:"Version" protobuf:"bytes,74,opt,name=version,proto3" sql:"type:varchar(50);" `
 	Entity  core.Storable `json:"-" datastore:"-" bson:"-" sql:"-" firestore:"-" protobuf:"group,64,opt,name=Entity,proto3"`
 }
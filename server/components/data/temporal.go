@@ -0,0 +1,22 @@
+package data
+
+import (
+	"time"
+
+	"laatoo.io/sdk/server/core"
+)
+
+// Revision is one stored state of a record of a Temporal object.
+type Revision struct {
+	// Version is the record's version in this state.
+	Version string
+	// At is when the write that produced this state was made.
+	At time.Time
+	// Deleted marks the state a delete left: the record no longer existed from At, and Item is the
+	// record as it was before it.
+	Deleted bool
+	// Purged marks the state a purge left: the soft-deleted record was removed for good at At.
+	// Item is the record as it was before it, and Deleted is set too.
+	Purged bool
+	Item   core.Storable
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/utils"
+)
+
+// The fields a Multitenant entity stores its tenant in.
+const (
+	FIELD_TENANTID   = "TenantId"
+	FIELD_TENANTNAME = "TenantName"
+)
+
+// TENANT_PARAM is the parameter the tenant predicate of a scoped query is bound with.
+const TENANT_PARAM = "tenant_scope"
+
+// TenantStrategy is how the records of different tenants are kept apart.
+type TenantStrategy string
+
+const (
+	// TenantShared keeps every tenant's records in one collection, told apart by their TenantId.
+	TenantShared TenantStrategy = "shared"
+	// TenantCollection keeps each tenant's records in a collection of its own.
+	TenantCollection TenantStrategy = "collection"
+	// TenantDatabase keeps each tenant's records in a database of its own.
+	TenantDatabase TenantStrategy = "database"
+)
+
+// TenantRouter is implemented by a data component that can keep each tenant's records apart from
+// the others' in storage of their own.
+type TenantRouter interface {
+	// ForTenant returns a component of the same object storing the records of tenant as strategy
+	// keeps them, with its collection created when the component's is. It is called once for
+	// each tenant, and the component returned is kept.
+	ForTenant(ctx core.ServerContext, tenant string, strategy TenantStrategy) (DataComponent, error)
+}
+
+// ScopeQuery returns query with its filter limited to the records of the tenant bound to
+// TENANT_PARAM. The tenant predicate is not optional, so a query bound without a tenant fails
+// rather than reaching every tenant's records.
+func ScopeQuery(query *Query) *Query {
+	predicate := &Comparison{Field: FIELD_TENANTID, Operator: OpEqual, Value: ParameterOperand(TENANT_PARAM)}
+	if query == nil {
+		query = NewQuery()
+	}
+	scoped := *query
+	if scoped.Filter == nil {
+		scoped.Filter = predicate
+	} else {
+		scoped.Filter = &Logical{Operator: LogicalAnd, Operands: []Predicate{query.Filter, predicate}}
+	}
+	return &scoped
+}
+
+// ScopeParams returns params with tenant bound to TENANT_PARAM, or params as they are when tenant
+// is empty.
+func ScopeParams(params utils.StringsMap, tenant string) utils.StringsMap {
+	if tenant == "" {
+		return params
+	}
+	scoped := make(utils.StringsMap, len(params)+1)
+	for name, val := range params {
+		scoped[name] = val
+	}
+	scoped[TENANT_PARAM] = tenant
+	return scoped
+}
+
+// tenantOfItem returns the tenant a record is stamped with, and false when it is not Multitenant.
+func tenantOfItem(item core.Storable) (string, bool) {
+	mt, ok := item.(Multitenant)
+	if !ok {
+		return "", false
+	}
+	return mt.GetTenantId(), true
+}
@@ -0,0 +1,886 @@
+package data
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"laatoo.io/sdk/config"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// CONF_DATA_TENANT_STRATEGY is how a TenantScopePlugin keeps tenants' records apart: shared,
+// collection or database.
+const CONF_DATA_TENANT_STRATEGY = "tenantstrategy"
+
+var _ DataComponent = (*TenantScopePlugin)(nil)
+
+/*
+TenantScopePlugin keeps the records of a Multitenant entity's tenants apart, so that neither the
+data service underneath nor its callers have to filter by tenant. Every request is scoped to the
+tenant it carries.
+
+Records written are stamped with the request's TenantId and TenantName, and writing a record
+stamped with another tenant, or changing a record's tenant, fails with CORE_ERROR_TENANT_MISMATCH.
+Every condition and compiled query made through the plugin is limited to the request's tenant by
+a predicate on TenantId, bound from the request when it is used. A condition keeps the tenant it
+was made for, and using it for another fails with CORE_ERROR_TENANT_MISMATCH; a condition or a
+compiled query not made through the plugin is refused. A record of another
+tenant read by id fails with CORE_ERROR_TENANT_MISMATCH too, and so does a write by id to one; a
+read of several ids leaves such records out.
+
+With the shared strategy every tenant's records are kept in the service underneath. With the
+collection or database strategy each tenant's are kept apart in a component the service creates
+for it as a TenantRouter, and requests are routed to their tenant's. The trash takes no condition,
+so in shared storage the plugin reads it whole and keeps tenants apart itself: ListDeleted lists
+the request's tenant's records, Restore fails with CORE_ERROR_TENANT_MISMATCH for another's, and
+Purge purges only the records deleted before the earliest deletion of another tenant's record,
+leaving the rest to a later purge.
+
+A system request, one marked by core.NewSystemRequest, is not scoped when it carries no tenant: it
+reaches every tenant's records in shared storage, and the service underneath otherwise. Any other
+request that carries no tenant is refused, whether or not it is made by a user. An entity that is
+not Multitenant is not scoped at all.
+*/
+type TenantScopePlugin struct {
+	DataPlugin
+	Strategy      TenantStrategy
+	multitenant   bool
+	mu            sync.Mutex
+	tenants       map[string]DataComponent
+	subscriptions []tenantSubscription
+}
+
+// tenantCondition is a condition made through the plugin, and the tenant it is scoped to, which is
+// empty for a system request's that is not scoped.
+type tenantCondition struct {
+	tenant string
+	cond   interface{}
+}
+
+// tenantQuery is a query compiled through the plugin. It is compiled limited to the tenant bound
+// to TENANT_PARAM, and compiled as it is the first time a system request that is not scoped runs
+// it.
+type tenantQuery struct {
+	query    *Query
+	scoped   interface{}
+	once     sync.Once
+	unscoped interface{}
+	err      error
+}
+
+// tenantSubscription is a subscription made through the plugin, made again on every tenant's
+// component as it is created.
+type tenantSubscription struct {
+	ctx       core.RequestContext
+	obj       string
+	eventType DataEventType
+	handler   core.MessageListener
+}
+
+func NewTenantScopePlugin(ctx core.ServerContext) *TenantScopePlugin {
+	return &TenantScopePlugin{}
+}
+
+// NewTenantScopePluginWithBase creates a plugin over comp keeping tenants' records apart as
+// strategy does.
+func NewTenantScopePluginWithBase(ctx core.ServerContext, comp DataComponent, strategy TenantStrategy) *TenantScopePlugin {
+	svc := &TenantScopePlugin{DataPlugin: DataPlugin{PluginDataComponent: comp}, Strategy: strategy}
+	svc.multitenant = isMultitenant(ctx, comp)
+	return svc
+}
+
+func (svc *TenantScopePlugin) Describe(ctx core.ServerContext) error {
+	if err := svc.DataPlugin.Describe(ctx); err != nil {
+		return err
+	}
+	if svc.Strategy == "" {
+		svc.AddStringConfiguration(ctx, CONF_DATA_TENANT_STRATEGY, "How tenants' records are kept apart: shared, collection or database", string(TenantShared))
+	}
+	return nil
+}
+
+func (svc *TenantScopePlugin) Initialize(ctx core.ServerContext, conf config.Config) error {
+	if err := svc.DataPlugin.Initialize(ctx, conf); err != nil {
+		return err
+	}
+	if svc.Strategy == "" {
+		strategy, _ := svc.GetStringConfiguration(ctx, CONF_DATA_TENANT_STRATEGY)
+		svc.Strategy = TenantStrategy(strategy)
+	}
+	switch svc.Strategy {
+	case "":
+		svc.Strategy = TenantShared
+	case TenantShared:
+	case TenantCollection, TenantDatabase:
+		if _, ok := svc.PluginDataComponent.(TenantRouter); !ok {
+			return errors.BadConf(ctx, CONF_DATA_TENANT_STRATEGY, slog.String("Strategy", string(svc.Strategy)))
+		}
+	default:
+		return errors.BadConf(ctx, CONF_DATA_TENANT_STRATEGY, slog.String("Strategy", string(svc.Strategy)))
+	}
+	svc.multitenant = isMultitenant(ctx, svc.PluginDataComponent)
+	return nil
+}
+
+// isMultitenant reports whether comp stores an entity configured as Multitenant.
+func isMultitenant(ctx core.ServerContext, comp DataComponent) bool {
+	factory := comp.GetObjectFactory()
+	if factory == nil {
+		return false
+	}
+	stor, ok := factory.CreateObject(ctx).(core.Storable)
+	return ok && stor.Config() != nil && stor.Config().Multitenant
+}
+
+// scope returns the component the request is routed to and the id of the tenant it is scoped to,
+// which is empty when it is not scoped.
+func (svc *TenantScopePlugin) scope(ctx core.RequestContext) (DataComponent, string, error) {
+	if !svc.multitenant {
+		return svc.PluginDataComponent, "", nil
+	}
+	tenant := ctx.GetTenant()
+	if tenant == nil || tenant.GetTenantId() == "" {
+		if core.IsSystemRequest(ctx) {
+			return svc.PluginDataComponent, "", nil
+		}
+		return nil, "", errors.TenantMismatch(ctx, svc.GetObject())
+	}
+	if svc.Strategy == "" || svc.Strategy == TenantShared {
+		return svc.PluginDataComponent, tenant.GetTenantId(), nil
+	}
+	comp, err := svc.forTenant(ctx.ServerContext(), tenant.GetTenantId())
+	return comp, tenant.GetTenantId(), err
+}
+
+// forTenant returns the component keeping the records of tenant, creating it the first time.
+func (svc *TenantScopePlugin) forTenant(ctx core.ServerContext, tenant string) (DataComponent, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if comp, ok := svc.tenants[tenant]; ok {
+		return comp, nil
+	}
+	router, ok := svc.PluginDataComponent.(TenantRouter)
+	if !ok {
+		return nil, errors.BadConf(ctx, CONF_DATA_TENANT_STRATEGY, slog.String("Strategy", string(svc.Strategy)))
+	}
+	comp, err := router.ForTenant(ctx, tenant, svc.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range svc.subscriptions {
+		if err = comp.Subscribe(sub.ctx, sub.obj, sub.eventType, sub.handler); err != nil {
+			return nil, err
+		}
+	}
+	if svc.tenants == nil {
+		svc.tenants = make(map[string]DataComponent)
+	}
+	svc.tenants[tenant] = comp
+	return comp, nil
+}
+
+// shared reports whether records of other tenants are kept with those of the request's.
+func (svc *TenantScopePlugin) shared(tenant string) bool {
+	return tenant != "" && (svc.Strategy == "" || svc.Strategy == TenantShared)
+}
+
+// stamp stamps items with the request's tenant, failing for an item stamped with another.
+func (svc *TenantScopePlugin) stamp(ctx core.RequestContext, tenant string, items []core.Storable) error {
+	if tenant == "" {
+		return nil
+	}
+	info := ctx.GetTenant()
+	for _, item := range items {
+		mt, ok := item.(Multitenant)
+		if !ok {
+			continue
+		}
+		if stamped := mt.GetTenantId(); stamped != "" && stamped != tenant {
+			return errors.TenantMismatch(ctx, svc.GetObject(), slog.String("Id", item.GetId()), slog.String("Tenant", stamped))
+		}
+		mt.SetTenant(tenant, info.GetTenantName())
+	}
+	return nil
+}
+
+// stampValues fails when newVals would move a record to another tenant. When create is set, the
+// values are those of a record that may be created, and are stamped with the request's tenant.
+func (svc *TenantScopePlugin) stampValues(ctx core.RequestContext, tenant string, newVals utils.StringMap, create bool) (utils.StringMap, error) {
+	if tenant == "" {
+		return newVals, nil
+	}
+	if val, ok := newVals[FIELD_TENANTID]; ok && val != tenant {
+		return nil, errors.TenantMismatch(ctx, svc.GetObject(), slog.Any("Tenant", val))
+	}
+	if !create {
+		return newVals, nil
+	}
+	stamped := make(utils.StringMap, len(newVals)+2)
+	for field, val := range newVals {
+		stamped[field] = val
+	}
+	stamped[FIELD_TENANTID] = tenant
+	stamped[FIELD_TENANTNAME] = ctx.GetTenant().GetTenantName()
+	return stamped, nil
+}
+
+// owned fails when a record stored with one of ids belongs to another tenant. Records are read
+// with a system request, so that the service's own scoping does not hide them.
+func (svc *TenantScopePlugin) owned(ctx core.RequestContext, comp DataComponent, tenant string, ids []string) error {
+	if !svc.shared(tenant) || len(ids) == 0 {
+		return nil
+	}
+	system := core.NewSystemRequest(ctx.ServerContext(), "TenantScope", nil, nil, nil)
+	stored, err := comp.GetMultiHash(system, nil, ids, "")
+	if err != nil {
+		return err
+	}
+	for id, item := range stored {
+		if other, ok := tenantOfItem(item); ok && other != tenant {
+			return errors.TenantMismatch(ctx, svc.GetObject(), slog.String("Id", id), slog.String("Tenant", other))
+		}
+	}
+	return nil
+}
+
+// checkItem fails when item belongs to a tenant other than tenant.
+func (svc *TenantScopePlugin) checkItem(ctx core.RequestContext, tenant string, item core.Storable) error {
+	if tenant == "" || item == nil {
+		return nil
+	}
+	if other, ok := tenantOfItem(item); ok && other != tenant {
+		return errors.TenantMismatch(ctx, svc.GetObject(), slog.String("Id", item.GetId()), slog.String("Tenant", other))
+	}
+	return nil
+}
+
+// condition returns the condition of the service underneath for queryCond, failing unless it was
+// made through the plugin for the request's tenant.
+func (svc *TenantScopePlugin) condition(ctx core.RequestContext, tenant string, queryCond interface{}) (interface{}, error) {
+	if !svc.multitenant || queryCond == nil {
+		return queryCond, nil
+	}
+	tc, ok := queryCond.(*tenantCondition)
+	if !ok {
+		return nil, errors.BadArg(ctx, "queryCond", slog.String("Object", svc.GetObject()))
+	}
+	if tc.tenant != tenant {
+		return nil, errors.TenantMismatch(ctx, svc.GetObject(), slog.String("Tenant", tc.tenant))
+	}
+	return tc.cond, nil
+}
+
+// compiledFor returns the query of the service underneath for compiled, as the request's tenant
+// runs it.
+func (svc *TenantScopePlugin) compiledFor(ctx core.RequestContext, tenant string, compiled interface{}) (interface{}, error) {
+	if !svc.multitenant {
+		return compiled, nil
+	}
+	tq, ok := compiled.(*tenantQuery)
+	if !ok {
+		return nil, errors.BadArg(ctx, "compiled", slog.String("Object", svc.GetObject()))
+	}
+	if tenant != "" {
+		return tq.scoped, nil
+	}
+	tq.once.Do(func() {
+		tq.unscoped, tq.err = svc.PluginDataComponent.CompileQuery(ctx.ServerContext(), tq.query)
+	})
+	return tq.unscoped, tq.err
+}
+
+// all returns a condition for every record of the request's tenant.
+func (svc *TenantScopePlugin) all(ctx core.RequestContext, comp DataComponent, tenant string) (interface{}, error) {
+	return comp.CreateQueryCondition(ctx, ScopeQuery(NewQuery()), ScopeParams(nil, tenant))
+}
+
+func (svc *TenantScopePlugin) CreateDBCollection(ctx core.ServerContext) error {
+	return svc.PluginDataComponent.CreateDBCollection(ctx)
+}
+
+// DropDBCollection drops the collection of the service underneath, and of every tenant's
+// component created.
+func (svc *TenantScopePlugin) DropDBCollection(ctx core.ServerContext) error {
+	svc.mu.Lock()
+	tenants := make([]DataComponent, 0, len(svc.tenants))
+	for _, comp := range svc.tenants {
+		tenants = append(tenants, comp)
+	}
+	svc.mu.Unlock()
+	for _, comp := range tenants {
+		if err := comp.DropDBCollection(ctx); err != nil {
+			return err
+		}
+	}
+	return svc.PluginDataComponent.DropDBCollection(ctx)
+}
+
+func (svc *TenantScopePlugin) CreateCondition(ctx core.RequestContext, args utils.StringMap) (interface{}, error) {
+	return svc.CreateQueryCondition(ctx, NewEqualityQuery(args), nil)
+}
+
+func (svc *TenantScopePlugin) CreateQueryCondition(ctx core.RequestContext, query *Query, params utils.StringsMap) (interface{}, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !svc.multitenant {
+		return comp.CreateQueryCondition(ctx, query, params)
+	}
+	if tenant != "" {
+		query, params = ScopeQuery(query), ScopeParams(params, tenant)
+	}
+	cond, err := comp.CreateQueryCondition(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	return &tenantCondition{tenant: tenant, cond: cond}, nil
+}
+
+// CompileQuery compiles query with the tenant predicate. A tenant's own component is created by
+// the service underneath, so it runs the queries the service compiles.
+func (svc *TenantScopePlugin) CompileQuery(ctx core.ServerContext, query *Query) (interface{}, error) {
+	if !svc.multitenant {
+		return svc.PluginDataComponent.CompileQuery(ctx, query)
+	}
+	scoped, err := svc.PluginDataComponent.CompileQuery(ctx, ScopeQuery(query))
+	if err != nil {
+		return nil, err
+	}
+	return &tenantQuery{query: query, scoped: scoped}, nil
+}
+
+func (svc *TenantScopePlugin) BindQuery(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (interface{}, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if compiled, err = svc.compiledFor(ctx, tenant, compiled); err != nil {
+		return nil, err
+	}
+	cond, err := comp.BindQuery(ctx, compiled, ScopeParams(params, tenant))
+	if err != nil || !svc.multitenant {
+		return cond, err
+	}
+	return &tenantCondition{tenant: tenant, cond: cond}, nil
+}
+
+func (svc *TenantScopePlugin) Query(ctx core.RequestContext, compiled interface{}, params utils.StringsMap) (*QueryPage, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if compiled, err = svc.compiledFor(ctx, tenant, compiled); err != nil {
+		return nil, err
+	}
+	return comp.Query(ctx, compiled, ScopeParams(params, tenant))
+}
+
+func (svc *TenantScopePlugin) Save(ctx core.RequestContext, item core.Storable) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = svc.stamp(ctx, tenant, []core.Storable{item}); err != nil {
+		return err
+	}
+	if item.GetId() != "" {
+		if err = svc.owned(ctx, comp, tenant, []string{item.GetId()}); err != nil {
+			return err
+		}
+	}
+	return comp.Save(ctx, item)
+}
+
+func (svc *TenantScopePlugin) Put(ctx core.RequestContext, id string, item core.Storable) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = svc.stamp(ctx, tenant, []core.Storable{item}); err != nil {
+		return err
+	}
+	if err = svc.owned(ctx, comp, tenant, []string{id}); err != nil {
+		return err
+	}
+	return comp.Put(ctx, id, item)
+}
+
+func (svc *TenantScopePlugin) PutMulti(ctx core.RequestContext, items []core.Storable) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = svc.stamp(ctx, tenant, items); err != nil {
+		return err
+	}
+	if err = svc.owned(ctx, comp, tenant, storableIds(items)); err != nil {
+		return err
+	}
+	return comp.PutMulti(ctx, items)
+}
+
+func (svc *TenantScopePlugin) CreateMulti(ctx core.RequestContext, items []core.Storable) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = svc.stamp(ctx, tenant, items); err != nil {
+		return err
+	}
+	return comp.CreateMulti(ctx, items)
+}
+
+// storableIds returns the ids items have been given.
+func storableIds(items []core.Storable) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil && item.GetId() != "" {
+			ids = append(ids, item.GetId())
+		}
+	}
+	return ids
+}
+
+func (svc *TenantScopePlugin) UpsertId(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if newVals, err = svc.stampValues(ctx, tenant, newVals, true); err != nil {
+		return err
+	}
+	if err = svc.owned(ctx, comp, tenant, []string{id}); err != nil {
+		return err
+	}
+	return comp.UpsertId(ctx, id, newVals)
+}
+
+func (svc *TenantScopePlugin) Update(ctx core.RequestContext, id string, newVals utils.StringMap) error {
+	return svc.UpdateMulti(ctx, []string{id}, newVals)
+}
+
+func (svc *TenantScopePlugin) UpdateMulti(ctx core.RequestContext, ids []string, newVals utils.StringMap) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if newVals, err = svc.stampValues(ctx, tenant, newVals, false); err != nil {
+		return err
+	}
+	if err = svc.owned(ctx, comp, tenant, ids); err != nil {
+		return err
+	}
+	if len(ids) == 1 {
+		return comp.Update(ctx, ids[0], newVals)
+	}
+	return comp.UpdateMulti(ctx, ids, newVals)
+}
+
+func (svc *TenantScopePlugin) Upsert(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if newVals, err = svc.stampValues(ctx, tenant, newVals, true); err != nil {
+		return nil, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return nil, err
+	}
+	return comp.Upsert(ctx, queryCond, newVals, getids)
+}
+
+func (svc *TenantScopePlugin) UpdateAll(ctx core.RequestContext, queryCond interface{}, newVals utils.StringMap, getids bool) ([]string, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if newVals, err = svc.stampValues(ctx, tenant, newVals, false); err != nil {
+		return nil, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return nil, err
+	}
+	return comp.UpdateAll(ctx, queryCond, newVals, getids)
+}
+
+func (svc *TenantScopePlugin) AddToArray(ctx core.RequestContext, id string, fieldName string, item interface{}) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = svc.owned(ctx, comp, tenant, []string{id}); err != nil {
+		return err
+	}
+	return comp.AddToArray(ctx, id, fieldName, item)
+}
+
+func (svc *TenantScopePlugin) Delete(ctx core.RequestContext, id string) error {
+	return svc.DeleteMulti(ctx, []string{id})
+}
+
+func (svc *TenantScopePlugin) DeleteMulti(ctx core.RequestContext, ids []string) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = svc.owned(ctx, comp, tenant, ids); err != nil {
+		return err
+	}
+	if len(ids) == 1 {
+		return comp.Delete(ctx, ids[0])
+	}
+	return comp.DeleteMulti(ctx, ids)
+}
+
+func (svc *TenantScopePlugin) DeleteAll(ctx core.RequestContext, queryCond interface{}, getids bool) ([]string, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return nil, err
+	}
+	return comp.DeleteAll(ctx, queryCond, getids)
+}
+
+// Restore restores records of the request's tenant, failing with CORE_ERROR_TENANT_MISMATCH when
+// one of ids is in the trash of another tenant.
+func (svc *TenantScopePlugin) Restore(ctx core.RequestContext, ids []string) error {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if svc.shared(tenant) && len(ids) > 0 {
+		_, others, err := svc.trashOf(ctx, comp, tenant, nil, nil)
+		if err != nil {
+			return err
+		}
+		restoring := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			restoring[id] = true
+		}
+		for _, item := range others {
+			if restoring[item.GetId()] {
+				other, _ := tenantOfItem(item)
+				return errors.TenantMismatch(ctx, svc.GetObject(), slog.String("Id", item.GetId()), slog.String("Tenant", other))
+			}
+		}
+	}
+	return comp.Restore(ctx, ids)
+}
+
+// trashOf lists the soft-deleted records comp shows the request, parted into those of tenant and
+// those of other tenants, which a service that does not scope its trash shows too.
+func (svc *TenantScopePlugin) trashOf(ctx core.RequestContext, comp DataComponent, tenant string, props []string, orderBy []string) ([]core.Storable, []core.Storable, error) {
+	if len(props) > 0 {
+		props = append(props[:len(props):len(props)], FIELD_TENANTID)
+	}
+	items, _, _, _, err := comp.ListDeleted(ctx, props, -1, 1, orderBy)
+	if err != nil {
+		return nil, nil, err
+	}
+	var own, others []core.Storable
+	for _, item := range items {
+		if svc.checkItem(ctx, tenant, item) != nil {
+			others = append(others, item)
+		} else {
+			own = append(own, item)
+		}
+	}
+	return own, others, nil
+}
+
+// GetById fails with CORE_ERROR_TENANT_MISMATCH for a record of another tenant, whether the
+// service underneath returns it or hides it.
+func (svc *TenantScopePlugin) GetById(ctx core.RequestContext, id string, dao string) (core.Storable, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item, err := comp.GetById(ctx, id, dao)
+	if errors.IsNotFound(err) {
+		if ownedErr := svc.owned(ctx, comp, tenant, []string{id}); ownedErr != nil {
+			return nil, ownedErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.checkItem(ctx, tenant, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// GetMulti leaves out records of other tenants.
+func (svc *TenantScopePlugin) GetMulti(ctx core.RequestContext, props []string, ids []string, orderBy []string, dao string) ([]core.Storable, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := comp.GetMulti(ctx, props, ids, orderBy, dao)
+	if err != nil || tenant == "" {
+		return items, err
+	}
+	scoped := items[:0]
+	for _, item := range items {
+		if svc.checkItem(ctx, tenant, item) == nil {
+			scoped = append(scoped, item)
+		}
+	}
+	return scoped, nil
+}
+
+// GetMultiHash leaves out records of other tenants.
+func (svc *TenantScopePlugin) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := comp.GetMultiHash(ctx, props, ids, dao)
+	if err != nil || tenant == "" {
+		return items, err
+	}
+	for id, item := range items {
+		if svc.checkItem(ctx, tenant, item) != nil {
+			delete(items, id)
+		}
+	}
+	return items, nil
+}
+
+func (svc *TenantScopePlugin) GetValue(ctx core.RequestContext, key string) (interface{}, error) {
+	comp, _, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return comp.GetValue(ctx, key)
+}
+
+func (svc *TenantScopePlugin) PutValue(ctx core.RequestContext, key string, value interface{}) error {
+	comp, _, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	return comp.PutValue(ctx, key, value)
+}
+
+func (svc *TenantScopePlugin) DeleteValue(ctx core.RequestContext, key string) error {
+	comp, _, err := svc.scope(ctx)
+	if err != nil {
+		return err
+	}
+	return comp.DeleteValue(ctx, key)
+}
+
+func (svc *TenantScopePlugin) Count(ctx core.RequestContext, queryCond interface{}) (int, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return -1, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return -1, err
+	}
+	return comp.Count(ctx, queryCond)
+}
+
+func (svc *TenantScopePlugin) CountGroups(ctx core.RequestContext, queryCond interface{}, groupids []string, group string) (utils.StringMap, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return nil, err
+	}
+	return comp.CountGroups(ctx, queryCond, groupids, group)
+}
+
+func (svc *TenantScopePlugin) GetList(ctx core.RequestContext, props []string, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	if !svc.shared(tenant) {
+		return comp.GetList(ctx, props, pageSize, pageNum, mode, orderBy, dao)
+	}
+	cond, err := svc.all(ctx, comp, tenant)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	return comp.Get(ctx, props, cond, pageSize, pageNum, mode, orderBy, dao)
+}
+
+func (svc *TenantScopePlugin) Get(ctx core.RequestContext, props []string, queryCond interface{}, pageSize int, pageNum int, mode string, orderBy []string, dao string) ([]core.Storable, []string, int, int, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return nil, nil, -1, -1, err
+	}
+	return comp.Get(ctx, props, queryCond, pageSize, pageNum, mode, orderBy, dao)
+}
+
+func (svc *TenantScopePlugin) GetOne(ctx core.RequestContext, props []string, queryCond interface{}, dao string) (core.Storable, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if queryCond, err = svc.condition(ctx, tenant, queryCond); err != nil {
+		return nil, err
+	}
+	return comp.GetOne(ctx, props, queryCond, dao)
+}
+
+func (svc *TenantScopePlugin) Execute(ctx core.RequestContext, name string, data interface{}, params utils.StringMap) (interface{}, error) {
+	comp, _, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return comp.Execute(ctx, name, data, params)
+}
+
+// ListDeleted lists the trash of the request's tenant. In shared storage the trash is read whole
+// and paged by the plugin.
+func (svc *TenantScopePlugin) ListDeleted(ctx core.RequestContext, props []string, pageSize int, pageNum int, orderBy []string) ([]core.Storable, []string, int, int, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	if !svc.shared(tenant) {
+		return comp.ListDeleted(ctx, props, pageSize, pageNum, orderBy)
+	}
+	own, _, err := svc.trashOf(ctx, comp, tenant, props, orderBy)
+	if err != nil {
+		return nil, nil, -1, -1, err
+	}
+	first, last := 0, len(own)
+	if pageSize > 0 {
+		if pageNum < 1 {
+			pageNum = 1
+		}
+		first, last = pageBounds(len(own), (pageNum-1)*pageSize, pageSize)
+	}
+	page := own[first:last]
+	ids := make([]string, len(page))
+	for i, item := range page {
+		ids[i] = item.GetId()
+	}
+	return page, ids, len(own), len(page), nil
+}
+
+// Purge purges the trash of the request's tenant. Purge takes no condition, so in shared storage
+// it is held to the records deleted before any record of another tenant that the service shows
+// the request, and before the trash was read, so that a record deleted since is not purged.
+func (svc *TenantScopePlugin) Purge(ctx core.RequestContext, olderThan time.Time) (int, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if svc.shared(tenant) {
+		if listed := time.Now(); listed.Before(olderThan) {
+			olderThan = listed
+		}
+		_, others, err := svc.trashOf(ctx, comp, tenant, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range others {
+			var at time.Time
+			if deletedAt, ok := FieldValue(item, FIELD_DELETEDAT); ok {
+				at, _ = deletedAt.(time.Time)
+			}
+			if at.Before(olderThan) {
+				olderThan = at
+			}
+		}
+	}
+	return comp.Purge(ctx, olderThan)
+}
+
+func (svc *TenantScopePlugin) GetAsOf(ctx core.RequestContext, id string, at time.Time) (core.Storable, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item, err := comp.GetAsOf(ctx, id, at)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.checkItem(ctx, tenant, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (svc *TenantScopePlugin) GetRevisions(ctx core.RequestContext, id string) ([]Revision, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	revs, err := comp.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, rev := range revs {
+		if err = svc.checkItem(ctx, tenant, rev.Item); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
+
+// Iterate iterates the records of the request's tenant when queryCond is nil.
+func (svc *TenantScopePlugin) Iterate(ctx core.RequestContext, props []string, queryCond interface{}, orderBy []string, batchSize int) (StorableIterator, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if queryCond == nil && svc.shared(tenant) {
+		queryCond, err = svc.all(ctx, comp, tenant)
+	} else {
+		queryCond, err = svc.condition(ctx, tenant, queryCond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return comp.Iterate(ctx, props, queryCond, orderBy, batchSize)
+}
+
+// VectorSearch ranks the records of the request's tenant when filter is nil.
+func (svc *TenantScopePlugin) VectorSearch(ctx core.RequestContext, vector []float32, limit int, filter interface{}) ([]VectorResult, error) {
+	comp, tenant, err := svc.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if filter == nil && svc.shared(tenant) {
+		filter, err = svc.all(ctx, comp, tenant)
+	} else {
+		filter, err = svc.condition(ctx, tenant, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return comp.VectorSearch(ctx, vector, limit, filter)
+}
+
+// Subscribe subscribes to the events of the service underneath, and of every tenant's component.
+func (svc *TenantScopePlugin) Subscribe(ctx core.RequestContext, obj string, eventType DataEventType, handler core.MessageListener) error {
+	if err := svc.PluginDataComponent.Subscribe(ctx, obj, eventType, handler); err != nil {
+		return err
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for _, comp := range svc.tenants {
+		if err := comp.Subscribe(ctx, obj, eventType, handler); err != nil {
+			return err
+		}
+	}
+	svc.subscriptions = append(svc.subscriptions, tenantSubscription{ctx: ctx, obj: obj, eventType: eventType, handler: handler})
+	return nil
+}
@@ -0,0 +1,234 @@
+package data_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// unscopedStore stores a Multitenant entity without scoping by tenant itself, as a store shared by
+// tenants may not, so that the plugin in front of it has to.
+type unscopedStore struct {
+	*memory.MemoryDataComponent
+	objects core.ObjectFactory
+}
+
+func (s *unscopedStore) GetObjectFactory() core.ObjectFactory { return s.objects }
+
+// newUnscopedWidgets creates an unscopedStore of widgets configured as conf is, and Multitenant.
+func newUnscopedWidgets(t *testing.T, conf core.StorableConfig) (*unscopedStore, *datatest.ObjectFactory) {
+	t.Helper()
+	base, _, _ := newWidgets(t, conf)
+	conf.Multitenant = true
+	objects := datatest.NewObjectFactory("widget", conf)
+	return &unscopedStore{MemoryDataComponent: base, objects: objects}, objects
+}
+
+func TestTenantScopePlugin(t *testing.T) {
+	base, objects := newUnscopedWidgets(t, core.StorableConfig{})
+	server := datatest.NewServerContext()
+	svc := data.NewTenantScopePluginWithBase(server, base, data.TenantShared)
+	acme := datatest.NewRequestContext(server, "u1", "acme")
+	globex := datatest.NewRequestContext(server, "u2", "globex")
+	system := core.NewSystemRequest(server, "Check", nil, nil, nil)
+
+	a1, a2, g1 := objects.NewRecord("a1", 1), objects.NewRecord("a2", 2), objects.NewRecord("g1", 3)
+	for _, write := range []struct {
+		c    core.RequestContext
+		item *datatest.Record
+	}{{acme, a1}, {acme, a2}, {globex, g1}} {
+		if err := svc.Save(write.c, write.item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if a1.TenantId != "acme" || a1.TenantName != "acme" || g1.TenantId != "globex" {
+		t.Fatalf("records were not stamped with their tenant: %q %q", a1.TenantId, g1.TenantId)
+	}
+	if _, _, total, _, _ := base.GetList(acme, nil, -1, 1, "", nil, ""); total != 3 {
+		t.Fatalf("the store scopes by tenant: acme lists %d", total)
+	}
+
+	t.Run("reads", func(t *testing.T) {
+		count := func(c core.RequestContext) int {
+			t.Helper()
+			cond, err := svc.CreateQueryCondition(c, data.NewQuery(), nil)
+			if err != nil {
+				t.Fatalf("CreateQueryCondition: %v", err)
+			}
+			n, err := svc.Count(c, cond)
+			if err != nil {
+				t.Fatalf("Count: %v", err)
+			}
+			return n
+		}
+		if n := count(acme); n != 2 {
+			t.Errorf("acme counts %d", n)
+		}
+		if n := count(system); n != 3 {
+			t.Errorf("a system request counts %d", n)
+		}
+		if _, _, total, _, err := svc.GetList(acme, nil, -1, 1, "", nil, ""); err != nil || total != 2 {
+			t.Errorf("acme lists %d %v", total, err)
+		}
+		if items, _ := svc.GetMulti(acme, nil, []string{a1.Id, g1.Id}, nil, ""); len(items) != 1 {
+			t.Errorf("acme reads %d of its own and another tenant's record", len(items))
+		}
+		compiled, err := svc.CompileQuery(server, data.NewShapedQuery())
+		if err != nil {
+			t.Fatalf("CompileQuery: %v", err)
+		}
+		if page, err := svc.Query(globex, compiled, nil); err != nil || page.Total != 1 {
+			t.Errorf("globex queries %v %v", page, err)
+		}
+		if page, err := svc.Query(system, compiled, nil); err != nil || page.Total != 3 {
+			t.Errorf("a system request queries %v %v", page, err)
+		}
+	})
+
+	t.Run("another tenant's records", func(t *testing.T) {
+		if _, err := svc.GetById(acme, g1.Id, ""); !errors.IsTenantMismatch(err) {
+			t.Errorf("GetById of another tenant's record: want mismatch, got %v", err)
+		}
+		if _, err := svc.GetById(acme, "missing", ""); !errors.IsNotFound(err) {
+			t.Errorf("GetById of a missing record: want not found, got %v", err)
+		}
+		if err := svc.Update(acme, g1.Id, utils.StringMap{"Size": 9}); !errors.IsTenantMismatch(err) {
+			t.Errorf("Update of another tenant's record: want mismatch, got %v", err)
+		}
+		if err := svc.Delete(acme, g1.Id); !errors.IsTenantMismatch(err) {
+			t.Errorf("Delete of another tenant's record: want mismatch, got %v", err)
+		}
+		if err := svc.Update(acme, a1.Id, utils.StringMap{data.FIELD_TENANTID: "globex"}); !errors.IsTenantMismatch(err) {
+			t.Errorf("moving a record to another tenant: want mismatch, got %v", err)
+		}
+		forged := objects.NewRecord("forged", 1)
+		forged.TenantId = "globex"
+		if err := svc.Save(acme, forged); !errors.IsTenantMismatch(err) {
+			t.Errorf("saving a record for another tenant: want mismatch, got %v", err)
+		}
+	})
+
+	t.Run("requests without a tenant", func(t *testing.T) {
+		if _, err := svc.CreateQueryCondition(datatest.NewRequestContext(server, "u3", ""), data.NewQuery(), nil); !errors.IsTenantMismatch(err) {
+			t.Errorf("a user's request without a tenant: want mismatch, got %v", err)
+		}
+		anonymous := datatest.NewRequestContext(server, "", "")
+		anonymous.User = nil
+		if _, err := svc.CreateQueryCondition(anonymous, data.NewQuery(), nil); !errors.IsTenantMismatch(err) {
+			t.Errorf("a request by no user that is not the system's: want mismatch, got %v", err)
+		}
+	})
+
+	t.Run("conditions", func(t *testing.T) {
+		raw, _ := base.CreateQueryCondition(acme, data.NewQuery(), nil)
+		if _, err := svc.DeleteAll(acme, raw, true); !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) {
+			t.Errorf("a condition of the service underneath: want bad argument, got %v", err)
+		}
+		acmes, _ := svc.CreateQueryCondition(acme, data.NewQuery(), nil)
+		if _, err := svc.UpdateAll(globex, acmes, utils.StringMap{"Size": 9}, true); !errors.IsTenantMismatch(err) {
+			t.Errorf("another tenant's condition: want mismatch, got %v", err)
+		}
+		if ids, err := svc.UpdateAll(acme, acmes, utils.StringMap{"Size": 9}, true); err != nil || len(ids) != 2 {
+			t.Errorf("UpdateAll: %v %v", ids, err)
+		}
+		if item, _ := base.GetById(system, g1.Id, ""); item.(*datatest.Record).Size != 3 {
+			t.Errorf("acme updated another tenant's record")
+		}
+	})
+
+	t.Run("a collection for each tenant", func(t *testing.T) {
+		base, objects := newUnscopedWidgets(t, core.StorableConfig{})
+		svc := data.NewTenantScopePluginWithBase(server, base, data.TenantCollection)
+		for _, c := range []core.RequestContext{acme, acme, globex} {
+			if err := svc.Save(c, objects.NewRecord("w", 1)); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		if _, _, total, _, err := svc.GetList(acme, nil, -1, 1, "", nil, ""); err != nil || total != 2 {
+			t.Errorf("acme lists %d %v", total, err)
+		}
+		if items, _, _, _, _ := base.GetList(system, nil, -1, 1, "", nil, ""); len(items) != 0 {
+			t.Errorf("the service underneath holds %d records", len(items))
+		}
+	})
+}
+
+func TestTenantScopePluginTrash(t *testing.T) {
+	base, objects := newUnscopedWidgets(t, core.StorableConfig{SoftDelete: true})
+	server := datatest.NewServerContext()
+	svc := data.NewTenantScopePluginWithBase(server, base, data.TenantShared)
+	acme := datatest.NewRequestContext(server, "u1", "acme")
+	globex := datatest.NewRequestContext(server, "u2", "globex")
+	system := core.NewSystemRequest(server, "Check", nil, nil, nil)
+
+	a1, a2, a3, g1 := objects.NewRecord("a1", 1), objects.NewRecord("a2", 2), objects.NewRecord("a3", 3), objects.NewRecord("g1", 4)
+	for _, write := range []struct {
+		c    core.RequestContext
+		item *datatest.Record
+	}{{acme, a1}, {acme, a2}, {acme, a3}, {globex, g1}} {
+		if err := svc.Save(write.c, write.item); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	for _, del := range []struct {
+		c  core.RequestContext
+		id string
+	}{{acme, a1.Id}, {globex, g1.Id}, {acme, a2.Id}, {acme, a3.Id}} {
+		if err := svc.Delete(del.c, del.id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	names := func(items []core.Storable) string {
+		got := make([]string, len(items))
+		for i, item := range items {
+			got[i] = item.(*datatest.Record).Name
+		}
+		return strings.Join(got, ", ")
+	}
+	if items, _, _, _, _ := base.ListDeleted(acme, nil, -1, 1, []string{"Name"}); names(items) != "a1, a2, a3, g1" {
+		t.Fatalf("the store scopes its trash by tenant: %s", names(items))
+	}
+
+	t.Run("ListDeleted", func(t *testing.T) {
+		items, ids, total, n, err := svc.ListDeleted(acme, []string{"Name"}, 2, 2, []string{"Name"})
+		if err != nil || total != 3 || n != 1 || names(items) != "a3" || ids[0] != a3.Id {
+			t.Errorf("acme's second page: %s of %d, %v", names(items), total, err)
+		}
+		if items, _, _, _, _ = svc.ListDeleted(globex, nil, -1, 1, nil); names(items) != "g1" {
+			t.Errorf("globex lists %s", names(items))
+		}
+	})
+	t.Run("Restore", func(t *testing.T) {
+		if err := svc.Restore(acme, []string{a3.Id, g1.Id}); !errors.IsTenantMismatch(err) {
+			t.Errorf("restoring another tenant's record: want mismatch, got %v", err)
+		}
+		if items, _, _, _, _ := base.ListDeleted(system, nil, -1, 1, []string{"Name"}); names(items) != "a1, a2, a3, g1" {
+			t.Errorf("a refused restore restored %s", names(items))
+		}
+		if err := svc.Restore(acme, []string{a3.Id}); err != nil {
+			t.Errorf("Restore: %v", err)
+		}
+	})
+	t.Run("Purge", func(t *testing.T) {
+		n, err := svc.Purge(acme, time.Now().Add(time.Hour))
+		if err != nil || n != 1 {
+			t.Errorf("acme purged %d, %v", n, err)
+		}
+		if items, _, _, _, _ := base.ListDeleted(system, nil, -1, 1, []string{"Name"}); names(items) != "a2, g1" {
+			t.Errorf("left in the trash: %s", names(items))
+		}
+		if n, err = svc.Purge(globex, time.Now().Add(time.Hour)); err != nil || n != 1 {
+			t.Errorf("globex purged %d, %v", n, err)
+		}
+		if n, err = svc.Purge(acme, time.Now().Add(time.Hour)); err != nil || n != 1 {
+			t.Errorf("acme purged %d once globex's trash was empty, %v", n, err)
+		}
+	})
+}
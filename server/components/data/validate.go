@@ -0,0 +1,383 @@
+package data
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/core"
+	"laatoo.io/sdk/server/errors"
+	"laatoo.io/sdk/utils"
+)
+
+// EntityMetadata describes the fields of an entity that a query may name. It is read from the
+// entity's Go type, so it knows exactly the fields a provider will store: those declared on the
+// entity, those promoted from the storage infos it embeds, and the fields of nested structs by
+// dotted path. A field whose type is a map or an interface is open, and any path below it is
+// accepted.
+type EntityMetadata struct {
+	Object string
+	typ    reflect.Type
+}
+
+// NewEntityMetadata reads the metadata of object from a sample instance of it.
+func NewEntityMetadata(object string, sample interface{}) *EntityMetadata {
+	return &EntityMetadata{Object: object, typ: reflect.TypeOf(sample)}
+}
+
+// EntityMetadataFor reads the metadata of object from an instance its factory creates.
+func EntityMetadataFor(ctx ctx.Context, object string, factory core.ObjectFactory) *EntityMetadata {
+	return NewEntityMetadata(object, factory.CreateObject(ctx))
+}
+
+// FieldType returns the type of the field at a dotted path, and false when the entity has no such
+// field. The type is nil when the path is below an open field and so cannot be known. A path that
+// passes through a collection names the field in each of its elements, and is a collection of it.
+func (meta *EntityMetadata) FieldType(path string) (reflect.Type, bool) {
+	typ := meta.typ
+	many := false
+	for _, name := range strings.Split(path, ".") {
+		for typ != nil && (typ.Kind() == reflect.Ptr || isCollection(typ)) {
+			many = many || typ.Kind() != reflect.Ptr
+			typ = typ.Elem()
+		}
+		if typ == nil {
+			return nil, true
+		}
+		switch typ.Kind() {
+		case reflect.Map, reflect.Interface:
+			return nil, true
+		case reflect.Struct:
+			field, ok := typ.FieldByName(name)
+			if !ok {
+				if field, ok = structFieldByJSONName(typ, name); !ok {
+					return nil, false
+				}
+			}
+			typ = field.Type
+		default:
+			return nil, false
+		}
+	}
+	if many && typ != nil {
+		return reflect.SliceOf(typ), true
+	}
+	return typ, true
+}
+
+// isCollection reports whether typ is a slice or array compared element by element, which a byte
+// slice is not.
+func isCollection(typ reflect.Type) bool {
+	return (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) && typ.Elem().Kind() != reflect.Uint8
+}
+
+func structFieldByJSONName(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		if strings.Split(typ.Field(i).Tag.Get("json"), ",")[0] == name {
+			return typ.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// valueClass is the family of values a field holds or a literal is, for type-checking one against
+// the other. Widths do not matter: an int field is compared with any number.
+type valueClass int
+
+const (
+	classUnknown valueClass = iota + 1
+	classNull
+	classString
+	classNumber
+	classBool
+	classTime
+)
+
+// fieldClass classifies a field's type. A collection is classified by its element, since a
+// comparison against a collection field tests its elements.
+func fieldClass(typ reflect.Type) valueClass {
+	for typ != nil && (typ.Kind() == reflect.Ptr || isCollection(typ)) {
+		typ = typ.Elem()
+	}
+	if typ == nil {
+		return classUnknown
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return classString
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return classNumber
+	case reflect.Bool:
+		return classBool
+	case reflect.Struct:
+		if typ == timeType {
+			return classTime
+		}
+	}
+	return classUnknown
+}
+
+func literalClass(value interface{}) valueClass {
+	if value == nil {
+		return classNull
+	}
+	return fieldClass(reflect.TypeOf(value))
+}
+
+// Validate checks the query before it is compiled, so that every provider rejects a malformed
+// query with the same errors.BadArg rather than each failing in its own way. The tree's structure
+// is always checked: known operators and functions, fields named where a node needs one, the
+// right number of arguments, and shaping that is allowed at the query's version and does not
+// contradict itself. With meta, every field the query names must exist on the entity and every
+// literal operand must be of a type its field can be compared with; parameters are not checked,
+// since they arrive as strings and are coerced at execution.
+//
+// A filter that can never match — Size gt 5 and Size lt 3, or Name eq null and Name eq 'x' — is
+// rejected as well: it is almost always a mistake, and a provider would otherwise run it to
+// return nothing.
+//
+// Extensions are passed over, since only the provider that recognises one can check it.
+func (q *Query) Validate(ctx ctx.Context, meta *EntityMetadata) error {
+	if q == nil {
+		return errors.MissingArg(ctx, "query")
+	}
+	switch q.Version {
+	case QueryV1:
+		if len(q.ShapeCapabilities()) > 0 {
+			return errors.BadArg(ctx, "query", slog.Int("Version", int(q.Version)), slog.String("Error", "shaping needs QueryV2"))
+		}
+	case QueryV2:
+		if err := q.validateShape(ctx, meta); err != nil {
+			return err
+		}
+	default:
+		return errors.BadArg(ctx, "query", slog.Int("Version", int(q.Version)))
+	}
+	v := validator{meta: meta}
+	if err := v.predicate(ctx, q.Filter); err != nil {
+		return err
+	}
+	// a collection field may be matched element by element, where Tags eq 'a' and Tags eq 'b'
+	// is satisfiable, so only scalar fields are checked for contradictions
+	collection := func(field string) bool {
+		if meta == nil {
+			return false
+		}
+		typ, _ := meta.FieldType(field)
+		for typ != nil && typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		return typ != nil && isCollection(typ)
+	}
+	if field, ok := contradiction(q.Normalize().Filter, collection); ok {
+		return errors.BadArg(ctx, field, slog.String("Error", "the filter can never match"))
+	}
+	return nil
+}
+
+func (q *Query) validateShape(ctx ctx.Context, meta *EntityMetadata) error {
+	v := validator{meta: meta}
+	if q.Skip < 0 || q.Top < 0 {
+		return errors.BadArg(ctx, "query", slog.Int("Skip", q.Skip), slog.Int("Top", q.Top))
+	}
+	if q.After != nil && q.Skip > 0 {
+		return errors.BadArg(ctx, "After", slog.String("Error", "a cursor cannot be combined with Skip"))
+	}
+	for _, field := range q.Select {
+		if err := v.field(ctx, field, "Select"); err != nil {
+			return err
+		}
+	}
+	if !q.Grouped() {
+		for _, term := range q.OrderBy {
+			if err := v.field(ctx, term.Field, "OrderBy"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(q.Select) > 0 || q.After != nil {
+		return errors.BadArg(ctx, "query", slog.String("Error", "a grouped query cannot select fields or resume from a cursor"))
+	}
+	names := make([]string, 0, len(q.GroupBy)+len(q.Aggregates))
+	for _, field := range q.GroupBy {
+		if err := v.field(ctx, field, "GroupBy"); err != nil {
+			return err
+		}
+		names = append(names, field)
+	}
+	for _, aggregate := range q.Aggregates {
+		switch aggregate.Function {
+		case AggregateCount:
+			if aggregate.Field != "" {
+				if err := v.field(ctx, aggregate.Field, "Aggregates"); err != nil {
+					return err
+				}
+			}
+		case AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+			if err := v.field(ctx, aggregate.Field, "Aggregates"); err != nil {
+				return err
+			}
+			numeric := aggregate.Function == AggregateSum || aggregate.Function == AggregateAvg
+			if class := v.class(aggregate.Field); numeric && class != classNumber && class != classUnknown {
+				return errors.BadArg(ctx, aggregate.Field, slog.String("Function", string(aggregate.Function)), slog.String("Error", "not a number"))
+			}
+		default:
+			return errors.BadArg(ctx, "Aggregates", slog.String("Function", string(aggregate.Function)))
+		}
+		names = append(names, aggregate.Name())
+	}
+	// a group row carries only its group's fields and its aggregates, so only those order it
+	for _, term := range q.OrderBy {
+		if utils.StrContains(names, term.Field) < 0 {
+			return errors.BadArg(ctx, "OrderBy", slog.String("Field", term.Field), slog.String("Error", "not a group field or aggregate"))
+		}
+	}
+	return nil
+}
+
+// validator checks predicate nodes, against the entity's fields when it has metadata.
+type validator struct {
+	meta *EntityMetadata
+}
+
+// field checks that a field is named and, with metadata, that the entity has it.
+func (v validator) field(ctx ctx.Context, field string, where string) error {
+	if field == "" {
+		return errors.BadArg(ctx, where, slog.String("Error", "no field named"))
+	}
+	if v.meta == nil {
+		return nil
+	}
+	if _, ok := v.meta.FieldType(field); !ok {
+		return errors.BadArg(ctx, field, slog.String("Object", v.meta.Object), slog.String("Error", "no such field"))
+	}
+	return nil
+}
+
+// class returns the value class of a field, which is unknown without metadata.
+func (v validator) class(field string) valueClass {
+	if v.meta == nil {
+		return classUnknown
+	}
+	typ, _ := v.meta.FieldType(field)
+	return fieldClass(typ)
+}
+
+// operand checks an operand compared with field. A literal must be of the field's class, except
+// that text is accepted for a time when it parses as one; a field operand must exist and be of a
+// compatible class.
+func (v validator) operand(ctx ctx.Context, field string, operand Operand) error {
+	switch operand.Kind {
+	case OperandParameter:
+		if operand.Name == "" {
+			return errors.BadArg(ctx, field, slog.String("Error", "parameter has no name"))
+		}
+		return nil
+	case OperandField:
+		if err := v.field(ctx, operand.Name, field); err != nil {
+			return err
+		}
+		return v.compatible(ctx, field, v.class(operand.Name), nil)
+	case OperandLiteral:
+		return v.compatible(ctx, field, literalClass(operand.Value), operand.Value)
+	}
+	return errors.BadArg(ctx, field, slog.String("Operand", string(operand.Kind)))
+}
+
+func (v validator) compatible(ctx ctx.Context, field string, class valueClass, literal interface{}) error {
+	want := v.class(field)
+	if want == classUnknown || class == classUnknown || class == classNull || class == want {
+		return nil
+	}
+	if want == classTime && class == classString && literal != nil {
+		if _, err := asTime(literal); err == nil {
+			return nil
+		}
+	}
+	return errors.BadArg(ctx, field, slog.String("Error", "operand type does not match the field"))
+}
+
+func (v validator) predicate(ctx ctx.Context, predicate Predicate) error {
+	switch node := predicate.(type) {
+	case nil:
+		return nil
+	case *Comparison:
+		if err := v.field(ctx, node.Field, string(node.Kind())); err != nil {
+			return err
+		}
+		switch node.Operator {
+		case OpEqual, OpNotEqual:
+		case OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+			if node.Value.Kind == OperandLiteral && node.Value.Value == nil {
+				return errors.BadArg(ctx, node.Field, slog.String("Operator", string(node.Operator)), slog.String("Error", "null is not ordered"))
+			}
+		default:
+			return errors.BadArg(ctx, "Operator", slog.String("Operator", string(node.Operator)))
+		}
+		return v.operand(ctx, node.Field, node.Value)
+	case *Logical:
+		if node.Operator != LogicalAnd && node.Operator != LogicalOr {
+			return errors.BadArg(ctx, "Operator", slog.String("Operator", string(node.Operator)))
+		}
+		if len(node.Operands) == 0 {
+			return errors.BadArg(ctx, "Operands", slog.String("Operator", string(node.Operator)), slog.String("Error", "no operands"))
+		}
+		for _, operand := range node.Operands {
+			if err := v.predicate(ctx, operand); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Not:
+		if node.Operand == nil {
+			return errors.BadArg(ctx, "Operand", slog.String("Kind", string(node.Kind())))
+		}
+		return v.predicate(ctx, node.Operand)
+	case *Membership:
+		if err := v.field(ctx, node.Field, string(node.Kind())); err != nil {
+			return err
+		}
+		if len(node.Values) == 0 {
+			return errors.BadArg(ctx, node.Field, slog.String("Kind", string(node.Kind())), slog.String("Error", "no values"))
+		}
+		for _, value := range node.Values {
+			if value.Kind == OperandField {
+				return errors.BadArg(ctx, node.Field, slog.String("Kind", string(node.Kind())), slog.String("Error", "a set holds values, not fields"))
+			}
+			if err := v.operand(ctx, node.Field, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *NullTest:
+		return v.field(ctx, node.Field, string(node.Kind()))
+	case *FunctionCall:
+		switch node.Function {
+		case FuncContains, FuncStartsWith, FuncEndsWith:
+		default:
+			return errors.BadArg(ctx, "Function", slog.String("Function", string(node.Function)))
+		}
+		if err := v.field(ctx, node.Field, string(node.Function)); err != nil {
+			return err
+		}
+		if len(node.Arguments) != 1 {
+			return errors.BadArg(ctx, "Arguments", slog.String("Function", string(node.Function)))
+		}
+		if class := v.class(node.Field); class != classString && class != classUnknown {
+			return errors.BadArg(ctx, node.Field, slog.String("Function", string(node.Function)), slog.String("Error", "not text"))
+		}
+		if argument := node.Arguments[0]; argument.Kind == OperandLiteral {
+			if _, ok := argument.Value.(string); !ok {
+				return errors.BadArg(ctx, node.Field, slog.String("Function", string(node.Function)), slog.String("Error", "argument is not text"))
+			}
+		}
+		return v.operand(ctx, node.Field, node.Arguments[0])
+	case *Extension:
+		return nil
+	}
+	return errors.BadArg(ctx, "Predicate", slog.String("Kind", string(predicate.Kind())))
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"laatoo.io/sdk/server/errors"
+)
+
+type validatedEntity struct {
+	StorageInfo
+	Name    string
+	Size    int
+	Due     time.Time
+	Tags    []string
+	Owner   struct{ Name string }
+	Refs    []StorableRef
+	Details map[string]interface{}
+}
+
+func TestValidate(t *testing.T) {
+	c := newTestContext()
+	meta := NewEntityMetadata("validated", &validatedEntity{})
+	cases := []struct {
+		text  string
+		valid bool
+	}{
+		{"Name eq 'a' and Size gt 2 and Owner/Name eq @owner and Details/Any eq 1", true},
+		{"Id eq 'x' and Due lt 2024-01-01 and Due ge '2023-01-01'", true},
+		{"Tags eq 'a' and Tags eq 'b'", true},
+		{"Missing eq 1", false},
+		{"Owner/Missing eq 1", false},
+		{"Size eq 'three'", false},
+		{"Due lt 'soon'", false},
+		{"contains(Size,'1')", false},
+		{"Size in (1,'two')", false},
+		{"Size gt 5 and Size lt 3", false},
+		{"(Size gt 5 and Size lt 3) or Name eq 'x'", true},
+		{"(Size gt 5 and Size lt 3) or (Name eq 'x' and Name eq 'y')", false},
+		{"Size gt 5 and not (Size ge 3)", true},
+		{"Name eq 'a' and not (Name ne 'b')", false},
+		{"Name eq null and startswith(Name,'a') and Name eq 'a'", false},
+		{"(Size ge 3 and Size le 3) or Size eq 9", true},
+		{"Refs/Id in ('a','b') and Refs/Id eq 'c'", true},
+		{"Refs/Missing eq 'a'", false},
+		{"Refs/Id gt 1", false},
+	}
+	for _, tc := range cases {
+		query, err := ParseODataFilter(tc.text)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.text, err)
+		}
+		err = query.Validate(c, meta)
+		if tc.valid && err != nil {
+			t.Errorf("%s: want valid, got %v", tc.text, err)
+		}
+		if !tc.valid && !errors.HasErrorCode(err, errors.CORE_ERROR_BAD_ARG) {
+			t.Errorf("%s: want a bad argument, got %v", tc.text, err)
+		}
+	}
+
+	query := NewQuery()
+	query.Top = 5
+	if err := query.Validate(c, nil); err == nil {
+		t.Errorf("QueryV1 carrying a Top must not validate")
+	}
+	query = NewShapedQuery()
+	query.GroupBy = []string{"Name"}
+	query.Aggregates = []Aggregate{{Function: AggregateSum, Field: "Size"}}
+	query.OrderBy = []OrderTerm{{Field: "sum_Size"}}
+	if err := query.Validate(c, meta); err != nil {
+		t.Errorf("grouped query: %v", err)
+	}
+	query.OrderBy = []OrderTerm{{Field: "Size"}}
+	if err := query.Validate(c, meta); err == nil {
+		t.Errorf("a grouped query ordered by a field its rows do not carry must not validate")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"(A eq 1 and B eq 2) and (C eq 3 and (D eq 4))", "A eq 1 and B eq 2 and C eq 3 and D eq 4"},
+		{"not (A eq 1 or B ne null)", "A ne 1 and B eq null"},
+		{"not (A gt 1 and not (B in (1,2)))", "not (A gt 1) or (B in (1,2))"},
+		{"not not contains(A,'x')", "contains(A,'x')"},
+		{"not (not (A eq 1 or B eq 2) or C eq 3)", "(A eq 1 or B eq 2) and C ne 3"},
+	}
+	for _, tc := range cases {
+		query, err := ParseODataFilter(tc.text)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.text, err)
+		}
+		before, _ := ParseODataFilter(tc.text)
+		got, err := query.Normalize().ToODataFilter()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.text, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.text, tc.want, got)
+		}
+		if !reflect.DeepEqual(query, before) {
+			t.Errorf("%s: Normalize changed the query it was called on", tc.text)
+		}
+	}
+}
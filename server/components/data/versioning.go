@@ -0,0 +1,40 @@
+package data
+
+import (
+	"log/slog"
+	"strconv"
+
+	"laatoo.io/sdk/ctx"
+	"laatoo.io/sdk/server/errors"
+)
+
+// FIELD_VERSION is the stored name of an entity's version, on every provider.
+const FIELD_VERSION = "Version"
+
+// Versionable is an entity whose writes can be made conditional on its version. StorageInfo
+// implements it, so every generated entity does.
+type Versionable interface {
+	GetVersion() string
+	SetVersion(string)
+}
+
+// NextVersion returns the version a write stores over current. Versions count writes from "1";
+// a version that is not a count, as one written before versioning was turned on may be, restarts
+// the count.
+func NextVersion(current string) string {
+	n, err := strconv.ParseUint(current, 10, 64)
+	if err != nil {
+		return "1"
+	}
+	return strconv.FormatUint(n+1, 10)
+}
+
+// CheckVersion fails with CORE_ERROR_VERSION_CONFLICT when the version a writer expects is not
+// the stored one. stored is empty when the record does not exist, so a writer creating a record
+// expects the empty version.
+func CheckVersion(c ctx.Context, object string, id string, stored string, expected string) error {
+	if stored == expected {
+		return nil
+	}
+	return errors.VersionConflict(c, object, slog.String("Id", id), slog.String("Stored", stored), slog.String("Expected", expected))
+}
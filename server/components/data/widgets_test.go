@@ -0,0 +1,52 @@
+package data_test
+
+import (
+	"testing"
+
+	"laatoo.io/sdk/server/components/data"
+	"laatoo.io/sdk/server/components/data/datatest"
+	"laatoo.io/sdk/server/components/data/memory"
+	"laatoo.io/sdk/server/core"
+)
+
+// newWidgets creates an in-memory component the plugin tests put their plugins in front of, storing
+// the suite's records as widgets, with a request of user1 in no tenant.
+func newWidgets(t *testing.T, conf core.StorableConfig) (*memory.MemoryDataComponent, *datatest.ObjectFactory, *datatest.RequestContext) {
+	t.Helper()
+	server := datatest.NewServerContext()
+	objects := datatest.NewObjectFactory("widget", conf)
+	return memory.NewMemoryDataComponentForObject(server, "widget", objects), objects, datatest.NewRequestContext(server, "user1", "")
+}
+
+func saveWidgets(t *testing.T, svc data.DataComponent, objects *datatest.ObjectFactory, c core.RequestContext, names ...string) {
+	t.Helper()
+	for i, name := range names {
+		if err := svc.Save(c, objects.NewRecord(name, i+1)); err != nil {
+			t.Fatalf("Save %s: %v", name, err)
+		}
+	}
+}
+
+// showingDeleted is a store that returns soft-deleted records read by id, as a store leaving its
+// trash for its callers to filter out does.
+type showingDeleted struct {
+	*memory.MemoryDataComponent
+}
+
+func (s *showingDeleted) GetMultiHash(ctx core.RequestContext, props []string, ids []string, dao string) (map[string]core.Storable, error) {
+	found, err := s.MemoryDataComponent.GetMultiHash(ctx, props, ids, dao)
+	if err != nil {
+		return nil, err
+	}
+	trash, _, _, _, err := s.ListDeleted(ctx, props, -1, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	deleted := data.StorableArrayToMap(trash)
+	for _, id := range ids {
+		if item, ok := deleted[id]; ok {
+			found[id] = item
+		}
+	}
+	return found, nil
+}
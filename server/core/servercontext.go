@@ -92,7 +92,10 @@ type ServerContext interface {
 	GetObjectFactory(name string) (ObjectFactory, bool)
 	// GetObjectMetadata retrieves metadata for an object.
 	GetObjectMetadata(objectName string) (Info, error)
-	// CreateSystemRequest creates a system request context (e.g., for background tasks).
+	// CreateSystemRequest creates a system request context (e.g., for background tasks), marked with
+	// CTX_SYSTEM_REQUEST so that IsSystemRequest tells it from a request made by no user.
+	// BREAKING: an implementation must set the marker, or the data plugins treat its requests as
+	// made by no user; NewSystemRequest marks the request whatever the implementation does.
 	CreateSystemRequest(name string, tenant auth.TenantInfo, behalfOf interface{}, responseHandler ResponseHandler) RequestContext
 	// SubscribeTopic subscribes to a message topic.
 	SubscribeTopic(topics []string, lstnr MessageListener, lsnrID string) error
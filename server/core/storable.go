@@ -1,6 +1,8 @@
 package core
 
 import (
+	"time"
+
 	"laatoo.io/sdk/ctx"
 	"laatoo.io/sdk/utils"
 )
@@ -17,14 +19,120 @@ type StorableConfig struct {
 	Trackable         bool
 	Collection        string
 	Cacheable         bool
-	RefOps            bool
-	Workflow          bool
-	Multitenant       bool
+	// RefOps turns on the reference policies the entity declares on its StorableRef fields with
+	// the ref tag, enforced by a data.RefIntegrityPlugin over the service of the entity referred to.
+	RefOps      bool
+	Workflow    bool
+	Multitenant bool
 	// SoftDelete makes Delete mark the record rather than remove it: the data service updates
 	// the entity's Deleted field to true, and every read excludes it. Every generated entity
 	// already embeds data.DeletionInfo unconditionally, so the field exists in storage whether
 	// or not this is set — turning it on is a configuration change and never a migration.
 	SoftDelete bool
+	// Retention is how long a soft-deleted record is kept before the data retention job purges
+	// it for good. Zero keeps deleted records until they are purged by hand.
+	Retention time.Duration
+	// Versioned makes writes conditional on the entity's Version: a save or update carrying a
+	// version other than the stored one fails with CORE_ERROR_VERSION_CONFLICT instead of
+	// overwriting a change the writer never saw, and every write that succeeds bumps the version.
+	// A new record is written expecting the empty version, and is stored as version "1". Unset,
+	// writes are last-writer-wins.
+	Versioned bool
+	// Temporal makes the data service keep every revision of a record rather than only the latest,
+	// so that it can be read as it was at any time since. Each write stores a new revision under
+	// the next Version, whether or not writes are Versioned, and a delete stores one marking the
+	// record deleted.
+	Temporal bool
+	// Indexes are the indexes of the entity's collection. The data service creates them with the
+	// collection in CreateDBCollection, and when it starts creates those missing from a collection
+	// that already exists.
+	Indexes []IndexSpec
+	// Embedding declares the fields whose text an embedding pipeline keeps a vector of, re-embedding
+	// a record whenever one of them is written.
+	Embedding *EmbeddingSpec
+	// RowPolicies limit the records a request may read and write to those a policy permits it,
+	// enforced by a data.RowSecurityPlugin over the entity's data service.
+	RowPolicies []RowPolicy
+	// Encrypted are fields stored encrypted by a data.EncryptionPlugin, besides those tagged
+	// encrypt on the entity.
+	Encrypted []EncryptedField
+}
+
+// EncryptedField declares a string field stored encrypted.
+type EncryptedField struct {
+	Field string
+	// BlindIndex optionally names a string field the data service keeps a keyed hash of the
+	// field's value in, so that the field can still be compared for equality.
+	BlindIndex string
+}
+
+// RowOperation is what a row policy permits.
+type RowOperation string
+
+const (
+	RowRead  RowOperation = "read"
+	RowWrite RowOperation = "write"
+)
+
+// RowPolicy permits the requests it applies to the records its filter matches. Policies add to
+// one another: a request may read or write a record when any policy applying to it for the
+// operation matches the record, and may touch no record when none applies.
+type RowPolicy struct {
+	Name string
+	// Operations are those the policy permits. Empty permits every operation.
+	Operations []RowOperation
+	// Roles limits the policy to users holding one of them. Empty applies it to every user.
+	Roles []string
+	// Filter holds the *data.Query template matching the records permitted, with the request's
+	// user, roles and tenant bound to its data.RLS_PARAM_* parameters. Nil permits every record.
+	Filter interface{}
+}
+
+// EmbeddingSpec declares what an entity embeds.
+type EmbeddingSpec struct {
+	// Fields hold the text embedded, joined in order.
+	Fields []string
+	// Vector is the field the vector is stored in. It defaults to the field of the entity's vector
+	// index, and to "Vector" when it has none.
+	Vector string
+	// Digest optionally names a string field the digest of the text last embedded is stored in, so
+	// that a record whose text has not changed is not embedded again.
+	Digest string
+}
+
+// VectorMetric is the distance a vector index ranks records by.
+type VectorMetric string
+
+const (
+	VectorCosine    VectorMetric = "cosine"
+	VectorEuclidean VectorMetric = "euclidean"
+	VectorDot       VectorMetric = "dot"
+)
+
+// IndexSpec declares one index of an entity's collection.
+type IndexSpec struct {
+	// Name identifies the index in the collection. It defaults to the index's fields joined by
+	// underscores.
+	Name string
+	// Fields are the fields indexed, in order. A field prefixed with "-" is indexed descending.
+	Fields []string
+	// Unique refuses a write that would give two records the same values for Fields. A record
+	// with no value for one of them is not checked.
+	Unique bool
+	// TTL makes the data service remove a record this long after the time held in its one field.
+	TTL time.Duration
+	// Filter limits the index to the records it matches. It holds a *data.Query, which this
+	// package cannot name, as the data package depends on it.
+	Filter interface{}
+	// Vector makes this a vector index over its one field, for vector search.
+	Vector *VectorIndex
+}
+
+// VectorIndex configures a vector index: the length of the vectors it holds and the distance it
+// ranks them by.
+type VectorIndex struct {
+	Dimension int
+	Metric    VectorMetric
 }
 
 // Object stored by data service
@@ -0,0 +1,28 @@
+package core
+
+import "laatoo.io/sdk/server/auth"
+
+// CTX_SYSTEM_REQUEST is the variable marking a request made by the server itself, telling it from a
+// request made by no user.
+//
+// BREAKING: the RowSecurityPlugin bypasses its policies, and the TenantPlugin its scope, only for a
+// request carrying the marker. A system request that does not carry it is treated as a request made
+// by no user, and is refused or restricted. Create the system requests that use them with
+// NewSystemRequest, and implement CreateSystemRequest to set the marker.
+const CTX_SYSTEM_REQUEST = "__systemrequest"
+
+// NewSystemRequest creates a system request through ctx and marks it with CTX_SYSTEM_REQUEST,
+// whether or not the server's CreateSystemRequest does.
+func NewSystemRequest(ctx ServerContext, name string, tenant auth.TenantInfo, behalfOf interface{}, responseHandler ResponseHandler) RequestContext {
+	req := ctx.CreateSystemRequest(name, tenant, behalfOf, responseHandler)
+	req.Set(CTX_SYSTEM_REQUEST, true)
+	return req
+}
+
+// IsSystemRequest reports whether a request is marked as a system request, or is a sub context of
+// one.
+func IsSystemRequest(ctx RequestContext) bool {
+	system, _ := ctx.Get(CTX_SYSTEM_REQUEST)
+	marked, _ := system.(bool)
+	return marked
+}
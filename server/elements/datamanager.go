@@ -1,6 +1,8 @@
 package elements
 
 import (
+	"time"
+
 	"laatoo.io/sdk/server/components/data"
 	"laatoo.io/sdk/server/core"
 	"laatoo.io/sdk/utils"
@@ -16,9 +18,18 @@ type DataManager interface {
 	//create condition from field/value pairs combined with equality — the shorthand, unchanged
 	//in shape from what callers have always written
 	CreateCondition(ctx core.RequestContext, obj string, args utils.StringMap) (interface{}, error)
-	//create condition from a query, for shapes the shorthand cannot express. Callers needing
-	//compile-once/bind-per-request reach the component through GetRegisteredComponent.
+	//create condition from a query, for shapes the shorthand cannot express. The query is
+	//compiled through the manager's query cache, so a shape already seen is only bound.
 	CreateQueryCondition(ctx core.RequestContext, obj string, query *data.Query, params utils.StringsMap) (interface{}, error)
+	//compile a query for an object through the query cache, keyed by the query's shape
+	CompileQuery(ctx core.ServerContext, obj string, query *data.Query) (*data.CachedQuery, error)
+	//bind parameters to a query compiled by CompileQuery
+	BindQuery(ctx core.RequestContext, obj string, compiled *data.CachedQuery, params utils.StringsMap) (interface{}, error)
+	//discard the compiled queries of an object, or of every object when obj is empty. Called
+	//when a module is reloaded or the component registered for an object is replaced.
+	InvalidateQueries(ctx core.ServerContext, obj string)
+	//size and hit rate of the query cache
+	QueryCacheStats() data.QueryCacheStats
 
 	Save(ctx core.RequestContext, obj string, item core.Storable) error
 	//Store an object against an id
@@ -70,9 +81,27 @@ type DataManager interface {
 	GetOne(ctx core.RequestContext, props []string, obj string, queryCond interface{}, dao string) (dataToReturn core.Storable, err error)
 	//Get a list of all items
 	GetList(ctx core.RequestContext, props []string, obj string, pageSize int, pageNum int, mode string, orderBy []string, dao string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error)
+	//restore soft-deleted records by id
+	Restore(ctx core.RequestContext, obj string, ids []string) error
+	//list soft-deleted records
+	ListDeleted(ctx core.RequestContext, props []string, obj string, pageSize int, pageNum int, orderBy []string) (dataToReturn []core.Storable, ids []string, totalrecs int, recsreturned int, err error)
+	//permanently delete soft-deleted records deleted before olderThan
+	Purge(ctx core.RequestContext, obj string, olderThan time.Time) (int, error)
+	//get a record as it was at a time, for objects configured as Temporal
+	GetAsOf(ctx core.RequestContext, obj string, id string, at time.Time) (core.Storable, error)
+	//get every revision of a record, oldest first, for objects configured as Temporal
+	GetRevisions(ctx core.RequestContext, obj string, id string) ([]data.Revision, error)
+	//load the entities the StorableRef fields of items refer to into their Entity, batched into
+	//one read per object type and level, as a data.RefResolver does. A dotted field resolves
+	//the references of the entities loaded before it.
+	ResolveRefs(ctx core.RequestContext, items []core.Storable, fields []string) error
+	//iterate the records matching a condition in batches, for jobs too large for a page
+	Iterate(ctx core.RequestContext, props []string, obj string, queryCond interface{}, orderBy []string, batchSize int) (data.StorableIterator, error)
 
 	//Vector Search
 	VectorSearch(ctx core.RequestContext, obj string, vector []float32, limit int, filter interface{}) ([]data.VectorResult, error)
+	//audit records of the record with id, oldest first, for objects served through an audit plugin
+	GetHistory(ctx core.RequestContext, obj string, id string) ([]*data.AuditRecord, error)
 	//Subscribe to data events
 	Subscribe(ctx core.RequestContext, obj string, eventType data.DataEventType, handler core.MessageListener) error
 }
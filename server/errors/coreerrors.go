@@ -35,6 +35,13 @@ const (
 	// this says the method exists and this particular provider cannot serve it, which is a
 	// condition the caller is expected to detect and degrade on rather than treat as a defect.
 	CORE_ERROR_DURABLE_NOT_SUPPORTED = "Core_Durable_Not_Supported"
+	// CORE_ERROR_VERSION_CONFLICT is returned by a conditional write whose expected version is not
+	// the stored one: someone else wrote the record since the caller read it. It is the caller's
+	// cue to reload and retry or to report the conflict, and maps to HTTP 409.
+	CORE_ERROR_VERSION_CONFLICT = "Core_Version_Conflict"
+	// CORE_ERROR_REF_RESTRICTED is returned by a delete refused because other records still
+	// refer to the record under a restrict policy. Maps to HTTP 409.
+	CORE_ERROR_REF_RESTRICTED = "Core_Ref_Restricted"
 )
 
 func init() {
@@ -62,6 +69,8 @@ func init() {
 	// panics on an unregistered code. Latent because nothing calls InvalidPayload yet.
 	RegisterCode(CORE_ERROR_INVALID_PAYLOAD, "Payload could not be read.")
 	RegisterCode(CORE_ERROR_DURABLE_NOT_SUPPORTED, "Durable operations are not supported by the configured provider.")
+	RegisterCode(CORE_ERROR_VERSION_CONFLICT, "Resource was modified by another writer.")
+	RegisterCode(CORE_ERROR_REF_RESTRICTED, "Resource is still referred to.")
 }
 
 func WrapError(ctx ctx.Context, err error, info ...slog.Attr) error {
@@ -124,6 +133,15 @@ func NotImplemented(ctx ctx.Context, methodName string, info ...slog.Attr) error
 func NotFound(ctx ctx.Context, resource string, info ...slog.Attr) error {
 	return throwStandardError(ctx, CORE_ERROR_RES_NOT_FOUND, append(info, slog.String("Resource", resource))...)
 }
+func VersionConflict(ctx ctx.Context, resource string, info ...slog.Attr) error {
+	return throwStandardError(ctx, CORE_ERROR_VERSION_CONFLICT, append(info, slog.String("Resource", resource))...)
+}
+func RefRestricted(ctx ctx.Context, resource string, info ...slog.Attr) error {
+	return throwStandardError(ctx, CORE_ERROR_REF_RESTRICTED, append(info, slog.String("Resource", resource))...)
+}
+func TenantMismatch(ctx ctx.Context, resource string, info ...slog.Attr) error {
+	return throwStandardError(ctx, CORE_ERROR_TENANT_MISMATCH, append(info, slog.String("Resource", resource))...)
+}
 func TypeMismatch(ctx ctx.Context, info ...slog.Attr) error {
 	return throwStandardError(ctx, CORE_ERROR_TYPE_MISMATCH, info...)
 }
@@ -183,3 +201,20 @@ func HasErrorCode(err error, code string) bool {
 func IsNotFound(err error) bool {
 	return HasErrorCode(err, CORE_ERROR_RES_NOT_FOUND)
 }
+
+// IsVersionConflict reports whether err means a conditional write lost to a concurrent one, as
+// opposed to failing outright. See HasErrorCode for where the code stops being visible.
+func IsVersionConflict(err error) bool {
+	return HasErrorCode(err, CORE_ERROR_VERSION_CONFLICT)
+}
+
+// IsRefRestricted reports whether err means a delete was refused because the record is still
+// referred to.
+func IsRefRestricted(err error) bool {
+	return HasErrorCode(err, CORE_ERROR_REF_RESTRICTED)
+}
+
+// IsTenantMismatch reports whether err means a request reached for a record of another tenant.
+func IsTenantMismatch(err error) bool {
+	return HasErrorCode(err, CORE_ERROR_TENANT_MISMATCH)
+}